@@ -0,0 +1,68 @@
+package agent
+
+import (
+	"fmt"
+	"hash"
+	"io"
+	"sort"
+	"strconv"
+)
+
+// ChecksumPipeline writes a parsed pipeline to a hash in a stable order, so
+// that pipelines with the same content always have the same hash regardless
+// of the order of their map keys. Each value is written with its type and
+// length, so that different pipelines can't write the same bytes.
+func ChecksumPipeline(parsed interface{}, h hash.Hash) error {
+	return checksumValue(parsed, h)
+}
+
+func checksumValue(v interface{}, w io.Writer) error {
+	var err error
+
+	switch tv := v.(type) {
+	case nil:
+		_, err = io.WriteString(w, "n;")
+	case bool:
+		_, err = fmt.Fprintf(w, "b%t;", tv)
+	case int:
+		_, err = fmt.Fprintf(w, "i%d;", tv)
+	case float64:
+		_, err = fmt.Fprintf(w, "f%s;", strconv.FormatFloat(tv, 'g', -1, 64))
+	case string:
+		_, err = fmt.Fprintf(w, "s%d:%s", len(tv), tv)
+
+	case []interface{}:
+		if _, err = fmt.Fprintf(w, "l%d:", len(tv)); err != nil {
+			return err
+		}
+		for _, item := range tv {
+			if err = checksumValue(item, w); err != nil {
+				return err
+			}
+		}
+
+	case map[string]interface{}:
+		keys := make([]string, 0, len(tv))
+		for key := range tv {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		if _, err = fmt.Fprintf(w, "m%d:", len(tv)); err != nil {
+			return err
+		}
+		for _, key := range keys {
+			if err = checksumValue(key, w); err != nil {
+				return err
+			}
+			if err = checksumValue(tv[key], w); err != nil {
+				return err
+			}
+		}
+
+	default:
+		return fmt.Errorf("Unexpected type of %T in pipeline", v)
+	}
+
+	return err
+}
@@ -0,0 +1,62 @@
+package agent
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+
+	"github.com/buildkite/agent/env"
+	"github.com/stretchr/testify/assert"
+)
+
+func checksumPipeline(t *testing.T, pipeline string) string {
+	parsed, err := PipelineParser{Pipeline: []byte(pipeline), Env: env.New()}.Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := sha256.New()
+	assert.NoError(t, ChecksumPipeline(parsed, h))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func TestChecksumPipeline(t *testing.T) {
+	t.Parallel()
+
+	checksum := checksumPipeline(t, `steps:
+  - label: Test
+    command: make test
+    parallelism: 2
+    soft_fail: true
+    retry: ~
+    priority: 1.5
+  - wait
+`)
+
+	// Map keys can be in any order
+	assert.Equal(t, checksum, checksumPipeline(t, `steps:
+  - priority: 1.5
+    retry: ~
+    soft_fail: true
+    parallelism: 2
+    command: make test
+    label: Test
+  - wait
+`))
+
+	for _, different := range []string{
+		"steps:\n  - wait\n  - label: Test\n    command: make test\n    parallelism: 2\n    soft_fail: true\n    retry: ~\n    priority: 1.5\n",
+		"steps:\n  - label: Test\n    command: make test\n    parallelism: \"2\"\n    soft_fail: true\n    retry: ~\n    priority: 1.5\n  - wait\n",
+		"steps:\n  - label: Test\n    command: make test\n    parallelism: 2\n    soft_fail: true\n    retry: ~\n  - wait\n",
+	} {
+		assert.NotEqual(t, checksum, checksumPipeline(t, different), different)
+	}
+
+	// Strings are length prefixed, so they can't run into each other
+	a, b := sha256.New(), sha256.New()
+	assert.NoError(t, ChecksumPipeline([]interface{}{"ab", "c"}, a))
+	assert.NoError(t, ChecksumPipeline([]interface{}{"a", "bc"}, b))
+	assert.NotEqual(t, a.Sum(nil), b.Sum(nil))
+
+	assert.EqualError(t, ChecksumPipeline(map[string]interface{}{"steps": []string{}}, sha256.New()), "Unexpected type of []string in pipeline")
+}
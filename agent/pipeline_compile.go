@@ -0,0 +1,102 @@
+package agent
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/buildkite/agent/env"
+)
+
+// compileTime is when a pipeline is compiled, which is replaced in tests
+var compileTime = time.Now
+
+var interpolationMarkerRegex = regexp.MustCompile(`^\$\{[^}]*\}`)
+
+// CompilePipeline parses a pipeline and returns it as static YAML with all of
+// its variables resolved, so that it can be stored and replayed later. It
+// starts with a `# compiled: <timestamp>` comment. Any $'s in the resolved
+// values are escaped, so that replaying it gives the same values. It's an
+// error for any `${...}` references to be left unresolved, such as when the
+// parser has NoInterpolation set.
+func CompilePipeline(parser *PipelineParser) ([]byte, error) {
+	parsed, err := parser.Parse()
+	if err != nil {
+		return nil, err
+	}
+
+	if parser.NoInterpolation {
+		// Nothing has been interpolated, so any references that aren't
+		// escaped are still waiting to be
+		if markers := unresolvedMarkers(parsed); len(markers) > 0 {
+			return nil, fmt.Errorf("Compiled pipeline still has references to interpolate: %s", strings.Join(markers, ", "))
+		}
+	} else {
+		// Interpolation unescapes `$$`, which has to be undone for the
+		// compiled pipeline to be interpolated to the same thing again
+		parsed = escapeCompiledStrings(parsed)
+	}
+
+	compiled, err := MarshalToYAML(parsed, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// The compiled pipeline is parsed again without anything in the
+	// environment, to make sure that it's valid
+	if _, err := (PipelineParser{
+		Pipeline:        compiled,
+		Env:             env.New(),
+		NoInterpolation: true,
+	}).Parse(); err != nil {
+		return nil, fmt.Errorf("Failed to parse compiled pipeline: %v", err)
+	}
+
+	header := fmt.Sprintf("# compiled: %s\n", compileTime().UTC().Format(time.RFC3339))
+	return append([]byte(header), compiled...), nil
+}
+
+// unresolvedMarkers returns the sorted `${...}` references in the strings of
+// an uninterpolated pipeline, ignoring escaped ones like `$${HOME}`
+func unresolvedMarkers(parsed interface{}) []string {
+	found := map[string]bool{}
+	walkYAMLStrings(parsed, func(s string) {
+		_, _ = replaceEnvReferences(s, func(ref string) (string, int, error) {
+			if marker := interpolationMarkerRegex.FindString(ref); marker != "" {
+				found[marker] = true
+			}
+			return "", 0, nil
+		})
+	})
+
+	markers := make([]string, 0, len(found))
+	for marker := range found {
+		markers = append(markers, marker)
+	}
+	sort.Strings(markers)
+	return markers
+}
+
+// escapeCompiledStrings returns a copy of a parsed pipeline with the $'s in
+// its strings escaped as `$$`
+func escapeCompiledStrings(v interface{}) interface{} {
+	switch t := v.(type) {
+	case string:
+		return strings.Replace(t, "$", "$$", -1)
+	case map[string]interface{}:
+		escaped := make(map[string]interface{}, len(t))
+		for key, value := range t {
+			escaped[key] = escapeCompiledStrings(value)
+		}
+		return escaped
+	case []interface{}:
+		escaped := make([]interface{}, len(t))
+		for idx, value := range t {
+			escaped[idx] = escapeCompiledStrings(value)
+		}
+		return escaped
+	}
+	return v
+}
@@ -0,0 +1,70 @@
+package agent
+
+import (
+	"testing"
+	"time"
+
+	"github.com/buildkite/agent/env"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompilePipeline(t *testing.T) {
+	compileTime = func() time.Time { return time.Date(2019, 3, 4, 5, 6, 7, 0, time.UTC) }
+	defer func() { compileTime = time.Now }()
+
+	pipeline := []byte(`env:
+  IMAGE: node:${NODE_VERSION}
+steps:
+  - label: Test ${NODE_VERSION}
+    command: docker run $IMAGE make test
+    agents:
+      queue: ${QUEUE:-default}
+`)
+
+	compiled, err := CompilePipeline(&PipelineParser{
+		Pipeline: pipeline,
+		Env:      env.FromSlice([]string{"NODE_VERSION=8"}),
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, `# compiled: 2019-03-04T05:06:07Z
+env:
+  IMAGE: node:8
+steps:
+- label: Test 8
+  command: docker run node:8 make test
+  agents:
+    queue: default
+`, string(compiled))
+
+	// Escaped references stay escaped, so replaying the compiled pipeline
+	// gives the same values
+	compiled, err = CompilePipeline(&PipelineParser{
+		Pipeline: []byte("steps:\n  - command: echo $${HOME} $$PATH costs $$5 in ${NODE_VERSION}\n"),
+		Env:      env.FromSlice([]string{"NODE_VERSION=8"}),
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, `# compiled: 2019-03-04T05:06:07Z
+steps:
+- command: echo $${HOME} $$PATH costs $$5 in 8
+`, string(compiled))
+
+	replayed, err := PipelineParser{Pipeline: compiled, Env: env.FromSlice([]string{"HOME=/root", "PATH=/bin"})}.Parse()
+	assert.NoError(t, err)
+	assert.Equal(t, "echo ${HOME} $PATH costs $5 in 8", pipelineSteps(replayed)[0].(map[string]interface{})["command"])
+
+	_, err = CompilePipeline(&PipelineParser{
+		Pipeline:        pipeline,
+		Env:             env.FromSlice([]string{}),
+		NoInterpolation: true,
+	})
+	assert.EqualError(t, err, "Compiled pipeline still has references to interpolate: ${NODE_VERSION}, ${QUEUE:-default}")
+
+	// Escaped references aren't waiting to be interpolated
+	compiled, err = CompilePipeline(&PipelineParser{
+		Pipeline:        []byte("steps:\n  - command: echo $${HOME}\n"),
+		Env:             env.FromSlice([]string{}),
+		NoInterpolation: true,
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "# compiled: 2019-03-04T05:06:07Z\nsteps:\n- command: echo $${HOME}\n", string(compiled))
+}
@@ -0,0 +1,250 @@
+package agent
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// CompressPipeline returns a copy of a pipeline returned from
+// PipelineParser.Parse with its no-op steps removed. A step is a no-op if:
+//
+//   - It's a command step with a blank `command`, and no `commands` or
+//     `plugins` (as plugins can still do something without a command)
+//   - It's a map that isn't any type of step and where every value is empty,
+//     such as `{}` or `label: ""`. Steps like `wait: ~` and `block: ~` are
+//     never empty.
+//   - It's a wait step without an `if`, `allow_dependency_failure` or
+//     `continue_on_failure`, and it's straight after another wait step, or
+//     every step after it already depends on every step before it (all of
+//     which must have a `key`)
+//
+// Wait steps at the start or end of the steps are always kept, as in an
+// uploaded pipeline they wait for the steps already in the build, or make the
+// steps after the upload wait. Steps inside groups are compressed too.
+// Everything else is kept as is.
+func CompressPipeline(parsed interface{}) (interface{}, error) {
+	switch p := parsed.(type) {
+	case []interface{}:
+		return compressSteps(p), nil
+	case map[string]interface{}:
+		compressed := map[string]interface{}{}
+		for k, v := range p {
+			compressed[k] = v
+		}
+		if steps, ok := p["steps"].([]interface{}); ok {
+			compressed["steps"] = compressSteps(steps)
+		}
+		return compressed, nil
+	}
+	return nil, fmt.Errorf("Unexpected type of %T for pipeline", parsed)
+}
+
+func compressSteps(steps []interface{}) []interface{} {
+	compressed, _ := rewriteSteps(steps, func(path string, steps []interface{}) ([]interface{}, error) {
+		return compressStepList(steps), nil
+	})
+	return compressed
+}
+
+// compressStepList compresses a list of steps, but not the steps in its
+// groups, which are copied so that their steps can be compressed without
+// changing them
+func compressStepList(steps []interface{}) []interface{} {
+	var kept []interface{}
+
+	for _, step := range steps {
+		stepMap, ok := step.(map[string]interface{})
+		if !ok {
+			kept = append(kept, step)
+			continue
+		}
+
+		if (stepType(stepMap) == "" && isEmptyValue(stepMap)) || isBlankCommandStep(stepMap) {
+			continue
+		}
+
+		if _, ok := stepMap["steps"].([]interface{}); ok {
+			group := map[string]interface{}{}
+			for k, v := range stepMap {
+				group[k] = v
+			}
+			stepMap = group
+		}
+
+		kept = append(kept, stepMap)
+	}
+
+	// Removing a wait step can make another redundant, so keep going until
+	// nothing changes
+	for {
+		idx := redundantWaitStep(kept)
+		if idx < 0 {
+			break
+		}
+		kept = append(kept[:idx], kept[idx+1:]...)
+	}
+
+	if kept == nil {
+		return []interface{}{}
+	}
+	return kept
+}
+
+func isBlankCommandStep(step map[string]interface{}) bool {
+	command, ok := step["command"]
+	if !ok {
+		return false
+	}
+	if s, ok := command.(string); command != nil && (!ok || strings.TrimSpace(s) != "") {
+		return false
+	}
+	for _, key := range []string{"commands", "plugins"} {
+		if !isEmptyValue(step[key]) {
+			return false
+		}
+	}
+	return true
+}
+
+// isEmptyValue returns whether a value is nil, or an empty string, list or
+// map, or false or zero, or a list or map of only empty values
+func isEmptyValue(value interface{}) bool {
+	switch v := value.(type) {
+	case nil:
+		return true
+	case string:
+		return v == ""
+	case bool:
+		return !v
+	case int:
+		return v == 0
+	case float64:
+		return v == 0
+	case []interface{}:
+		for _, item := range v {
+			if !isEmptyValue(item) {
+				return false
+			}
+		}
+		return true
+	case map[string]interface{}:
+		for _, item := range v {
+			if !isEmptyValue(item) {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// isBareWaitStep returns whether a step is a wait step that doesn't do
+// anything other than wait
+func isBareWaitStep(step interface{}) bool {
+	if stepType(step) != "wait" {
+		return false
+	}
+	if stepMap, ok := step.(map[string]interface{}); ok {
+		for _, key := range []string{"if", "allow_dependency_failure", "continue_on_failure"} {
+			if !isEmptyValue(stepMap[key]) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// redundantWaitStep returns the index of the first wait step that can be
+// removed, or -1 if there aren't any
+func redundantWaitStep(steps []interface{}) int {
+	for idx, step := range steps {
+		if !isBareWaitStep(step) {
+			continue
+		}
+
+		if idx == 0 || idx == len(steps)-1 {
+			continue
+		}
+
+		if stepType(steps[idx-1]) == "wait" {
+			return idx
+		}
+
+		if waitIsExplicit(steps, idx) {
+			return idx
+		}
+	}
+
+	return -1
+}
+
+// waitIsExplicit returns whether every step after the wait step at idx (up to
+// the next wait) already depends on every step before it (back to the
+// previous wait)
+func waitIsExplicit(steps []interface{}, idx int) bool {
+	var before []string
+	for i := idx - 1; i >= 0 && stepType(steps[i]) != "wait"; i-- {
+		stepMap, ok := steps[i].(map[string]interface{})
+		if !ok || stepString(stepMap, "key") == "" {
+			return false
+		}
+		before = append(before, stepString(stepMap, "key"))
+	}
+
+	for i := idx + 1; i < len(steps) && stepType(steps[i]) != "wait"; i++ {
+		stepMap, ok := steps[i].(map[string]interface{})
+		if !ok {
+			return false
+		}
+
+		deps := map[string]bool{}
+		for _, dep := range stepDependencies(stepMap) {
+			deps[dep] = true
+		}
+		for _, key := range before {
+			if !deps[key] {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// DeduplicateSteps returns the steps with any step maps that are identical to
+// an earlier one removed, keeping the order of the rest. Steps with the same
+// `key` as an earlier step are always removed, as keys have to be unique.
+// Steps that aren't maps, like `wait`, are always kept.
+func DeduplicateSteps(steps []interface{}) []interface{} {
+	kept := []interface{}{}
+	keys := map[string]bool{}
+
+	for _, step := range steps {
+		stepMap, ok := step.(map[string]interface{})
+		if !ok {
+			kept = append(kept, step)
+			continue
+		}
+
+		if key := stepString(stepMap, "key"); key != "" {
+			if keys[key] {
+				continue
+			}
+			keys[key] = true
+		}
+
+		duplicate := false
+		for _, k := range kept {
+			if reflect.DeepEqual(k, step) {
+				duplicate = true
+				break
+			}
+		}
+		if !duplicate {
+			kept = append(kept, step)
+		}
+	}
+
+	return kept
+}
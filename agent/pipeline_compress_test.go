@@ -0,0 +1,125 @@
+package agent
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompressPipeline(t *testing.T) {
+	t.Parallel()
+
+	parsed, err := PipelineParser{Pipeline: []byte(`
+env:
+  FOO: bar
+steps:
+  - wait
+  - command: ""
+  - label: ""
+    command: ~
+  - {}
+  - key: build
+    command: make
+  - key: lint
+    command: make lint
+  - wait
+  - command: make test
+    depends_on: [build, lint]
+  - wait: ~
+    continue_on_failure: true
+  - command: make report
+  - wait
+  - wait
+  - command: make deploy
+  - command: ""
+    plugins:
+      - docker#v1.0.0: {image: node}
+  - group: Cleanup
+    steps:
+      - command: make clean
+      - wait
+  - wait
+`), NoInterpolation: true}.Parse()
+	assert.NoError(t, err)
+
+	compressed, err := CompressPipeline(parsed)
+	assert.NoError(t, err)
+
+	j, err := json.Marshal(compressed)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"env":{"FOO":"bar"},"steps":[`+
+		`"wait",`+
+		`{"command":"make","key":"build"},`+
+		`{"command":"make lint","key":"lint"},`+
+		`{"command":"make test","depends_on":["build","lint"]},`+
+		`{"continue_on_failure":true,"wait":null},`+
+		`{"command":"make report"},`+
+		`"wait",`+
+		`{"command":"make deploy"},`+
+		`{"command":"","plugins":[{"docker#v1.0.0":{"image":"node"}}]},`+
+		`{"group":"Cleanup","steps":[{"command":"make clean"},"wait"]},`+
+		`"wait"]}`, string(j))
+
+	_, err = CompressPipeline("nope")
+	assert.EqualError(t, err, "Unexpected type of string for pipeline")
+}
+
+func TestCompressPipelineKeepsWaitsWithoutExplicitDependencies(t *testing.T) {
+	t.Parallel()
+
+	steps := []interface{}{
+		map[string]interface{}{"key": "build", "command": "make"},
+		map[string]interface{}{"command": "make lint"},
+		"wait",
+		map[string]interface{}{"command": "make test", "depends_on": "build"},
+	}
+
+	compressed, err := CompressPipeline(steps)
+	assert.NoError(t, err)
+	assert.Equal(t, steps, compressed)
+}
+
+func TestCompressPipelineKeepsWaitAndBlockMaps(t *testing.T) {
+	t.Parallel()
+
+	parsed, err := PipelineParser{Pipeline: []byte(`
+steps:
+  - wait: ~
+  - command: a
+  - wait: ~
+  - command: b
+  - block: ~
+  - command: c
+`), NoInterpolation: true}.Parse()
+	assert.NoError(t, err)
+
+	compressed, err := CompressPipeline(parsed)
+	assert.NoError(t, err)
+	assert.Equal(t, parsed, compressed)
+}
+
+func TestDeduplicateSteps(t *testing.T) {
+	t.Parallel()
+
+	parsed, err := PipelineParser{Pipeline: []byte(`steps:
+  - command: test a
+    agents: {queue: test}
+  - command: test b
+  - wait
+  - command: test a
+    agents: {queue: test}
+  - wait
+  - key: deploy
+    command: deploy a
+  - key: deploy
+    command: deploy b
+  - command: test a
+    agents: {queue: deploy}
+`), NoInterpolation: true}.Parse()
+	assert.NoError(t, err)
+
+	j, err := json.Marshal(DeduplicateSteps(pipelineSteps(parsed)))
+	assert.NoError(t, err)
+	assert.Equal(t, `[{"agents":{"queue":"test"},"command":"test a"},{"command":"test b"},"wait","wait",{"command":"deploy a","key":"deploy"},{"agents":{"queue":"deploy"},"command":"test a"}]`, string(j))
+}
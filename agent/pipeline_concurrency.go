@@ -0,0 +1,205 @@
+package agent
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// ConcurrencyReport lists the wait steps in a pipeline that hold up steps
+// which could otherwise run at the same time as the steps before them
+type ConcurrencyReport struct {
+	RedundantWaits []RedundantWait
+}
+
+// RedundantWait is a wait step where none of the steps after it depend on the
+// steps before it, either with `depends_on` or by downloading artifacts they
+// upload. Before and After are the indexes of the top-level steps that it
+// separates, and Cost is the number of steps it holds up.
+type RedundantWait struct {
+	Index  int
+	Before []int
+	After  []int
+	Cost   int
+}
+
+var (
+	artifactUploadRegex   = regexp.MustCompile(`buildkite-agent artifact upload\s+(?:--?\S+\s+)*("[^"]*"|'[^']*'|\S+)`)
+	artifactDownloadRegex = regexp.MustCompile(`buildkite-agent artifact download\s+(?:--?\S+\s+)*("[^"]*"|'[^']*'|\S+)`)
+)
+
+// AnalyzeConcurrency returns the wait steps in a pipeline returned from
+// PipelineParser.Parse that don't need to be there. A wait step also stops the
+// steps after it from running if a step before it fails, which isn't taken
+// into account, so it's up to you whether that's wanted.
+func AnalyzeConcurrency(parsed interface{}) (*ConcurrencyReport, error) {
+	switch parsed.(type) {
+	case []interface{}, map[string]interface{}:
+	default:
+		return nil, fmt.Errorf("Unexpected type of %T for pipeline", parsed)
+	}
+
+	report := &ConcurrencyReport{RedundantWaits: []RedundantWait{}}
+	steps := pipelineSteps(parsed)
+
+	for idx, step := range steps {
+		if stepType(step) != "wait" {
+			continue
+		}
+
+		// The steps between this wait and the ones either side of it, where
+		// block and input steps hold steps up too
+		var before, after []int
+		for i := idx - 1; i >= 0 && !isBarrierStep(steps[i]); i-- {
+			before = append([]int{i}, before...)
+		}
+		for i := idx + 1; i < len(steps) && !isBarrierStep(steps[i]); i++ {
+			after = append(after, i)
+		}
+		if len(before) == 0 || len(after) == 0 {
+			continue
+		}
+
+		keys := map[string]bool{}
+		var uploads []string
+		for _, i := range before {
+			walkSteps([]interface{}{steps[i]}, "steps", func(path string, s map[string]interface{}) {
+				if key := stepString(s, "key"); key != "" {
+					keys[key] = true
+				}
+				stepUploads, _ := stepArtifacts(s)
+				uploads = append(uploads, stepUploads...)
+			})
+		}
+
+		dependent := false
+		for _, i := range after {
+			walkSteps([]interface{}{steps[i]}, "steps", func(path string, s map[string]interface{}) {
+				for _, dep := range stepDependencies(s) {
+					if keys[dep] {
+						dependent = true
+					}
+				}
+				_, downloads := stepArtifacts(s)
+				for _, download := range downloads {
+					for _, upload := range uploads {
+						if artifactPathsOverlap(upload, download) {
+							dependent = true
+						}
+					}
+				}
+			})
+		}
+		if dependent {
+			continue
+		}
+
+		report.RedundantWaits = append(report.RedundantWaits, RedundantWait{
+			Index:  idx,
+			Before: before,
+			After:  after,
+			Cost:   len(after),
+		})
+	}
+
+	return report, nil
+}
+
+// isBarrierStep returns whether a step stops the steps after it from running
+// until the steps before it have finished
+func isBarrierStep(step interface{}) bool {
+	switch stepType(step) {
+	case "wait", "block", "input":
+		return true
+	}
+	return false
+}
+
+// stepArtifacts returns the paths of the artifacts a step uploads and
+// downloads, from its `artifact_paths`, its commands and the artifacts plugin
+func stepArtifacts(step map[string]interface{}) (uploads []string, downloads []string) {
+	switch paths := step["artifact_paths"].(type) {
+	case string:
+		uploads = append(uploads, strings.Split(paths, ";")...)
+	case []interface{}:
+		for _, path := range paths {
+			if s, ok := path.(string); ok {
+				uploads = append(uploads, s)
+			}
+		}
+	}
+
+	for _, key := range []string{"command", "commands"} {
+		var commands []interface{}
+		switch c := step[key].(type) {
+		case string:
+			commands = append(commands, c)
+		case []interface{}:
+			commands = c
+		}
+		for _, command := range commands {
+			s, _ := command.(string)
+			for _, match := range artifactUploadRegex.FindAllStringSubmatch(s, -1) {
+				uploads = append(uploads, strings.Split(strings.Trim(match[1], `"'`), ";")...)
+			}
+			for _, match := range artifactDownloadRegex.FindAllStringSubmatch(s, -1) {
+				downloads = append(downloads, strings.Trim(match[1], `"'`))
+			}
+		}
+	}
+
+	var plugins []map[string]interface{}
+	switch p := step["plugins"].(type) {
+	case []interface{}:
+		for _, plugin := range p {
+			if m, ok := plugin.(map[string]interface{}); ok {
+				plugins = append(plugins, m)
+			}
+		}
+	case map[string]interface{}:
+		plugins = append(plugins, p)
+	}
+	for _, plugin := range plugins {
+		for location, config := range plugin {
+			configMap, ok := config.(map[string]interface{})
+			if !ok || !pluginMatches(location, "artifacts") {
+				continue
+			}
+			uploads = append(uploads, artifactPluginPaths(configMap["upload"])...)
+			downloads = append(downloads, artifactPluginPaths(configMap["download"])...)
+		}
+	}
+
+	for i := range uploads {
+		uploads[i] = strings.TrimSpace(uploads[i])
+	}
+
+	return uploads, downloads
+}
+
+// artifactPluginPaths returns the paths in the artifacts plugin's `upload` or
+// `download` option, which is a path or a list of them
+func artifactPluginPaths(option interface{}) []string {
+	switch o := option.(type) {
+	case string:
+		return []string{o}
+	case []interface{}:
+		var paths []string
+		for _, path := range o {
+			if s, ok := path.(string); ok {
+				paths = append(paths, s)
+			}
+		}
+		return paths
+	}
+	return nil
+}
+
+// artifactPathsOverlap returns whether an uploaded and downloaded artifact
+// path could be the same file, where either of them can be a glob
+func artifactPathsOverlap(upload, download string) bool {
+	if upload == "" || download == "" {
+		return false
+	}
+	return globMatch(upload, download) || globMatch(download, upload)
+}
@@ -0,0 +1,57 @@
+package agent
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAnalyzeConcurrency(t *testing.T) {
+	t.Parallel()
+
+	parsed, err := PipelineParser{Pipeline: []byte(`
+steps:
+  - label: Lint
+    command: make lint
+  - label: Build
+    key: build
+    command: make build
+  - wait
+  - label: Test
+    command: make test
+    depends_on: build
+  - wait
+  - label: Package
+    command: make package
+    artifact_paths: "dist/*.tar.gz;dist/checksums"
+  - wait
+  - label: Publish
+    command: buildkite-agent artifact download "dist/app.tar.gz" .
+  - wait
+  - label: Docs
+    command: make docs
+  - group: Checks
+    steps:
+      - command: make audit
+        plugins:
+          - artifacts#v1.2.0:
+              download: reports/*.json
+  - wait
+  - block: Release
+  - wait
+  - label: Release
+    command: make release
+`), NoInterpolation: true}.Parse()
+	assert.NoError(t, err)
+
+	report, err := AnalyzeConcurrency(parsed)
+	assert.NoError(t, err)
+
+	assert.Equal(t, []RedundantWait{
+		{Index: 4, Before: []int{3}, After: []int{5}, Cost: 1},
+		{Index: 8, Before: []int{7}, After: []int{9, 10}, Cost: 2},
+	}, report.RedundantWaits)
+
+	_, err = AnalyzeConcurrency("steps")
+	assert.EqualError(t, err, "Unexpected type of string for pipeline")
+}
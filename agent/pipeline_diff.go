@@ -0,0 +1,111 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+)
+
+// DiffEntry is a single difference between two pipelines
+type DiffEntry struct {
+	// Where the difference is, like `steps[0].command`
+	Path string
+
+	// One of "added", "removed" or "changed"
+	Type string
+
+	Old interface{}
+	New interface{}
+}
+
+// DiffPipelines returns the structural differences between two parsed
+// pipelines. Maps are compared key by key and lists item by item, so a step
+// inserted in the middle of a list shows up as changes to all of the steps
+// after it.
+func DiffPipelines(old, new interface{}) []DiffEntry {
+	diff := []DiffEntry{}
+	diffValues(&diff, "", old, new)
+	return diff
+}
+
+// DiffAgainstStored parses the pipeline and returns how it differs from a
+// previously stored JSON version of it. Both are compared as JSON, so
+// differences that don't survive JSON serialization (such as 1 vs 1.0) are
+// ignored.
+func (p PipelineParser) DiffAgainstStored(storedJSON []byte) ([]DiffEntry, error) {
+	current, err := p.ParseAndMarshal()
+	if err != nil {
+		return nil, err
+	}
+
+	var currentPipeline, storedPipeline interface{}
+
+	if err := json.Unmarshal(current, &currentPipeline); err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(storedJSON, &storedPipeline); err != nil {
+		return nil, fmt.Errorf("Failed to parse stored pipeline: %v", err)
+	}
+
+	return DiffPipelines(storedPipeline, currentPipeline), nil
+}
+
+func diffValues(diff *[]DiffEntry, path string, old, new interface{}) {
+	switch o := old.(type) {
+	case map[string]interface{}:
+		n, ok := new.(map[string]interface{})
+		if !ok {
+			break
+		}
+
+		keys := []string{}
+		for k := range o {
+			keys = append(keys, k)
+		}
+		for k := range n {
+			if _, exists := o[k]; !exists {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+
+		for _, k := range keys {
+			ov, inOld := o[k]
+			nv, inNew := n[k]
+			switch {
+			case !inOld:
+				*diff = append(*diff, DiffEntry{Path: joinPath(path, k), Type: "added", New: nv})
+			case !inNew:
+				*diff = append(*diff, DiffEntry{Path: joinPath(path, k), Type: "removed", Old: ov})
+			default:
+				diffValues(diff, joinPath(path, k), ov, nv)
+			}
+		}
+		return
+
+	case []interface{}:
+		n, ok := new.([]interface{})
+		if !ok {
+			break
+		}
+
+		for i := 0; i < len(o) || i < len(n); i++ {
+			itemPath := fmt.Sprintf("%s[%d]", path, i)
+			switch {
+			case i >= len(o):
+				*diff = append(*diff, DiffEntry{Path: itemPath, Type: "added", New: n[i]})
+			case i >= len(n):
+				*diff = append(*diff, DiffEntry{Path: itemPath, Type: "removed", Old: o[i]})
+			default:
+				diffValues(diff, itemPath, o[i], n[i])
+			}
+		}
+		return
+	}
+
+	if !reflect.DeepEqual(old, new) {
+		*diff = append(*diff, DiffEntry{Path: path, Type: "changed", Old: old, New: new})
+	}
+}
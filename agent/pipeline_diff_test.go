@@ -0,0 +1,62 @@
+package agent
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPipelineParserDiffAgainstStored(t *testing.T) {
+	t.Parallel()
+
+	stored := []byte(`{"env":{"FOO":"bar"},"steps":[{"command":"make test","parallelism":2},"wait"]}`)
+
+	for _, tc := range []struct {
+		name     string
+		pipeline string
+		expected []DiffEntry
+	}{
+		{
+			name:     "identical",
+			pipeline: "env:\n  FOO: bar\nsteps:\n  - command: make test\n    parallelism: 2\n  - wait",
+			expected: []DiffEntry{},
+		},
+		{
+			name:     "added step",
+			pipeline: "env:\n  FOO: bar\nsteps:\n  - command: make test\n    parallelism: 2\n  - wait\n  - command: make deploy",
+			expected: []DiffEntry{
+				{Path: "steps[2]", Type: "added", New: map[string]interface{}{"command": "make deploy"}},
+			},
+		},
+		{
+			name:     "removed step",
+			pipeline: "env:\n  FOO: bar\nsteps:\n  - command: make test\n    parallelism: 2",
+			expected: []DiffEntry{
+				{Path: "steps[1]", Type: "removed", Old: "wait"},
+			},
+		},
+		{
+			name:     "changed command",
+			pipeline: "env:\n  FOO: bar\nsteps:\n  - command: make lint\n  - wait",
+			expected: []DiffEntry{
+				{Path: "steps[0].command", Type: "changed", Old: "make test", New: "make lint"},
+				{Path: "steps[0].parallelism", Type: "removed", Old: float64(2)},
+			},
+		},
+	} {
+		tc := tc
+		t.Run(tc.name, func(tt *testing.T) {
+			tt.Parallel()
+			diff, err := PipelineParser{Pipeline: []byte(tc.pipeline)}.DiffAgainstStored(stored)
+			assert.NoError(tt, err)
+			assert.Equal(tt, tc.expected, diff)
+		})
+	}
+}
+
+func TestPipelineParserDiffAgainstInvalidStored(t *testing.T) {
+	t.Parallel()
+
+	_, err := PipelineParser{Pipeline: []byte("steps: []")}.DiffAgainstStored([]byte("{"))
+	assert.EqualError(t, err, "Failed to parse stored pipeline: unexpected end of JSON input")
+}
@@ -0,0 +1,81 @@
+package agent
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/buildkite/agent/env"
+)
+
+// EnvLayer is a named set of env vars, such as the process's environment or
+// a pipeline's env block
+type EnvLayer struct {
+	Name string
+	Env  *env.Environment
+}
+
+// EnvShadow is a definition of an env var that's overridden by a later layer
+type EnvShadow struct {
+	Layer string
+	Value string
+}
+
+// EnvExplanation is where an env var's value comes from, as returned by
+// ExplainEnv
+type EnvExplanation struct {
+	Name          string
+	ResolvedValue string
+
+	// The name of the layer the value comes from
+	DefinedIn string
+
+	// The definitions in earlier layers that are overridden, starting with
+	// the one closest to DefinedIn
+	ShadowedBy []EnvShadow
+}
+
+// ExplainEnv explains which of the layers an env var's value comes from, where
+// each layer overrides the ones before it, like the process's environment
+// followed by the pipeline's env block and then a step's. It returns nil if
+// none of the layers set the variable.
+func ExplainEnv(varName string, layers []EnvLayer) *EnvExplanation {
+	var explanation *EnvExplanation
+
+	for idx := len(layers) - 1; idx >= 0; idx-- {
+		if layers[idx].Env == nil {
+			continue
+		}
+
+		value, ok := layers[idx].Env.Get(varName)
+		if !ok {
+			continue
+		}
+
+		if explanation == nil {
+			explanation = &EnvExplanation{
+				Name:          varName,
+				ResolvedValue: value,
+				DefinedIn:     layers[idx].Name,
+				ShadowedBy:    []EnvShadow{},
+			}
+			continue
+		}
+
+		explanation.ShadowedBy = append(explanation.ShadowedBy, EnvShadow{Layer: layers[idx].Name, Value: value})
+	}
+
+	return explanation
+}
+
+// String prints the explanation as a tree, with the overridden definitions
+// under the value that's used
+func (e *EnvExplanation) String() string {
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "%s=%q (from %s)\n", e.Name, e.ResolvedValue, e.DefinedIn)
+	for _, shadow := range e.ShadowedBy {
+		fmt.Fprintf(&b, "  overrides %s=%q (from %s)\n", e.Name, shadow.Value, shadow.Layer)
+	}
+
+	return b.String()
+}
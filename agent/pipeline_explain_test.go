@@ -0,0 +1,37 @@
+package agent
+
+import (
+	"testing"
+
+	"github.com/buildkite/agent/env"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExplainEnv(t *testing.T) {
+	t.Parallel()
+
+	layers := []EnvLayer{
+		{Name: "os", Env: env.FromSlice([]string{"STAGE=development", "HOME=/root"})},
+		{Name: "pipeline", Env: env.FromSlice([]string{"STAGE=staging"})},
+		{Name: "group", Env: nil},
+		{Name: "step", Env: env.FromSlice([]string{"STAGE=production"})},
+	}
+
+	explanation := ExplainEnv("STAGE", layers)
+	assert.Equal(t, &EnvExplanation{
+		Name:          "STAGE",
+		ResolvedValue: "production",
+		DefinedIn:     "step",
+		ShadowedBy: []EnvShadow{
+			{Layer: "pipeline", Value: "staging"},
+			{Layer: "os", Value: "development"},
+		},
+	}, explanation)
+	assert.Equal(t, `STAGE="production" (from step)
+  overrides STAGE="staging" (from pipeline)
+  overrides STAGE="development" (from os)
+`, explanation.String())
+
+	assert.Equal(t, &EnvExplanation{Name: "HOME", ResolvedValue: "/root", DefinedIn: "os", ShadowedBy: []EnvShadow{}}, ExplainEnv("HOME", layers))
+	assert.Nil(t, ExplainEnv("UNSET", layers))
+}
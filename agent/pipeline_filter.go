@@ -0,0 +1,400 @@
+package agent
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode"
+
+	"github.com/buildkite/agent/env"
+)
+
+// FilterSteps returns the steps that would run for the current build, based on
+// each step's `branches` patterns and `if` condition. The branch is taken from
+// BUILDKITE_BRANCH in the environment. Steps without either are always kept,
+// and the steps inside groups are filtered too.
+//
+// Only a subset of the conditional language is supported: comparisons of
+// `build.*` and `pipeline.*` variables with `==`, `!=`, `=~` and `!~`,
+// combined with `&&`, `||`, `!` and parentheses.
+func FilterSteps(steps []interface{}, environ *env.Environment) ([]interface{}, error) {
+	return rewriteSteps(steps, func(path string, steps []interface{}) ([]interface{}, error) {
+		return filterStepList(steps, environ)
+	})
+}
+
+// filterStepList filters a list of steps, but not the steps in its groups,
+// which are copied so that their steps can be filtered without changing them
+func filterStepList(steps []interface{}, environ *env.Environment) ([]interface{}, error) {
+	filtered := []interface{}{}
+
+	for idx, step := range steps {
+		stepMap, ok := step.(map[string]interface{})
+		if !ok {
+			filtered = append(filtered, step)
+			continue
+		}
+
+		if branches, ok := stepMap["branches"]; ok && branches != nil {
+			patterns, err := branchPatterns(branches)
+			if err != nil {
+				return nil, fmt.Errorf("Step %d: %v", idx, err)
+			}
+			branch, _ := environ.Get("BUILDKITE_BRANCH")
+			if !branchMatches(patterns, branch) {
+				continue
+			}
+		}
+
+		if condition, ok := stepMap["if"]; ok && condition != nil {
+			s, ok := condition.(string)
+			if !ok {
+				return nil, fmt.Errorf("Step %d: expected `if` to be a string, got %T", idx, condition)
+			}
+			pass, err := evaluateCondition(s, environ)
+			if err != nil {
+				return nil, fmt.Errorf("Step %d: %v", idx, err)
+			}
+			if !pass {
+				continue
+			}
+		}
+
+		if _, ok := stepMap["steps"].([]interface{}); ok {
+			group := map[string]interface{}{}
+			for k, v := range stepMap {
+				group[k] = v
+			}
+			stepMap = group
+		}
+
+		filtered = append(filtered, stepMap)
+	}
+
+	return filtered, nil
+}
+
+// branchPatterns returns the patterns in a `branches` value, which is either
+// a space separated string or a list
+func branchPatterns(branches interface{}) ([]string, error) {
+	switch b := branches.(type) {
+	case string:
+		return strings.Fields(b), nil
+	case []interface{}:
+		var patterns []string
+		for _, pattern := range b {
+			s, ok := pattern.(string)
+			if !ok {
+				return nil, fmt.Errorf("expected branch pattern to be a string, got %T", pattern)
+			}
+			patterns = append(patterns, strings.Fields(s)...)
+		}
+		return patterns, nil
+	}
+	return nil, fmt.Errorf("expected `branches` to be a string or list, got %T", branches)
+}
+
+// branchMatches returns whether a branch matches a list of patterns, where `*`
+// matches anything and patterns starting with `!` exclude branches. If there
+// are only exclusions, any other branch matches.
+func branchMatches(patterns []string, branch string) bool {
+	included := false
+	hasInclusions := false
+
+	for _, pattern := range patterns {
+		if strings.HasPrefix(pattern, "!") {
+			if globMatch(strings.TrimPrefix(pattern, "!"), branch) {
+				return false
+			}
+			continue
+		}
+		hasInclusions = true
+		if globMatch(pattern, branch) {
+			included = true
+		}
+	}
+
+	return included || !hasInclusions
+}
+
+// conditionVariables are the variables that can be used in conditions, and
+// the env vars they come from
+var conditionVariables = map[string]string{
+	"build.branch":            "BUILDKITE_BRANCH",
+	"build.commit":            "BUILDKITE_COMMIT",
+	"build.message":           "BUILDKITE_MESSAGE",
+	"build.source":            "BUILDKITE_SOURCE",
+	"build.tag":               "BUILDKITE_TAG",
+	"build.creator.email":     "BUILDKITE_BUILD_CREATOR_EMAIL",
+	"build.pull_request.id":   "BUILDKITE_PULL_REQUEST",
+	"pipeline.slug":           "BUILDKITE_PIPELINE_SLUG",
+	"pipeline.default_branch": "BUILDKITE_PIPELINE_DEFAULT_BRANCH",
+}
+
+// evaluateCondition evaluates an `if` condition against the environment
+func evaluateCondition(condition string, environ *env.Environment) (bool, error) {
+	return (&conditionEvaluator{env: environ}).evaluate(condition)
+}
+
+// evalCondition evaluates a condition where the variables are env vars, such
+// as `BUILDKITE_BRANCH == "main" && DEPLOY != "false"`. It supports the same
+// operators as `if` conditions on steps, and env vars that aren't set are
+// empty strings.
+func evalCondition(expr string, environ *env.Environment) (bool, error) {
+	return (&conditionEvaluator{env: environ, envVars: true}).evaluate(expr)
+}
+
+type conditionToken struct {
+	kind string // ident, string, regex, op
+	text string
+}
+
+func tokenizeCondition(condition string) ([]conditionToken, error) {
+	var tokens []conditionToken
+
+	for pos := 0; pos < len(condition); {
+		c := condition[pos]
+		rest := condition[pos:]
+
+		switch {
+		case c == ' ' || c == '\t' || c == '\n':
+			pos++
+
+		case c == '"' || c == '\'':
+			end := strings.IndexByte(rest[1:], c)
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated string in condition")
+			}
+			tokens = append(tokens, conditionToken{kind: "string", text: rest[1 : end+1]})
+			pos += end + 2
+
+		// Regular expressions can only come after a match operator
+		case c == '/' && len(tokens) > 0 && (tokens[len(tokens)-1].text == "=~" || tokens[len(tokens)-1].text == "!~"):
+			end := -1
+			for i := 1; i < len(rest); i++ {
+				if rest[i] == '\\' {
+					i++
+				} else if rest[i] == '/' {
+					end = i
+					break
+				}
+			}
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated regular expression in condition")
+			}
+			pattern := strings.Replace(rest[1:end], `\/`, `/`, -1)
+			tokens = append(tokens, conditionToken{kind: "regex", text: pattern})
+			pos += end + 1
+
+		case strings.HasPrefix(rest, "==") || strings.HasPrefix(rest, "!=") ||
+			strings.HasPrefix(rest, "=~") || strings.HasPrefix(rest, "!~") ||
+			strings.HasPrefix(rest, "&&") || strings.HasPrefix(rest, "||"):
+			tokens = append(tokens, conditionToken{kind: "op", text: rest[:2]})
+			pos += 2
+
+		case c == '!' || c == '(' || c == ')':
+			tokens = append(tokens, conditionToken{kind: "op", text: rest[:1]})
+			pos++
+
+		case c == '_' || unicode.IsLetter(rune(c)):
+			end := strings.IndexFunc(rest, func(r rune) bool {
+				return !unicode.IsLetter(r) && !unicode.IsNumber(r) && r != '_' && r != '.'
+			})
+			if end < 0 {
+				end = len(rest)
+			}
+			tokens = append(tokens, conditionToken{kind: "ident", text: rest[:end]})
+			pos += end
+
+		default:
+			return nil, fmt.Errorf("unexpected %q in condition", string(c))
+		}
+	}
+
+	return tokens, nil
+}
+
+type conditionEvaluator struct {
+	tokens []conditionToken
+	pos    int
+	env    *env.Environment
+
+	// Whether variables are env var names, rather than `build.*` and
+	// `pipeline.*` variables
+	envVars bool
+}
+
+func (e *conditionEvaluator) evaluate(condition string) (bool, error) {
+	tokens, err := tokenizeCondition(condition)
+	if err != nil {
+		return false, err
+	}
+	e.tokens = tokens
+
+	result, err := e.or()
+	if err != nil {
+		return false, err
+	}
+	if e.pos < len(e.tokens) {
+		return false, fmt.Errorf("unexpected %q in condition", e.tokens[e.pos].text)
+	}
+
+	return truthy(result), nil
+}
+
+func (e *conditionEvaluator) peek(text string) bool {
+	return e.pos < len(e.tokens) && e.tokens[e.pos].kind == "op" && e.tokens[e.pos].text == text
+}
+
+func (e *conditionEvaluator) or() (interface{}, error) {
+	left, err := e.and()
+	if err != nil {
+		return nil, err
+	}
+	for e.peek("||") {
+		e.pos++
+		right, err := e.and()
+		if err != nil {
+			return nil, err
+		}
+		left = truthy(left) || truthy(right)
+	}
+	return left, nil
+}
+
+func (e *conditionEvaluator) and() (interface{}, error) {
+	left, err := e.unary()
+	if err != nil {
+		return nil, err
+	}
+	for e.peek("&&") {
+		e.pos++
+		right, err := e.unary()
+		if err != nil {
+			return nil, err
+		}
+		left = truthy(left) && truthy(right)
+	}
+	return left, nil
+}
+
+func (e *conditionEvaluator) unary() (interface{}, error) {
+	if e.peek("!") {
+		e.pos++
+		value, err := e.unary()
+		if err != nil {
+			return nil, err
+		}
+		return !truthy(value), nil
+	}
+	return e.comparison()
+}
+
+func (e *conditionEvaluator) comparison() (interface{}, error) {
+	left, err := e.operand()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, op := range []string{"==", "!=", "=~", "!~"} {
+		if !e.peek(op) {
+			continue
+		}
+		e.pos++
+
+		right, err := e.operand()
+		if err != nil {
+			return nil, err
+		}
+
+		switch op {
+		case "==":
+			return left == right, nil
+		case "!=":
+			return left != right, nil
+		}
+
+		re, ok := right.(*regexp.Regexp)
+		if !ok {
+			return nil, fmt.Errorf("expected a regular expression after %s", op)
+		}
+		s, _ := left.(string)
+		matched := left != nil && re.MatchString(s)
+		if op == "=~" {
+			return matched, nil
+		}
+		return !matched, nil
+	}
+
+	return left, nil
+}
+
+// operand returns a string, bool, nil or *regexp.Regexp
+func (e *conditionEvaluator) operand() (interface{}, error) {
+	if e.peek("(") {
+		e.pos++
+		value, err := e.or()
+		if err != nil {
+			return nil, err
+		}
+		if !e.peek(")") {
+			return nil, fmt.Errorf("expected ) in condition")
+		}
+		e.pos++
+		return value, nil
+	}
+
+	if e.pos >= len(e.tokens) {
+		return nil, fmt.Errorf("unexpected end of condition")
+	}
+	token := e.tokens[e.pos]
+	e.pos++
+
+	switch token.kind {
+	case "string":
+		return token.text, nil
+	case "regex":
+		re, err := regexp.Compile(token.text)
+		if err != nil {
+			return nil, fmt.Errorf("invalid regular expression /%s/: %v", token.text, err)
+		}
+		return re, nil
+	case "ident":
+		switch token.text {
+		case "null":
+			return nil, nil
+		case "true":
+			return true, nil
+		case "false":
+			return false, nil
+		}
+		if e.envVars {
+			value, _ := e.env.Get(token.text)
+			return value, nil
+		}
+		name, ok := conditionVariables[token.text]
+		if !ok {
+			return nil, fmt.Errorf("unsupported variable %q in condition", token.text)
+		}
+		value, ok := e.env.Get(name)
+		// Builds that aren't for a pull request have BUILDKITE_PULL_REQUEST=false
+		if !ok || value == "" || (name == "BUILDKITE_PULL_REQUEST" && value == "false") {
+			return nil, nil
+		}
+		return value, nil
+	}
+
+	return nil, fmt.Errorf("unexpected %q in condition", token.text)
+}
+
+func truthy(value interface{}) bool {
+	switch v := value.(type) {
+	case nil:
+		return false
+	case bool:
+		return v
+	case string:
+		return v != ""
+	}
+	return true
+}
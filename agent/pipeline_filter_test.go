@@ -0,0 +1,107 @@
+package agent
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/buildkite/agent/env"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFilterSteps(t *testing.T) {
+	t.Parallel()
+
+	parsed, err := PipelineParser{Pipeline: []byte(`
+steps:
+  - command: always
+  - command: main only
+    branches: main
+  - command: releases
+    branches: "release/* v*"
+  - command: not main
+    branches: "!main"
+  - command: if main
+    if: build.branch == "main"
+  - command: if not a pull request
+    if: build.pull_request.id == null && build.message !~ /skip ci/
+  - command: if tagged
+    if: build.tag != null || (build.branch =~ /^release\// && !false)
+  - wait
+  - group: Deploy
+    steps:
+      - command: deploy
+        branches: main
+      - command: deploy staging
+        branches: "release/*"
+`), NoInterpolation: true}.Parse()
+	assert.NoError(t, err)
+
+	for _, tc := range []struct {
+		name     string
+		env      []string
+		expected string
+	}{
+		{
+			name:     "main",
+			env:      []string{"BUILDKITE_BRANCH=main", "BUILDKITE_PULL_REQUEST=false", "BUILDKITE_MESSAGE=Fix"},
+			expected: `[{"command":"always"},{"command":"main only","branches":"main"},{"command":"if main","if":"build.branch == \"main\""},{"command":"if not a pull request","if":"build.pull_request.id == null && build.message !~ /skip ci/"},"wait",{"group":"Deploy","steps":[{"branches":"main","command":"deploy"}]}]`,
+		},
+		{
+			name:     "release pull request",
+			env:      []string{"BUILDKITE_BRANCH=release/1.0", "BUILDKITE_PULL_REQUEST=12", "BUILDKITE_MESSAGE=Release"},
+			expected: `[{"command":"always"},{"branches":"release/* v*","command":"releases"},{"branches":"!main","command":"not main"},{"command":"if tagged","if":"build.tag != null || (build.branch =~ /^release\\// && !false)"},"wait",{"group":"Deploy","steps":[{"branches":"release/*","command":"deploy staging"}]}]`,
+		},
+	} {
+		steps, err := FilterSteps(pipelineSteps(parsed), env.FromSlice(tc.env))
+		assert.NoError(t, err, tc.name)
+
+		actual, err := json.Marshal(steps)
+		assert.NoError(t, err)
+		assert.JSONEq(t, tc.expected, string(actual), tc.name)
+	}
+}
+
+func TestFilterStepsReturnsErrorsForInvalidConditions(t *testing.T) {
+	t.Parallel()
+
+	environ := env.FromSlice([]string{"BUILDKITE_BRANCH=main"})
+
+	for _, tc := range []struct {
+		condition string
+		err       string
+	}{
+		{`build.env("FOO") == "bar"`, `Step 0: unsupported variable "build.env" in condition`},
+		{`build.branch == main`, `Step 0: unsupported variable "main" in condition`},
+		{`build.branch == "main`, `Step 0: unterminated string in condition`},
+		{`build.state == "passed"`, `Step 0: unsupported variable "build.state" in condition`},
+		{`(build.branch == "main"`, `Step 0: expected ) in condition`},
+		{`build.branch =~ "main"`, `Step 0: expected a regular expression after =~`},
+		{`build.branch ==`, `Step 0: unexpected end of condition`},
+	} {
+		_, err := FilterSteps([]interface{}{map[string]interface{}{"command": "make", "if": tc.condition}}, environ)
+		assert.EqualError(t, err, tc.err, tc.condition)
+	}
+}
+
+func TestEvalCondition(t *testing.T) {
+	t.Parallel()
+
+	environ := env.FromSlice([]string{"BUILDKITE_BRANCH=main", "DEPLOY=true", "EMPTY="})
+
+	for expr, expected := range map[string]bool{
+		`BUILDKITE_BRANCH == "main"`:                     true,
+		`BUILDKITE_BRANCH != 'main'`:                     false,
+		`BUILDKITE_BRANCH == "main" && DEPLOY == "true"`: true,
+		`BUILDKITE_BRANCH == "main" && DEPLOY != "true"`: false,
+		`UNSET == "" && EMPTY == ""`:                     true,
+		`DEPLOY`:                                         true,
+		`EMPTY || UNSET`:                                 false,
+	} {
+		actual, err := evalCondition(expr, environ)
+		assert.NoError(t, err, expr)
+		assert.Equal(t, expected, actual, expr)
+	}
+
+	_, err := evalCondition(`BUILDKITE_BRANCH ==`, environ)
+	assert.EqualError(t, err, "unexpected end of condition")
+}
@@ -0,0 +1,62 @@
+package agent
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// FileSystem is where the parser reads any files referenced by a pipeline
+// from. It's a subset of Go 1.16's fs.ReadFileFS, which we can't use yet, so
+// an fs.FS (such as an embed.FS) can be used by wrapping fs.ReadFile.
+type FileSystem interface {
+	ReadFile(name string) ([]byte, error)
+}
+
+// DirFileSystem is a FileSystem that reads files from a directory on disk
+type DirFileSystem string
+
+func (dir DirFileSystem) ReadFile(name string) ([]byte, error) {
+	return ioutil.ReadFile(filepath.Join(string(dir), filepath.FromSlash(name)))
+}
+
+// readFile reads a file from the parser's FileSystem, or from disk relative
+// to the current directory if it doesn't have one
+func (p PipelineParser) readFile(name string) ([]byte, error) {
+	if p.FS == nil {
+		return ioutil.ReadFile(filepath.FromSlash(name))
+	}
+	return p.FS.ReadFile(name)
+}
+
+// GitRunner runs git with some arguments and returns what it prints, which
+// the parser uses to read pipelines at a git revision
+type GitRunner interface {
+	Run(args ...string) ([]byte, error)
+}
+
+// ExecGitRunner is a GitRunner that runs the git executable in a directory,
+// or the current directory if it's empty
+type ExecGitRunner struct {
+	Dir string
+}
+
+func (r ExecGitRunner) Run(args ...string) ([]byte, error) {
+	var stderr bytes.Buffer
+
+	cmd := exec.Command("git", args...)
+	cmd.Dir = r.Dir
+	cmd.Stderr = &stderr
+
+	out, err := cmd.Output()
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("%v: %s", err, msg)
+		}
+		return nil, err
+	}
+	return out, nil
+}
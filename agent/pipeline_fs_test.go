@@ -0,0 +1,119 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/buildkite/agent/env"
+	"github.com/stretchr/testify/assert"
+)
+
+type mapFileSystem map[string]string
+
+func (m mapFileSystem) ReadFile(name string) ([]byte, error) {
+	if contents, ok := m[name]; ok {
+		return []byte(contents), nil
+	}
+	return nil, os.ErrNotExist
+}
+
+func TestPipelineParserReadFile(t *testing.T) {
+	t.Parallel()
+
+	parser := PipelineParser{FS: mapFileSystem{"steps/test.yml": "- command: make test"}}
+
+	b, err := parser.readFile("steps/test.yml")
+	assert.NoError(t, err)
+	assert.Equal(t, "- command: make test", string(b))
+
+	_, err = parser.readFile("steps/missing.yml")
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestDirFileSystem(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "pipeline-fs")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	assert.NoError(t, os.MkdirAll(filepath.Join(dir, "steps"), 0755))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "steps", "test.yml"), []byte("- wait"), 0644))
+
+	b, err := DirFileSystem(dir).ReadFile("steps/test.yml")
+	assert.NoError(t, err)
+	assert.Equal(t, "- wait", string(b))
+}
+
+type fakeGitRunner map[string]string
+
+func (g fakeGitRunner) Run(args ...string) ([]byte, error) {
+	if len(args) == 2 && args[0] == "show" {
+		if contents, ok := g[args[1]]; ok {
+			return []byte(contents), nil
+		}
+	}
+	return nil, fmt.Errorf("exit status 128: fatal: invalid object name")
+}
+
+func TestPipelineParserReadsFromGit(t *testing.T) {
+	t.Parallel()
+
+	git := fakeGitRunner{"abc123:.buildkite/pipeline.yml": "steps:\n  - command: echo $FOO\n"}
+	environ := env.FromSlice([]string{"FOO=bar"})
+
+	result, err := PipelineParser{Filename: "abc123:.buildkite/pipeline.yml", Env: environ, GitRunner: git}.Parse()
+	assert.NoError(t, err)
+	j, err := json.Marshal(result)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"steps":[{"command":"echo bar"}]}`, string(j))
+
+	_, err = PipelineParser{Filename: "main:.buildkite/pipeline.yml", Env: environ, GitRunner: git}.Parse()
+	assert.EqualError(t, err, "Failed to read pipeline main:.buildkite/pipeline.yml from git: exit status 128: fatal: invalid object name")
+
+	// Without a GitRunner, or with a Pipeline, the Filename is just a name
+	for _, parser := range []PipelineParser{
+		{Filename: "abc123:.buildkite/pipeline.yml", Env: environ, Pipeline: []byte("- wait")},
+		{Filename: "abc123:.buildkite/pipeline.yml", Env: environ, Pipeline: []byte("- wait"), GitRunner: git},
+		{Filename: `C:\pipeline.yml`, Env: environ, Pipeline: []byte("- wait"), GitRunner: git},
+	} {
+		result, err := parser.Parse()
+		assert.NoError(t, err)
+		assert.Equal(t, []interface{}{"wait"}, result)
+	}
+}
+
+func TestExecGitRunner(t *testing.T) {
+	t.Parallel()
+
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git isn't installed")
+	}
+
+	dir, err := ioutil.TempDir("", "pipeline-git")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	git := ExecGitRunner{Dir: dir}
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "pipeline.yml"), []byte("- wait\n"), 0644))
+	for _, args := range [][]string{
+		{"init", "-q"},
+		{"add", "pipeline.yml"},
+		{"-c", "user.name=Test", "-c", "user.email=test@example.com", "commit", "-q", "-m", "Add pipeline"},
+	} {
+		_, err := git.Run(args...)
+		assert.NoError(t, err)
+	}
+
+	b, err := git.Run("show", "HEAD:pipeline.yml")
+	assert.NoError(t, err)
+	assert.Equal(t, "- wait\n", string(b))
+
+	_, err = git.Run("show", "HEAD:missing.yml")
+	assert.Error(t, err)
+}
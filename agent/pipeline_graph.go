@@ -0,0 +1,136 @@
+package agent
+
+import (
+	"fmt"
+	"strings"
+)
+
+// StepGraph is the dependency graph of the steps in a pipeline
+type StepGraph struct {
+	Nodes []StepNode
+	Edges []StepEdge
+}
+
+// StepNode is a step in a StepGraph. Steps without a `key` are keyed by their
+// path, such as `steps[2]`.
+type StepNode struct {
+	Key   string
+	Label string
+	Type  string
+}
+
+// StepEdge is a dependency between two steps in a StepGraph. The Type is
+// `depends_on` for explicit dependencies, `wait` for dependencies from a wait
+// step, and `group` from a group step to the steps in it.
+type StepEdge struct {
+	From string
+	To   string
+	Type string
+}
+
+// BuildStepGraph returns the dependency graph of a pipeline returned from
+// PipelineParser.Parse. Wait steps aren't nodes in the graph, instead each of
+// the steps since the previous wait step depends on each of the steps until
+// the next one. Dependencies on steps that aren't in the pipeline are ignored.
+func BuildStepGraph(parsed interface{}) (*StepGraph, error) {
+	switch parsed.(type) {
+	case []interface{}, map[string]interface{}:
+	default:
+		return nil, fmt.Errorf("Unexpected type of %T for pipeline", parsed)
+	}
+
+	graph := &StepGraph{Nodes: []StepNode{}, Edges: []StepEdge{}}
+	dependsOn := map[string][]string{}
+
+	addStepsToGraph(graph, pipelineSteps(parsed), "steps", dependsOn)
+
+	keys := map[string]bool{}
+	for _, node := range graph.Nodes {
+		keys[node.Key] = true
+	}
+
+	for _, node := range graph.Nodes {
+		for _, dep := range dependsOn[node.Key] {
+			if keys[dep] {
+				graph.Edges = append(graph.Edges, StepEdge{From: dep, To: node.Key, Type: "depends_on"})
+			}
+		}
+	}
+
+	return graph, nil
+}
+
+func addStepsToGraph(graph *StepGraph, steps []interface{}, path string, dependsOn map[string][]string) []string {
+	var all, before, since []string
+
+	for idx, step := range steps {
+		t := stepType(step)
+		if t == "wait" {
+			before, since = since, nil
+			continue
+		}
+
+		stepPath := fmt.Sprintf("%s[%d]", path, idx)
+		key, label := stepPath, stepPath
+
+		stepMap, isMap := step.(map[string]interface{})
+		if isMap {
+			if k := stepString(stepMap, "key"); k != "" {
+				key = k
+			}
+			label = stepName(stepPath, stepMap)
+			dependsOn[key] = stepDependencies(stepMap)
+		} else if s, ok := step.(string); ok {
+			label = s
+		}
+
+		graph.Nodes = append(graph.Nodes, StepNode{Key: key, Label: label, Type: t})
+
+		for _, from := range before {
+			graph.Edges = append(graph.Edges, StepEdge{From: from, To: key, Type: "wait"})
+		}
+
+		if children, ok := stepMap["steps"].([]interface{}); isMap && ok {
+			for _, child := range addStepsToGraph(graph, children, stepPath+".steps", dependsOn) {
+				graph.Edges = append(graph.Edges, StepEdge{From: key, To: child, Type: "group"})
+			}
+		}
+
+		since = append(since, key)
+		all = append(all, key)
+	}
+
+	return all
+}
+
+// ToDOT returns the graph in Graphviz's DOT format. Wait dependencies are
+// drawn dashed, and group membership dotted.
+func (g *StepGraph) ToDOT() string {
+	var b strings.Builder
+
+	b.WriteString("digraph pipeline {\n")
+
+	for _, node := range g.Nodes {
+		fmt.Fprintf(&b, "  %s [label=%s];\n", dotQuote(node.Key), dotQuote(node.Label))
+	}
+
+	for _, edge := range g.Edges {
+		fmt.Fprintf(&b, "  %s -> %s", dotQuote(edge.From), dotQuote(edge.To))
+		switch edge.Type {
+		case "wait":
+			b.WriteString(" [style=dashed]")
+		case "group":
+			b.WriteString(" [style=dotted]")
+		}
+		b.WriteString(";\n")
+	}
+
+	b.WriteString("}\n")
+
+	return b.String()
+}
+
+// dotQuote quotes a string as a DOT identifier
+func dotQuote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s) + `"`
+}
@@ -0,0 +1,87 @@
+package agent
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBuildStepGraph(t *testing.T) {
+	t.Parallel()
+
+	parsed, err := PipelineParser{Pipeline: []byte(`
+steps:
+  - label: Build
+    key: build
+    command: make
+  - label: Lint
+    command: make lint
+  - wait
+  - label: Test
+    key: test
+    command: make test
+  - group: Deploy
+    key: deploy
+    depends_on: test
+    steps:
+      - trigger: deploy-app
+        key: deploy-app
+  - block: "Release \"now\"?"
+    key: release
+    depends_on:
+      - build
+      - step: external
+`), NoInterpolation: true}.Parse()
+	assert.NoError(t, err)
+
+	graph, err := BuildStepGraph(parsed)
+	assert.NoError(t, err)
+
+	assert.Equal(t, []StepNode{
+		{Key: "build", Label: "Build", Type: "command"},
+		{Key: "steps[1]", Label: "Lint", Type: "command"},
+		{Key: "test", Label: "Test", Type: "command"},
+		{Key: "deploy", Label: "Deploy", Type: "group"},
+		{Key: "deploy-app", Label: "deploy-app", Type: "trigger"},
+		{Key: "release", Label: `Release "now"?`, Type: "block"},
+	}, graph.Nodes)
+
+	assert.Equal(t, []StepEdge{
+		{From: "build", To: "test", Type: "wait"},
+		{From: "steps[1]", To: "test", Type: "wait"},
+		{From: "build", To: "deploy", Type: "wait"},
+		{From: "steps[1]", To: "deploy", Type: "wait"},
+		{From: "deploy", To: "deploy-app", Type: "group"},
+		{From: "build", To: "release", Type: "wait"},
+		{From: "steps[1]", To: "release", Type: "wait"},
+		{From: "test", To: "deploy", Type: "depends_on"},
+		{From: "build", To: "release", Type: "depends_on"},
+	}, graph.Edges)
+}
+
+func TestStepGraphToDOT(t *testing.T) {
+	t.Parallel()
+
+	graph := &StepGraph{
+		Nodes: []StepNode{
+			{Key: "build", Label: "Build", Type: "command"},
+			{Key: "test", Label: `Test "all"`, Type: "command"},
+			{Key: "deploy", Label: "Deploy", Type: "group"},
+		},
+		Edges: []StepEdge{
+			{From: "build", To: "test", Type: "wait"},
+			{From: "test", To: "deploy", Type: "depends_on"},
+			{From: "deploy", To: "build", Type: "group"},
+		},
+	}
+
+	assert.Equal(t, `digraph pipeline {
+  "build" [label="Build"];
+  "test" [label="Test \"all\""];
+  "deploy" [label="Deploy"];
+  "build" -> "test" [style=dashed];
+  "test" -> "deploy";
+  "deploy" -> "build" [style=dotted];
+}
+`, graph.ToDOT())
+}
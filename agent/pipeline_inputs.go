@@ -0,0 +1,137 @@
+package agent
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	// This is a fork of gopkg.in/yaml.v2 that fixes anchors with MapSlice
+	yaml "github.com/buildkite/yaml"
+)
+
+// MissingInputError is returned for a required input that isn't set
+type MissingInputError struct {
+	Input string
+}
+
+func (e MissingInputError) Error() string {
+	return fmt.Sprintf("Input %s is required but isn't set", e.Input)
+}
+
+// InvalidInputError is returned for an input with a value that doesn't match
+// its type
+type InvalidInputError struct {
+	Input      string
+	Value      string
+	Constraint string
+}
+
+func (e InvalidInputError) Error() string {
+	return fmt.Sprintf("Input %s is %q, but must be %s", e.Input, e.Value, e.Constraint)
+}
+
+// validateInputs checks the environment against the pipeline's top-level
+// `inputs` block, which declares the env vars the pipeline expects. Each
+// input can have a `type` of string, number, boolean or enum (with the
+// allowed `values`), and be `required`. Inputs that aren't set are only
+// checked if they're required. This is only done with StrictInterpolation.
+func (p PipelineParser) validateInputs(pipeline yaml.MapSlice) error {
+	item, ok := mapSliceItem("inputs", pipeline)
+	if !ok {
+		return nil
+	}
+
+	inputs, ok := item.Value.(yaml.MapSlice)
+	if !ok {
+		return fmt.Errorf("Expected pipeline top-level inputs block to be a map, got %T", item.Value)
+	}
+
+	var errs []error
+
+	for _, input := range inputs {
+		name := fmt.Sprintf("%v", input.Key)
+
+		var definition yaml.MapSlice
+		if input.Value != nil {
+			if definition, ok = input.Value.(yaml.MapSlice); !ok {
+				return fmt.Errorf("Expected input %s to be a map, got %T", name, input.Value)
+			}
+		}
+
+		if err := checkInputDefinition(name, definition); err != nil {
+			return err
+		}
+
+		value, exists := p.Env.Get(name)
+		if !exists {
+			if required, _ := mapSliceValue("required", definition).(bool); required {
+				errs = append(errs, MissingInputError{Input: name})
+			}
+			continue
+		}
+
+		if constraint := inputConstraint(definition, value); constraint != "" {
+			errs = append(errs, InvalidInputError{Input: name, Value: value, Constraint: constraint})
+		}
+	}
+
+	if len(errs) > 0 {
+		return &PipelineValidationError{Errors: errs}
+	}
+
+	return nil
+}
+
+// checkInputDefinition returns an error if an input's type isn't known, or
+// it's an enum without a list of values
+func checkInputDefinition(name string, definition yaml.MapSlice) error {
+	inputType, _ := mapSliceValue("type", definition).(string)
+
+	switch inputType {
+	case "", "string", "number", "boolean":
+		return nil
+	case "enum":
+		if _, ok := mapSliceValue("values", definition).([]interface{}); !ok {
+			return fmt.Errorf("Expected input %s to have a list of values", name)
+		}
+		return nil
+	}
+
+	return fmt.Errorf("Input %s has an unknown type of %q", name, inputType)
+}
+
+// inputConstraint returns the constraint a value doesn't meet for an input,
+// or an empty string if it's valid
+func inputConstraint(definition yaml.MapSlice, value string) string {
+	inputType, _ := mapSliceValue("type", definition).(string)
+
+	switch inputType {
+	case "number":
+		if _, err := strconv.ParseFloat(value, 64); err != nil {
+			return "a number"
+		}
+
+	case "boolean":
+		if value != "true" && value != "false" {
+			return "true or false"
+		}
+
+	case "enum":
+		var allowed []string
+		for _, v := range mapSliceValue("values", definition).([]interface{}) {
+			if fmt.Sprintf("%v", v) == value {
+				return ""
+			}
+			allowed = append(allowed, fmt.Sprintf("%v", v))
+		}
+		return fmt.Sprintf("one of %s", strings.Join(allowed, ", "))
+	}
+
+	return ""
+}
+
+// mapSliceValue returns the value of a key in a yaml.MapSlice, or nil
+func mapSliceValue(key string, m yaml.MapSlice) interface{} {
+	item, _ := mapSliceItem(key, m)
+	return item.Value
+}
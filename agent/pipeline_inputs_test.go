@@ -0,0 +1,96 @@
+package agent
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/buildkite/agent/env"
+	"github.com/stretchr/testify/assert"
+)
+
+const inputsPipeline = `inputs:
+  DEPLOY_ENV:
+    type: enum
+    values: [prod, staging]
+    required: true
+    description: The environment to deploy to
+  REPLICAS:
+    type: number
+  DRY_RUN:
+    type: boolean
+  NOTES:
+    description: Anything else
+env:
+  REPLICAS: 3
+steps:
+  - command: deploy $DEPLOY_ENV
+`
+
+func TestPipelineParserValidatesInputs(t *testing.T) {
+	t.Parallel()
+
+	result, err := PipelineParser{
+		Pipeline:            []byte(inputsPipeline),
+		Env:                 env.FromSlice([]string{"DEPLOY_ENV=staging", "DRY_RUN=true"}),
+		StrictInterpolation: true,
+	}.Parse()
+	assert.NoError(t, err)
+
+	j, err := json.Marshal(result)
+	assert.NoError(t, err)
+	assert.Contains(t, string(j), `"steps":[{"command":"deploy staging"}]`)
+
+	_, err = PipelineParser{
+		Pipeline:            []byte(inputsPipeline),
+		Env:                 env.FromSlice([]string{"DRY_RUN=yes"}),
+		StrictInterpolation: true,
+	}.Parse()
+	if assert.IsType(t, &PipelineValidationError{}, err) {
+		assert.Equal(t, []error{
+			MissingInputError{Input: "DEPLOY_ENV"},
+			InvalidInputError{Input: "DRY_RUN", Value: "yes", Constraint: "true or false"},
+		}, err.(*PipelineValidationError).Errors)
+	}
+
+	_, err = PipelineParser{
+		Pipeline:            []byte(inputsPipeline),
+		Env:                 env.FromSlice([]string{"DEPLOY_ENV=dev", "REPLICAS=lots"}),
+		StrictInterpolation: true,
+	}.Parse()
+	assert.EqualError(t, err, `Pipeline validation failed: Input DEPLOY_ENV is "dev", but must be one of prod, staging`)
+
+	// Inputs are only checked with strict interpolation
+	_, err = PipelineParser{
+		Pipeline: []byte(inputsPipeline),
+		Env:      env.FromSlice([]string{}),
+	}.Parse()
+	assert.NoError(t, err)
+}
+
+func TestPipelineParserInputsErrors(t *testing.T) {
+	t.Parallel()
+
+	for pipeline, expected := range map[string]string{
+		"inputs: [FOO]\nsteps: []\n":                         "Expected pipeline top-level inputs block to be a map, got []interface {}",
+		"inputs:\n  FOO: string\nsteps: []\n":                "Expected input FOO to be a map, got string",
+		"inputs:\n  FOO:\n    type: enum\nsteps: []\n":       "Expected input FOO to have a list of values",
+		"inputs:\n  FOO:\n    type: duration\nsteps: []\n":   `Input FOO has an unknown type of "duration"`,
+		"inputs:\n  FOO:\n    required: true\nsteps: []\n":   "Pipeline validation failed: Input FOO is required but isn't set",
+		"inputs:\n  FOO:\n    type: number\nsteps: []\n":     "",
+		"inputs:\n  BAR:\n    type: number\nsteps: []\n":     "Pipeline validation failed: Input BAR is \"x\", but must be a number",
+		"inputs:\n  NOTES:\nsteps: []\n":                     "",
+		"inputs:\n  BAR:\n    type: string\nsteps: []\n":     "",
+		"inputs:\n  BAR:\n    type: enum\n    values: [z]\n": "Pipeline validation failed: Input BAR is \"x\", but must be one of z",
+	} {
+		_, err := PipelineParser{
+			Pipeline:            []byte(pipeline),
+			Env:                 env.FromSlice([]string{"BAR=x"}),
+			StrictInterpolation: true,
+		}.Parse()
+		if expected == "" {
+			assert.NoError(t, err, pipeline)
+		} else {
+			assert.EqualError(t, err, expected, pipeline)
+		}
+	}
+}
@@ -0,0 +1,521 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/buildkite/agent/env"
+	"github.com/buildkite/interpolate"
+)
+
+// Interpolator replaces the variables in a string with their values from an
+// environment
+type Interpolator interface {
+	Interpolate(environ *env.Environment, str string) (string, error)
+}
+
+// packageInterpolator is an Interpolator that uses the interpolate package
+type packageInterpolator struct{}
+
+func (packageInterpolator) Interpolate(environ *env.Environment, str string) (string, error) {
+	return interpolate.Interpolate(environ, str)
+}
+
+// interpolator returns the parser's Interpolator, or the interpolate package
+// if it doesn't have one
+func (p PipelineParser) interpolator() Interpolator {
+	if p.Interpolator == nil {
+		return packageInterpolator{}
+	}
+	return p.Interpolator
+}
+
+// expandTrimOperators expands the POSIX prefix and suffix removal operators
+// (`${VAR#pattern}`, `${VAR##pattern}`, `${VAR%pattern}` and `${VAR%%pattern}`)
+// which the interpolate package doesn't support. Everything else is left as
+// is for interpolate to handle, with any $'s in the expanded values escaped.
+func expandTrimOperators(environ *env.Environment, str string, strict bool) (string, error) {
+	return replaceEnvReferences(str, func(ref string) (string, int, error) {
+		expansion, length, ok := parseTrimExpansion(ref)
+		if !ok {
+			return "", 0, nil
+		}
+		val, exists := environ.Get(expansion.identifier)
+		if !exists && strict {
+			return "", 0, fmt.Errorf("$%s: not set", expansion.identifier)
+		}
+		return strings.Replace(expansion.apply(val), "$", "$$", -1), length, nil
+	})
+}
+
+// replaceEnvReferences calls fn with the rest of a string from each `${` that
+// isn't escaped (with `$$` or `\$`), and replaces as many bytes as fn says
+// with what it returns. If fn returns a length of 0, the string is left as
+// it is there. This is for the kinds of references that interpolate doesn't
+// support, which are expanded before it runs.
+func replaceEnvReferences(str string, fn func(ref string) (string, int, error)) (string, error) {
+	if !strings.Contains(str, "${") {
+		return str, nil
+	}
+
+	var b strings.Builder
+
+	for pos := 0; pos < len(str); {
+		rest := str[pos:]
+
+		if strings.HasPrefix(rest, `\\`) || strings.HasPrefix(rest, `\$`) || strings.HasPrefix(rest, `$$`) {
+			b.WriteString(rest[:2])
+			pos += 2
+			continue
+		}
+
+		if strings.HasPrefix(rest, "${") {
+			replacement, length, err := fn(rest)
+			if err != nil {
+				return "", err
+			}
+			if length > 0 {
+				b.WriteString(replacement)
+				pos += length
+				continue
+			}
+		}
+
+		b.WriteByte(str[pos])
+		pos++
+	}
+
+	return b.String(), nil
+}
+
+type trimExpansion struct {
+	identifier string
+	operator   string
+	pattern    string
+}
+
+// parseTrimExpansion parses a trim expansion from the start of a string,
+// returning it along with the number of bytes it took up
+func parseTrimExpansion(str string) (trimExpansion, int, bool) {
+	pos := len("${")
+
+	// Identifiers must start with a letter, which also rules out `${#VAR}`
+	r, _ := utf8.DecodeRuneInString(str[pos:])
+	if !unicode.IsLetter(r) {
+		return trimExpansion{}, 0, false
+	}
+
+	end := strings.IndexFunc(str[pos:], func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r) && r != '_'
+	})
+	if end < 0 {
+		return trimExpansion{}, 0, false
+	}
+
+	identifier := str[pos : pos+end]
+	pos += end
+
+	var operator string
+	for _, op := range []string{"##", "#", "%%", "%"} {
+		if strings.HasPrefix(str[pos:], op) {
+			operator = op
+			break
+		}
+	}
+	if operator == "" {
+		return trimExpansion{}, 0, false
+	}
+	pos += len(operator)
+
+	closing := strings.IndexByte(str[pos:], '}')
+	if closing < 0 {
+		return trimExpansion{}, 0, false
+	}
+
+	return trimExpansion{
+		identifier: identifier,
+		operator:   operator,
+		pattern:    str[pos : pos+closing],
+	}, pos + closing + 1, true
+}
+
+func (e trimExpansion) apply(val string) string {
+	switch e.operator {
+	case "#":
+		for i := 0; i <= len(val); i++ {
+			if globMatch(e.pattern, val[:i]) {
+				return val[i:]
+			}
+		}
+	case "##":
+		for i := len(val); i >= 0; i-- {
+			if globMatch(e.pattern, val[:i]) {
+				return val[i:]
+			}
+		}
+	case "%":
+		for i := len(val); i >= 0; i-- {
+			if globMatch(e.pattern, val[i:]) {
+				return val[:i]
+			}
+		}
+	case "%%":
+		for i := 0; i <= len(val); i++ {
+			if globMatch(e.pattern, val[i:]) {
+				return val[:i]
+			}
+		}
+	}
+	return val
+}
+
+var envNamespaceRegex = regexp.MustCompile(`^\$\{([a-zA-Z_][a-zA-Z0-9_]*)\.([a-zA-Z_][a-zA-Z0-9_]*)`)
+
+// expandEnvNamespaces replaces `${namespace.VAR` with `${PREFIX_VAR`, where
+// the namespace is case insensitive and PREFIX_ is its prefix, so that the
+// rest of the reference (like a default value) is interpolated as normal
+func expandEnvNamespaces(namespaces map[string]string, str string) string {
+	if len(namespaces) == 0 {
+		return str
+	}
+
+	// This never returns an error
+	expanded, _ := replaceEnvReferences(str, func(ref string) (string, int, error) {
+		match := envNamespaceRegex.FindStringSubmatch(ref)
+		if match == nil {
+			return "", 0, nil
+		}
+		if prefix, ok := envNamespacePrefix(namespaces, match[1]); ok {
+			return "${" + prefix + match[2], len(match[0]), nil
+		}
+		return match[0], len(match[0]), nil
+	})
+	return expanded
+}
+
+// envNamespacePrefix returns the prefix of a namespace, ignoring case
+func envNamespacePrefix(namespaces map[string]string, name string) (string, bool) {
+	if prefix, ok := namespaces[name]; ok {
+		return prefix, true
+	}
+	for namespace, prefix := range namespaces {
+		if strings.EqualFold(namespace, name) {
+			return prefix, true
+		}
+	}
+	return "", false
+}
+
+var jsonPathExpansionRegex = regexp.MustCompile(`^\$\{([a-zA-Z_][a-zA-Z0-9_]*)((?:\.[a-zA-Z0-9_-]+)+)\}`)
+
+// expandJSONPaths expands `${VAR.field.nested}` by parsing the value of VAR as
+// JSON and extracting the field at the path, where numbers index into arrays.
+// Strings are expanded as is, and everything else as JSON. If the value isn't
+// JSON or the path doesn't exist, it's an error when strict and expands to an
+// empty string otherwise.
+func expandJSONPaths(environ *env.Environment, str string, strict bool) (string, error) {
+	return replaceEnvReferences(str, func(ref string) (string, int, error) {
+		match := jsonPathExpansionRegex.FindStringSubmatch(ref)
+		if match == nil {
+			return "", 0, nil
+		}
+		val, err := jsonPathValue(environ, match[1], strings.Split(match[2][1:], "."))
+		if err != nil && strict {
+			return "", 0, err
+		}
+		return strings.Replace(val, "$", "$$", -1), len(match[0]), nil
+	})
+}
+
+// jsonPathValue returns the value at a path in the JSON value of a variable
+func jsonPathValue(environ *env.Environment, name string, path []string) (string, error) {
+	raw, exists := environ.Get(name)
+	if !exists {
+		return "", fmt.Errorf("$%s: not set", name)
+	}
+
+	decoder := json.NewDecoder(strings.NewReader(raw))
+	decoder.UseNumber()
+
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return "", fmt.Errorf("$%s: not valid JSON", name)
+	}
+
+	for idx, key := range path {
+		found := false
+		switch v := value.(type) {
+		case map[string]interface{}:
+			value, found = v[key]
+		case []interface{}:
+			if i, err := strconv.Atoi(key); err == nil && i >= 0 && i < len(v) {
+				value, found = v[i], true
+			}
+		}
+		if !found {
+			return "", fmt.Errorf("$%s.%s: not set", name, strings.Join(path[:idx+1], "."))
+		}
+	}
+
+	switch v := value.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	case json.Number:
+		return v.String(), nil
+	}
+
+	b, err := json.Marshal(value)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+var arithmeticRegex = regexp.MustCompile(`^\s*-?\d+(\s*[-+*/]\s*-?\d+)+\s*$`)
+var arithmeticTokenRegex = regexp.MustCompile(`-?\d+|[-+*/]`)
+
+// evalEnvArithmetic evaluates an env block value if it's integer arithmetic,
+// such as `5 * 2 + 1`, with the usual precedence. Anything else, including a
+// single number, is returned as is.
+func evalEnvArithmetic(path, value string) (string, error) {
+	if !arithmeticRegex.MatchString(value) {
+		return value, nil
+	}
+
+	// Tokens alternate between numbers and operators, and a `-` straight
+	// after an operator is part of the number
+	tokens := arithmeticTokenRegex.FindAllString(value, -1)
+	var merged []string
+	for _, token := range tokens {
+		if len(merged)%2 == 0 && token == "-" {
+			continue
+		}
+		if len(merged)%2 == 1 && len(token) > 1 && token[0] == '-' {
+			merged = append(merged, "-", token[1:])
+			continue
+		}
+		merged = append(merged, token)
+	}
+	tokens = merged
+
+	// Multiplication and division are done first, leaving a sum
+	terms := []int64{}
+	ops := []string{}
+	current, err := strconv.ParseInt(tokens[0], 10, 64)
+	if err != nil {
+		return "", fmt.Errorf("Failed to evaluate %s: %v", path, err)
+	}
+
+	for i := 1; i < len(tokens); i += 2 {
+		op := tokens[i]
+		n, err := strconv.ParseInt(tokens[i+1], 10, 64)
+		if err != nil {
+			return "", fmt.Errorf("Failed to evaluate %s: %v", path, err)
+		}
+
+		switch op {
+		case "*":
+			current *= n
+		case "/":
+			if n == 0 {
+				return "", fmt.Errorf("Failed to evaluate %s: division by zero in %q", path, value)
+			}
+			current /= n
+		default:
+			terms = append(terms, current)
+			ops = append(ops, op)
+			current = n
+		}
+	}
+	terms = append(terms, current)
+
+	result := terms[0]
+	for i, op := range ops {
+		if op == "+" {
+			result += terms[i+1]
+		} else {
+			result -= terms[i+1]
+		}
+	}
+
+	return strconv.FormatInt(result, 10), nil
+}
+
+// globMatch matches a string against a shell pattern, where `*` matches any
+// sequence of characters (including `/`), `?` matches any single character and
+// `\` escapes the next character
+func globMatch(pattern, str string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for i := len(str); i >= 0; i-- {
+				if globMatch(pattern[1:], str[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(str) == 0 {
+				return false
+			}
+			_, size := utf8.DecodeRuneInString(str)
+			pattern, str = pattern[1:], str[size:]
+			continue
+		case '\\':
+			if len(pattern) > 1 {
+				pattern = pattern[1:]
+			}
+		}
+		if len(str) == 0 || pattern[0] != str[0] {
+			return false
+		}
+		pattern, str = pattern[1:], str[1:]
+	}
+	return len(str) == 0
+}
+
+// ExtractEnvRefs returns the sorted names of all the variables referenced in
+// a pipeline, without interpolating it. It finds the same references as
+// interpolation would, so can be used to check they're all set beforehand.
+func ExtractEnvRefs(pipeline []byte) ([]string, error) {
+	var parsed interface{}
+	if err := unmarshalYAML(pipeline, &parsed); err != nil {
+		return nil, fmt.Errorf("Failed to parse pipeline: %v", parseYAMLError(err))
+	}
+
+	seen := map[string]bool{}
+	refs := []string{}
+	walkYAMLStrings(parsed, func(s string) {
+		for _, ref := range referencedVariables(s) {
+			if !seen[ref] {
+				seen[ref] = true
+				refs = append(refs, ref)
+			}
+		}
+	})
+	sort.Strings(refs)
+
+	return refs, nil
+}
+
+// referencedVariables returns the names of all the variables referenced in a
+// string, including those in default values such as `${FOO:-$BAR}`. Escaped
+// dollars (`$$` and `\$`) aren't references.
+func referencedVariables(str string) []string {
+	var refs []string
+	seen := map[string]bool{}
+
+	for pos := 0; pos < len(str); pos++ {
+		rest := str[pos:]
+
+		if strings.HasPrefix(rest, `\\`) || strings.HasPrefix(rest, `\$`) || strings.HasPrefix(rest, `$$`) {
+			pos++
+			continue
+		}
+
+		if rest[0] != '$' {
+			continue
+		}
+
+		start := 1
+		if strings.HasPrefix(rest, "${") {
+			start = 2
+		}
+
+		r, _ := utf8.DecodeRuneInString(rest[start:])
+		if !unicode.IsLetter(r) {
+			continue
+		}
+
+		end := strings.IndexFunc(rest[start:], func(r rune) bool {
+			return !unicode.IsLetter(r) && !unicode.IsNumber(r) && r != '_'
+		})
+		if end < 0 {
+			end = len(rest) - start
+		}
+
+		name := rest[start : start+end]
+		if !seen[name] {
+			seen[name] = true
+			refs = append(refs, name)
+		}
+		pos += start + end - 1
+	}
+
+	return refs
+}
+
+var sequenceExpansionRegex = regexp.MustCompile(`^\$\{([a-zA-Z_][a-zA-Z0-9_]*)\*\}$`)
+
+// expandSequence expands a string of just `${PREFIX_*}` into a list of the
+// values of the env vars named PREFIX_ followed by a number, such as
+// PREFIX_0 and PREFIX_1, in the order of their numbers. This is for teams that
+// encode lists as indexed env vars. Anything else returns false.
+//
+// With strict set, it's an error for none of the env vars to be set, or for
+// one to have a number that isn't an index (like PREFIX_01), rather than them
+// being left out of the list.
+func expandSequence(environ *env.Environment, str string, strict bool) ([]interface{}, bool, error) {
+	match := sequenceExpansionRegex.FindStringSubmatch(str)
+	if match == nil {
+		return nil, false, nil
+	}
+	prefix := match[1]
+
+	type indexedValue struct {
+		index int
+		value string
+	}
+
+	var values []indexedValue
+	for name, value := range environ.ToMap() {
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		suffix := strings.TrimPrefix(name, prefix)
+		index, err := strconv.Atoi(suffix)
+		if err != nil {
+			continue
+		}
+		if index < 0 || strconv.Itoa(index) != suffix {
+			if strict {
+				return nil, true, fmt.Errorf("%s: %s isn't a valid index for the sequence", str, name)
+			}
+			continue
+		}
+		values = append(values, indexedValue{index: index, value: value})
+	}
+
+	if strict && len(values) == 0 {
+		return nil, true, fmt.Errorf("%s: no %s0, %s1, ... env vars are set", str, prefix, prefix)
+	}
+
+	sort.Slice(values, func(i, j int) bool {
+		return values[i].index < values[j].index
+	})
+
+	seq := []interface{}{}
+	for _, v := range values {
+		seq = append(seq, v.value)
+	}
+
+	return seq, true, nil
+}
+
+// placeholderEnv returns an environment with each of the variables referenced
+// in a string set to a placeholder like `__VAR__`
+func placeholderEnv(str string) *env.Environment {
+	environ := env.New()
+	for _, name := range referencedVariables(str) {
+		environ.Set(name, "__"+name+"__")
+	}
+	return environ
+}
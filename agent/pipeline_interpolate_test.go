@@ -0,0 +1,301 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/buildkite/agent/env"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExpandTrimOperators(t *testing.T) {
+	t.Parallel()
+
+	environ := env.FromSlice([]string{
+		`BRANCH=refs/heads/feature/llamas`,
+		`FILE=archive.tar.gz`,
+		`PRICE=$100`,
+	})
+
+	for _, tc := range []struct {
+		input    string
+		expected string
+	}{
+		{`${BRANCH#refs/heads/}`, `feature/llamas`},
+		{`${BRANCH#*/}`, `heads/feature/llamas`},
+		{`${BRANCH##*/}`, `llamas`},
+		{`${FILE%.*}`, `archive.tar`},
+		{`${FILE%%.*}`, `archive`},
+		{`${FILE%.t?r.gz}`, `archive`},
+		{`${FILE#nope}`, `archive.tar.gz`},
+		{`${MISSING#foo}`, ``},
+		{`${PRICE#$}`, `100`},
+		{`$${FILE%%.*} ${FILE%%.*}`, `$${FILE%%.*} archive`},
+		{`\${FILE%%.*}`, `\${FILE%%.*}`},
+		{`${PRICE%0}`, `$$10`},
+	} {
+		actual, err := expandTrimOperators(environ, tc.input, false)
+		assert.NoError(t, err)
+		assert.Equal(t, tc.expected, actual, tc.input)
+	}
+
+	_, err := expandTrimOperators(environ, `${MISSING#foo}`, true)
+	assert.EqualError(t, err, "$MISSING: not set")
+}
+
+func TestPipelineParserInterpolatesTrimOperators(t *testing.T) {
+	t.Parallel()
+
+	environ := env.FromSlice([]string{`BUILDKITE_BRANCH=refs/heads/main`})
+
+	result, err := PipelineParser{
+		Pipeline: []byte("steps:\n  - label: \"${BUILDKITE_BRANCH#refs/heads/} ${BUILDKITE_BRANCH##*/}\""),
+		Env:      environ,
+	}.Parse()
+	assert.NoError(t, err)
+	j, err := json.Marshal(result)
+	assert.Equal(t, `{"steps":[{"label":"main main"}]}`, string(j))
+}
+
+func TestReferencedVariables(t *testing.T) {
+	t.Parallel()
+
+	assert.Equal(t, []string{"FOO", "BAR", "BAZ", "QUX"},
+		referencedVariables(`$FOO ${BAR} ${BAZ:-$QUX} $FOO $$ESCAPED \$ESCAPED $(command) ${BAR#prefix} $1`))
+	assert.Nil(t, referencedVariables(`no variables here $`))
+}
+
+func TestExtractEnvRefs(t *testing.T) {
+	t.Parallel()
+
+	refs, err := ExtractEnvRefs([]byte(`env:
+  IMAGE: node:$NODE_VERSION
+steps:
+  - label: "${LABEL:-Build}"
+    command: docker run $IMAGE make $$TARGET
+    agents:
+      queue: $QUEUE
+  - wait
+  - command: echo $IMAGE
+`))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"IMAGE", "LABEL", "NODE_VERSION", "QUEUE"}, refs)
+
+	refs, err = ExtractEnvRefs([]byte("- command: make\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{}, refs)
+
+	_, err = ExtractEnvRefs([]byte("steps: [\n"))
+	assert.EqualError(t, err, "Failed to parse pipeline: line 1: did not find expected node content")
+}
+
+func TestPipelineParserJSONEnvExpansion(t *testing.T) {
+	t.Parallel()
+
+	environ := env.FromSlice([]string{
+		`BUILD_META={"version":"1.2","tier":"prod","build":{"number":42,"tags":["a","b"]},"price":"$5"}`,
+		`NOT_JSON=nope`,
+	})
+
+	result, err := PipelineParser{
+		Pipeline:         []byte(`steps: [{label: "${BUILD_META.version} ${BUILD_META.tier} #${BUILD_META.build.number} ${BUILD_META.build.tags.1} ${BUILD_META.build.tags} ${BUILD_META.price} $${BUILD_META.tier} ${BUILD_META.missing}${NOT_JSON.field}"}]`),
+		Env:              environ,
+		JSONEnvExpansion: true,
+	}.Parse()
+	assert.NoError(t, err)
+	j, err := json.Marshal(result)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"steps":[{"label":"1.2 prod #42 b [\"a\",\"b\"] $5 ${BUILD_META.tier} "}]}`, string(j))
+
+	for pipeline, expected := range map[string]string{
+		`steps: [{label: "${BUILD_META.missing}"}]`:   "$BUILD_META.missing: not set",
+		`steps: [{label: "${BUILD_META.tier.name}"}]`: "$BUILD_META.tier.name: not set",
+		`steps: [{label: "${NOT_JSON.field}"}]`:       "$NOT_JSON: not valid JSON",
+		`steps: [{label: "${UNSET.field}"}]`:          "$UNSET: not set",
+	} {
+		_, err = PipelineParser{
+			Pipeline:            []byte(pipeline),
+			Env:                 environ,
+			JSONEnvExpansion:    true,
+			StrictInterpolation: true,
+		}.Parse()
+		assert.EqualError(t, err, expected, pipeline)
+	}
+}
+
+func TestPipelineParserEnvNamespaces(t *testing.T) {
+	t.Parallel()
+
+	environ := env.FromSlice([]string{
+		`PROD_DB_HOST=db.prod.internal`,
+		`STAGING_DB_HOST=db.staging.internal`,
+		`PROD_CONFIG={"region":"us-east-1"}`,
+	})
+
+	result, err := PipelineParser{
+		Pipeline:         []byte(`steps: [{command: "deploy ${prod.DB_HOST} ${Staging.DB_HOST} ${prod.DB_USER:-deploy} ${PROD.CONFIG.region} $${prod.DB_HOST} ${other.DB_HOST}"}]`),
+		Env:              environ,
+		JSONEnvExpansion: true,
+		EnvNamespaces: map[string]string{
+			"prod":    "PROD_",
+			"STAGING": "STAGING_",
+		},
+	}.Parse()
+	assert.NoError(t, err)
+	j, err := json.Marshal(result)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"steps":[{"command":"deploy db.prod.internal db.staging.internal deploy us-east-1 ${prod.DB_HOST} "}]}`, string(j))
+
+	_, err = PipelineParser{
+		Pipeline:            []byte(`steps: [{command: "deploy ${prod.DB_NAME}"}]`),
+		Env:                 environ,
+		EnvNamespaces:       map[string]string{"prod": "PROD_"},
+		StrictInterpolation: true,
+	}.Parse()
+	assert.EqualError(t, err, "$PROD_DB_NAME: not set")
+}
+
+// upperInterpolator replaces `@VAR` with the value of VAR in upper case
+type upperInterpolator struct{}
+
+var upperInterpolatorRegex = regexp.MustCompile(`@[A-Z_]+`)
+
+func (upperInterpolator) Interpolate(environ *env.Environment, str string) (string, error) {
+	if strings.Contains(str, "{{") {
+		return "", fmt.Errorf("unsupported syntax in %q", str)
+	}
+	return upperInterpolatorRegex.ReplaceAllStringFunc(str, func(match string) string {
+		value, _ := environ.Get(match[1:])
+		return strings.ToUpper(value)
+	}), nil
+}
+
+func TestPipelineParserCustomInterpolator(t *testing.T) {
+	t.Parallel()
+
+	result, err := PipelineParser{
+		Pipeline:     []byte("env:\n  NAME: llama\nsteps:\n  - command: echo @NAME $NAME\n"),
+		Env:          env.FromSlice([]string{}),
+		Interpolator: upperInterpolator{},
+	}.Parse()
+	assert.NoError(t, err)
+	j, err := json.Marshal(result)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"env":{"NAME":"llama"},"steps":[{"command":"echo LLAMA $NAME"}]}`, string(j))
+
+	_, err = PipelineParser{
+		Pipeline:     []byte("steps:\n  - command: echo {{ name }}\n"),
+		Env:          env.FromSlice([]string{}),
+		Interpolator: upperInterpolator{},
+	}.Parse()
+	assert.EqualError(t, err, `unsupported syntax in "echo {{ name }}"`)
+}
+
+func TestPipelineParserEvalEnvArithmetic(t *testing.T) {
+	t.Parallel()
+
+	pipeline := []byte(`env:
+  TIMEOUT: "${BASE_TIMEOUT} * 2"
+  RETRIES: "10 - 2 * 3 + -1"
+  PARALLELISM: "42"
+  NAME: "1 * llama"
+steps:
+  - command: "sleep $TIMEOUT"
+    timeout_in_minutes: "$RETRIES"
+`)
+	environ := env.FromSlice([]string{"BASE_TIMEOUT=15"})
+
+	result, err := PipelineParser{Pipeline: pipeline, Env: environ, EvalEnvArithmetic: true}.Parse()
+	assert.NoError(t, err)
+	j, err := json.Marshal(result)
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"env":{"TIMEOUT":"30","RETRIES":"3","PARALLELISM":"42","NAME":"1 * llama"},"steps":[{"command":"sleep 30","timeout_in_minutes":"3"}]}`, string(j))
+
+	result, err = PipelineParser{Pipeline: pipeline, Env: environ}.Parse()
+	assert.NoError(t, err)
+	j, err = json.Marshal(result)
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"env":{"TIMEOUT":"15 * 2","RETRIES":"10 - 2 * 3 + -1","PARALLELISM":"42","NAME":"1 * llama"},"steps":[{"command":"sleep 15 * 2","timeout_in_minutes":"10 - 2 * 3 + -1"}]}`, string(j))
+
+	_, err = PipelineParser{
+		Pipeline:          []byte("env:\n  TIMEOUT: \"10 / 0\"\n"),
+		Env:               environ,
+		EvalEnvArithmetic: true,
+	}.Parse()
+	assert.EqualError(t, err, `Failed to parse pipeline: Failed to evaluate env.TIMEOUT: division by zero in "10 / 0"`)
+}
+
+func TestPipelineParserExpandsSequences(t *testing.T) {
+	t.Parallel()
+
+	result, err := PipelineParser{
+		Pipeline: []byte(`steps:
+  - command: make
+    plugins: ${PLUGIN_*}
+    env:
+      FIRST: ${PLUGIN_0}
+      NONE: ${NOPE_*}
+`),
+		Env: env.FromSlice([]string{
+			`PLUGIN_10=ten`,
+			`PLUGIN_0=zero`,
+			`PLUGIN_2=two`,
+			`PLUGIN_01=padded`,
+			`PLUGIN_X=nope`,
+		}),
+	}.Parse()
+	assert.NoError(t, err)
+
+	j, err := json.Marshal(result)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"steps":[{"command":"make","env":{"FIRST":"zero","NONE":[]},"plugins":["zero","two","ten"]}]}`, string(j))
+
+	// With StrictInterpolation, an empty or malformed sequence is an error
+	for _, tc := range []struct {
+		environ []string
+		err     string
+	}{
+		{
+			environ: []string{`PLUGIN_X=nope`},
+			err:     "${PLUGIN_*}: no PLUGIN_0, PLUGIN_1, ... env vars are set",
+		},
+		{
+			environ: []string{`PLUGIN_0=zero`, `PLUGIN_01=padded`},
+			err:     "${PLUGIN_*}: PLUGIN_01 isn't a valid index for the sequence",
+		},
+	} {
+		_, err = PipelineParser{
+			Pipeline:            []byte("steps:\n  - command: make\n    plugins: ${PLUGIN_*}\n"),
+			Env:                 env.FromSlice(tc.environ),
+			StrictInterpolation: true,
+		}.Parse()
+		assert.EqualError(t, err, tc.err)
+	}
+}
+
+func TestPipelineParserSyntaxOnlyMode(t *testing.T) {
+	t.Parallel()
+
+	result, err := PipelineParser{
+		Pipeline: []byte(`env:
+  IMAGE: $REGISTRY/app
+steps:
+  - command: deploy ${TARGET:-staging} $IMAGE ${BRANCH#refs/heads/} $${RUNTIME}
+    plugins: ${PLUGIN_*}
+    env:
+      TOKEN: ${SECRET{token}}
+      REQUIRED: ${REQUIRED?}
+`),
+		Env:                 env.FromSlice([]string{`TARGET=production`, `PLUGIN_0=docker`}),
+		SyntaxOnlyMode:      true,
+		StrictInterpolation: true,
+	}.Parse()
+	assert.NoError(t, err)
+
+	j, err := json.Marshal(result)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"env":{"IMAGE":"__REGISTRY__/app"},"steps":[{"command":"deploy __TARGET__ __IMAGE__ __BRANCH__ ${RUNTIME}","env":{"REQUIRED":"__REQUIRED__","TOKEN":"__token__"},"plugins":[]}]}`, string(j))
+}
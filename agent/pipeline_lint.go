@@ -0,0 +1,429 @@
+package agent
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/buildkite/agent/env"
+	"github.com/buildkite/interpolate"
+
+	// This is a fork of gopkg.in/yaml.v2 that fixes anchors with MapSlice
+	yaml "github.com/buildkite/yaml"
+)
+
+// The severities of a LintIssue
+const (
+	LintSeverityWarning = "warning"
+	LintSeverityError   = "error"
+)
+
+// LintIssue is a problem found in a pipeline by LintEnvBlock
+type LintIssue struct {
+	// Either LintSeverityWarning or LintSeverityError
+	Severity string
+
+	// The env var the issue is with, if there is one
+	Key string
+
+	Message string
+}
+
+// LintEnvBlock checks the top-level env block of a pipeline for mistakes. It
+// returns errors for variables with circular references, and warnings for
+// variables that shadow Buildkite's own `BUILDKITE_*` variables or that
+// aren't referenced anywhere else in the pipeline. The pipeline isn't
+// interpolated, so references escaped with `$$` count as being used.
+func LintEnvBlock(pipeline []byte) []LintIssue {
+	var parsed yaml.MapSlice
+	if err := unmarshalYAML(pipeline, &parsed); err != nil {
+		// Pipelines that are just a list of steps don't have an env block
+		var steps []interface{}
+		if unmarshalYAML(pipeline, &steps) == nil {
+			return []LintIssue{}
+		}
+		return []LintIssue{{
+			Severity: LintSeverityError,
+			Message:  fmt.Sprintf("Failed to parse pipeline: %v", parseYAMLError(err)),
+		}}
+	}
+
+	item, ok := mapSliceItem("env", parsed)
+	if !ok {
+		return []LintIssue{}
+	}
+
+	envMap, ok := item.Value.(yaml.MapSlice)
+	if !ok {
+		return []LintIssue{{
+			Severity: LintSeverityError,
+			Message:  fmt.Sprintf("Expected pipeline top-level env block to be a map, got %T", item.Value),
+		}}
+	}
+
+	for _, envItem := range envMap {
+		if _, ok := envItem.Key.(string); !ok {
+			return []LintIssue{{
+				Severity: LintSeverityError,
+				Message:  fmt.Sprintf("Unexpected type of %T for env block key %v", envItem.Key, envItem.Key),
+			}}
+		}
+	}
+
+	circular := map[string]string{}
+	if _, err := sortEnvBlock(envMap); err != nil {
+		if cycleErr, ok := err.(circularEnvReferenceError); ok {
+			for _, key := range cycleErr.Keys {
+				circular[key] = cycleErr.Error()
+			}
+		}
+	}
+
+	// Find everything referenced outside of the env block, and by other
+	// variables within it
+	used := map[string]bool{}
+	markUsed := func(s string) {
+		s = strings.NewReplacer(`$$`, `$`, `\$`, `$`).Replace(s)
+		for _, ref := range referencedVariables(s) {
+			used[ref] = true
+		}
+	}
+	for _, pipelineItem := range parsed {
+		if k, ok := pipelineItem.Key.(string); ok && k == "env" {
+			continue
+		}
+		walkYAMLStrings(pipelineItem, markUsed)
+	}
+	for _, envItem := range envMap {
+		if s, ok := envItem.Value.(string); ok {
+			for _, ref := range referencedVariables(s) {
+				if ref != envItem.Key.(string) {
+					used[ref] = true
+				}
+			}
+		}
+	}
+
+	issues := []LintIssue{}
+
+	for _, envItem := range envMap {
+		key := envItem.Key.(string)
+
+		if msg, ok := circular[key]; ok {
+			issues = append(issues, LintIssue{Severity: LintSeverityError, Key: key, Message: msg})
+		}
+
+		// The agent itself reads BUILDKITE_* variables, so they're never
+		// reported as unused
+		if strings.HasPrefix(key, "BUILDKITE_") {
+			issues = append(issues, LintIssue{
+				Severity: LintSeverityWarning,
+				Key:      key,
+				Message:  fmt.Sprintf("%s shadows a variable set by Buildkite", key),
+			})
+		} else if !used[key] {
+			issues = append(issues, LintIssue{
+				Severity: LintSeverityWarning,
+				Key:      key,
+				Message:  fmt.Sprintf("%s isn't referenced anywhere in the pipeline", key),
+			})
+		}
+	}
+
+	return issues
+}
+
+// walkYAMLStrings calls fn for every string in an unmarshalled YAML value or
+// a parsed pipeline, including map keys
+func walkYAMLStrings(v interface{}, fn func(string)) {
+	switch t := v.(type) {
+	case string:
+		fn(t)
+	case yaml.MapSlice:
+		for _, item := range t {
+			walkYAMLStrings(item, fn)
+		}
+	case yaml.MapItem:
+		walkYAMLStrings(t.Key, fn)
+		walkYAMLStrings(t.Value, fn)
+	case []interface{}:
+		for _, item := range t {
+			walkYAMLStrings(item, fn)
+		}
+	case map[interface{}]interface{}:
+		for key, value := range t {
+			walkYAMLStrings(key, fn)
+			walkYAMLStrings(value, fn)
+		}
+	case map[string]interface{}:
+		for key, value := range t {
+			walkYAMLStrings(key, fn)
+			walkYAMLStrings(value, fn)
+		}
+	}
+}
+
+// EnvUsageReport is how the variables in a pipeline's env block are used, as
+// returned by AnalyzeEnvUsage. All of the lists are sorted.
+type EnvUsageReport struct {
+	// The variables in the env block
+	Defined []string
+
+	// The variables in the env block that are referenced elsewhere
+	Used []string
+
+	// The variables in the env block that aren't referenced anywhere
+	Unused []string
+
+	// The variables that are referenced but aren't in the env block
+	Referenced []string
+}
+
+// AnalyzeEnvUsage reports which of the variables in a parsed pipeline's env
+// block are referenced in the rest of the pipeline, and which referenced
+// variables aren't in it. The pipeline should be parsed with NoInterpolation,
+// otherwise the references will have already been replaced. References
+// escaped with `$$` count, as they're still expanded when the step runs.
+func AnalyzeEnvUsage(parsed interface{}) (*EnvUsageReport, error) {
+	report := &EnvUsageReport{
+		Defined:    []string{},
+		Used:       []string{},
+		Unused:     []string{},
+		Referenced: []string{},
+	}
+
+	pipeline, _ := parsed.(map[string]interface{})
+
+	var envMap map[string]interface{}
+	if envBlock, ok := pipeline["env"]; ok && envBlock != nil {
+		if envMap, ok = envBlock.(map[string]interface{}); !ok {
+			return nil, fmt.Errorf("Expected pipeline top-level env block to be a map, got %T", envBlock)
+		}
+	}
+
+	unescape := strings.NewReplacer(`$$`, `$`, `\$`, `$`).Replace
+
+	referenced := map[string]bool{}
+	markReferenced := func(s string) {
+		for _, ref := range referencedVariables(unescape(s)) {
+			referenced[ref] = true
+		}
+	}
+
+	if pipeline == nil {
+		walkYAMLStrings(parsed, markReferenced)
+	}
+	for key, value := range pipeline {
+		if key == "env" {
+			continue
+		}
+		walkYAMLStrings(value, markReferenced)
+	}
+
+	// Variables in the env block can be used by each other
+	for key, value := range envMap {
+		report.Defined = append(report.Defined, key)
+		walkYAMLStrings(value, func(s string) {
+			for _, ref := range referencedVariables(unescape(s)) {
+				if ref != key {
+					referenced[ref] = true
+				}
+			}
+		})
+	}
+	sort.Strings(report.Defined)
+
+	for _, key := range report.Defined {
+		if referenced[key] {
+			report.Used = append(report.Used, key)
+		} else {
+			report.Unused = append(report.Unused, key)
+		}
+	}
+
+	for ref := range referenced {
+		if _, ok := envMap[ref]; !ok {
+			report.Referenced = append(report.Referenced, ref)
+		}
+	}
+	sort.Strings(report.Referenced)
+
+	return report, nil
+}
+
+// EnvType is the type of value an env var is expected to have by
+// TypeCheckEnv
+type EnvType string
+
+const (
+	TypeInt    EnvType = "int"
+	TypeBool   EnvType = "bool"
+	TypeString EnvType = "string"
+)
+
+// TypeError is an env var that doesn't have the type TypeCheckEnv expected
+type TypeError struct {
+	Name     string
+	Expected EnvType
+	Value    string
+}
+
+func (e TypeError) Error() string {
+	return fmt.Sprintf("$%s should be of type %s, got %q", e.Name, e.Expected, e.Value)
+}
+
+// TypeCheckEnv checks that the env vars in types have values of the right
+// type, so that a pipeline with something like `parallelism: ${COUNT}` can
+// be rejected before it's parsed and uploaded. The values come from the
+// parsed pipeline's env block, which should be parsed with NoInterpolation,
+// or otherwise from the current process's environment. Variables that
+// aren't set aren't checked. Ints must be whole numbers, and bools either
+// `true` or `false`. The errors are sorted by the variables' names.
+func TypeCheckEnv(parsed interface{}, types map[string]EnvType) []TypeError {
+	environ := env.FromSlice(os.Environ())
+
+	pipeline, _ := parsed.(map[string]interface{})
+	envMap, _ := pipeline["env"].(map[string]interface{})
+
+	names := make([]string, 0, len(types))
+	for name := range types {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	errs := []TypeError{}
+	for _, name := range names {
+		var value string
+
+		if blockValue, ok := envMap[name]; ok && blockValue != nil {
+			value = fmt.Sprintf("%v", blockValue)
+			// Values in the env block can refer to the environment
+			if interpolated, err := interpolate.Interpolate(environ, value); err == nil {
+				value = interpolated
+			}
+		} else if envValue, ok := environ.Get(name); ok {
+			value = envValue
+		} else {
+			continue
+		}
+
+		if !envValueHasType(value, types[name]) {
+			errs = append(errs, TypeError{Name: name, Expected: types[name], Value: value})
+		}
+	}
+
+	return errs
+}
+
+func envValueHasType(value string, envType EnvType) bool {
+	switch envType {
+	case TypeInt:
+		_, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+		return err == nil
+	case TypeBool:
+		return value == "true" || value == "false"
+	}
+	return true
+}
+
+// DeprecationRule is a part of the step syntax that's been replaced, which
+// LintPipeline warns about
+type DeprecationRule struct {
+	DeprecatedField  string
+	ReplacementField string
+
+	// If it's set, the rule only applies when the deprecated field has this
+	// value, such as for `type: script`
+	DeprecatedValue string
+
+	Message string
+
+	// Either LintSeverityWarning or LintSeverityError
+	Severity string
+}
+
+// DeprecationRules are the rules that LintPipeline checks steps against
+var DeprecationRules = []DeprecationRule{
+	{
+		DeprecatedField:  "type",
+		DeprecatedValue:  "script",
+		ReplacementField: "command",
+		Message:          "`type: script` steps are now just command steps",
+		Severity:         LintSeverityWarning,
+	},
+	{
+		DeprecatedField:  "type",
+		DeprecatedValue:  "waiter",
+		ReplacementField: "wait",
+		Message:          "`type: waiter` steps are now wait steps",
+		Severity:         LintSeverityWarning,
+	},
+	{
+		DeprecatedField:  "type",
+		DeprecatedValue:  "manual",
+		ReplacementField: "block",
+		Message:          "`type: manual` steps are now block steps",
+		Severity:         LintSeverityWarning,
+	},
+	{
+		DeprecatedField:  "agent_query_rules",
+		ReplacementField: "agents",
+		Message:          "`agent_query_rules` has been replaced by `agents`",
+		Severity:         LintSeverityWarning,
+	},
+	{
+		DeprecatedField:  "branches",
+		ReplacementField: "if",
+		Message:          "`branches` has been replaced by `if` conditions, such as `build.branch == \"main\"`",
+		Severity:         LintSeverityWarning,
+	},
+	{
+		DeprecatedField:  "name",
+		ReplacementField: "label",
+		Message:          "`name` has been replaced by `label`",
+		Severity:         LintSeverityWarning,
+	},
+}
+
+// LintWarning is a step that uses deprecated syntax, as found by LintPipeline
+type LintWarning struct {
+	// The path of the deprecated field, like `steps[0].branches`
+	Path       string
+	Rule       DeprecationRule
+	Suggestion string
+}
+
+// LintPipeline checks the steps of a parsed pipeline, including those in
+// groups, against DeprecationRules and returns a warning for each use of
+// deprecated syntax, in the order the steps are in. The pipeline isn't
+// changed.
+func LintPipeline(parsed interface{}) []LintWarning {
+	warnings := []LintWarning{}
+
+	walkSteps(pipelineSteps(parsed), "steps", func(path string, step map[string]interface{}) {
+		for _, rule := range DeprecationRules {
+			value, ok := step[rule.DeprecatedField]
+			if !ok {
+				continue
+			}
+
+			suggestion := fmt.Sprintf("Use `%s` instead of `%s`", rule.ReplacementField, rule.DeprecatedField)
+			if rule.DeprecatedValue != "" {
+				if s, _ := value.(string); s != rule.DeprecatedValue {
+					continue
+				}
+				suggestion = fmt.Sprintf("Use a `%s` step instead of `%s: %s`", rule.ReplacementField, rule.DeprecatedField, rule.DeprecatedValue)
+			}
+
+			warnings = append(warnings, LintWarning{
+				Path:       joinPath(path, rule.DeprecatedField),
+				Rule:       rule,
+				Suggestion: suggestion,
+			})
+		}
+	})
+
+	return warnings
+}
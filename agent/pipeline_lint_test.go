@@ -0,0 +1,158 @@
+package agent
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLintEnvBlock(t *testing.T) {
+	t.Parallel()
+
+	issues := LintEnvBlock([]byte(`env:
+  IMAGE: node:8
+  TAG: "$IMAGE-$$BUILDKITE_COMMIT"
+  FIRST: $SECOND
+  SECOND: $FIRST
+  PATH: "$PATH:/opt/bin"
+  BUILDKITE_REPO: git@example.com:org/repo.git
+  TARGET: production
+steps:
+  - command: docker build -t $TAG .
+  - command: make deploy TARGET=$$TARGET
+  - command: echo $FIRST
+`))
+
+	assert.Equal(t, []LintIssue{
+		{Severity: LintSeverityError, Key: "FIRST", Message: "Circular reference in env block between FIRST, SECOND"},
+		{Severity: LintSeverityError, Key: "SECOND", Message: "Circular reference in env block between FIRST, SECOND"},
+		{Severity: LintSeverityWarning, Key: "PATH", Message: "PATH isn't referenced anywhere in the pipeline"},
+		{Severity: LintSeverityWarning, Key: "BUILDKITE_REPO", Message: "BUILDKITE_REPO shadows a variable set by Buildkite"},
+	}, issues)
+}
+
+func TestLintEnvBlockWithoutEnv(t *testing.T) {
+	t.Parallel()
+
+	assert.Equal(t, []LintIssue{}, LintEnvBlock([]byte("steps:\n  - command: make\n")))
+	assert.Equal(t, []LintIssue{}, LintEnvBlock([]byte("- command: make\n")))
+	assert.Equal(t, []LintIssue{
+		{Severity: LintSeverityError, Message: "Expected pipeline top-level env block to be a map, got string"},
+	}, LintEnvBlock([]byte("env: nope\n")))
+}
+
+func TestAnalyzeEnvUsage(t *testing.T) {
+	t.Parallel()
+
+	parsed, err := PipelineParser{Pipeline: []byte(`env:
+  IMAGE: node:8
+  TAG: "$IMAGE-$$BUILDKITE_COMMIT"
+  STALE: old
+  TARGET: production
+steps:
+  - command: docker build -t $TAG .
+  - command: make deploy TARGET=$$TARGET REGION=${REGION:-us}
+    agents:
+      queue: $QUEUE
+`), NoInterpolation: true}.Parse()
+	assert.NoError(t, err)
+
+	report, err := AnalyzeEnvUsage(parsed)
+	assert.NoError(t, err)
+	assert.Equal(t, &EnvUsageReport{
+		Defined:    []string{"IMAGE", "STALE", "TAG", "TARGET"},
+		Used:       []string{"IMAGE", "TAG", "TARGET"},
+		Unused:     []string{"STALE"},
+		Referenced: []string{"BUILDKITE_COMMIT", "QUEUE", "REGION"},
+	}, report)
+}
+
+func TestAnalyzeEnvUsageWithoutEnv(t *testing.T) {
+	t.Parallel()
+
+	report, err := AnalyzeEnvUsage([]interface{}{map[string]interface{}{"command": "echo $FOO"}})
+	assert.NoError(t, err)
+	assert.Equal(t, &EnvUsageReport{Defined: []string{}, Used: []string{}, Unused: []string{}, Referenced: []string{"FOO"}}, report)
+
+	_, err = AnalyzeEnvUsage(map[string]interface{}{"env": "nope"})
+	assert.EqualError(t, err, "Expected pipeline top-level env block to be a map, got string")
+}
+
+func TestTypeCheckEnv(t *testing.T) {
+	t.Parallel()
+
+	parsed, err := PipelineParser{Pipeline: []byte(`env:
+  COUNT: hello
+  RETRIES: 3
+  DEBUG: "true"
+  VERBOSE: "yes please"
+  NAME: test
+steps:
+  - command: make test
+    parallelism: ${COUNT}
+`), NoInterpolation: true}.Parse()
+	assert.NoError(t, err)
+
+	errs := TypeCheckEnv(parsed, map[string]EnvType{
+		"COUNT":   TypeInt,
+		"RETRIES": TypeInt,
+		"DEBUG":   TypeBool,
+		"VERBOSE": TypeBool,
+		"NAME":    TypeString,
+		"PATH":    TypeInt,
+		"UNSET":   TypeInt,
+	})
+	assert.Equal(t, []TypeError{
+		{Name: "COUNT", Expected: TypeInt, Value: "hello"},
+		{Name: "PATH", Expected: TypeInt, Value: os.Getenv("PATH")},
+		{Name: "VERBOSE", Expected: TypeBool, Value: "yes please"},
+	}, errs)
+	assert.EqualError(t, errs[0], `$COUNT should be of type int, got "hello"`)
+}
+
+func TestLintPipeline(t *testing.T) {
+	t.Parallel()
+
+	parsed, err := PipelineParser{Pipeline: []byte(`steps:
+  - type: script
+    name: Test
+    command: make test
+    agent_query_rules: ["queue=test"]
+  - type: waiter
+  - label: Build
+    command: make build
+    agents: {queue: build}
+  - group: Deploy
+    steps:
+      - command: make deploy
+        branches: main
+`), NoInterpolation: true}.Parse()
+	assert.NoError(t, err)
+
+	warnings := LintPipeline(parsed)
+
+	var paths, suggestions []string
+	for _, warning := range warnings {
+		paths = append(paths, warning.Path)
+		suggestions = append(suggestions, warning.Suggestion)
+	}
+	assert.Equal(t, []string{
+		"steps[0].type",
+		"steps[0].agent_query_rules",
+		"steps[0].name",
+		"steps[1].type",
+		"steps[3].steps[0].branches",
+	}, paths)
+	assert.Equal(t, []string{
+		"Use a `command` step instead of `type: script`",
+		"Use `agents` instead of `agent_query_rules`",
+		"Use `label` instead of `name`",
+		"Use a `wait` step instead of `type: waiter`",
+		"Use `if` instead of `branches`",
+	}, suggestions)
+	assert.Equal(t, "branches", warnings[4].Rule.DeprecatedField)
+	assert.Equal(t, LintSeverityWarning, warnings[4].Rule.Severity)
+
+	assert.Equal(t, []LintWarning{}, LintPipeline([]interface{}{"wait", map[string]interface{}{"command": "make"}}))
+}
@@ -0,0 +1,226 @@
+package agent
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// matrixTemplateRegex matches `{{matrix}}` and `{{matrix.name}}` in the
+// strings of a matrix step
+var matrixTemplateRegex = regexp.MustCompile(`\{\{\s*matrix(?:\.([a-zA-Z0-9_-]+))?\s*\}\}`)
+
+// matrixDimension is one of the dimensions of a step's matrix, where name is
+// empty if the matrix is just a list of values
+type matrixDimension struct {
+	name   string
+	values []interface{}
+}
+
+// expandMatrix replaces each step with a `matrix`, including those in groups,
+// with a step for every combination of the matrix's values
+func expandMatrix(pipeline interface{}) (interface{}, error) {
+	steps, err := rewriteSteps(pipelineSteps(pipeline), expandMatrixSteps)
+	if err != nil {
+		return nil, err
+	}
+
+	switch p := pipeline.(type) {
+	case []interface{}:
+		return steps, nil
+	case map[string]interface{}:
+		if _, ok := p["steps"].([]interface{}); ok {
+			p["steps"] = steps
+		}
+	}
+	return pipeline, nil
+}
+
+// expandMatrixSteps expands the matrix steps in a list of steps, but not
+// those in its groups
+func expandMatrixSteps(path string, steps []interface{}) ([]interface{}, error) {
+	expanded := make([]interface{}, 0, len(steps))
+
+	for idx, step := range steps {
+		stepMap, ok := step.(map[string]interface{})
+		if !ok {
+			expanded = append(expanded, step)
+			continue
+		}
+		stepPath := fmt.Sprintf("%s[%d]", path, idx)
+
+		matrix, ok := stepMap["matrix"]
+		if !ok || matrix == nil {
+			expanded = append(expanded, stepMap)
+			continue
+		}
+
+		dimensions, err := matrixDimensions(matrix)
+		if err != nil {
+			return nil, fmt.Errorf("%s.matrix: %v", stepPath, err)
+		}
+
+		for _, combination := range matrixCombinations(dimensions) {
+			matrixStep, err := matrixStepFor(stepMap, combination)
+			if err != nil {
+				return nil, fmt.Errorf("%s.matrix: %v", stepPath, err)
+			}
+
+			// Keys have to be unique, so each step's key gets its values
+			// added unless the key uses them already
+			if key, ok := stepMap["key"].(string); ok && key != "" && matrixStep["key"] == key {
+				matrixStep["key"] = matrixKeyFor(key, dimensions, combination)
+			}
+
+			expanded = append(expanded, matrixStep)
+		}
+	}
+
+	return expanded, nil
+}
+
+// matrixDimensions returns the dimensions of a matrix, which is either a
+// list of values, or a map of dimension names to lists of values that can be
+// under a `setup` key. Named dimensions are sorted by name.
+func matrixDimensions(matrix interface{}) ([]matrixDimension, error) {
+	switch m := matrix.(type) {
+	case []interface{}:
+		if len(m) == 0 {
+			return nil, fmt.Errorf("expected at least one value")
+		}
+		return []matrixDimension{{values: m}}, nil
+
+	case map[string]interface{}:
+		if _, ok := m["adjustments"]; ok {
+			return nil, fmt.Errorf("adjustments aren't supported")
+		}
+		if setup, ok := m["setup"]; ok {
+			if len(m) > 1 {
+				return nil, fmt.Errorf("expected only `setup`")
+			}
+			return matrixDimensions(setup)
+		}
+		if len(m) == 0 {
+			return nil, fmt.Errorf("expected at least one dimension")
+		}
+
+		names := make([]string, 0, len(m))
+		for name := range m {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		dimensions := make([]matrixDimension, 0, len(names))
+		for _, name := range names {
+			values, ok := m[name].([]interface{})
+			if !ok || len(values) == 0 {
+				return nil, fmt.Errorf("expected %s to be a list of values", name)
+			}
+			dimensions = append(dimensions, matrixDimension{name: name, values: values})
+		}
+		return dimensions, nil
+	}
+
+	return nil, fmt.Errorf("expected a list or a map, got %T", matrix)
+}
+
+// matrixCombinations returns the Cartesian product of the dimensions' values,
+// as maps of dimension names to values
+func matrixCombinations(dimensions []matrixDimension) []map[string]interface{} {
+	combinations := []map[string]interface{}{{}}
+
+	for _, dimension := range dimensions {
+		next := make([]map[string]interface{}, 0, len(combinations)*len(dimension.values))
+		for _, combination := range combinations {
+			for _, value := range dimension.values {
+				c := make(map[string]interface{}, len(combination)+1)
+				for k, v := range combination {
+					c[k] = v
+				}
+				c[dimension.name] = value
+				next = append(next, c)
+			}
+		}
+		combinations = next
+	}
+
+	return combinations
+}
+
+// matrixStepFor returns a copy of a matrix step for one combination of its
+// values. The values are added to its env block, as MATRIX for a list of
+// values or MATRIX_<NAME> for a named dimension, and `{{matrix}}` or
+// `{{matrix.name}}` in any of its strings is replaced with them.
+func matrixStepFor(step map[string]interface{}, combination map[string]interface{}) (map[string]interface{}, error) {
+	var err error
+
+	replaceTemplates := func(s string) string {
+		return matrixTemplateRegex.ReplaceAllStringFunc(s, func(match string) string {
+			name := matrixTemplateRegex.FindStringSubmatch(match)[1]
+			value, ok := combination[name]
+			if !ok && err == nil {
+				err = fmt.Errorf("unknown dimension in %s", match)
+			}
+			return fmt.Sprintf("%v", value)
+		})
+	}
+
+	copied := replaceMatrixTemplates(ClonePipeline(step), replaceTemplates).(map[string]interface{})
+	if err != nil {
+		return nil, err
+	}
+	delete(copied, "matrix")
+
+	envMap, ok := copied["env"].(map[string]interface{})
+	if !ok {
+		if existing, exists := copied["env"]; exists && existing != nil {
+			return nil, fmt.Errorf("expected the step's env to be a map, got %T", existing)
+		}
+		envMap = map[string]interface{}{}
+	}
+	for name, value := range combination {
+		key := "MATRIX"
+		if name != "" {
+			key += "_" + strings.ToUpper(strings.Replace(name, "-", "_", -1))
+		}
+		envMap[key] = fmt.Sprintf("%v", value)
+	}
+	copied["env"] = envMap
+
+	return copied, nil
+}
+
+// matrixKeyFor returns the key of a matrix step for one combination of its
+// values, like `test-linux-amd64`, with anything other than letters, numbers,
+// `_` and `-` in the values replaced with `-`
+func matrixKeyFor(key string, dimensions []matrixDimension, combination map[string]interface{}) string {
+	parts := []string{key}
+	for _, dimension := range dimensions {
+		value := fmt.Sprintf("%v", combination[dimension.name])
+		parts = append(parts, matrixKeyUnsafeRegex.ReplaceAllString(value, "-"))
+	}
+	return strings.Join(parts, "-")
+}
+
+var matrixKeyUnsafeRegex = regexp.MustCompile(`[^a-zA-Z0-9_-]+`)
+
+// replaceMatrixTemplates calls fn with each string in a step, other than the
+// ones in its matrix, replacing the string with the result
+func replaceMatrixTemplates(v interface{}, fn func(string) string) interface{} {
+	switch t := v.(type) {
+	case string:
+		return fn(t)
+	case map[string]interface{}:
+		for key, value := range t {
+			if key != "matrix" {
+				t[key] = replaceMatrixTemplates(value, fn)
+			}
+		}
+	case []interface{}:
+		for idx, value := range t {
+			t[idx] = replaceMatrixTemplates(value, fn)
+		}
+	}
+	return v
+}
@@ -0,0 +1,63 @@
+package agent
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/buildkite/agent/env"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPipelineParserExpandMatrix(t *testing.T) {
+	t.Parallel()
+
+	pipeline := []byte(`steps:
+  - label: "Test {{matrix.os}}/{{ matrix.arch }}"
+    key: test
+    command: make test
+    env:
+      CI: "true"
+    matrix:
+      setup:
+        os: [linux, darwin]
+        arch: [amd64, arm64]
+  - wait
+  - group: Node
+    steps:
+      - command: "nvm use {{matrix}}"
+        key: "node-{{matrix}}"
+        matrix: [8, 10]
+`)
+
+	result, err := PipelineParser{Pipeline: pipeline, Env: env.New(), ExpandMatrix: true}.Parse()
+	assert.NoError(t, err)
+
+	j, err := json.Marshal(result)
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"steps":[
+		{"label":"Test linux/amd64","key":"test-amd64-linux","command":"make test","env":{"CI":"true","MATRIX_ARCH":"amd64","MATRIX_OS":"linux"}},
+		{"label":"Test darwin/amd64","key":"test-amd64-darwin","command":"make test","env":{"CI":"true","MATRIX_ARCH":"amd64","MATRIX_OS":"darwin"}},
+		{"label":"Test linux/arm64","key":"test-arm64-linux","command":"make test","env":{"CI":"true","MATRIX_ARCH":"arm64","MATRIX_OS":"linux"}},
+		{"label":"Test darwin/arm64","key":"test-arm64-darwin","command":"make test","env":{"CI":"true","MATRIX_ARCH":"arm64","MATRIX_OS":"darwin"}},
+		"wait",
+		{"group":"Node","steps":[
+			{"command":"nvm use 8","key":"node-8","env":{"MATRIX":"8"}},
+			{"command":"nvm use 10","key":"node-10","env":{"MATRIX":"10"}}
+		]}
+	]}`, string(j))
+
+	// Without ExpandMatrix the matrix is left alone
+	result, err = PipelineParser{Pipeline: pipeline, Env: env.New()}.Parse()
+	assert.NoError(t, err)
+	assert.Len(t, pipelineSteps(result), 3)
+
+	for source, expected := range map[string]string{
+		"- command: make\n  matrix: []\n":                                      "steps[0].matrix: expected at least one value",
+		"- command: make\n  matrix: {os: linux}\n":                             "steps[0].matrix: expected os to be a list of values",
+		"- command: make\n  matrix: {setup: {os: [linux]}, adjustments: []}\n": "steps[0].matrix: adjustments aren't supported",
+		"- command: \"make {{matrix.arch}}\"\n  matrix: {os: [linux]}\n":       "steps[0].matrix: unknown dimension in {{matrix.arch}}",
+	} {
+		_, err := PipelineParser{Pipeline: []byte(source), Env: env.New(), ExpandMatrix: true}.Parse()
+		assert.EqualError(t, err, expected, source)
+	}
+}
@@ -0,0 +1,112 @@
+package agent
+
+import (
+	"fmt"
+)
+
+// MergePipelines merges an overlay pipeline into a base pipeline, both as
+// returned from PipelineParser.Parse. The overlay's steps are appended to the
+// base's steps, the `env` blocks are deep merged (with the overlay winning on
+// conflicts) and `notify` blocks are concatenated. Any other top-level keys
+// are taken from the overlay if present. Neither input is modified.
+func MergePipelines(base, overlay interface{}) (interface{}, error) {
+	baseMap, err := pipelineAsMap(base)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to merge base pipeline: %v", err)
+	}
+
+	overlayMap, err := pipelineAsMap(overlay)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to merge overlay pipeline: %v", err)
+	}
+
+	// Merging two bare lists of steps gives a bare list of steps
+	_, baseIsSlice := base.([]interface{})
+	_, overlayIsSlice := overlay.([]interface{})
+	if baseIsSlice && overlayIsSlice {
+		return appendSlices(baseMap["steps"], overlayMap["steps"]), nil
+	}
+
+	result := map[string]interface{}{}
+	for k, v := range baseMap {
+		result[k] = v
+	}
+
+	for k, v := range overlayMap {
+		existing, exists := result[k]
+		if !exists {
+			result[k] = v
+			continue
+		}
+
+		switch k {
+		case "steps", "notify":
+			if _, ok := existing.([]interface{}); !ok {
+				return nil, fmt.Errorf("Expected base %s to be a list, got %T", k, existing)
+			}
+			if _, ok := v.([]interface{}); !ok {
+				return nil, fmt.Errorf("Expected overlay %s to be a list, got %T", k, v)
+			}
+			result[k] = appendSlices(existing, v)
+		case "env":
+			existingEnv, ok := existing.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("Expected base env to be a map, got %T", existing)
+			}
+			env, ok := v.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("Expected overlay env to be a map, got %T", v)
+			}
+			result[k] = deepMergeMaps(existingEnv, env)
+		default:
+			result[k] = v
+		}
+	}
+
+	return result, nil
+}
+
+// pipelineAsMap returns a parsed pipeline as a map, wrapping bare lists of
+// steps in a map with a `steps` key
+func pipelineAsMap(pipeline interface{}) (map[string]interface{}, error) {
+	switch p := pipeline.(type) {
+	case []interface{}:
+		return map[string]interface{}{"steps": p}, nil
+	case map[string]interface{}:
+		return p, nil
+	case nil:
+		return map[string]interface{}{}, nil
+	default:
+		return nil, fmt.Errorf("Unexpected type of %T for pipeline", pipeline)
+	}
+}
+
+func appendSlices(a, b interface{}) []interface{} {
+	as, _ := a.([]interface{})
+	bs, _ := b.([]interface{})
+
+	result := make([]interface{}, 0, len(as)+len(bs))
+	result = append(result, as...)
+	return append(result, bs...)
+}
+
+// deepMergeMaps returns a new map with the values of b merged into a,
+// recursing into any maps that exist in both
+func deepMergeMaps(a, b map[string]interface{}) map[string]interface{} {
+	result := make(map[string]interface{}, len(a)+len(b))
+	for k, v := range a {
+		result[k] = v
+	}
+
+	for k, v := range b {
+		existing, ok := result[k].(map[string]interface{})
+		incoming, ok2 := v.(map[string]interface{})
+		if ok && ok2 {
+			result[k] = deepMergeMaps(existing, incoming)
+		} else {
+			result[k] = v
+		}
+	}
+
+	return result
+}
@@ -0,0 +1,79 @@
+package agent
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMergePipelines(t *testing.T) {
+	t.Parallel()
+
+	base, err := PipelineParser{Pipeline: []byte(`
+env:
+  FOO: base
+  BAR: base
+notify:
+  - email: dev@example.com
+steps:
+  - command: one
+`)}.Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	overlay, err := PipelineParser{Pipeline: []byte(`
+env:
+  FOO: overlay
+  BAZ: overlay
+notify:
+  - slack: "#builds"
+steps:
+  - wait
+  - command: two
+`)}.Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	merged, err := MergePipelines(base, overlay)
+	assert.NoError(t, err)
+
+	j, err := json.Marshal(merged)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"env":{"BAR":"base","BAZ":"overlay","FOO":"overlay"},"notify":[{"email":"dev@example.com"},{"slack":"#builds"}],"steps":[{"command":"one"},"wait",{"command":"two"}]}`, string(j))
+
+	// The base pipeline is left untouched
+	j, err = json.Marshal(base)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"env":{"BAR":"base","FOO":"base"},"notify":[{"email":"dev@example.com"}],"steps":[{"command":"one"}]}`, string(j))
+}
+
+func TestMergePipelinesWithStepLists(t *testing.T) {
+	t.Parallel()
+
+	merged, err := MergePipelines([]interface{}{"wait"}, []interface{}{map[string]interface{}{"command": "two"}})
+	assert.NoError(t, err)
+	assert.Equal(t, []interface{}{"wait", map[string]interface{}{"command": "two"}}, merged)
+
+	merged, err = MergePipelines([]interface{}{"wait"}, map[string]interface{}{"env": map[string]interface{}{"FOO": "bar"}})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{
+		"env":   map[string]interface{}{"FOO": "bar"},
+		"steps": []interface{}{"wait"},
+	}, merged)
+}
+
+func TestMergePipelinesReturnsErrors(t *testing.T) {
+	t.Parallel()
+
+	_, err := MergePipelines("llamas", []interface{}{})
+	assert.EqualError(t, err, "Failed to merge base pipeline: Unexpected type of string for pipeline")
+
+	_, err = MergePipelines(
+		map[string]interface{}{"env": map[string]interface{}{}},
+		map[string]interface{}{"env": []interface{}{}},
+	)
+	assert.EqualError(t, err, "Expected overlay env to be a map, got []interface {}")
+}
@@ -0,0 +1,142 @@
+package agent
+
+import (
+	"time"
+
+	"github.com/buildkite/agent/env"
+	"github.com/buildkite/interpolate"
+)
+
+// ParseResult is a parsed pipeline, along with measurements of its parsing
+type ParseResult struct {
+	Pipeline interface{}
+
+	// How long parsing took altogether, and how much of that was
+	// interpolation
+	ParseDuration       time.Duration
+	InterpolateDuration time.Duration
+
+	// The number of steps, including those in groups
+	StepCount int
+
+	// The number of env var references that were set, and that weren't and
+	// didn't have a default. Each variable is only counted once for each
+	// string that it's in.
+	EnvRefsResolved int
+	EnvRefsMissing  int
+
+	// The number of variables in the top-level env block
+	EnvBlockVarCount int
+}
+
+// ParseWithMetadata is like Parse, but also returns how long parsing took and
+// some statistics about the pipeline and its interpolation
+func (p PipelineParser) ParseWithMetadata() (*ParseResult, error) {
+	return p.parseWithMetadata(true)
+}
+
+// parseWithMetadata does the parsing for Parse and ParseWithMetadata. The
+// statistics are only gathered with withStats set, as counting the env var
+// references in every string isn't free, so otherwise only the Pipeline of
+// the result is set.
+func (p PipelineParser) parseWithMetadata(withStats bool) (*ParseResult, error) {
+	start := time.Now()
+
+	p, err := p.loadPipeline()
+	if err != nil {
+		return nil, err
+	}
+
+	if p.Metrics != nil {
+		p.interpolations = new(int)
+		defer func() {
+			p.Metrics.ObserveParseDuration(time.Since(start))
+			p.Metrics.ObserveInterpolationCount(*p.interpolations)
+		}()
+	}
+
+	if withStats {
+		p.stats = &parseStats{refs: map[string]bool{}}
+	}
+
+	result, err := p.parse()
+	if err != nil {
+		return nil, err
+	}
+
+	result, err = p.finalize(result)
+	if err != nil {
+		return nil, err
+	}
+
+	if !withStats {
+		return &ParseResult{Pipeline: result}, nil
+	}
+
+	parsed := &ParseResult{
+		Pipeline:            result,
+		ParseDuration:       time.Since(start),
+		InterpolateDuration: p.stats.interpolateDuration,
+		StepCount:           countSteps(pipelineSteps(result)),
+	}
+
+	for _, resolved := range p.stats.refs {
+		if resolved {
+			parsed.EnvRefsResolved++
+		} else {
+			parsed.EnvRefsMissing++
+		}
+	}
+
+	if pipeline, ok := result.(map[string]interface{}); ok {
+		if envMap, ok := pipeline["env"].(map[string]interface{}); ok {
+			parsed.EnvBlockVarCount = len(envMap)
+		}
+	}
+
+	return parsed, nil
+}
+
+// parseStats is what's measured while parsing for ParseWithMetadata
+type parseStats struct {
+	interpolateDuration time.Duration
+
+	// Whether each variable in each path was set. The env block is
+	// interpolated twice, so they're only counted the first time.
+	refs map[string]bool
+}
+
+// countRefs records whether each variable referenced in a string is set.
+// Strings that can't be parsed are left for the interpolator to return an
+// error for.
+func (s *parseStats) countRefs(environ *env.Environment, path, str string) {
+	expr, err := interpolate.NewParser(str).Parse()
+	if err != nil {
+		return
+	}
+
+	missing := map[string]bool{}
+	for _, name := range missingVariables(environ, expr) {
+		missing[name] = true
+	}
+
+	for _, name := range referencedVariables(str) {
+		key := path + "\x00" + name
+		if _, ok := s.refs[key]; !ok {
+			s.refs[key] = !missing[name]
+		}
+	}
+}
+
+// countSteps returns the number of steps, including those in groups
+func countSteps(steps []interface{}) int {
+	count := len(steps)
+	for _, step := range steps {
+		if stepMap, ok := step.(map[string]interface{}); ok {
+			if children, ok := stepMap["steps"].([]interface{}); ok {
+				count += countSteps(children)
+			}
+		}
+	}
+	return count
+}
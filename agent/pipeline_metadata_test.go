@@ -0,0 +1,44 @@
+package agent
+
+import (
+	"testing"
+
+	"github.com/buildkite/agent/env"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPipelineParserParseWithMetadata(t *testing.T) {
+	t.Parallel()
+
+	result, err := PipelineParser{
+		Pipeline: []byte(`env:
+  IMAGE: node:$NODE_VERSION
+  TAG: $$BUILDKITE_COMMIT
+steps:
+  - command: docker run $IMAGE make test $MISSING
+  - wait
+  - group: Deploy
+    steps:
+      - command: deploy ${TARGET:-staging} $NODE_VERSION
+      - block: Release
+`),
+		Env: env.FromSlice([]string{"NODE_VERSION=8"}),
+	}.ParseWithMetadata()
+	assert.NoError(t, err)
+
+	assert.Equal(t, map[string]interface{}{"IMAGE": "node:8", "TAG": "$BUILDKITE_COMMIT"}, result.Pipeline.(map[string]interface{})["env"])
+	assert.Equal(t, 5, result.StepCount)
+	assert.Equal(t, 2, result.EnvBlockVarCount)
+
+	// NODE_VERSION twice, IMAGE and TARGET (which has a default) are
+	// resolved, and MISSING isn't
+	assert.Equal(t, 4, result.EnvRefsResolved)
+	assert.Equal(t, 1, result.EnvRefsMissing)
+
+	assert.True(t, result.ParseDuration > 0)
+	assert.True(t, result.InterpolateDuration > 0)
+	assert.True(t, result.InterpolateDuration <= result.ParseDuration)
+
+	_, err = PipelineParser{Pipeline: []byte("steps: [\n"), Env: env.New()}.ParseWithMetadata()
+	assert.Error(t, err)
+}
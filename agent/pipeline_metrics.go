@@ -0,0 +1,30 @@
+package agent
+
+import "time"
+
+// PipelineMetrics is used by PipelineParser to report on parsing to a
+// telemetry system
+type PipelineMetrics interface {
+	// Called with how long each call to Parse took, whether or not it
+	// returned an error
+	ObserveParseDuration(d time.Duration)
+
+	// Called with the number of strings changed by interpolation in each
+	// call to Parse
+	ObserveInterpolationCount(n int)
+
+	// The parser doesn't cache anything itself, this is for callers that
+	// cache parsed pipelines to report through the same metrics
+	ObserveCacheHit(hit bool)
+}
+
+// NopMetrics returns a PipelineMetrics that discards everything
+func NopMetrics() PipelineMetrics {
+	return nopMetrics{}
+}
+
+type nopMetrics struct{}
+
+func (nopMetrics) ObserveParseDuration(time.Duration) {}
+func (nopMetrics) ObserveInterpolationCount(int)      {}
+func (nopMetrics) ObserveCacheHit(bool)               {}
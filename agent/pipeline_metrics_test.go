@@ -0,0 +1,50 @@
+package agent
+
+import (
+	"testing"
+	"time"
+
+	"github.com/buildkite/agent/env"
+	"github.com/stretchr/testify/assert"
+)
+
+type recordingMetrics struct {
+	durations      []time.Duration
+	interpolations []int
+}
+
+func (m *recordingMetrics) ObserveParseDuration(d time.Duration) {
+	m.durations = append(m.durations, d)
+}
+
+func (m *recordingMetrics) ObserveInterpolationCount(n int) {
+	m.interpolations = append(m.interpolations, n)
+}
+
+func (m *recordingMetrics) ObserveCacheHit(hit bool) {}
+
+func TestPipelineParserMetrics(t *testing.T) {
+	t.Parallel()
+
+	metrics := &recordingMetrics{}
+
+	_, err := PipelineParser{
+		Pipeline: []byte("steps:\n  - command: echo $FOO\n    label: $$ESCAPED\n  - command: make\n    label: ${FOO}"),
+		Env:      env.FromSlice([]string{"FOO=bar"}),
+		Metrics:  metrics,
+	}.Parse()
+	assert.NoError(t, err)
+
+	_, err = PipelineParser{Pipeline: []byte("steps: ["), Metrics: metrics}.Parse()
+	assert.Error(t, err)
+
+	assert.Len(t, metrics.durations, 2)
+	assert.Equal(t, []int{3, 0}, metrics.interpolations)
+}
+
+func TestPipelineParserNopMetrics(t *testing.T) {
+	t.Parallel()
+
+	_, err := PipelineParser{Pipeline: []byte("steps:\n  - command: make"), Metrics: NopMetrics()}.Parse()
+	assert.NoError(t, err)
+}
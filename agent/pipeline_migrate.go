@@ -0,0 +1,201 @@
+package agent
+
+import (
+	"fmt"
+	"strings"
+)
+
+// CurrentPipelineVersion is the version of the step syntax that
+// MigratePipeline can upgrade pipelines to
+const CurrentPipelineVersion = 3
+
+// MigrationChange is a change made to a step by MigratePipeline
+type MigrationChange struct {
+	// The path of the field that was changed, like `steps[0].type`
+	Path     string
+	OldValue interface{}
+	NewValue interface{}
+
+	// The name of the migration rule that made the change
+	Rule string
+}
+
+// migrationRule changes a step from an old syntax to a newer one, returning
+// the new step, which doesn't have to be a map, and what it changed
+type migrationRule struct {
+	name    string
+	migrate func(path string, step map[string]interface{}) (interface{}, []MigrationChange, error)
+}
+
+// pipelineMigrations are the rules that upgrade pipelines from each version
+// to the next, with the version they upgrade to
+var pipelineMigrations = []struct {
+	version int
+	rules   []migrationRule
+}{
+	{version: 2, rules: []migrationRule{
+		{name: "script-type", migrate: migrateScriptType},
+		{name: "waiter-type", migrate: migrateWaiterType},
+		{name: "manual-type", migrate: migrateManualType},
+	}},
+	{version: 3, rules: []migrationRule{
+		{name: "agent-query-rules", migrate: migrateAgentQueryRules},
+		{name: "name-to-label", migrate: migrateNameToLabel},
+	}},
+}
+
+// MigratePipeline upgrades the steps of a parsed pipeline, including those in
+// groups, from one version of the step syntax to another by applying each
+// version's migrations in turn. Version 1 has `type` steps, version 2 has
+// `agent_query_rules` and `name`, and version 3 is the current syntax. The
+// pipeline passed in isn't changed.
+func MigratePipeline(parsed interface{}, fromVersion, toVersion int) (interface{}, []MigrationChange, error) {
+	if fromVersion < 1 || toVersion > CurrentPipelineVersion || fromVersion > toVersion {
+		return nil, nil, fmt.Errorf("Can't migrate a pipeline from version %d to %d", fromVersion, toVersion)
+	}
+
+	migrated := ClonePipeline(parsed)
+	changes := []MigrationChange{}
+
+	for _, migration := range pipelineMigrations {
+		if migration.version <= fromVersion || migration.version > toVersion {
+			continue
+		}
+		for _, rule := range migration.rules {
+			if err := migrateSteps(pipelineSteps(migrated), "steps", rule, &changes); err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+
+	return migrated, changes, nil
+}
+
+func migrateSteps(steps []interface{}, path string, rule migrationRule, changes *[]MigrationChange) error {
+	for idx, step := range steps {
+		stepMap, ok := step.(map[string]interface{})
+		if !ok {
+			continue
+		}
+
+		stepPath := fmt.Sprintf("%s[%d]", path, idx)
+		migrated, stepChanges, err := rule.migrate(stepPath, stepMap)
+		if err != nil {
+			return fmt.Errorf("Failed to migrate %s: %v", stepPath, err)
+		}
+		for _, change := range stepChanges {
+			change.Rule = rule.name
+			*changes = append(*changes, change)
+		}
+		steps[idx] = migrated
+
+		if migratedMap, ok := migrated.(map[string]interface{}); ok {
+			if children, ok := migratedMap["steps"].([]interface{}); ok {
+				if err := migrateSteps(children, stepPath+".steps", rule, changes); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// migrateScriptType removes `type: script`, as steps with a command are
+// command steps
+func migrateScriptType(path string, step map[string]interface{}) (interface{}, []MigrationChange, error) {
+	if stepString(step, "type") != "script" {
+		return step, nil, nil
+	}
+	delete(step, "type")
+	return step, []MigrationChange{{Path: joinPath(path, "type"), OldValue: "type: script"}}, nil
+}
+
+// migrateWaiterType replaces `type: waiter` with a wait step
+func migrateWaiterType(path string, step map[string]interface{}) (interface{}, []MigrationChange, error) {
+	if stepString(step, "type") != "waiter" {
+		return step, nil, nil
+	}
+	delete(step, "type")
+	changes := []MigrationChange{{Path: path, OldValue: "type: waiter", NewValue: "wait"}}
+
+	if len(step) == 0 {
+		return "wait", changes, nil
+	}
+	step["wait"] = nil
+	return step, changes, nil
+}
+
+// migrateManualType replaces `type: manual` with a block step, using the
+// step's label as the block's
+func migrateManualType(path string, step map[string]interface{}) (interface{}, []MigrationChange, error) {
+	if stepString(step, "type") != "manual" {
+		return step, nil, nil
+	}
+	delete(step, "type")
+
+	label := "Continue"
+	for _, key := range []string{"label", "name"} {
+		if s := stepString(step, key); s != "" {
+			label = s
+			delete(step, key)
+			break
+		}
+	}
+	step["block"] = label
+
+	return step, []MigrationChange{{Path: path, OldValue: "type: manual", NewValue: "block: " + label}}, nil
+}
+
+// migrateAgentQueryRules replaces `agent_query_rules: ["queue=deploy"]` with
+// `agents: {queue: deploy}`
+func migrateAgentQueryRules(path string, step map[string]interface{}) (interface{}, []MigrationChange, error) {
+	rules, ok := step["agent_query_rules"]
+	if !ok {
+		return step, nil, nil
+	}
+	if _, ok := step["agents"]; ok {
+		return nil, nil, fmt.Errorf("can't have both `agent_query_rules` and `agents`")
+	}
+
+	var list []interface{}
+	switch r := rules.(type) {
+	case []interface{}:
+		list = r
+	case string:
+		list = []interface{}{r}
+	default:
+		return nil, nil, fmt.Errorf("expected `agent_query_rules` to be a list, got %T", rules)
+	}
+
+	agents := map[string]interface{}{}
+	for _, rule := range list {
+		s, _ := rule.(string)
+		parts := strings.SplitN(s, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, nil, fmt.Errorf("expected agent query rule %v to be key=value", rule)
+		}
+		agents[parts[0]] = parts[1]
+	}
+
+	delete(step, "agent_query_rules")
+	step["agents"] = agents
+
+	return step, []MigrationChange{{Path: joinPath(path, "agent_query_rules"), OldValue: rules, NewValue: agents}}, nil
+}
+
+// migrateNameToLabel renames `name` to `label`, unless the step already has a
+// label
+func migrateNameToLabel(path string, step map[string]interface{}) (interface{}, []MigrationChange, error) {
+	name, ok := step["name"]
+	if !ok {
+		return step, nil, nil
+	}
+	if _, ok := step["label"]; ok {
+		return step, nil, nil
+	}
+
+	delete(step, "name")
+	step["label"] = name
+
+	return step, []MigrationChange{{Path: joinPath(path, "name"), OldValue: fmt.Sprintf("name: %v", name), NewValue: fmt.Sprintf("label: %v", name)}}, nil
+}
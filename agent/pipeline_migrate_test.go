@@ -0,0 +1,76 @@
+package agent
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/buildkite/agent/env"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMigratePipeline(t *testing.T) {
+	t.Parallel()
+
+	source := []byte(`steps:
+  - type: script
+    name: Test
+    command: make test
+    agent_query_rules: ["queue=test", "os=linux"]
+  - type: waiter
+  - type: waiter
+    continue_on_failure: true
+  - type: manual
+    name: Release
+  - group: Deploy
+    steps:
+      - name: Deploy
+        label: ":rocket: Deploy"
+        command: make deploy
+`)
+
+	parsed, err := PipelineParser{Pipeline: source, Env: env.New()}.Parse()
+	assert.NoError(t, err)
+	original, err := json.Marshal(parsed)
+	assert.NoError(t, err)
+
+	migrated, changes, err := MigratePipeline(parsed, 1, CurrentPipelineVersion)
+	assert.NoError(t, err)
+
+	j, err := json.Marshal(migrated)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"steps":[{"agents":{"os":"linux","queue":"test"},"command":"make test","label":"Test"},"wait",{"continue_on_failure":true,"wait":null},{"block":"Release"},{"group":"Deploy","steps":[{"command":"make deploy","label":":rocket: Deploy","name":"Deploy"}]}]}`, string(j))
+
+	assert.Equal(t, []MigrationChange{
+		{Path: "steps[0].type", OldValue: "type: script", Rule: "script-type"},
+		{Path: "steps[1]", OldValue: "type: waiter", NewValue: "wait", Rule: "waiter-type"},
+		{Path: "steps[2]", OldValue: "type: waiter", NewValue: "wait", Rule: "waiter-type"},
+		{Path: "steps[3]", OldValue: "type: manual", NewValue: "block: Release", Rule: "manual-type"},
+		{
+			Path:     "steps[0].agent_query_rules",
+			OldValue: []interface{}{"queue=test", "os=linux"},
+			NewValue: map[string]interface{}{"queue": "test", "os": "linux"},
+			Rule:     "agent-query-rules",
+		},
+		{Path: "steps[0].name", OldValue: "name: Test", NewValue: "label: Test", Rule: "name-to-label"},
+	}, changes)
+
+	// The original pipeline isn't changed
+	after, err := json.Marshal(parsed)
+	assert.NoError(t, err)
+	assert.Equal(t, string(original), string(after))
+
+	// Migrations can be applied a version at a time
+	v2, changes, err := MigratePipeline(parsed, 1, 2)
+	assert.NoError(t, err)
+	assert.Len(t, changes, 4)
+	v3, changes, err := MigratePipeline(v2, 2, 3)
+	assert.NoError(t, err)
+	assert.Len(t, changes, 2)
+	assert.Equal(t, migrated, v3)
+
+	_, _, err = MigratePipeline(parsed, 2, 1)
+	assert.EqualError(t, err, "Can't migrate a pipeline from version 2 to 1")
+
+	_, _, err = MigratePipeline([]interface{}{map[string]interface{}{"agent_query_rules": []interface{}{"queue"}}}, 2, 3)
+	assert.EqualError(t, err, "Failed to migrate steps[0]: expected agent query rule queue to be key=value")
+}
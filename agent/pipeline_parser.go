@@ -1,17 +1,32 @@
 package agent
 
 import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
 	"os"
+	"path"
 	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
+	"unicode/utf8"
 
 	"github.com/buildkite/agent/env"
+	"github.com/buildkite/agent/logger"
 	"github.com/buildkite/interpolate"
 
 	// This is a fork of gopkg.in/yaml.v2 that fixes anchors with MapSlice
 	yaml "github.com/buildkite/yaml"
+	yaml3 "gopkg.in/yaml.v3"
 )
 
 type PipelineParser struct {
@@ -19,121 +34,1666 @@ type PipelineParser struct {
 	Filename        string
 	Pipeline        []byte
 	NoInterpolation bool
+
+	// Return an error for any group step that doesn't have a non-empty
+	// `group` or `label`
+	RequireGroupLabels bool
+
+	// Set `concurrency` and `concurrency_group` on command steps based on the
+	// capacity of the queue they target. Steps without a queue use the
+	// capacity of the `default` queue.
+	AnnotateRateLimits bool
+	QueueCapacity      map[string]int
+
+	// Return an error when a variable that isn't set is interpolated, rather
+	// than replacing it with an empty string
+	StrictInterpolation bool
+
+	// When set, only these env vars (or patterns like `BUILDKITE_*`) are
+	// available for interpolation. Combined with StrictInterpolation, any
+	// reference to another variable is an error.
+	AllowedEnvKeys []string
+
+	// Return an error for any step with an `if` condition that doesn't have
+	// a comment above it or on the same line
+	RequireConditionComments bool
+
+	// Return an error for any step with `allow_dependency_failure: true` that
+	// doesn't have any `depends_on`
+	ValidateAllowDependencyFailure bool
+
+	// Write a markdown section to DocumentationWriter for each step that has a
+	// `metadata.description`
+	ExtractDocumentation bool
+	DocumentationWriter  io.Writer
+
+	// Require a `timeout_in_minutes` on every command step. Steps without one
+	// are given DefaultTimeoutMinutes if it's set, otherwise it's an error.
+	EnforceTimeout        bool
+	DefaultTimeoutMinutes int
+
+	// Return an error if the pipeline isn't valid UTF-8, rather than leaving
+	// it up to the YAML parser
+	ValidateUTF8 bool
+
+	// Strings that shouldn't be interpolated. Each entry is either a key name
+	// (such as an env var name, which matches that key anywhere), or a path
+	// pattern like `steps.*.command` where `*` matches any key or index.
+	SkipInterpolationKeys []string
+
+	// When set, every interpolation is recorded here rather than unresolved
+	// variables being an error. See DryRun.
+	report *InterpolationReport
+
+	// Return an error for any command step that isn't marked as idempotent,
+	// either with `metadata.idempotent: true` or an `# idempotent` comment on
+	// its command
+	RequireIdempotencyMarkers bool
+
+	// Return an error for any step with a `concurrency` that isn't a positive
+	// integer
+	ValidateConcurrencyValue bool
+
+	// Plugins that must be used by every command step that targets a queue,
+	// as a map of queue name to plugin name
+	QueueRequiredPlugins map[string]string
+
+	// Return an error for any command step with a `parallelism` higher than
+	// this. Zero means there's no limit.
+	MaxParallelism int
+
+	// Return an error for any trigger step with a pipeline slug that isn't
+	// lowercase letters, numbers and hyphens
+	ValidateTriggerSlugs bool
+
+	// Store the names of any variables set in the pipeline's env block that
+	// aren't referenced in the command of any step in UnusedEnvVars, sorted.
+	// UnusedEnvVars has to point to the slice to store them in, as nothing
+	// is stored if it's nil.
+	FindUnusedEnvVars bool
+	UnusedEnvVars     *[]string
+
+	// Interpolation stops with the context's error if it's cancelled or times
+	// out, so that adversarial pipelines can't keep the parser busy forever.
+	// See ParseContext.
+	Context context.Context
+
+	// Return the comments in the pipeline source from ParseWithComments
+	PreserveComments bool
+
+	// Return where each key and list item is in the pipeline source from
+	// ParseWithSourceMap
+	WithSourceMap bool
+
+	// Return a PipelineSizeError if the pipeline source is larger than
+	// MaxPipelineBytes, or has more than MaxSteps top-level steps. Zero means
+	// there's no limit.
+	MaxPipelineBytes int
+	MaxSteps         int
+
+	// Where files referenced by the pipeline are read from. Defaults to the
+	// current directory.
+	FS FileSystem
+
+	// Where to report how long parsing takes and how much interpolation was
+	// done. Nothing is measured if it's nil.
+	Metrics PipelineMetrics
+
+	// The number of strings changed by interpolation, when there's Metrics
+	interpolations *int
+
+	// What's measured for ParseWithMetadata
+	stats *parseStats
+
+	// Pipeline is base64 encoded, and is decoded before it's parsed
+	Base64Pipeline bool
+
+	// The separator used to join env block values that are lists, such as
+	// `TAGS: [alpha, beta]`. Defaults to `:`.
+	ListEnvSeparator string
+
+	// Used to resolve `${SECRET{name}}` references and the top-level
+	// `secrets` block in the pipeline. Any secrets that are resolved are
+	// appended to Redactions, so that they can be redacted from output.
+	// Without a resolver, the `secrets` block is left as it is.
+	SecretResolver SecretResolver
+	Redactions     *[]string
+
+	// Replace every variable reference with a placeholder like `__VAR__`
+	// rather than its value, for checking the syntax of a pipeline without
+	// the environment it would be uploaded with
+	SyntaxOnlyMode bool
+
+	// When set, a line is written here for each variable referenced in each
+	// string that's interpolated, with the string before and after
+	TraceWriter io.Writer
+
+	// Check for keys that appear more than once in the same map, of which
+	// only the last value is used. As the YAML parser drops them, this parses
+	// the pipeline a second time.
+	CheckDuplicateKeys bool
+
+	// Called for each duplicate key found with CheckDuplicateKeys. A warning
+	// is logged if it isn't set.
+	DuplicateKeyHandler func(key, path string)
+
+	// Expand `${VAR.field}` to a field of the JSON in VAR
+	JSONEnvExpansion bool
+
+	// Also interpolate plugin names (the keys of plugin maps) like
+	// `$PLUGIN_REGISTRY/my-plugin#v1` in pipelines that are just a list of
+	// steps, where map keys are otherwise left as they are. Plugin names in
+	// pipelines with a `steps` key are always interpolated.
+	InterpolatePluginNames bool
+
+	// Expand `${namespace.VAR}` to `${PREFIX_VAR}`, as a map of namespace
+	// names (which are case insensitive) to prefixes like `PROD_`
+	EnvNamespaces map[string]string
+
+	// The file extensions NewPipelineParserFromFile allows, which are
+	// DefaultPipelineExtensions if this isn't set
+	AllowedExtensions []string
+
+	// Replace strings that fail to interpolate with an empty string rather
+	// than returning an error. The failures are appended to
+	// InterpolationErrors, which has to be set (NewPipelineParser sets it),
+	// and can be read with Errors.
+	LenientInterpolation bool
+	InterpolationErrors  *[]InterpolationError
+
+	// Interpolates each string, after the parser's own extensions like trim
+	// operators have been expanded. The interpolate package is used if this
+	// isn't set.
+	Interpolator Interpolator
+
+	// Remove any emoji (either as characters or `:shortcodes:`) from the
+	// start and end of the `label` and `name` of each step
+	NormalizeLabels bool
+
+	// Evaluate env block values that are integer arithmetic once they've
+	// been interpolated, such as `${BASE_TIMEOUT} * 2`
+	EvalEnvArithmetic bool
+
+	// Used to download the pipeline when there's no Pipeline and the
+	// Filename is an HTTP(S) URL. Defaults to http.DefaultClient.
+	HTTPClient *http.Client
+
+	// Used to read the pipeline with `git show` when there's no Pipeline and
+	// the Filename is a git revision and path, like `main:pipeline.yml`.
+	// Filenames are never read from git if it's nil.
+	GitRunner GitRunner
+
+	// The env vars with values that SanitizeInput removes from the pipeline
+	RedactedEnvKeys []string
+
+	// Called with the Filename and the pipeline before it's parsed, and the
+	// pipeline is replaced with what it returns, so that things like
+	// templates can be expanded first
+	Preprocessor func(filename string, content []byte) ([]byte, error)
+
+	// Replace each step that has a `matrix` with a step for each combination
+	// of its values, which are added to the step's env block, and to its key
+	// (like `test-linux`) so that the keys stay unique
+	ExpandMatrix bool
+
+	// Expand steps with a `template: name` key using the pipeline's top-level
+	// `templates` block. Without it, `templates` and `template` are left as
+	// they are.
+	ExpandTemplates bool
+
+	// Expand steps with an `extends` key onto the step template (from the
+	// pipeline's top-level `step_templates` block) or step that they name.
+	// Without it, `step_templates` and `extends` are left as they are.
+	ExpandExtends bool
+
+	// Called with each step once the pipeline has been interpolated, including
+	// the steps in groups, and the step is replaced with the map it returns.
+	// It's called before any of the other transformations and validations,
+	// so it can be used to add fields like `retry` to every step.
+	StepTransformer func(step map[string]interface{}) (map[string]interface{}, error)
+
+	// Handlers for custom YAML tags like `!vault`, keyed by the tag without
+	// its `!`. Any other tags are a warning, or an error with StrictTags.
+	TagHandlers map[string]TagHandler
+	StrictTags  bool
+
+	// Parse the pipeline with gopkg.in/yaml.v3 rather than the buildkite/yaml
+	// fork, to check whether that changes anything. It's for diagnosing
+	// differences along with CompareYAMLBehavior, rather than for everyday use.
+	UseStandardYAML bool
+
+	// Parse the pipeline as TOML, which is done anyway if the Filename has a
+	// `.toml` extension. A top-level `env` table is the same as an `env:`
+	// block.
+	TOML bool
+
+	// Where the pipeline is read from when the Filename is `-`, which is
+	// os.Stdin unless it's been replaced in tests
+	stdin io.Reader
+
+	// References that couldn't be resolved, when parsing with ParsePartial
+	partialErrors *[]PartialError
+}
+
+// InterpolationError is a string that failed to interpolate with
+// LenientInterpolation
+type InterpolationError struct {
+	Path     string
+	Original string
+	Err      error
+}
+
+func (e InterpolationError) Error() string {
+	return fmt.Sprintf("Failed to interpolate %s (%q): %v", e.Path, e.Original, e.Err)
+}
+
+// Errors returns the strings that failed to interpolate when parsing with
+// LenientInterpolation, which are kept in InterpolationErrors
+func (p PipelineParser) Errors() []InterpolationError {
+	if p.InterpolationErrors == nil {
+		return nil
+	}
+	return *p.InterpolationErrors
+}
+
+// InvalidUTF8Error is returned when the pipeline contains invalid UTF-8
+type InvalidUTF8Error struct {
+	Offset int
+}
+
+func (e InvalidUTF8Error) Error() string {
+	return fmt.Sprintf("Invalid UTF-8 at byte offset %d", e.Offset)
+}
+
+// PipelineSizeError is returned when a pipeline is larger than the limits set
+// on the parser. Unit is either "bytes" or "steps".
+type PipelineSizeError struct {
+	Unit   string
+	Limit  int
+	Actual int
+}
+
+func (e PipelineSizeError) Error() string {
+	return fmt.Sprintf("Pipeline has %d %s, which is more than the limit of %d", e.Actual, e.Unit, e.Limit)
+}
+
+// Parse parses the pipeline, interpolating it with Env. Variables set in the
+// pipeline's env block are set in Env, so Parse isn't safe to call from
+// multiple goroutines with the same Env. Use ParseCopy for that.
+func (p PipelineParser) Parse() (interface{}, error) {
+	result, err := p.parseWithMetadata(false)
+	if err != nil {
+		return nil, err
+	}
+	return result.Pipeline, nil
+}
+
+// gitBlobRegex matches a Filename that refers to a file at a git revision,
+// like `main:.buildkite/pipeline.yml`. Revisions have to be more than one
+// character, so that Windows paths like `C:\pipeline.yml` don't match.
+var gitBlobRegex = regexp.MustCompile(`^[^:\s]{2,}:[^:]+$`)
+
+// loadPipeline returns a copy of the parser with the pipeline read from stdin
+// if the Filename is `-` and there's no Pipeline, or from git if the Filename
+// is like `<revision>:<path>` and there's a GitRunner, or from the URL if the
+// Filename is an HTTP(S) URL, and then decoded if it's
+// base64 encoded. It's checked against MaxPipelineBytes before it's decoded,
+// and is checked for invalid UTF-8 with ValidateUTF8 after. If there's no
+// Filename, it's taken from a `# pipeline:` comment at the top of the
+// pipeline. Finally, it's passed through the Preprocessor if there is one.
+func (p PipelineParser) loadPipeline() (PipelineParser, error) {
+	if p.Filename == "-" && len(p.Pipeline) == 0 {
+		stdin := p.stdin
+		if stdin == nil {
+			stdin = os.Stdin
+		}
+
+		// Read one more byte than the limit so we know if it's been exceeded
+		if p.MaxPipelineBytes > 0 {
+			stdin = io.LimitReader(stdin, int64(p.MaxPipelineBytes)+1)
+		}
+
+		pipeline, err := ioutil.ReadAll(stdin)
+		if err != nil {
+			return p, fmt.Errorf("Failed to read pipeline from stdin: %v", err)
+		}
+		p.Pipeline = pipeline
+	}
+
+	if len(p.Pipeline) == 0 && (strings.HasPrefix(p.Filename, "http://") || strings.HasPrefix(p.Filename, "https://")) {
+		pipeline, err := p.fetchPipeline()
+		if err != nil {
+			return p, err
+		}
+		p.Pipeline = pipeline
+	} else if p.GitRunner != nil && len(p.Pipeline) == 0 && gitBlobRegex.MatchString(p.Filename) {
+		pipeline, err := p.GitRunner.Run("show", p.Filename)
+		if err != nil {
+			return p, fmt.Errorf("Failed to read pipeline %s from git: %v", p.Filename, err)
+		}
+		p.Pipeline = pipeline
+	}
+
+	// The limit is on the pipeline as it's given, rather than what it's
+	// turned into, so that it's checked before any work is done with it
+	if p.MaxPipelineBytes > 0 && len(p.Pipeline) > p.MaxPipelineBytes {
+		return p, PipelineSizeError{Unit: "bytes", Limit: p.MaxPipelineBytes, Actual: len(p.Pipeline)}
+	}
+
+	p, err := p.decodePipeline()
+	if err != nil {
+		return p, err
+	}
+
+	if p.ValidateUTF8 && !utf8.Valid(p.Pipeline) {
+		return p, InvalidUTF8Error{Offset: invalidUTF8Offset(p.Pipeline)}
+	}
+
+	// The copy might be loaded again, which shouldn't check what the
+	// pipeline is turned into below
+	p.MaxPipelineBytes = 0
+	p.ValidateUTF8 = false
+
+	// Only a filename that's been given says it's TOML, as one in a
+	// `# pipeline:` comment is part of what might be YAML
+	if isTOMLFilename(p.Filename) {
+		p.TOML = true
+	}
+
+	if p.Filename == "" {
+		p.Filename = pipelineFilenameHeader(p.Pipeline)
+	}
+
+	if p.Preprocessor != nil {
+		pipeline, err := p.Preprocessor(p.Filename, p.Pipeline)
+		if err != nil {
+			if p.Filename == "" {
+				return p, fmt.Errorf("Failed to preprocess pipeline: %v", err)
+			}
+			return p, fmt.Errorf("Failed to preprocess %s: %v", p.Filename, err)
+		}
+		p.Pipeline = pipeline
+
+		// The copy might be loaded again, which shouldn't preprocess twice
+		p.Preprocessor = nil
+	}
+
+	return p.resolveTags()
+}
+
+// fetchPipeline downloads the pipeline from the URL in the Filename, with no
+// more than one byte over MaxPipelineBytes read if there's a limit
+func (p PipelineParser) fetchPipeline() ([]byte, error) {
+	client := p.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	req, err := http.NewRequest("GET", p.Filename, nil)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to fetch pipeline from %s: %v", p.Filename, err)
+	}
+	if p.Context != nil {
+		req = req.WithContext(p.Context)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to fetch pipeline from %s: %v", p.Filename, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Failed to fetch pipeline from %s: %s", p.Filename, resp.Status)
+	}
+
+	// Read one more byte than the limit so we know if it's been exceeded
+	var body io.Reader = resp.Body
+	if p.MaxPipelineBytes > 0 {
+		body = io.LimitReader(body, int64(p.MaxPipelineBytes)+1)
+	}
+
+	pipeline, err := ioutil.ReadAll(body)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to fetch pipeline from %s: %v", p.Filename, err)
+	}
+
+	return pipeline, nil
+}
+
+// pipelineFilenameHeader returns the filename from a `# pipeline: filename`
+// comment on the first line of a pipeline, if there is one
+func pipelineFilenameHeader(pipeline []byte) string {
+	line := string(pipeline)
+	if idx := strings.IndexByte(line, '\n'); idx >= 0 {
+		line = line[:idx]
+	}
+
+	line = strings.TrimSpace(line)
+	if !strings.HasPrefix(line, "#") {
+		return ""
+	}
+
+	comment := strings.TrimSpace(strings.TrimPrefix(line, "#"))
+	if !strings.HasPrefix(comment, "pipeline:") {
+		return ""
+	}
+
+	return strings.TrimSpace(strings.TrimPrefix(comment, "pipeline:"))
+}
+
+// decodePipeline returns a copy of the parser with the pipeline decoded if
+// it's base64 encoded
+func (p PipelineParser) decodePipeline() (PipelineParser, error) {
+	if !p.Base64Pipeline {
+		return p, nil
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(string(p.Pipeline))
+	if err != nil {
+		return p, fmt.Errorf("Failed to decode base64 pipeline: %v", err)
+	}
+
+	p.Pipeline = decoded
+	p.Base64Pipeline = false
+	return p, nil
+}
+
+// SanitizeInput replaces the values of the env vars in RedactedEnvKeys with
+// `[REDACTED]` wherever they appear in the pipeline, before it's parsed, so
+// that the pipeline can be logged without leaking them. A base64 encoded
+// pipeline is decoded first. Any values that are replaced are also appended
+// to Redactions if it's set.
+func (p *PipelineParser) SanitizeInput() error {
+	decoded, err := p.decodePipeline()
+	if err != nil {
+		return err
+	}
+
+	environ := decoded.Env
+	if environ == nil {
+		environ = env.FromSlice(os.Environ())
+	}
+
+	var values []string
+	for _, key := range decoded.RedactedEnvKeys {
+		if value, ok := environ.Get(key); ok && value != "" {
+			values = append(values, value)
+		}
+	}
+
+	// Longer values go first, in case one contains another
+	sort.SliceStable(values, func(i, j int) bool {
+		return len(values[i]) > len(values[j])
+	})
+
+	for _, value := range values {
+		if !bytes.Contains(decoded.Pipeline, []byte(value)) {
+			continue
+		}
+		decoded.Pipeline = bytes.Replace(decoded.Pipeline, []byte(value), []byte("[REDACTED]"), -1)
+		if decoded.Redactions != nil {
+			decoded.addRedaction(value)
+		}
+	}
+
+	*p = decoded
+	return nil
+}
+
+// ParseCopy is like Parse, but parses with a copy of Env so that it isn't
+// changed, which makes it safe to call concurrently
+func (p PipelineParser) ParseCopy() (interface{}, error) {
+	if p.Env != nil {
+		p.Env = p.Env.Copy()
+	}
+	return p.Parse()
+}
+
+// Clone returns a copy of the parser with its own copy of Env, so that the
+// copy can be used to parse at the same time as the original. Any of
+// UnusedEnvVars, Redactions and InterpolationErrors that are set are replaced
+// with new empty slices, so the copy's results are kept separately.
+func (p PipelineParser) Clone() *PipelineParser {
+	if p.Env != nil {
+		p.Env = p.Env.Copy()
+	}
+	if p.UnusedEnvVars != nil {
+		p.UnusedEnvVars = &[]string{}
+	}
+	if p.Redactions != nil {
+		p.Redactions = &[]string{}
+	}
+	if p.InterpolationErrors != nil {
+		p.InterpolationErrors = &[]InterpolationError{}
+	}
+	return &p
+}
+
+// ParseContext is like Parse, but stops if ctx is cancelled or times out
+func (p PipelineParser) ParseContext(ctx context.Context) (interface{}, error) {
+	p.Context = ctx
+	return p.Parse()
+}
+
+// parse parses and interpolates the pipeline, without any of the optional
+// transformations or validations
+func (p PipelineParser) parse() (interface{}, error) {
+	// The parser is passed by value, so there's nowhere else for the errors
+	// to go, and silently dropping them would hide the failures
+	if p.LenientInterpolation && p.InterpolationErrors == nil {
+		return nil, errors.New("LenientInterpolation needs InterpolationErrors to be set, or use NewPipelineParser")
+	}
+
+	if p.TOML {
+		pipeline, err := tomlToYAML(p.Pipeline)
+		if err != nil {
+			if p.Filename == "" {
+				return nil, fmt.Errorf("Failed to parse pipeline: %v", err)
+			}
+			return nil, fmt.Errorf("Failed to parse %s: %v", p.Filename, err)
+		}
+		p.Pipeline = pipeline
+	} else if p.UseStandardYAML {
+		pipeline, err := standardYAMLToFork(p.Pipeline)
+		if err != nil {
+			if p.Filename == "" {
+				return nil, fmt.Errorf("Failed to parse pipeline: %v", parseYAMLError(err))
+			}
+			return nil, fmt.Errorf("Failed to parse %s: %v", p.Filename, parseYAMLError(err))
+		}
+		p.Pipeline = pipeline
+	}
+
+	return p.parseYAML()
+}
+
+func (p PipelineParser) parseYAML() (interface{}, error) {
+	if p.Env == nil {
+		p.Env = env.FromSlice(os.Environ())
+	}
+
+	if len(p.AllowedEnvKeys) > 0 {
+		p.Env = filterEnv(p.Env, p.AllowedEnvKeys)
+	}
+
+	var errPrefix string
+	if p.Filename == "" {
+		errPrefix = "Failed to parse pipeline"
+	} else {
+		errPrefix = fmt.Sprintf("Failed to parse %s", p.Filename)
+	}
+
+	// If interpolation is disabled, just parse and return
+	if p.NoInterpolation {
+		var result interface{}
+		if err := unmarshalAsStringMap([]byte(p.Pipeline), &result); err != nil {
+			return nil, fmt.Errorf("%s: %v", errPrefix, parseYAMLError(err))
+		}
+		if err := p.checkStepCount(result); err != nil {
+			return nil, err
+		}
+		if p.FindUnusedEnvVars && p.UnusedEnvVars != nil {
+			*p.UnusedEnvVars = findUnusedEnvVars(result)
+		}
+		return result, nil
+	}
+
+	var pipeline interface{}
+	var pipelineAsSlice []interface{}
+
+	// Historically we support uploading just steps, so we parse it as either a
+	// slice, or if it's a map we need to do environment block processing. If
+	// it's clearly a slice we don't need to consider it being a map at all.
+	if p.IsSlice() {
+		if err := unmarshalYAML([]byte(p.Pipeline), &pipelineAsSlice); err != nil {
+			return nil, fmt.Errorf("%s: %v", errPrefix, parseYAMLError(err))
+		}
+		pipeline = pipelineAsSlice
+	} else if err := unmarshalYAML([]byte(p.Pipeline), &pipelineAsSlice); err == nil {
+		pipeline = pipelineAsSlice
+	} else {
+		pipelineAsMap, err := p.parseWithEnv()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", errPrefix, parseYAMLError(err))
+		}
+		pipeline = pipelineAsMap
+
+		// Inputs can be set by the env block, so they're checked after it
+		if m, ok := pipelineAsMap.(yaml.MapSlice); ok && p.StrictInterpolation {
+			if err := p.validateInputs(m); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if p.CheckDuplicateKeys {
+		p.checkDuplicateKeys()
+	}
+
+	// Check the size before interpolation, which is the expensive part
+	if err := p.checkStepCount(pipeline); err != nil {
+		return nil, err
+	}
+
+	// Variables are found before the commands are interpolated, while the
+	// references to them are still there
+	if p.FindUnusedEnvVars && p.UnusedEnvVars != nil {
+		*p.UnusedEnvVars = findUnusedEnvVars(standardYAMLStringMap(pipeline))
+	}
+
+	// Recursively go through the entire pipeline and perform environment
+	// variable interpolation on strings
+	start := time.Now()
+	interpolated, err := p.interpolate(pipeline)
+	if err != nil {
+		return nil, err
+	}
+	if p.stats != nil {
+		p.stats.interpolateDuration += time.Since(start)
+	}
+
+	// Now we roundtrip this back into YAML bytes and back into a generic interface{}
+	// that works with all upstream code (which likes working with JSON). Specifically we
+	// need to convert the map[interface{}]interface{}'s that YAML likes into JSON compatible
+	// map[string]interface{}
+	b, err := yaml.Marshal(interpolated)
+	if err != nil {
+		return nil, err
+	}
+
+	var result interface{}
+	if err := unmarshalAsStringMap(b, &result); err != nil {
+		return nil, fmt.Errorf("%s: %v", errPrefix, parseYAMLError(err))
+	}
+
+	return result, nil
+}
+
+// checkDuplicateKeys reports any keys that appear more than once in the same
+// map. The yaml package only keeps the last value of a duplicated key (even in
+// a yaml.MapSlice), so they're found in the YAML node tree instead, which has
+// every key whether it's in a block, flow or JSON style map.
+func (p PipelineParser) checkDuplicateKeys() {
+	var doc yaml3.Node
+	if err := yaml3.Unmarshal(p.Pipeline, &doc); err != nil {
+		// The pipeline failing to parse is reported elsewhere
+		return
+	}
+	p.checkDuplicateNodeKeys(&doc, "")
+}
+
+func (p PipelineParser) checkDuplicateNodeKeys(n *yaml3.Node, path string) {
+	switch n.Kind {
+	case yaml3.DocumentNode:
+		for _, child := range n.Content {
+			p.checkDuplicateNodeKeys(child, path)
+		}
+
+	case yaml3.SequenceNode:
+		for idx, child := range n.Content {
+			p.checkDuplicateNodeKeys(child, fmt.Sprintf("%s[%d]", path, idx))
+		}
+
+	case yaml3.MappingNode:
+		seen := map[string]bool{}
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			keyNode, valueNode := n.Content[i], n.Content[i+1]
+			if isStandardYAMLMergeKey(keyNode) {
+				continue
+			}
+
+			name := keyNode.Value
+			if seen[name] {
+				p.reportDuplicateKey(name, path)
+			}
+			seen[name] = true
+
+			childPath := name
+			if path != "" {
+				childPath = path + "." + name
+			}
+			p.checkDuplicateNodeKeys(valueNode, childPath)
+		}
+	}
+}
+
+func (p PipelineParser) reportDuplicateKey(name, parent string) {
+	if p.DuplicateKeyHandler != nil {
+		p.DuplicateKeyHandler(name, parent)
+	} else if parent == "" {
+		logger.Warn("The key %q appears more than once in the pipeline, only the last value will be used", name)
+	} else {
+		logger.Warn("The key %q appears more than once in %s, only the last value will be used", name, parent)
+	}
+}
+
+// checkStepCount returns a PipelineSizeError if an unmarshalled pipeline has
+// more top-level steps than MaxSteps
+func (p PipelineParser) checkStepCount(pipeline interface{}) error {
+	if p.MaxSteps <= 0 {
+		return nil
+	}
+
+	var steps interface{}
+	switch v := pipeline.(type) {
+	case yaml.MapSlice:
+		if item, ok := mapSliceItem("steps", v); ok {
+			steps = item.Value
+		}
+	default:
+		steps = pipelineSteps(pipeline)
+	}
+
+	if s, ok := steps.([]interface{}); ok && len(s) > p.MaxSteps {
+		return PipelineSizeError{Unit: "steps", Limit: p.MaxSteps, Actual: len(s)}
+	}
+
+	return nil
+}
+
+// IsSlice returns whether the pipeline is just a list of steps, going by
+// whether the first thing in it (other than comments and a `---`) is a YAML
+// sequence item or a JSON array
+func (p PipelineParser) IsSlice() bool {
+	p, err := p.decodePipeline()
+	if err != nil {
+		return false
+	}
+
+	for _, line := range strings.Split(string(p.Pipeline), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || line == "---" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		return line == "-" || strings.HasPrefix(line, "- ") || strings.HasPrefix(line, "[")
+	}
+
+	return false
+}
+
+// invalidUTF8Offset returns the offset of the first invalid UTF-8 sequence
+func invalidUTF8Offset(b []byte) int {
+	for offset := 0; offset < len(b); {
+		r, size := utf8.DecodeRune(b[offset:])
+		if r == utf8.RuneError && size <= 1 {
+			return offset
+		}
+		offset += size
+	}
+	return -1
+}
+
+// ParseAndMarshal parses the pipeline and returns it serialized as JSON
+func (p PipelineParser) ParseAndMarshal() ([]byte, error) {
+	parsed, err := p.Parse()
+	if err != nil {
+		return nil, err
+	}
+	return MarshalPipeline(parsed)
+}
+
+// MarshalPipeline serializes a parsed pipeline to JSON. As Parse returns
+// map[string]interface{}'s the keys are sorted, so the output is stable for
+// the same pipeline.
+func MarshalPipeline(parsed interface{}) ([]byte, error) {
+	return json.Marshal(parsed)
+}
+
+// DefaultYAMLKeyOrder is the order of the keys in pipelines marshalled by
+// MarshalToYAML, following the order they're documented in
+var DefaultYAMLKeyOrder = []string{
+	"key", "label", "name", "group", "block", "input", "wait", "trigger",
+	"command", "commands", "plugins", "env", "agents", "depends_on",
+	"allow_dependency_failure", "if", "branches", "timeout_in_minutes",
+	"parallelism", "concurrency", "concurrency_group", "retry", "soft_fail",
+	"artifact_paths", "notify", "steps",
+}
+
+// MarshalToYAML serializes a parsed pipeline to YAML. The keys of each map
+// are in the order of keyOrder, followed by any other keys sorted
+// alphabetically. DefaultYAMLKeyOrder is used if keyOrder is nil.
+func MarshalToYAML(parsed interface{}, keyOrder []string) ([]byte, error) {
+	if keyOrder == nil {
+		keyOrder = DefaultYAMLKeyOrder
+	}
+	return yaml.Marshal(orderYAMLKeys(parsed, yamlKeyRanks(keyOrder)))
+}
+
+// yamlKeyRanks returns the position of each key in a key order
+func yamlKeyRanks(keyOrder []string) map[string]int {
+	rank := map[string]int{}
+	for idx, key := range keyOrder {
+		if _, ok := rank[key]; !ok {
+			rank[key] = idx
+		}
+	}
+	return rank
+}
+
+// orderYAMLKeys converts the maps in a parsed pipeline to a yaml.MapSlice
+// with the keys in order of their rank, then alphabetically
+func orderYAMLKeys(value interface{}, rank map[string]int) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Slice(keys, func(i, j int) bool {
+			ri, iok := rank[keys[i]]
+			rj, jok := rank[keys[j]]
+			switch {
+			case iok && jok:
+				return ri < rj
+			case iok != jok:
+				return iok
+			}
+			return keys[i] < keys[j]
+		})
+
+		ordered := make(yaml.MapSlice, 0, len(keys))
+		for _, key := range keys {
+			ordered = append(ordered, yaml.MapItem{Key: key, Value: orderYAMLKeys(v[key], rank)})
+		}
+		return ordered
+
+	case []interface{}:
+		ordered := make([]interface{}, len(v))
+		for idx, item := range v {
+			ordered[idx] = orderYAMLKeys(item, rank)
+		}
+		return ordered
+	}
+
+	return value
+}
+
+// finalize applies any of the optional transformations and validations to
+// the parsed pipeline
+func (p PipelineParser) finalize(result interface{}) (interface{}, error) {
+	if p.ExpandMatrix {
+		var err error
+		if result, err = expandMatrix(result); err != nil {
+			return nil, err
+		}
+	}
+
+	if p.StepTransformer != nil {
+		if err := transformSteps(pipelineSteps(result), "steps", p.StepTransformer); err != nil {
+			return nil, err
+		}
+	}
+
+	if p.AnnotateRateLimits {
+		p.annotateRateLimits(result)
+	}
+
+	if p.EnforceTimeout && p.DefaultTimeoutMinutes > 0 {
+		p.injectDefaultTimeouts(result)
+	}
+
+	if p.NormalizeLabels {
+		normalizeLabels(result)
+	}
+
+	if err := p.validate(result); err != nil {
+		return nil, err
+	}
+
+	if p.ExtractDocumentation && p.DocumentationWriter != nil {
+		if err := writeStepDocumentation(p.DocumentationWriter, result); err != nil {
+			return nil, err
+		}
+	}
+
+	return result, nil
+}
+
+// injectDefaultTimeouts sets DefaultTimeoutMinutes on any command steps that
+// don't have a timeout
+func (p PipelineParser) injectDefaultTimeouts(pipeline interface{}) {
+	walkSteps(pipelineSteps(pipeline), "steps", func(path string, step map[string]interface{}) {
+		if timeout, ok := step["timeout_in_minutes"]; isCommandStep(step) && (!ok || timeout == nil) {
+			step["timeout_in_minutes"] = p.DefaultTimeoutMinutes
+		}
+	})
+}
+
+// writeStepDocumentation writes a markdown section for each step with a
+// `metadata.description`, headed by the step's label
+func writeStepDocumentation(w io.Writer, pipeline interface{}) error {
+	var err error
+
+	walkSteps(pipelineSteps(pipeline), "steps", func(path string, step map[string]interface{}) {
+		metadata, ok := step["metadata"].(map[string]interface{})
+		if !ok || err != nil {
+			return
+		}
+
+		description, ok := metadata["description"].(string)
+		if !ok || strings.TrimSpace(description) == "" {
+			return
+		}
+
+		_, err = fmt.Fprintf(w, "## %s\n\n%s\n\n", stepName(path, step), strings.TrimSpace(description))
+	})
+
+	return err
+}
+
+// annotateRateLimits sets a concurrency limit on each command step that
+// matches the capacity of its queue. Steps that already have a concurrency
+// set, or that target a queue with no known capacity are left alone.
+func (p PipelineParser) annotateRateLimits(pipeline interface{}) {
+	walkSteps(pipelineSteps(pipeline), "steps", func(path string, step map[string]interface{}) {
+		if !isCommandStep(step) {
+			return
+		}
+		if _, ok := step["concurrency"]; ok {
+			return
+		}
+
+		queue := stepQueue(step)
+		if queue == "" {
+			queue = "default"
+		}
+
+		capacity, ok := p.QueueCapacity[queue]
+		if !ok || capacity <= 0 {
+			return
+		}
+
+		step["concurrency_group"] = "queue/" + queue
+		step["concurrency"] = capacity
+	})
+}
+
+// findUnusedEnvVars returns the variables set in the env block that no step
+// command references. Commands are checked before they're interpolated, and
+// escaped references like `$$FOO` count too as they're expanded at runtime.
+func findUnusedEnvVars(raw interface{}) []string {
+	pipelineMap, ok := raw.(map[string]interface{})
+	if !ok {
+		return []string{}
+	}
+	envMap, _ := pipelineMap["env"].(map[string]interface{})
+
+	used := map[string]bool{}
+	walkSteps(pipelineSteps(raw), "steps", func(path string, step map[string]interface{}) {
+		var commands []interface{}
+		for _, key := range []string{"command", "commands"} {
+			switch c := step[key].(type) {
+			case string:
+				commands = append(commands, c)
+			case []interface{}:
+				commands = append(commands, c...)
+			}
+		}
+		for _, command := range commands {
+			s, ok := command.(string)
+			if !ok {
+				continue
+			}
+			s = strings.NewReplacer(`$$`, `$`, `\$`, `$`).Replace(s)
+			for _, ref := range referencedVariables(s) {
+				used[ref] = true
+			}
+		}
+	})
+
+	unused := []string{}
+	for name := range envMap {
+		if !used[name] {
+			unused = append(unused, name)
+		}
+	}
+	sort.Strings(unused)
+
+	return unused
+}
+
+func (p PipelineParser) parseWithEnv() (interface{}, error) {
+	var pipeline yaml.MapSlice
+
+	// Initially we unmarshal this into a yaml.MapSlice so that we preserve the order of maps
+	if err := unmarshalYAML([]byte(p.Pipeline), &pipeline); err != nil {
+		return nil, err
+	}
+
+	// Secrets are resolved first, so that they can be used in the env block.
+	// The `secrets` key is only ours when there's a resolver, otherwise it's
+	// passed through untouched.
+	if item, ok := mapSliceItem("secrets", pipeline); ok && item.Value != nil && p.SecretResolver != nil {
+		if err := p.resolveSecretsBlock(item.Value); err != nil {
+			return nil, err
+		}
+	}
+
+	// Preprocess any env tat are defined in the top level block and place them into env for
+	// later interpolation into env blocks. Users don't always get the case of `env` right, so
+	// it's matched regardless of case, and keeps the key they used.
+	if item, ok := mapSliceItemCI("env", pipeline); ok {
+		envKey := item.Key.(string)
+		if envMap, ok := item.Value.(yaml.MapSlice); ok {
+			// Conditional values are resolved up front, so that the env
+			// block in the pipeline only has the values that were set
+			resolved, err := p.resolveEnvConditions(envMap)
+			if err != nil {
+				return nil, err
+			}
+			start := time.Now()
+			if err := p.interpolateEnvBlock(resolved); err != nil {
+				return nil, err
+			}
+			if p.stats != nil {
+				p.stats.interpolateDuration += time.Since(start)
+			}
+			pipeline = replaceMapSliceValue(pipeline, envKey, resolved)
+		} else if envFile, ok := item.Value.(string); ok && strings.HasPrefix(envFile, "$") {
+			envMap, err := p.loadEnvFile(envFile)
+			if err != nil {
+				return nil, err
+			}
+			pipeline = replaceMapSliceValue(pipeline, envKey, envMap)
+		} else {
+			return nil, fmt.Errorf("Expected pipeline top-level env block to be a map, got %T", item)
+		}
+	}
+
+	// Expand any steps that use templates or extend other steps, so that
+	// they're interpolated along with everything else
+	if p.ExpandTemplates {
+		expanded, err := expandTemplates(pipeline)
+		if err != nil {
+			return nil, err
+		}
+		pipeline = expanded
+	}
+	if p.ExpandExtends {
+		return expandExtends(pipeline)
+	}
+
+	return pipeline, nil
+}
+
+// loadEnvFile reads the env file at the path a top-level `env: $VAR` refers
+// to, and sets the KEY=VALUE pairs in it in the environment. It returns them
+// as an env block to replace the reference in the pipeline with, with any
+// $'s escaped as the values are used as is. If the file doesn't exist, a
+// warning is logged and an empty env block returned, unless interpolation
+// is strict.
+func (p PipelineParser) loadEnvFile(reference string) (yaml.MapSlice, error) {
+	path, err := p.interpolateString("env", reference)
+	if err != nil {
+		return nil, err
+	}
+
+	contents, err := p.readFile(path)
+	if err != nil && p.partialErrors != nil {
+		return p.unresolved("env", reference, err), nil
+	} else if os.IsNotExist(err) && !p.StrictInterpolation {
+		logger.Warn("The env file %q (from %s) doesn't exist", path, reference)
+		return yaml.MapSlice{}, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("Failed to read env file %q: %v", path, err)
+	}
+
+	envMap := yaml.MapSlice{}
+	for idx, line := range strings.Split(string(contents), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		parts := strings.SplitN(strings.TrimPrefix(line, "export "), "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			return nil, fmt.Errorf("Expected KEY=VALUE on line %d of env file %q", idx+1, path)
+		}
+
+		key, value := strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+		if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+			value = value[1 : len(value)-1]
+		}
+
+		p.Env.Set(key, value)
+		envMap = append(envMap, yaml.MapItem{Key: key, Value: strings.Replace(value, "$", "$$", -1)})
+	}
+
+	return envMap, nil
+}
+
+// ParseEnvBlock resolves just the top-level env block of a pipeline against a
+// base environment, without parsing the rest of the pipeline. It returns a
+// copy of the base environment with the pipeline's env vars added. If base is
+// nil, the current process's environment is used.
+func ParseEnvBlock(pipeline []byte, base *env.Environment) (*env.Environment, error) {
+	if base == nil {
+		base = env.FromSlice(os.Environ())
+	}
+
+	p := PipelineParser{Pipeline: pipeline, Env: base.Copy()}
+
+	// Pipelines that are just a list of steps don't have an env block
+	if p.IsSlice() {
+		return p.Env, nil
+	}
+
+	var parsed yaml.MapSlice
+	if err := unmarshalYAML(pipeline, &parsed); err != nil {
+		return nil, fmt.Errorf("Failed to parse pipeline: %v", parseYAMLError(err))
+	}
+
+	if item, ok := mapSliceItemCI("env", parsed); ok {
+		envMap, ok := item.Value.(yaml.MapSlice)
+		if !ok {
+			return nil, fmt.Errorf("Expected pipeline top-level env block to be a map, got %T", item.Value)
+		}
+		if err := p.interpolateEnvBlock(envMap); err != nil {
+			return nil, err
+		}
+	}
+
+	return p.Env, nil
+}
+
+func mapSliceItem(key string, s yaml.MapSlice) (yaml.MapItem, bool) {
+	for _, item := range s {
+		if k, ok := item.Key.(string); ok && k == key {
+			return item, true
+		}
+	}
+	return yaml.MapItem{}, false
+}
+
+// mapSliceItemCI is like mapSliceItem, but the key is matched regardless of
+// its case. The item has the key as it was in the pipeline.
+func mapSliceItemCI(key string, s yaml.MapSlice) (yaml.MapItem, bool) {
+	for _, item := range s {
+		if k, ok := item.Key.(string); ok && strings.EqualFold(k, key) {
+			return item, true
+		}
+	}
+	return yaml.MapItem{}, false
 }
 
-func (p PipelineParser) Parse() (interface{}, error) {
-	if p.Env == nil {
-		p.Env = env.FromSlice(os.Environ())
+// replaceMapSliceValue returns a copy of a yaml.MapSlice with the value of a
+// key replaced
+func replaceMapSliceValue(s yaml.MapSlice, key string, value interface{}) yaml.MapSlice {
+	replaced := make(yaml.MapSlice, 0, len(s))
+	for _, item := range s {
+		if k, ok := item.Key.(string); ok && k == key {
+			item.Value = value
+		}
+		replaced = append(replaced, item)
 	}
+	return replaced
+}
 
-	var errPrefix string
-	if p.Filename == "" {
-		errPrefix = "Failed to parse pipeline"
-	} else {
-		errPrefix = fmt.Sprintf("Failed to parse %s", p.Filename)
+func (p PipelineParser) interpolateEnvBlock(envMap yaml.MapSlice) error {
+	for _, item := range envMap {
+		if _, ok := item.Key.(string); !ok {
+			return fmt.Errorf("Unexpected type of %T for env block key %v", item.Key, item.Key)
+		}
 	}
 
-	// If interpolation is disabled, just parse and return
-	if p.NoInterpolation {
-		var result interface{}
-		if err := unmarshalAsStringMap([]byte(p.Pipeline), &result); err != nil {
-			return nil, fmt.Errorf("%s: %v", errPrefix, formatYAMLError(err))
+	envMap, err := p.resolveEnvConditions(envMap)
+	if err != nil {
+		return err
+	}
+
+	// Variables can reference others that are defined later in the block, so
+	// we process them in the order of their dependencies
+	sorted, err := sortEnvBlock(envMap)
+	if err != nil {
+		return err
+	}
+
+	for _, item := range sorted {
+		k := item.Key.(string)
+		value := item.Value
+
+		// Keys can use variables too, like `${SERVICE}_HOST`, and ones that
+		// can't be interpolated are skipped unless interpolation is strict
+		if strings.Contains(k, "$") && !p.skipInterpolation(joinPath("env", k)) {
+			interpolatedKey, err := p.interpolateString(joinPath("env", k), k)
+			if err != nil {
+				if p.StrictInterpolation {
+					return err
+				}
+				logger.Warn("Skipping env block key %q: %v", k, err)
+				continue
+			}
+			k = interpolatedKey
+		}
+
+		// Lists are joined into a single string, which is then interpolated
+		// like any other string value
+		if list, ok := value.([]interface{}); ok {
+			joined, err := p.joinEnvList(k, list)
+			if err != nil {
+				return err
+			}
+			value = joined
+		}
+
+		switch tv := value.(type) {
+		case string:
+			if p.skipInterpolation(joinPath("env", k)) {
+				p.Env.Set(k, tv)
+				continue
+			}
+			interpolated, err := p.interpolateString(joinPath("env", k), tv)
+			if err != nil {
+				return err
+			}
+			if p.EvalEnvArithmetic {
+				if interpolated, err = evalEnvArithmetic(joinPath("env", k), interpolated); err != nil {
+					return err
+				}
+			}
+			p.Env.Set(k, interpolated)
+
+		// Shells treat all env vars as strings, so values like `42` or `true`
+		// are set as their string representation, and ones without a value
+		// are empty
+		case int:
+			p.Env.Set(k, strconv.Itoa(tv))
+		case int64:
+			p.Env.Set(k, strconv.FormatInt(tv, 10))
+		case uint64:
+			p.Env.Set(k, strconv.FormatUint(tv, 10))
+		case bool:
+			p.Env.Set(k, strconv.FormatBool(tv))
+		case float64:
+			p.Env.Set(k, strconv.FormatFloat(tv, 'f', -1, 64))
+		case nil:
+			p.Env.Set(k, "")
 		}
-		return result, nil
 	}
+	return nil
+}
 
-	var pipeline interface{}
-	var pipelineAsSlice []interface{}
+// resolveEnvConditions returns a copy of an env block with any conditional
+// values, like `{if: 'BUILDKITE_BRANCH == "main"', value: "1"}`, replaced by
+// their value if the condition is true and removed if it isn't. Conditions
+// are evaluated against the environment before the block is applied.
+func (p PipelineParser) resolveEnvConditions(envMap yaml.MapSlice) (yaml.MapSlice, error) {
+	resolved := make(yaml.MapSlice, 0, len(envMap))
 
-	// Historically we support uploading just steps, so we parse it as either a
-	// slice, or if it's a map we need to do environment block processing
-	if err := yaml.Unmarshal([]byte(p.Pipeline), &pipelineAsSlice); err == nil {
-		pipeline = pipelineAsSlice
-	} else {
-		pipelineAsMap, err := p.parseWithEnv()
+	for _, item := range envMap {
+		conditional, ok := item.Value.(yaml.MapSlice)
+		if !ok {
+			resolved = append(resolved, item)
+			continue
+		}
+
+		condition, ok := mapSliceItem("if", conditional)
+		if !ok {
+			resolved = append(resolved, item)
+			continue
+		}
+
+		expr, ok := condition.Value.(string)
+		if !ok {
+			return nil, fmt.Errorf("Expected the condition of env block key %v to be a string, got %T", item.Key, condition.Value)
+		}
+
+		value, ok := mapSliceItem("value", conditional)
+		if !ok {
+			return nil, fmt.Errorf("Env block key %v has a condition without a value", item.Key)
+		}
+
+		pass, err := evalCondition(expr, p.Env)
 		if err != nil {
-			return nil, fmt.Errorf("%s: %v", errPrefix, formatYAMLError(err))
+			return nil, fmt.Errorf("Failed to evaluate the condition of env block key %v: %v", item.Key, err)
+		}
+		if pass {
+			resolved = append(resolved, yaml.MapItem{Key: item.Key, Value: value.Value})
 		}
-		pipeline = pipelineAsMap
 	}
 
-	// Recursively go through the entire pipeline and perform environment
-	// variable interpolation on strings
-	interpolated, err := p.interpolate(pipeline)
+	return resolved, nil
+}
+
+// joinEnvList joins the items of a list value in the env block with the
+// ListEnvSeparator
+func (p PipelineParser) joinEnvList(key string, list []interface{}) (string, error) {
+	separator := p.ListEnvSeparator
+	if separator == "" {
+		separator = ":"
+	}
+
+	items := make([]string, 0, len(list))
+	for _, item := range list {
+		switch tv := item.(type) {
+		case nil:
+			items = append(items, "")
+		case string:
+			items = append(items, tv)
+		case int:
+			items = append(items, strconv.Itoa(tv))
+		case bool:
+			items = append(items, strconv.FormatBool(tv))
+		case float64:
+			items = append(items, strconv.FormatFloat(tv, 'f', -1, 64))
+		default:
+			return "", fmt.Errorf("Unexpected type of %T in env block list %s", item, key)
+		}
+	}
+
+	return strings.Join(items, separator), nil
+}
+
+// circularEnvReferenceError is returned by sortEnvBlock when variables in the
+// env block reference each other
+type circularEnvReferenceError struct {
+	Keys []string
+}
+
+func (e circularEnvReferenceError) Error() string {
+	return fmt.Sprintf("Circular reference in env block between %s", strings.Join(e.Keys, ", "))
+}
+
+// sortEnvBlock orders the items in an env block so that each variable comes
+// after any others in the block that it references, otherwise keeping the
+// order they were declared in. A variable referencing itself refers to the
+// value from the environment (e.g. `PATH: "$PATH:/opt/bin"`), so it isn't
+// considered a dependency.
+func sortEnvBlock(envMap yaml.MapSlice) (yaml.MapSlice, error) {
+	declared := map[string]int{}
+	for idx, item := range envMap {
+		declared[item.Key.(string)] = idx
+	}
+
+	deps := make([]map[int]bool, len(envMap))
+	for idx, item := range envMap {
+		deps[idx] = map[int]bool{}
+		var values []interface{}
+		if list, ok := item.Value.([]interface{}); ok {
+			values = list
+		} else {
+			values = []interface{}{item.Value}
+		}
+		for _, value := range values {
+			s, ok := value.(string)
+			if !ok {
+				continue
+			}
+			for _, ref := range referencedVariables(s) {
+				if dep, ok := declared[ref]; ok && dep != idx {
+					deps[idx][dep] = true
+				}
+			}
+		}
+	}
+
+	sorted := make(yaml.MapSlice, 0, len(envMap))
+	done := make([]bool, len(envMap))
+
+	for len(sorted) < len(envMap) {
+		progressed := false
+
+		for idx, item := range envMap {
+			if done[idx] {
+				continue
+			}
+
+			ready := true
+			for dep := range deps[idx] {
+				if !done[dep] {
+					ready = false
+					break
+				}
+			}
+
+			if ready {
+				sorted = append(sorted, item)
+				done[idx] = true
+				progressed = true
+				break
+			}
+		}
+
+		if !progressed {
+			var cycle []string
+			for idx, item := range envMap {
+				if !done[idx] {
+					cycle = append(cycle, item.Key.(string))
+				}
+			}
+			return nil, circularEnvReferenceError{Keys: cycle}
+		}
+	}
+
+	return sorted, nil
+}
+
+// skipInterpolation returns whether the string at a path has been excluded
+// from interpolation with SkipInterpolationKeys
+func (p PipelineParser) skipInterpolation(path string) bool {
+	if len(p.SkipInterpolationKeys) == 0 || path == "" {
+		return false
+	}
+
+	segments := pathSegments(path)
+
+	for _, pattern := range p.SkipInterpolationKeys {
+		patternSegments := pathSegments(pattern)
+
+		// A bare key name matches that key at any depth
+		if len(patternSegments) == 1 {
+			if segments[len(segments)-1] == pattern {
+				return true
+			}
+			continue
+		}
+
+		if len(patternSegments) != len(segments) {
+			continue
+		}
+
+		matched := true
+		for i := range segments {
+			if patternSegments[i] != "*" && patternSegments[i] != segments[i] {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return true
+		}
+	}
+
+	return false
+}
+
+// interpolateString performs env interpolation on a single string, which is
+// at the given path in the pipeline
+func (p PipelineParser) interpolateString(path, str string) (string, error) {
+	original := str
+
+	// When reporting, unresolved variables are recorded rather than errors
+	strict := p.StrictInterpolation && p.report == nil
+
+	if p.SyntaxOnlyMode {
+		p.Env = placeholderEnv(str)
+	}
+
+	str, err := p.expandSecrets(str)
 	if err != nil {
-		return nil, err
+		return "", err
 	}
 
-	// Now we roundtrip this back into YAML bytes and back into a generic interface{}
-	// that works with all upstream code (which likes working with JSON). Specifically we
-	// need to convert the map[interface{}]interface{}'s that YAML likes into JSON compatible
-	// map[string]interface{}
-	b, err := yaml.Marshal(interpolated)
+	str = expandEnvNamespaces(p.EnvNamespaces, str)
+
+	if p.JSONEnvExpansion {
+		str, err = expandJSONPaths(p.Env, str, strict)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	str, err = expandTrimOperators(p.Env, str, strict)
 	if err != nil {
-		return nil, err
+		return "", err
 	}
 
-	var result interface{}
-	if err := unmarshalAsStringMap(b, &result); err != nil {
-		return nil, fmt.Errorf("%s: %v", errPrefix, formatYAMLError(err))
+	if p.stats != nil && strings.Contains(str, "$") {
+		p.stats.countRefs(p.Env, path, str)
 	}
 
-	return result, nil
-}
+	if strict || p.report != nil {
+		expr, err := interpolate.NewParser(str).Parse()
+		if err != nil {
+			return "", err
+		}
+		missing := missingVariables(p.Env, expr)
+		if len(missing) > 0 && strict {
+			return "", fmt.Errorf("$%s: not set", missing[0])
+		}
+		for _, name := range missing {
+			p.report.addUnresolved(UnresolvedVariable{Path: path, Variable: name})
+		}
+	}
 
-func (p PipelineParser) parseWithEnv() (interface{}, error) {
-	var pipeline yaml.MapSlice
+	interpolated, err := p.interpolator().Interpolate(p.Env, str)
+	if err != nil {
+		return "", err
+	}
 
-	// Initially we unmarshal this into a yaml.MapSlice so that we preserve the order of maps
-	if err := yaml.Unmarshal([]byte(p.Pipeline), &pipeline); err != nil {
-		return nil, err
+	if p.TraceWriter != nil {
+		for _, name := range referencedVariables(original) {
+			fmt.Fprintf(p.TraceWriter, "[TRACE] path=%s var=%s before=%q after=%q\n", path, name, original, interpolated)
+		}
 	}
 
-	// Preprocess any env tat are defined in the top level block and place them into env for
-	// later interpolation into env blocks
-	if item, ok := mapSliceItem("env", pipeline); ok {
-		if envMap, ok := item.Value.(yaml.MapSlice); ok {
-			if err := p.interpolateEnvBlock(envMap); err != nil {
-				return nil, err
+	if p.interpolations != nil && interpolated != original {
+		*p.interpolations++
+	}
+
+	if p.report != nil {
+		if refs := referencedVariables(original); len(refs) > 0 {
+			p.report.addSubstitution(InterpolationSubstitution{
+				Path:      path,
+				Original:  original,
+				Resolved:  interpolated,
+				Variables: refs,
+			})
+		}
+	}
+
+	return interpolated, nil
+}
+
+// missingVariables returns the names of any variables an expression would
+// expand that aren't set in the environment. Variables that are only used
+// with a default value aren't considered missing.
+func missingVariables(environ *env.Environment, expr interpolate.Expression) []string {
+	var missing []string
+
+	for _, item := range expr {
+		switch e := item.Expansion.(type) {
+		case interpolate.VariableExpansion:
+			if !environ.Exists(e.Identifier) {
+				missing = append(missing, e.Identifier)
+			}
+		case interpolate.SubstringExpansion:
+			if !environ.Exists(e.Identifier) {
+				missing = append(missing, e.Identifier)
+			}
+		case interpolate.EmptyValueExpansion:
+			if v, _ := environ.Get(e.Identifier); v == "" {
+				missing = append(missing, missingVariables(environ, e.Content)...)
+			}
+		case interpolate.UnsetValueExpansion:
+			if !environ.Exists(e.Identifier) {
+				missing = append(missing, missingVariables(environ, e.Content)...)
 			}
-		} else {
-			return nil, fmt.Errorf("Expected pipeline top-level env block to be a map, got %T", item)
 		}
 	}
 
-	return pipeline, nil
+	return missing
 }
 
-func mapSliceItem(key string, s yaml.MapSlice) (yaml.MapItem, bool) {
-	for _, item := range s {
-		if k, ok := item.Key.(string); ok && k == key {
-			return item, true
+// filterEnv returns a copy of an environment that only contains the keys
+// that match one of the allowed names or patterns
+func filterEnv(environ *env.Environment, allowed []string) *env.Environment {
+	filtered := env.New()
+
+	for k, v := range environ.ToMap() {
+		for _, pattern := range allowed {
+			if matched, _ := path.Match(pattern, k); matched || pattern == k {
+				filtered.Set(k, v)
+				break
+			}
 		}
 	}
-	return yaml.MapItem{}, false
+
+	return filtered
 }
 
-func (p PipelineParser) interpolateEnvBlock(envMap yaml.MapSlice) error {
+// YAMLError is an error from parsing a pipeline's YAML. Line and Column are 0
+// if the error message didn't include them.
+type YAMLError struct {
+	Line    int
+	Column  int
+	Message string
+}
+
+func (e *YAMLError) Error() string {
+	switch {
+	case e.Line > 0 && e.Column > 0:
+		return fmt.Sprintf("line %d, column %d: %s", e.Line, e.Column, e.Message)
+	case e.Line > 0:
+		return fmt.Sprintf("line %d: %s", e.Line, e.Message)
+	}
+	return e.Message
+}
+
+var yamlErrorPositionRegex = regexp.MustCompile(`(?s)^line (\d+)(?:, column (\d+))?: (.*)$`)
+
+// parseYAMLError returns the position and message of an error from the yaml
+// package, which look like `yaml: line 42: did not find expected key`
+func parseYAMLError(err error) *YAMLError {
+	message := strings.TrimPrefix(err.Error(), "yaml: ")
+
+	matches := yamlErrorPositionRegex.FindStringSubmatch(message)
+	if matches == nil {
+		return &YAMLError{Message: message}
+	}
+
+	line, _ := strconv.Atoi(matches[1])
+	column, _ := strconv.Atoi(matches[2])
+
+	return &YAMLError{Line: line, Column: column, Message: matches[3]}
+}
+
+// groupEnvBlock returns a copy of a group's env block with the values it
+// resolved to. Values that aren't strings are left as they are.
+func groupEnvBlock(envMap yaml.MapSlice, environ *env.Environment) yaml.MapSlice {
+	resolved := make(yaml.MapSlice, 0, len(envMap))
 	for _, item := range envMap {
-		k, ok := item.Key.(string)
-		if !ok {
-			return fmt.Errorf("Unexpected type of %T for env block key %v", item.Key, item.Key)
-		}
-		switch tv := item.Value.(type) {
-		case string:
-			interpolated, err := interpolate.Interpolate(p.Env, tv)
-			if err != nil {
-				return err
+		if _, ok := item.Value.(string); ok {
+			if value, exists := environ.Get(fmt.Sprint(item.Key)); exists {
+				item.Value = value
 			}
-			p.Env.Set(k, interpolated)
 		}
+		resolved = append(resolved, item)
 	}
-	return nil
+	return resolved
 }
 
-func formatYAMLError(err error) error {
-	return errors.New(strings.TrimPrefix(err.Error(), "yaml: "))
-}
+// envBlockValuePathRegex matches the paths of the values in the top-level
+// env block
+var envBlockValuePathRegex = regexp.MustCompile(`(?i)^env\.[^.\[]+$`)
+
+// stepPathRegex matches the paths of steps, including those in groups
+var stepPathRegex = regexp.MustCompile(`^(steps)?\[\d+\](\.steps\[\d+\])*$`)
+
+// pluginsPathRegex matches the paths of the plugins of each step, whether
+// they're a list of plugin maps or a single map
+var pluginsPathRegex = regexp.MustCompile(`^(steps)?\[\d+\](\.steps\[\d+\])*\.plugins(\[\d+\])?$`)
 
 // interpolate function inspired from: https://gist.github.com/hvoecking/10772475
 
@@ -149,7 +1709,7 @@ func (p PipelineParser) interpolate(obj interface{}) (interface{}, error) {
 	// Make a copy that we'll add the new values to
 	copy := reflect.New(original.Type()).Elem()
 
-	err := p.interpolateRecursive(copy, original)
+	err := p.interpolateRecursive(copy, original, "")
 	if err != nil {
 		return nil, err
 	}
@@ -158,7 +1718,17 @@ func (p PipelineParser) interpolate(obj interface{}) (interface{}, error) {
 	return copy.Interface(), nil
 }
 
-func (p PipelineParser) interpolateRecursive(copy, original reflect.Value) error {
+// contextErr returns the error of the parser's context, if it has one
+func (p PipelineParser) contextErr() error {
+	if p.Context == nil {
+		return nil
+	}
+	return p.Context.Err()
+}
+
+// interpolateRecursive interpolates original into copy. The path is where in
+// the pipeline original is, in the form of `steps[0].command`.
+func (p PipelineParser) interpolateRecursive(copy, original reflect.Value, path string) error {
 	switch original.Kind() {
 	// If it is a pointer we need to unwrap and call once again
 	case reflect.Ptr:
@@ -176,7 +1746,7 @@ func (p PipelineParser) interpolateRecursive(copy, original reflect.Value) error
 		copy.Set(reflect.New(originalValue.Type()))
 
 		// Unwrap the newly created pointer
-		err := p.interpolateRecursive(copy.Elem(), originalValue)
+		err := p.interpolateRecursive(copy.Elem(), originalValue, path)
 		if err != nil {
 			return err
 		}
@@ -194,21 +1764,44 @@ func (p PipelineParser) interpolateRecursive(copy, original reflect.Value) error
 			return nil
 		}
 
+		// A value of just `${PREFIX_*}` becomes a list of the matching env vars,
+		// which can only be done here as it changes the type of the value
+		if s, ok := originalValue.Interface().(string); ok && !p.skipInterpolation(path) {
+			environ := p.Env
+			if p.SyntaxOnlyMode {
+				environ = env.New()
+			}
+			seq, ok, err := expandSequence(environ, s, p.StrictInterpolation && !p.SyntaxOnlyMode)
+			if err != nil {
+				return err
+			}
+			if ok {
+				copy.Set(reflect.ValueOf(seq))
+				return nil
+			}
+		}
+
 		// Create a new object. Now new gives us a pointer, but we want the value it
 		// points to, so we have to call Elem() to unwrap it
 		copyValue := reflect.New(originalValue.Type()).Elem()
 
-		err := p.interpolateRecursive(copyValue, originalValue)
+		err := p.interpolateRecursive(copyValue, originalValue, path)
 		if err != nil {
 			return err
 		}
 
 		copy.Set(copyValue)
 
-	// If it is a struct we interpolate each field
+	// If it is a struct we interpolate each field. The yaml.MapItem's in a
+	// yaml.MapSlice are the entries of a map, so both their key and value are
+	// at the path of the key.
 	case reflect.Struct:
+		if item, ok := original.Interface().(yaml.MapItem); ok {
+			path = joinPath(path, fmt.Sprintf("%v", item.Key))
+		}
+
 		for i := 0; i < original.NumField(); i += 1 {
-			err := p.interpolateRecursive(copy.Field(i), original.Field(i))
+			err := p.interpolateRecursive(copy.Field(i), original.Field(i), path)
 			if err != nil {
 				return err
 			}
@@ -218,8 +1811,50 @@ func (p PipelineParser) interpolateRecursive(copy, original reflect.Value) error
 	case reflect.Slice:
 		copy.Set(reflect.MakeSlice(original.Type(), original.Len(), original.Cap()))
 
+		// A yaml.MapSlice is a map, so its items don't have an index in the path
+		mapSlice, isMapSlice := original.Interface().(yaml.MapSlice)
+
+		// Group steps can have their own env block, which is only used for
+		// the steps in that group
+		var groupEnv yaml.MapSlice
+		if isMapSlice && stepPathRegex.MatchString(path) {
+			if _, isGroup := mapSliceItem("steps", mapSlice); isGroup {
+				if item, ok := mapSliceItem("env", mapSlice); ok {
+					envMap, ok := item.Value.(yaml.MapSlice)
+					if !ok {
+						return fmt.Errorf("Expected %s.env to be a map, got %T", path, item.Value)
+					}
+					resolved, err := p.resolveEnvConditions(envMap)
+					if err != nil {
+						return err
+					}
+					p.Env = p.Env.Copy()
+					if err := p.interpolateEnvBlock(resolved); err != nil {
+						return err
+					}
+					groupEnv = groupEnvBlock(resolved, p.Env)
+				}
+			}
+		}
+
 		for i := 0; i < original.Len(); i += 1 {
-			err := p.interpolateRecursive(copy.Index(i), original.Index(i))
+			itemPath := path
+			if !isMapSlice {
+				itemPath = fmt.Sprintf("%s[%d]", path, i)
+			}
+
+			if err := p.contextErr(); err != nil {
+				return err
+			}
+
+			// The group's env block has already been interpolated, and doing
+			// it again would expand references to the outer values twice
+			if groupEnv != nil && mapSlice[i].Key == "env" {
+				copy.Index(i).Set(reflect.ValueOf(yaml.MapItem{Key: "env", Value: groupEnv}))
+				continue
+			}
+
+			err := p.interpolateRecursive(copy.Index(i), original.Index(i), itemPath)
 			if err != nil {
 				return err
 			}
@@ -230,18 +1865,29 @@ func (p PipelineParser) interpolateRecursive(copy, original reflect.Value) error
 		copy.Set(reflect.MakeMap(original.Type()))
 
 		for _, key := range original.MapKeys() {
+			if err := p.contextErr(); err != nil {
+				return err
+			}
+
 			originalValue := original.MapIndex(key)
+			valuePath := joinPath(path, fmt.Sprintf("%v", key.Interface()))
 
 			// New gives us a pointer, but again we want the value
 			copyValue := reflect.New(originalValue.Type()).Elem()
-			err := p.interpolateRecursive(copyValue, originalValue)
+			err := p.interpolateRecursive(copyValue, originalValue, valuePath)
 			if err != nil {
 				return err
 			}
 
-			// Also interpolate the key if it's a string
-			if key.Kind() == reflect.String {
-				interpolatedKey, err := interpolate.Interpolate(p.Env, key.Interface().(string))
+			// Also interpolate the key if it's a string. Keys of maps that
+			// can have any type of key are only interpolated if they're
+			// plugin names (e.g. `$PLUGIN_REGISTRY/my-plugin#v1`) and
+			// InterpolatePluginNames is set.
+			name, isString := key.Interface().(string)
+			interpolateKey := key.Kind() == reflect.String ||
+				(isString && p.InterpolatePluginNames && pluginsPathRegex.MatchString(path))
+			if interpolateKey && !p.skipInterpolation(valuePath) {
+				interpolatedKey, err := p.interpolateString(valuePath, name)
 				if err != nil {
 					return err
 				}
@@ -253,10 +1899,32 @@ func (p PipelineParser) interpolateRecursive(copy, original reflect.Value) error
 
 	// If it is a string interpolate it (yay finally we're doing what we came for)
 	case reflect.String:
-		interpolated, err := interpolate.Interpolate(p.Env, original.Interface().(string))
+		if p.skipInterpolation(path) {
+			copy.Set(original)
+			return nil
+		}
+
+		interpolated, err := p.interpolateString(path, original.Interface().(string))
+		if err != nil && p.LenientInterpolation {
+			*p.InterpolationErrors = append(*p.InterpolationErrors, InterpolationError{
+				Path:     path,
+				Original: original.Interface().(string),
+				Err:      err,
+			})
+			interpolated, err = "", nil
+		}
 		if err != nil {
 			return err
 		}
+
+		// The env block is evaluated the same way as when it was first
+		// processed, so that the pipeline has the same values
+		if p.EvalEnvArithmetic && envBlockValuePathRegex.MatchString(path) {
+			if interpolated, err = evalEnvArithmetic(path, interpolated); err != nil {
+				return err
+			}
+		}
+
 		copy.SetString(interpolated)
 
 	// And everything else will simply be taken from the original
@@ -267,13 +1935,25 @@ func (p PipelineParser) interpolateRecursive(copy, original reflect.Value) error
 	return nil
 }
 
+// unmarshalYAML is yaml.Unmarshal, but returns an error rather than
+// panicking on input it can't represent, like a map with a sequence as a key
+func unmarshalYAML(in []byte, out interface{}) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("yaml: %v", r)
+		}
+	}()
+
+	return yaml.Unmarshal(in, out)
+}
+
 // Unmarshal YAML to map[string]interface{} instead of map[interface{}]interface{}, such that
 // we can Marshal cleanly into JSON
 // Via https://github.com/go-yaml/yaml/issues/139#issuecomment-220072190
 func unmarshalAsStringMap(in []byte, out interface{}) error {
 	var res interface{}
 
-	if err := yaml.Unmarshal(in, &res); err != nil {
+	if err := unmarshalYAML(in, &res); err != nil {
 		return err
 	}
 	*out.(*interface{}) = cleanupMapValue(res)
@@ -303,7 +1983,7 @@ func cleanupMapValue(v interface{}) interface{} {
 		return cleanupInterfaceArray(v)
 	case map[interface{}]interface{}:
 		return cleanupInterfaceMap(v)
-	case nil, bool, string, int, float64:
+	case nil, bool, string, int, int64, uint64, float64:
 		return v
 	default:
 		panic("Unhandled map type " + fmt.Sprintf("%T", v))
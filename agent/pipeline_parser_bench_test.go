@@ -0,0 +1,95 @@
+package agent
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/buildkite/agent/env"
+)
+
+// benchmarkPipeline generates a pipeline with the given number of command
+// steps. Larger pipelines also have an env block, and steps that share their
+// agents and plugins with an anchor.
+func benchmarkPipeline(steps int, withAnchors bool) []byte {
+	var b strings.Builder
+
+	if withAnchors {
+		b.WriteString("env:\n")
+		b.WriteString("  IMAGE: node:${NODE_VERSION:-8}\n")
+		b.WriteString("  REGISTRY: docker.example.com\n")
+		b.WriteString("  TAG: $REGISTRY/app:$BUILDKITE_COMMIT\n")
+		b.WriteString("\n")
+		b.WriteString("base_step: &base_step\n")
+		b.WriteString("  agents:\n")
+		b.WriteString("    queue: ${QUEUE:-default}\n")
+		b.WriteString("  plugins:\n")
+		b.WriteString("    - docker#v3.0.0:\n")
+		b.WriteString("        image: $IMAGE\n")
+		b.WriteString("        environment: [BUILDKITE_BRANCH, BUILDKITE_COMMIT]\n")
+		b.WriteString("\n")
+	}
+
+	b.WriteString("steps:\n")
+	for i := 0; i < steps; i++ {
+		if withAnchors {
+			b.WriteString("  - <<: *base_step\n")
+			fmt.Fprintf(&b, "    label: \"Test %d on ${BUILDKITE_BRANCH}\"\n", i)
+		} else {
+			fmt.Fprintf(&b, "  - label: \"Test %d on ${BUILDKITE_BRANCH}\"\n", i)
+		}
+		fmt.Fprintf(&b, "    command: make test SHARD=%d COMMIT=${BUILDKITE_COMMIT:0:7}\n", i)
+		if withAnchors && i%10 == 0 {
+			b.WriteString("    env:\n")
+			fmt.Fprintf(&b, "      SHARD: \"%d\"\n", i)
+			b.WriteString("      ESCAPED: $$NOT_INTERPOLATED\n")
+		}
+		if i%25 == 24 {
+			b.WriteString("  - wait\n")
+		}
+	}
+
+	return []byte(b.String())
+}
+
+func benchmarkParse(b *testing.B, pipeline []byte) {
+	environ := env.FromSlice([]string{
+		"BUILDKITE_BRANCH=main",
+		"BUILDKITE_COMMIT=0123456789abcdef",
+	})
+
+	for _, noInterpolation := range []bool{false, true} {
+		name := "interpolation"
+		if noInterpolation {
+			name = "no interpolation"
+		}
+
+		b.Run(name, func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(len(pipeline)))
+
+			for i := 0; i < b.N; i++ {
+				_, err := PipelineParser{
+					Pipeline:        pipeline,
+					Env:             environ,
+					NoInterpolation: noInterpolation,
+				}.Parse()
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkPipelineParserSmall(b *testing.B) {
+	benchmarkParse(b, benchmarkPipeline(5, false))
+}
+
+func BenchmarkPipelineParserMedium(b *testing.B) {
+	benchmarkParse(b, benchmarkPipeline(50, true))
+}
+
+func BenchmarkPipelineParserLarge(b *testing.B) {
+	benchmarkParse(b, benchmarkPipeline(500, true))
+}
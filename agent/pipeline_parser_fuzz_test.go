@@ -0,0 +1,56 @@
+//go:build go1.18
+// +build go1.18
+
+package agent
+
+import (
+	"testing"
+
+	"github.com/buildkite/agent/env"
+)
+
+// fuzzPipelineSeeds are the pipelines used by the parser tests, which give
+// the fuzzer a head start on the shapes of input it's likely to see
+var fuzzPipelineSeeds = []string{
+	"",
+	"steps:\n  - command: \"hello world\"\n",
+	"- command: \"echo ${ENV_VAR_FRIEND}\"\n",
+	"steps:\n  - label: \"${ENV_VAR_FRIEND:-default}\"\n    command: echo $$ESCAPED\n",
+	"steps:\n  - command: \"${BUILDKITE_COMMIT:0:7}\"\n  - wait\n  - block: \"Deploy?\"\n",
+	"env:\n  ENV_VAR_FRIEND: \"friend\"\n  COMBINED: \"$ENV_VAR_FRIEND and $${ESCAPED}\"\nsteps:\n  - command: echo $COMBINED\n",
+	"base_step: &base_step\n  type: script\n  agent_query_rules: ['queue=default']\nsteps:\n  - <<: *base_step\n    name: Build\n  - *base_step\n",
+	"steps:\n  - group: \"Tests\"\n    steps:\n      - command: make test\n      - trigger: deploy\n",
+	"steps:\n  - command: \"echo {{matrix}}\"\n    matrix: [\"a\", \"b\"]\n",
+	"steps:\n  - command: test\n    plugins:\n      - docker#v3.0.0:\n          image: ${IMAGE:?not set}\n",
+	"{\"steps\":[{\"command\":\"echo ${FOO}\"}]}",
+	"- wait\n- ${",
+	"steps: !!map\n  ? [1, 2]\n  : &a [*a]\n",
+}
+
+func FuzzPipelineParse(f *testing.F) {
+	for _, seed := range fuzzPipelineSeeds {
+		f.Add([]byte(seed))
+	}
+	f.Add(benchmarkPipeline(3, false))
+	f.Add(benchmarkPipeline(11, true))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		for _, p := range []PipelineParser{
+			{},
+			{NoInterpolation: true},
+			{StrictInterpolation: true},
+		} {
+			// Only the input changes between runs, so nothing is read from
+			// stdin, the network or the environment of the test itself
+			p.Pipeline = data
+			p.Env = env.FromSlice([]string{
+				"ENV_VAR_FRIEND=friend",
+				"BUILDKITE_COMMIT=0123456789abcdef",
+			})
+
+			// Errors are fine, it's panics and exits we're looking for,
+			// which the fuzzer reports as failures by itself
+			_, _ = p.Parse()
+		}
+	})
+}
@@ -0,0 +1,119 @@
+package agent
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/buildkite/agent/env"
+)
+
+// DefaultPipelineExtensions are the file extensions NewPipelineParserFromFile
+// allows if the parser doesn't have AllowedExtensions
+var DefaultPipelineExtensions = []string{".yml", ".yaml", ".json", ".toml"}
+
+// ParserOption configures a PipelineParser created with NewPipelineParser
+type ParserOption func(*PipelineParser)
+
+// NewPipelineParser returns a PipelineParser for a pipeline, with an
+// environment built from a slice of KEY=VALUE strings like os.Environ()
+// returns
+func NewPipelineParser(pipeline []byte, environ []string, opts ...ParserOption) *PipelineParser {
+	p := &PipelineParser{
+		Pipeline:            pipeline,
+		Env:                 env.FromSlice(environ),
+		InterpolationErrors: &[]InterpolationError{},
+	}
+
+	for _, opt := range opts {
+		opt(p)
+	}
+
+	return p
+}
+
+// NewPipelineParserFromFile returns a PipelineParser for the pipeline in a
+// file, using the file's name in error messages. An error is returned if the
+// file can't be read, or doesn't have one of the allowed extensions.
+func NewPipelineParserFromFile(path string, environ *env.Environment, opts ...ParserOption) (*PipelineParser, error) {
+	p := &PipelineParser{
+		Filename:            filepath.Base(path),
+		Env:                 environ,
+		InterpolationErrors: &[]InterpolationError{},
+	}
+
+	for _, opt := range opts {
+		opt(p)
+	}
+
+	allowed := p.AllowedExtensions
+	if allowed == nil {
+		allowed = DefaultPipelineExtensions
+	}
+
+	ext := strings.ToLower(filepath.Ext(path))
+	supported := false
+	for _, a := range allowed {
+		if ext == strings.ToLower(a) {
+			supported = true
+			break
+		}
+	}
+	if !supported {
+		return nil, fmt.Errorf("Pipeline file %q must have one of the extensions %s", path, strings.Join(allowed, ", "))
+	}
+
+	pipeline, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	p.Pipeline = pipeline
+
+	return p, nil
+}
+
+// WithFilename sets the filename used in error messages
+func WithFilename(filename string) ParserOption {
+	return func(p *PipelineParser) {
+		p.Filename = filename
+	}
+}
+
+// WithNoInterpolation sets whether interpolation is disabled
+func WithNoInterpolation(noInterpolation bool) ParserOption {
+	return func(p *PipelineParser) {
+		p.NoInterpolation = noInterpolation
+	}
+}
+
+// WithStrictInterpolation sets whether interpolating a variable that isn't
+// set is an error
+func WithStrictInterpolation(strict bool) ParserOption {
+	return func(p *PipelineParser) {
+		p.StrictInterpolation = strict
+	}
+}
+
+// WithAllowedEnvKeys limits the env vars available for interpolation
+func WithAllowedEnvKeys(keys ...string) ParserOption {
+	return func(p *PipelineParser) {
+		p.AllowedEnvKeys = keys
+	}
+}
+
+// WithAllowedExtensions sets the file extensions NewPipelineParserFromFile
+// allows, instead of DefaultPipelineExtensions
+func WithAllowedExtensions(extensions ...string) ParserOption {
+	return func(p *PipelineParser) {
+		p.AllowedExtensions = extensions
+	}
+}
+
+// WithLenientInterpolation sets whether strings that fail to interpolate are
+// replaced with an empty string rather than being an error
+func WithLenientInterpolation(lenient bool) ParserOption {
+	return func(p *PipelineParser) {
+		p.LenientInterpolation = lenient
+	}
+}
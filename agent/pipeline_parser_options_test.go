@@ -0,0 +1,107 @@
+package agent
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/buildkite/agent/env"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewPipelineParser(t *testing.T) {
+	t.Parallel()
+
+	p := NewPipelineParser([]byte("steps:\n  - command: echo $FOO $BAR"), []string{"FOO=llamas", "BAR=alpacas", "INVALID"},
+		WithFilename("pipeline.yml"),
+		WithAllowedEnvKeys("FOO"),
+	)
+
+	assert.Equal(t, "pipeline.yml", p.Filename)
+	assert.Equal(t, []string{"BAR=alpacas", "FOO=llamas"}, p.Env.ToSlice())
+
+	j, err := p.ParseAndMarshal()
+	assert.NoError(t, err)
+	assert.Equal(t, `{"steps":[{"command":"echo llamas "}]}`, string(j))
+
+	_, err = NewPipelineParser([]byte("steps:\n  - command: echo $MISSING"), nil, WithStrictInterpolation(true)).Parse()
+	assert.EqualError(t, err, "$MISSING: not set")
+
+	j, err = NewPipelineParser([]byte("steps:\n  - command: echo $MISSING"), nil, WithNoInterpolation(true)).ParseAndMarshal()
+	assert.NoError(t, err)
+	assert.Equal(t, `{"steps":[{"command":"echo $MISSING"}]}`, string(j))
+}
+
+func TestNewPipelineParserFromFile(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "pipeline-parser")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, name := range []string{"pipeline.yml", "pipeline.YAML", "pipeline.json", "pipeline.txt"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte("steps:\n  - command: echo $FOO"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, name := range []string{"pipeline.yml", "pipeline.YAML", "pipeline.json"} {
+		p, err := NewPipelineParserFromFile(filepath.Join(dir, name), env.FromSlice([]string{"FOO=bar"}))
+		if assert.NoError(t, err, name) {
+			assert.Equal(t, name, p.Filename)
+
+			j, err := p.ParseAndMarshal()
+			assert.NoError(t, err)
+			assert.Equal(t, `{"steps":[{"command":"echo bar"}]}`, string(j))
+		}
+	}
+
+	_, err = NewPipelineParserFromFile(filepath.Join(dir, "pipeline.txt"), env.New())
+	assert.EqualError(t, err, fmt.Sprintf("Pipeline file %q must have one of the extensions .yml, .yaml, .json, .toml", filepath.Join(dir, "pipeline.txt")))
+
+	p, err := NewPipelineParserFromFile(filepath.Join(dir, "pipeline.txt"), env.New(), WithAllowedExtensions(".txt"), WithNoInterpolation(true))
+	if assert.NoError(t, err) {
+		assert.Equal(t, []string{".txt"}, p.AllowedExtensions)
+		assert.True(t, p.NoInterpolation)
+	}
+
+	_, err = NewPipelineParserFromFile(filepath.Join(dir, "missing.yml"), env.New())
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestNewPipelineParserWithLenientInterpolation(t *testing.T) {
+	t.Parallel()
+
+	p := NewPipelineParser([]byte("steps:\n  - command: echo ${FOO}\n  - command: echo ${BAR\n  - label: ${BAZ?}\n"), []string{"FOO=llamas"},
+		WithLenientInterpolation(true),
+	)
+
+	j, err := p.ParseAndMarshal()
+	assert.NoError(t, err)
+	assert.Equal(t, `{"steps":[{"command":"echo llamas"},{"command":""},{"label":""}]}`, string(j))
+
+	errs := p.Errors()
+	if assert.Len(t, errs, 2) {
+		assert.Equal(t, "steps[1].command", errs[0].Path)
+		assert.Equal(t, "echo ${BAR", errs[0].Original)
+		assert.Equal(t, "steps[2].label", errs[1].Path)
+		assert.Equal(t, "${BAZ?}", errs[1].Original)
+		assert.EqualError(t, errs[1], `Failed to interpolate steps[2].label ("${BAZ?}"): $BAZ: not set`)
+	}
+
+	// Without it, the first failure is returned
+	_, err = NewPipelineParser([]byte("steps:\n  - command: echo ${BAR\n"), nil).Parse()
+	assert.Error(t, err)
+
+	// Without InterpolationErrors there'd be nowhere to keep the errors
+	_, err = PipelineParser{
+		Pipeline:             []byte("steps:\n  - command: echo ${BAR\n"),
+		Env:                  env.New(),
+		LenientInterpolation: true,
+	}.Parse()
+	assert.EqualError(t, err, "LenientInterpolation needs InterpolationErrors to be set, or use NewPipelineParser")
+}
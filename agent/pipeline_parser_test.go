@@ -1,10 +1,19 @@
 package agent
 
 import (
+	"bytes"
+	"context"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/buildkite/agent/env"
 	"github.com/stretchr/testify/assert"
@@ -241,3 +250,1174 @@ func TestPipelineParserLoadsSystemEnvironment(t *testing.T) {
 		t.Fatalf("Unexpected: %q", decoded.Steps[0].Command)
 	}
 }
+
+func TestPipelineParserAnnotatesRateLimits(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		name     string
+		pipeline string
+		capacity map[string]int
+		expected string
+	}{
+		{
+			name:     "single queue",
+			pipeline: "steps:\n  - command: one\n    agents:\n      queue: deploy\n  - wait",
+			capacity: map[string]int{"deploy": 2},
+			expected: `{"steps":[{"agents":{"queue":"deploy"},"command":"one","concurrency":2,"concurrency_group":"queue/deploy"},"wait"]}`,
+		},
+		{
+			name:     "multiple queues",
+			pipeline: "steps:\n  - command: one\n    agents:\n      queue: deploy\n  - command: two\n    agents: [\"queue=test\"]\n  - command: three",
+			capacity: map[string]int{"deploy": 2, "test": 10, "default": 5},
+			expected: `{"steps":[{"agents":{"queue":"deploy"},"command":"one","concurrency":2,"concurrency_group":"queue/deploy"},{"agents":["queue=test"],"command":"two","concurrency":10,"concurrency_group":"queue/test"},{"command":"three","concurrency":5,"concurrency_group":"queue/default"}]}`,
+		},
+		{
+			name:     "missing queue capacity",
+			pipeline: "steps:\n  - command: one\n    agents:\n      queue: unknown\n  - command: two",
+			capacity: map[string]int{"deploy": 2},
+			expected: `{"steps":[{"agents":{"queue":"unknown"},"command":"one"},{"command":"two"}]}`,
+		},
+	} {
+		tc := tc
+		t.Run(tc.name, func(tt *testing.T) {
+			tt.Parallel()
+			result, err := PipelineParser{
+				Pipeline:           []byte(tc.pipeline),
+				AnnotateRateLimits: true,
+				QueueCapacity:      tc.capacity,
+			}.Parse()
+			assert.NoError(tt, err)
+			j, err := json.Marshal(result)
+			assert.NoError(tt, err)
+			assert.Equal(tt, tc.expected, string(j))
+		})
+	}
+}
+
+func TestPipelineParserStrictInterpolation(t *testing.T) {
+	t.Parallel()
+
+	environ := env.FromSlice([]string{`FRIEND=llamas`})
+	pipeline := "steps:\n  - command: \"echo ${FRIEND} ${ENEMY:-alpacas} $MISSING\""
+
+	_, err := PipelineParser{Pipeline: []byte(pipeline), Env: environ, StrictInterpolation: true}.Parse()
+	assert.EqualError(t, err, "$MISSING: not set")
+
+	result, err := PipelineParser{Pipeline: []byte(pipeline), Env: environ}.Parse()
+	assert.NoError(t, err)
+	j, err := json.Marshal(result)
+	assert.Equal(t, `{"steps":[{"command":"echo llamas alpacas "}]}`, string(j))
+}
+
+func TestPipelineParserAllowedEnvKeys(t *testing.T) {
+	t.Parallel()
+
+	environ := env.FromSlice([]string{`BUILDKITE_BRANCH=main`, `BUILDKITE_COMMIT=abc`, `SECRET=hunter2`})
+	pipeline := "env:\n  DEPLOY: \"yes\"\nsteps:\n  - command: \"deploy $BUILDKITE_BRANCH $BUILDKITE_COMMIT $DEPLOY $SECRET\""
+
+	result, err := PipelineParser{
+		Pipeline:       []byte(pipeline),
+		Env:            environ,
+		AllowedEnvKeys: []string{"BUILDKITE_*"},
+	}.Parse()
+	assert.NoError(t, err)
+	j, err := json.Marshal(result)
+	assert.Equal(t, `{"env":{"DEPLOY":"yes"},"steps":[{"command":"deploy main abc yes "}]}`, string(j))
+
+	_, err = PipelineParser{
+		Pipeline:            []byte(pipeline),
+		Env:                 environ,
+		AllowedEnvKeys:      []string{"BUILDKITE_BRANCH", "BUILDKITE_COMMIT"},
+		StrictInterpolation: true,
+	}.Parse()
+	assert.EqualError(t, err, "$SECRET: not set")
+
+	// The original environment is left untouched
+	assert.Equal(t, []string{`BUILDKITE_BRANCH=main`, `BUILDKITE_COMMIT=abc`, `SECRET=hunter2`}, environ.ToSlice())
+}
+
+func TestPipelineParserInterpolatesPluginNames(t *testing.T) {
+	t.Parallel()
+
+	environ := env.FromSlice([]string{`PLUGIN_REGISTRY=github.com/my-org`, `PLUGIN_VERSION=v1.2.0`})
+
+	result, err := PipelineParser{
+		Pipeline: []byte("steps:\n  - command: make\n    plugins:\n      - $PLUGIN_REGISTRY/docker-compose#${PLUGIN_VERSION}:\n          run: app\n      - $PLUGIN_REGISTRY/ping#master"),
+		Env:      environ,
+	}.Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var decoded struct {
+		Steps []struct {
+			Plugins json.RawMessage `json:"plugins"`
+		} `json:"steps"`
+	}
+	if err = decodeIntoStruct(&decoded, result); err != nil {
+		t.Fatal(err)
+	}
+
+	plugins, err := CreatePluginsFromJSON(string(decoded.Steps[0].Plugins))
+	assert.NoError(t, err)
+	if assert.Len(t, plugins, 2) {
+		assert.Equal(t, "github.com/my-org/docker-compose", plugins[0].Location)
+		assert.Equal(t, "v1.2.0", plugins[0].Version)
+		assert.Equal(t, map[string]interface{}{"run": "app"}, plugins[0].Configuration)
+		assert.Equal(t, "github.com/my-org/ping", plugins[1].Location)
+		assert.Equal(t, "master", plugins[1].Version)
+	}
+}
+
+func TestPipelineParserInterpolatePluginNamesInStepLists(t *testing.T) {
+	t.Parallel()
+
+	environ := env.FromSlice([]string{`PLUGIN_REGISTRY=github.com/my-org`, `APP=web`})
+	pipeline := []byte("- command: make\n  plugins:\n    - $PLUGIN_REGISTRY/docker-compose#v1.0.0:\n        run: $APP\n")
+
+	// Map keys in a list of steps are left alone by default
+	result, err := PipelineParser{Pipeline: pipeline, Env: environ}.Parse()
+	assert.NoError(t, err)
+	j, err := json.Marshal(result)
+	assert.NoError(t, err)
+	assert.Equal(t, `[{"command":"make","plugins":[{"$PLUGIN_REGISTRY/docker-compose#v1.0.0":{"run":"web"}}]}]`, string(j))
+
+	result, err = PipelineParser{Pipeline: pipeline, Env: environ, InterpolatePluginNames: true}.Parse()
+	assert.NoError(t, err)
+	j, err = json.Marshal(result)
+	assert.NoError(t, err)
+	assert.Equal(t, `[{"command":"make","plugins":[{"github.com/my-org/docker-compose#v1.0.0":{"run":"web"}}]}]`, string(j))
+}
+
+func TestPipelineParserParseAndMarshal(t *testing.T) {
+	t.Parallel()
+
+	environ := env.FromSlice([]string{`ENV_VAR_FRIEND=friend`})
+
+	j, err := PipelineParser{
+		Pipeline: []byte("steps:\n  - label: \"hello ${ENV_VAR_FRIEND}\"\n    command: echo\n    agents:\n      queue: default\n      os: linux"),
+		Env:      environ,
+	}.ParseAndMarshal()
+	assert.NoError(t, err)
+	assert.Equal(t, `{"steps":[{"agents":{"os":"linux","queue":"default"},"command":"echo","label":"hello friend"}]}`, string(j))
+
+	_, err = PipelineParser{Pipeline: []byte("steps: %blah%")}.ParseAndMarshal()
+	assert.Error(t, err)
+}
+
+func TestPipelineParserExtractsDocumentation(t *testing.T) {
+	t.Parallel()
+
+	var buf bytes.Buffer
+
+	_, err := PipelineParser{
+		Pipeline: []byte(`steps:
+  - label: ":hammer: Build"
+    command: make
+    metadata:
+      description: Builds the binaries
+  - command: make test
+    metadata:
+      description: |
+        Runs the test suite
+  - command: make lint
+  - group: Deploy
+    steps:
+      - key: deploy-prod
+        command: make deploy
+        metadata:
+          description: Deploys to production
+`),
+		ExtractDocumentation: true,
+		DocumentationWriter:  &buf,
+	}.Parse()
+	assert.NoError(t, err)
+
+	assert.Equal(t, "## :hammer: Build\n\nBuilds the binaries\n\n"+
+		"## steps[1]\n\nRuns the test suite\n\n"+
+		"## deploy-prod\n\nDeploys to production\n\n", buf.String())
+}
+
+func TestPipelineParserEnvBlockForwardReferences(t *testing.T) {
+	t.Parallel()
+
+	var pipeline = `{
+		"env": {
+			"HEADLINE": "${TEAM1} smashes ${TEAM2}",
+			"TEAM1": "${COUNTRY}",
+			"TEAM2": "Australia",
+			"COUNTRY": "England",
+			"PATH": "${PATH}:/opt/bin"
+		},
+		"steps": [{
+			"command": "echo ${HEADLINE} $PATH"
+		}]
+	}`
+
+	environ := env.FromSlice([]string{`PATH=/usr/bin`})
+
+	result, err := PipelineParser{Pipeline: []byte(pipeline), Env: environ}.Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var decoded struct {
+		Steps []struct {
+			Command string `json:"command"`
+		} `json:"steps"`
+	}
+	if err = decodeIntoStruct(&decoded, result); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, `echo England smashes Australia /usr/bin:/opt/bin`, decoded.Steps[0].Command)
+}
+
+func TestPipelineParserEnvBlockCircularReferences(t *testing.T) {
+	t.Parallel()
+
+	_, err := PipelineParser{
+		Pipeline: []byte("env:\n  FIRST: \"${SECOND}\"\n  OK: fine\n  SECOND: \"${THIRD:-$FIRST}\"\n  THIRD: \"$SECOND\"\n"),
+		Env:      env.New(),
+	}.Parse()
+	assert.EqualError(t, err, "Failed to parse pipeline: Circular reference in env block between FIRST, SECOND, THIRD")
+}
+
+func TestPipelineParserValidateUTF8(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		name     string
+		pipeline []byte
+		err      error
+	}{
+		{"valid", []byte("steps:\n  - label: \":llama: ✅ ünïcödé\""), nil},
+		{"bom", append([]byte("\xef\xbb\xbf"), "steps:\n  - command: make"...), nil},
+		{"invalid start byte", []byte("steps:\n  - command: \xff"), InvalidUTF8Error{Offset: 20}},
+		{"truncated sequence", []byte("steps: \xe2\x9c\n"), InvalidUTF8Error{Offset: 7}},
+		{"overlong encoding", []byte("\xc0\xaf"), InvalidUTF8Error{Offset: 0}},
+		{"surrogate half", []byte("steps: \xed\xa0\x80"), InvalidUTF8Error{Offset: 7}},
+	} {
+		tc := tc
+		t.Run(tc.name, func(tt *testing.T) {
+			tt.Parallel()
+			_, err := PipelineParser{Pipeline: tc.pipeline, ValidateUTF8: true}.Parse()
+			assert.Equal(tt, tc.err, err)
+		})
+	}
+
+	// The pipeline is checked as it's given, before anything else sees it
+	preprocessed := false
+	_, err := PipelineParser{
+		Pipeline:     []byte("steps:\n  - command: \xff"),
+		ValidateUTF8: true,
+		Preprocessor: func(filename string, content []byte) ([]byte, error) {
+			preprocessed = true
+			return content, nil
+		},
+	}.Parse()
+	assert.Equal(t, InvalidUTF8Error{Offset: 20}, err)
+	assert.False(t, preprocessed)
+
+	_, err = PipelineParser{Pipeline: []byte("[env]\nFOO = \"\xff\"\n"), Filename: "pipeline.toml", ValidateUTF8: true}.Parse()
+	assert.Equal(t, InvalidUTF8Error{Offset: 13}, err)
+}
+
+func TestPipelineParserSkipInterpolationKeys(t *testing.T) {
+	t.Parallel()
+
+	var pipeline = `env:
+  ARN: "arn:aws:iam::$ACCOUNT:role/$ROLE"
+  GREETING: "hello $NAME"
+steps:
+  - label: "$NAME"
+    command: "perl -e 'my $name = shift; print $name'"
+  - label: "${NAME}"
+    command: "echo $NAME"
+    env:
+      ARN: "$ROLE"
+`
+
+	result, err := PipelineParser{
+		Pipeline:              []byte(pipeline),
+		Env:                   env.FromSlice([]string{`NAME=llamas`, `ACCOUNT=1234`, `ROLE=admin`}),
+		SkipInterpolationKeys: []string{"ARN", "steps.0.command"},
+	}.Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	j, err := json.Marshal(result)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"env":{"ARN":"arn:aws:iam::$ACCOUNT:role/$ROLE","GREETING":"hello llamas"},"steps":[{"command":"perl -e 'my $name = shift; print $name'","label":"llamas"},{"command":"echo llamas","env":{"ARN":"$ROLE"},"label":"llamas"}]}`, string(j))
+}
+
+func TestPipelineParserEnvBlockTypedValues(t *testing.T) {
+	t.Parallel()
+
+	environ := env.New()
+
+	result, err := PipelineParser{
+		Pipeline: []byte("env:\n  MY_COUNT: 42\n  DEBUG: true\n  RATIO: 0.75\nsteps:\n  - command: \"run --count $MY_COUNT --debug $DEBUG --ratio $RATIO\""),
+		Env:      environ,
+	}.Parse()
+	assert.NoError(t, err)
+
+	j, err := json.Marshal(result)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"env":{"DEBUG":true,"MY_COUNT":42,"RATIO":0.75},"steps":[{"command":"run --count 42 --debug true --ratio 0.75"}]}`, string(j))
+}
+
+func TestPipelineParserEnvBlockUnquotedValues(t *testing.T) {
+	t.Parallel()
+
+	result, err := PipelineParser{
+		Pipeline:            []byte("env:\n  PORT: 8080\n  BIG: 18446744073709551615\n  TAGGED: !!str 0100\n  EMPTY:\n  NOTHING: null\nsteps:\n  - command: \"serve $PORT $BIG $TAGGED [$EMPTY$NOTHING]\""),
+		Env:                 env.New(),
+		StrictInterpolation: true,
+	}.Parse()
+	assert.NoError(t, err)
+
+	j, err := json.Marshal(result)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"env":{"BIG":18446744073709551615,"EMPTY":null,"NOTHING":null,"PORT":8080,"TAGGED":"0100"},"steps":[{"command":"serve 8080 18446744073709551615 0100 []"}]}`, string(j))
+}
+
+func TestPipelineParserFindUnusedEnvVars(t *testing.T) {
+	t.Parallel()
+
+	var unused []string
+
+	_, err := PipelineParser{
+		Pipeline: []byte(`env:
+  IMAGE: node:8
+  TARGET: production
+  VERBOSE: "true"
+steps:
+  - command: docker run $IMAGE
+  - commands:
+      - echo "deploying"
+      - make deploy TARGET=$$TARGET
+`),
+		Env:               env.FromSlice([]string{}),
+		FindUnusedEnvVars: true,
+		UnusedEnvVars:     &unused,
+	}.Parse()
+
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"VERBOSE"}, unused)
+
+	// The same are found without interpolation
+	unused = nil
+	_, err = PipelineParser{
+		Pipeline:          []byte("env:\n  IMAGE: node:8\n  TARGET: production\nsteps:\n  - command: docker run $IMAGE\n"),
+		Env:               env.FromSlice([]string{}),
+		NoInterpolation:   true,
+		FindUnusedEnvVars: true,
+		UnusedEnvVars:     &unused,
+	}.Parse()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"TARGET"}, unused)
+
+	// A list of steps has no env block
+	unused = nil
+	_, err = PipelineParser{
+		Pipeline:          []byte("- command: docker run $IMAGE\n"),
+		Env:               env.FromSlice([]string{}),
+		FindUnusedEnvVars: true,
+		UnusedEnvVars:     &unused,
+	}.Parse()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{}, unused)
+}
+
+func TestPipelineParserParseContext(t *testing.T) {
+	t.Parallel()
+
+	pipeline := []byte("steps:\n  - command: echo $FOO\n")
+	environ := env.FromSlice([]string{`FOO=bar`})
+
+	result, err := PipelineParser{Pipeline: pipeline, Env: environ}.ParseContext(context.Background())
+	assert.NoError(t, err)
+	j, err := json.Marshal(result)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"steps":[{"command":"echo bar"}]}`, string(j))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err = PipelineParser{Pipeline: pipeline, Env: environ}.ParseContext(ctx)
+	assert.Equal(t, context.Canceled, err)
+
+	ctx, cancel = context.WithTimeout(context.Background(), time.Nanosecond)
+	defer cancel()
+	<-ctx.Done()
+
+	_, err = PipelineParser{Pipeline: pipeline, Env: environ, Context: ctx}.Parse()
+	assert.Equal(t, context.DeadlineExceeded, err)
+}
+
+func TestPipelineParserSizeLimits(t *testing.T) {
+	t.Parallel()
+
+	pipeline := []byte("steps:\n  - command: one\n  - command: two\n  - command: three\n")
+
+	_, err := PipelineParser{Pipeline: pipeline, MaxPipelineBytes: len(pipeline), MaxSteps: 3}.Parse()
+	assert.NoError(t, err)
+
+	_, err = PipelineParser{Pipeline: pipeline, MaxPipelineBytes: 10}.Parse()
+	assert.Equal(t, PipelineSizeError{Unit: "bytes", Limit: 10, Actual: len(pipeline)}, err)
+
+	// The limit is on the pipeline that's given, not what it's turned into
+	_, err = PipelineParser{
+		Pipeline:         []byte("- wait\n"),
+		MaxPipelineBytes: 10,
+		Preprocessor: func(filename string, content []byte) ([]byte, error) {
+			return pipeline, nil
+		},
+	}.Parse()
+	assert.NoError(t, err)
+
+	_, err = PipelineParser{
+		Pipeline:         pipeline,
+		MaxPipelineBytes: 10,
+		Preprocessor: func(filename string, content []byte) ([]byte, error) {
+			return nil, errors.New("shouldn't be preprocessed")
+		},
+	}.Parse()
+	assert.Equal(t, PipelineSizeError{Unit: "bytes", Limit: 10, Actual: len(pipeline)}, err)
+
+	_, err = PipelineParser{Pipeline: pipeline, MaxSteps: 2}.Parse()
+	assert.Equal(t, PipelineSizeError{Unit: "steps", Limit: 2, Actual: 3}, err)
+	assert.EqualError(t, err, "Pipeline has 3 steps, which is more than the limit of 2")
+
+	_, err = PipelineParser{Pipeline: []byte("- one\n- two\n- three\n"), MaxSteps: 2}.Parse()
+	assert.Equal(t, PipelineSizeError{Unit: "steps", Limit: 2, Actual: 3}, err)
+
+	_, err = PipelineParser{Pipeline: pipeline, MaxSteps: 2, NoInterpolation: true}.Parse()
+	assert.Equal(t, PipelineSizeError{Unit: "steps", Limit: 2, Actual: 3}, err)
+}
+
+func TestPipelineParserBase64Pipeline(t *testing.T) {
+	t.Parallel()
+
+	pipeline := "steps:\n  - command: echo $FOO\n"
+	environ := env.FromSlice([]string{`FOO=bar`})
+
+	result, err := PipelineParser{
+		Pipeline:       []byte(base64.StdEncoding.EncodeToString([]byte(pipeline))),
+		Base64Pipeline: true,
+		Env:            environ,
+	}.Parse()
+	assert.NoError(t, err)
+	j, err := json.Marshal(result)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"steps":[{"command":"echo bar"}]}`, string(j))
+
+	_, sourceMap, err := PipelineParser{
+		Pipeline:       []byte(base64.StdEncoding.EncodeToString([]byte(pipeline))),
+		Base64Pipeline: true,
+		Env:            environ,
+		WithSourceMap:  true,
+	}.ParseWithSourceMap()
+	assert.NoError(t, err)
+	assert.Equal(t, SourceLocation{Line: 2, Column: 5}, (*sourceMap)["steps[0].command"])
+
+	_, err = PipelineParser{Pipeline: []byte("not base64!"), Base64Pipeline: true, Env: environ}.Parse()
+	assert.EqualError(t, err, "Failed to decode base64 pipeline: illegal base64 data at input byte 3")
+}
+
+func TestPipelineParserSanitizeInput(t *testing.T) {
+	t.Parallel()
+
+	var redactions []string
+
+	parser := &PipelineParser{
+		Pipeline:        []byte("steps:\n  - command: deploy --token t0ken --password hunter2 # hunter2\n"),
+		Env:             env.FromSlice([]string{"DEPLOY_TOKEN=t0ken", "DB_PASSWORD=hunter2", "EMPTY=", "TOKEN_PREFIX=t0"}),
+		RedactedEnvKeys: []string{"TOKEN_PREFIX", "DEPLOY_TOKEN", "DB_PASSWORD", "EMPTY", "UNSET"},
+		Redactions:      &redactions,
+	}
+	assert.NoError(t, parser.SanitizeInput())
+	assert.Equal(t, "steps:\n  - command: deploy --token [REDACTED] --password [REDACTED] # [REDACTED]\n", string(parser.Pipeline))
+	assert.Equal(t, []string{"hunter2", "t0ken"}, redactions)
+
+	result, err := parser.Parse()
+	assert.NoError(t, err)
+	j, err := json.Marshal(result)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"steps":[{"command":"deploy --token [REDACTED] --password [REDACTED]"}]}`, string(j))
+
+	parser = &PipelineParser{
+		Pipeline:        []byte(base64.StdEncoding.EncodeToString([]byte("steps:\n  - command: deploy hunter2\n"))),
+		Base64Pipeline:  true,
+		Env:             env.FromSlice([]string{"DB_PASSWORD=hunter2"}),
+		RedactedEnvKeys: []string{"DB_PASSWORD"},
+	}
+	assert.NoError(t, parser.SanitizeInput())
+	assert.Equal(t, "steps:\n  - command: deploy [REDACTED]\n", string(parser.Pipeline))
+	assert.False(t, parser.Base64Pipeline)
+
+	parser = &PipelineParser{Pipeline: []byte("not base64!"), Base64Pipeline: true}
+	assert.EqualError(t, parser.SanitizeInput(), "Failed to decode base64 pipeline: illegal base64 data at input byte 3")
+}
+
+func TestPipelineParserIsSlice(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		pipeline string
+		isSlice  bool
+	}{
+		{"- command: make", true},
+		{"# Steps\n---\n\n  - wait\n", true},
+		{"-\n  command: make", true},
+		{`[{"command": "make"}]`, true},
+		{"steps:\n  - command: make", false},
+		{`{"steps": []}`, false},
+		{"---\nsteps: []", false},
+		{"-not-a-list: true", false},
+		{"", false},
+	} {
+		assert.Equal(t, tc.isSlice, PipelineParser{Pipeline: []byte(tc.pipeline)}.IsSlice(), tc.pipeline)
+	}
+}
+
+func TestParseEnvBlock(t *testing.T) {
+	t.Parallel()
+
+	base := env.FromSlice([]string{`REGISTRY=docker.example.com`})
+
+	environ, err := ParseEnvBlock([]byte(`env:
+  IMAGE: $REGISTRY/app:$TAG
+  TAG: latest
+steps:
+  - command: $$NOT_INTERPOLATED
+`), base)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		"REGISTRY": "docker.example.com",
+		"IMAGE":    "docker.example.com/app:latest",
+		"TAG":      "latest",
+	}, environ.ToMap())
+
+	// The base environment isn't changed
+	assert.Equal(t, map[string]string{"REGISTRY": "docker.example.com"}, base.ToMap())
+
+	environ, err = ParseEnvBlock([]byte("- command: make"), base)
+	assert.NoError(t, err)
+	assert.Equal(t, base.ToMap(), environ.ToMap())
+
+	_, err = ParseEnvBlock([]byte("env: [nope]"), base)
+	assert.EqualError(t, err, "Expected pipeline top-level env block to be a map, got []interface {}")
+}
+
+func TestPipelineParserEnvBlockKeyCase(t *testing.T) {
+	t.Parallel()
+
+	for _, key := range []string{"env", "Env", "ENV"} {
+		result, err := PipelineParser{
+			Pipeline: []byte(key + ":\n  STAGE: production\nsteps:\n  - command: deploy $STAGE\n"),
+			Env:      env.FromSlice([]string{}),
+		}.Parse()
+		assert.NoError(t, err, key)
+
+		j, err := json.Marshal(result)
+		assert.NoError(t, err)
+		assert.Equal(t, `{"`+key+`":{"STAGE":"production"},"steps":[{"command":"deploy production"}]}`, string(j), key)
+
+		environ, err := ParseEnvBlock([]byte(key+":\n  STAGE: production\n"), env.FromSlice([]string{}))
+		assert.NoError(t, err, key)
+		assert.Equal(t, map[string]string{"STAGE": "production"}, environ.ToMap(), key)
+	}
+}
+
+func TestPipelineParserEnvBlockInterpolatedKeys(t *testing.T) {
+	t.Parallel()
+
+	pipeline := []byte(`env:
+  ${SERVICE}_HOST: payments.example.com
+  ${SERVICE}_URL: https://$${SERVICE}_HOST
+steps:
+  - command: curl $PAYMENTS_HOST
+`)
+
+	result, err := PipelineParser{Pipeline: pipeline, Env: env.FromSlice([]string{"SERVICE=PAYMENTS"})}.Parse()
+	assert.NoError(t, err)
+	j, err := json.Marshal(result)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"env":{"PAYMENTS_HOST":"payments.example.com","PAYMENTS_URL":"https://${SERVICE}_HOST"},"steps":[{"command":"curl payments.example.com"}]}`, string(j))
+
+	_, err = PipelineParser{Pipeline: pipeline, Env: env.FromSlice([]string{}), StrictInterpolation: true}.Parse()
+	assert.EqualError(t, err, "Failed to parse pipeline: $SERVICE: not set")
+
+	// Keys that can't be interpolated are skipped
+	environ, err := ParseEnvBlock([]byte("env:\n  \"${BROKEN_HOST\": nope\n  HOST: example.com\n"), env.FromSlice([]string{}))
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"HOST": "example.com"}, environ.ToMap())
+}
+
+func TestPipelineParserEnvBlockListValues(t *testing.T) {
+	t.Parallel()
+
+	pipeline := []byte(`env:
+  TAGS: [alpha, "$CHANNEL", 2]
+  CHANNEL: rc
+  EMPTY: []
+steps:
+  - command: echo $TAGS
+`)
+
+	result, err := PipelineParser{Pipeline: pipeline, Env: env.FromSlice([]string{})}.Parse()
+	assert.NoError(t, err)
+	j, err := json.Marshal(result)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"env":{"CHANNEL":"rc","EMPTY":[],"TAGS":["alpha","rc",2]},"steps":[{"command":"echo alpha:rc:2"}]}`, string(j))
+
+	environ := env.FromSlice([]string{})
+	_, err = PipelineParser{Pipeline: pipeline, Env: environ, ListEnvSeparator: ","}.Parse()
+	assert.NoError(t, err)
+	tags, _ := environ.Get("TAGS")
+	assert.Equal(t, "alpha,rc,2", tags)
+
+	_, err = PipelineParser{Pipeline: []byte("env:\n  BAD: [[nested]]\n"), Env: env.FromSlice([]string{})}.Parse()
+	assert.EqualError(t, err, "Failed to parse pipeline: Unexpected type of []interface {} in env block list BAD")
+}
+
+func TestPipelineParserReadsFromStdin(t *testing.T) {
+	t.Parallel()
+
+	pipeline := "steps:\n  - command: echo $FOO\n"
+	environ := env.FromSlice([]string{`FOO=bar`})
+
+	result, err := PipelineParser{Filename: "-", Env: environ, stdin: strings.NewReader(pipeline)}.Parse()
+	assert.NoError(t, err)
+	j, err := json.Marshal(result)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"steps":[{"command":"echo bar"}]}`, string(j))
+
+	// Only MaxPipelineBytes + 1 bytes are read
+	_, err = PipelineParser{Filename: "-", Env: environ, stdin: strings.NewReader(pipeline), MaxPipelineBytes: 10}.Parse()
+	assert.Equal(t, PipelineSizeError{Unit: "bytes", Limit: 10, Actual: 11}, err)
+
+	// A pipeline that's already been given isn't replaced
+	result, err = PipelineParser{Filename: "-", Env: environ, Pipeline: []byte("- wait"), stdin: strings.NewReader(pipeline)}.Parse()
+	assert.NoError(t, err)
+	assert.Equal(t, []interface{}{"wait"}, result)
+}
+
+func TestPipelineParserFetchesFromURL(t *testing.T) {
+	t.Parallel()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/pipeline.yml":
+			fmt.Fprint(w, "steps:\n  - command: echo $FOO\n")
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	environ := env.FromSlice([]string{`FOO=bar`})
+
+	result, err := PipelineParser{Filename: server.URL + "/pipeline.yml", Env: environ, HTTPClient: server.Client()}.Parse()
+	assert.NoError(t, err)
+	j, err := json.Marshal(result)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"steps":[{"command":"echo bar"}]}`, string(j))
+
+	// The default client is used if there isn't one
+	_, err = PipelineParser{Filename: server.URL + "/pipeline.yml", Env: environ}.Parse()
+	assert.NoError(t, err)
+
+	_, err = PipelineParser{Filename: server.URL + "/pipeline.yml", Env: environ, MaxPipelineBytes: 10}.Parse()
+	assert.EqualError(t, err, "Pipeline has 11 bytes, which is more than the limit of 10")
+
+	_, err = PipelineParser{Filename: server.URL + "/missing.yml", Env: environ}.Parse()
+	assert.EqualError(t, err, fmt.Sprintf("Failed to fetch pipeline from %s/missing.yml: 404 Not Found", server.URL))
+
+	// The Filename is just a name if there's a pipeline
+	result, err = PipelineParser{Filename: server.URL + "/missing.yml", Env: environ, Pipeline: []byte("- wait")}.Parse()
+	assert.NoError(t, err)
+	assert.Equal(t, []interface{}{"wait"}, result)
+}
+
+func TestPipelineParserPreprocessor(t *testing.T) {
+	t.Parallel()
+
+	preprocessor := func(filename string, content []byte) ([]byte, error) {
+		if bytes.Contains(content, []byte("{{ broken")) {
+			return nil, errors.New("unclosed action")
+		}
+		return bytes.Replace(content, []byte("{{ .Filename }}"), []byte(filename), -1), nil
+	}
+
+	result, err := PipelineParser{
+		Filename:     "pipeline.yml",
+		Pipeline:     []byte("steps:\n  - command: echo {{ .Filename }} $FOO\n"),
+		Env:          env.FromSlice([]string{"FOO=bar"}),
+		Preprocessor: preprocessor,
+	}.Parse()
+	assert.NoError(t, err)
+	j, err := json.Marshal(result)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"steps":[{"command":"echo pipeline.yml bar"}]}`, string(j))
+
+	// It's only called once, even when the pipeline is loaded again
+	calls := 0
+	_, _, err = PipelineParser{
+		Pipeline: []byte("- wait\n"),
+		Env:      env.New(),
+		Preprocessor: func(filename string, content []byte) ([]byte, error) {
+			calls++
+			return content, nil
+		},
+	}.ParseWithSourceMap()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, calls)
+
+	_, err = PipelineParser{
+		Filename:     "pipeline.yml",
+		Pipeline:     []byte("steps:\n  - command: echo {{ broken\n"),
+		Env:          env.New(),
+		Preprocessor: preprocessor,
+	}.Parse()
+	assert.EqualError(t, err, "Failed to preprocess pipeline.yml: unclosed action")
+
+	_, err = PipelineParser{
+		Pipeline:     []byte("steps:\n  - command: echo {{ broken\n"),
+		Env:          env.New(),
+		Preprocessor: preprocessor,
+	}.Parse()
+	assert.EqualError(t, err, "Failed to preprocess pipeline: unclosed action")
+}
+
+func TestPipelineParserParseCopy(t *testing.T) {
+	t.Parallel()
+
+	environ := env.FromSlice([]string{`FOO=bar`})
+	parser := PipelineParser{
+		Pipeline: []byte("env:\n  BAR: $FOO-baz\nsteps:\n  - command: echo $BAR\n"),
+		Env:      environ,
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			result, err := parser.ParseCopy()
+			assert.NoError(t, err)
+			j, err := json.Marshal(result)
+			assert.NoError(t, err)
+			assert.Equal(t, `{"env":{"BAR":"bar-baz"},"steps":[{"command":"echo bar-baz"}]}`, string(j))
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, map[string]string{"FOO": "bar"}, environ.ToMap())
+}
+
+func TestPipelineParserClone(t *testing.T) {
+	t.Parallel()
+
+	environ := env.FromSlice([]string{`FOO=bar`})
+	parser := NewPipelineParser([]byte("env:\n  BAR: $FOO-baz\nsteps:\n  - command: echo $BAR ${MISSING?}\n"), nil,
+		WithLenientInterpolation(true),
+	)
+	parser.Env = environ
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			clone := parser.Clone()
+			clone.Env.Set("FOO", fmt.Sprintf("bar%d", i))
+
+			result, err := clone.Parse()
+			assert.NoError(t, err)
+			j, err := json.Marshal(result)
+			assert.NoError(t, err)
+			assert.Equal(t, fmt.Sprintf(`{"env":{"BAR":"bar%d-baz"},"steps":[{"command":""}]}`, i), string(j))
+			assert.Len(t, clone.Errors(), 1)
+		}(i)
+	}
+	wg.Wait()
+
+	assert.Equal(t, map[string]string{"FOO": "bar"}, environ.ToMap())
+	assert.Len(t, parser.Errors(), 0)
+}
+
+func TestPipelineParserInterpolatesAgentsBlocks(t *testing.T) {
+	t.Parallel()
+
+	result, err := PipelineParser{
+		Pipeline: []byte(`agents:
+  queue: ${DEFAULT_QUEUE}
+steps:
+  - command: make
+    agents:
+      queue: ${DEPLOY_QUEUE}
+      tier: ${TIER}
+      cpus: 4
+      gpu: true
+      ${GPU_TAG}: true
+  - group: Tests
+    steps:
+      - command: make test
+        agents:
+          - queue=${DEPLOY_QUEUE}
+          - size=2
+`),
+		Env: env.FromSlice([]string{`DEFAULT_QUEUE=default`, `DEPLOY_QUEUE=deploy`, `TIER=3`, `GPU_TAG=nvidia`}),
+	}.Parse()
+	assert.NoError(t, err)
+
+	j, err := json.Marshal(result)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"agents":{"queue":"default"},"steps":[{"agents":{"cpus":4,"gpu":true,"nvidia":true,"queue":"deploy","tier":"3"},"command":"make"},{"group":"Tests","steps":[{"agents":["queue=deploy","size=2"],"command":"make test"}]}]}`, string(j))
+
+	// A pipeline that's just a list of steps keeps the types of its values too
+	result, err = PipelineParser{
+		Pipeline: []byte("- command: make\n  agents:\n    queue: ${DEPLOY_QUEUE}\n    cpus: 4\n    gpu: true\n"),
+		Env:      env.FromSlice([]string{`DEPLOY_QUEUE=deploy`}),
+	}.Parse()
+	assert.NoError(t, err)
+
+	j, err = json.Marshal(result)
+	assert.NoError(t, err)
+	assert.Equal(t, `[{"agents":{"cpus":4,"gpu":true,"queue":"deploy"},"command":"make"}]`, string(j))
+}
+
+func TestPipelineParserFilenameHeader(t *testing.T) {
+	t.Parallel()
+
+	_, err := PipelineParser{Pipeline: []byte("# pipeline: .buildkite/deploy.yml\nsteps: [\n")}.Parse()
+	assert.EqualError(t, err, "Failed to parse .buildkite/deploy.yml: line 2: did not find expected node content")
+
+	_, err = PipelineParser{Pipeline: []byte("# pipeline: .buildkite/deploy.yml\nsteps: [\n"), Filename: "pipeline.yml"}.Parse()
+	assert.EqualError(t, err, "Failed to parse pipeline.yml: line 2: did not find expected node content")
+
+	_, err = PipelineParser{Pipeline: []byte("steps: [\n# pipeline: .buildkite/deploy.yml\n")}.Parse()
+	assert.EqualError(t, err, "Failed to parse pipeline: line 2: did not find expected node content")
+
+	assert.Equal(t, "deploy.yml", pipelineFilenameHeader([]byte("#pipeline:deploy.yml")))
+	assert.Equal(t, "", pipelineFilenameHeader([]byte("# Deploys the app\n# pipeline: deploy.yml")))
+}
+
+func TestPipelineParserTraceWriter(t *testing.T) {
+	t.Parallel()
+
+	var trace bytes.Buffer
+
+	_, err := PipelineParser{
+		Pipeline:    []byte("steps:\n  - command: ${DEPLOY_ENV}_deploy $$ESCAPED\n    label: ${DEPLOY_ENV} ${REGION:-us}\n  - wait\n"),
+		Env:         env.FromSlice([]string{`DEPLOY_ENV=production`}),
+		TraceWriter: &trace,
+	}.Parse()
+	assert.NoError(t, err)
+
+	assert.Equal(t, `[TRACE] path=steps[0].command var=DEPLOY_ENV before="${DEPLOY_ENV}_deploy $$ESCAPED" after="production_deploy $ESCAPED"
+[TRACE] path=steps[0].label var=DEPLOY_ENV before="${DEPLOY_ENV} ${REGION:-us}" after="production us"
+[TRACE] path=steps[0].label var=REGION before="${DEPLOY_ENV} ${REGION:-us}" after="production us"
+`, trace.String())
+}
+
+func TestPipelineParserGroupEnvBlocks(t *testing.T) {
+	t.Parallel()
+
+	environ := env.FromSlice([]string{`REGION=us`})
+
+	result, err := PipelineParser{
+		Pipeline: []byte(`env:
+  APP: shop
+steps:
+  - group: Deploy
+    env:
+      TARGET: $APP-$REGION
+      REGION: eu
+    steps:
+      - command: deploy $TARGET
+      - group: Canary
+        env:
+          TARGET: $TARGET-canary
+        steps:
+          - command: deploy $TARGET
+  - command: echo $APP $REGION $TARGET
+`),
+		Env: environ,
+	}.Parse()
+	assert.NoError(t, err)
+
+	j, err := json.Marshal(result)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"env":{"APP":"shop"},"steps":[{"env":{"REGION":"eu","TARGET":"shop-eu"},"group":"Deploy","steps":[{"command":"deploy shop-eu"},{"env":{"TARGET":"shop-eu-canary"},"group":"Canary","steps":[{"command":"deploy shop-eu-canary"}]}]},{"command":"echo shop us "}]}`, string(j))
+
+	// Group env vars aren't set in the parser's environment
+	_, exists := environ.Get("TARGET")
+	assert.False(t, exists)
+}
+
+func TestParseYAMLError(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		err      string
+		expected YAMLError
+	}{
+		{"yaml: line 42: did not find expected key", YAMLError{Line: 42, Message: "did not find expected key"}},
+		{"yaml: line 3, column 7: mapping values are not allowed in this context", YAMLError{Line: 3, Column: 7, Message: "mapping values are not allowed in this context"}},
+		{"yaml: unmarshal errors:\n  line 2: cannot unmarshal !!str", YAMLError{Message: "unmarshal errors:\n  line 2: cannot unmarshal !!str"}},
+	} {
+		yamlErr := parseYAMLError(errors.New(tc.err))
+		assert.Equal(t, tc.expected, *yamlErr)
+		assert.Equal(t, strings.TrimPrefix(tc.err, "yaml: "), yamlErr.Error())
+	}
+}
+
+func TestPipelineParserReportsDuplicateKeys(t *testing.T) {
+	t.Parallel()
+
+	var duplicates []string
+	result, err := PipelineParser{
+		Pipeline: []byte(`steps:
+  - label: Greet
+    command: echo hello
+    command: echo goodbye
+    agents:
+      queue: default
+      queue: deploy
+steps:
+  - command: make
+`),
+		Env:                env.New(),
+		CheckDuplicateKeys: true,
+		DuplicateKeyHandler: func(key, path string) {
+			duplicates = append(duplicates, fmt.Sprintf("%s in %q", key, path))
+		},
+	}.Parse()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{`command in "steps[0]"`, `queue in "steps[0].agents"`, `steps in ""`}, duplicates)
+
+	j, err := json.Marshal(result)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"steps":[{"command":"make"}]}`, string(j))
+
+	duplicates = nil
+	_, err = PipelineParser{
+		Pipeline:           []byte("- command: echo hello\n  command: echo goodbye\n"),
+		Env:                env.New(),
+		CheckDuplicateKeys: true,
+		DuplicateKeyHandler: func(key, path string) {
+			duplicates = append(duplicates, fmt.Sprintf("%s in %q", key, path))
+		},
+	}.Parse()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{`command in "[0]"`}, duplicates)
+
+	// Keys in JSON and flow style maps are found too, but not lines that
+	// look like keys inside multi-line strings
+	for _, pipeline := range []string{
+		`{"steps": [{"command": "a", "command": "b"}]}`,
+		"steps:\n  - {command: a, command: b}\n",
+		"steps:\n  - label: \"Greet\n\n      label: again\"\n    command: a\n    command: b\n",
+	} {
+		duplicates = nil
+		_, err = PipelineParser{
+			Pipeline:           []byte(pipeline),
+			Env:                env.New(),
+			CheckDuplicateKeys: true,
+			DuplicateKeyHandler: func(key, path string) {
+				duplicates = append(duplicates, fmt.Sprintf("%s in %q", key, path))
+			},
+		}.Parse()
+		assert.NoError(t, err)
+		assert.Equal(t, []string{`command in "steps[0]"`}, duplicates, pipeline)
+	}
+
+	// Nothing is checked without CheckDuplicateKeys
+	duplicates = nil
+	_, err = PipelineParser{
+		Pipeline: []byte("- command: echo hello\n  command: echo goodbye\n"),
+		Env:      env.New(),
+		DuplicateKeyHandler: func(key, path string) {
+			duplicates = append(duplicates, fmt.Sprintf("%s in %q", key, path))
+		},
+	}.Parse()
+	assert.NoError(t, err)
+	assert.Empty(t, duplicates)
+}
+
+func TestPipelineParserConditionalEnvBlockValues(t *testing.T) {
+	t.Parallel()
+
+	pipeline := []byte(`env:
+  DEBUG:
+    if: BUILDKITE_BRANCH == 'main'
+    value: "1"
+  TARGET:
+    if: BUILDKITE_BRANCH != 'main' && BUILDKITE_TAG == ''
+    value: $BUILDKITE_BRANCH-preview
+  ALWAYS: set
+steps:
+  - group: Deploy
+    env:
+      CANARY:
+        if: BUILDKITE_BRANCH == "main"
+        value: true
+    steps:
+      - command: echo $DEBUG $TARGET $CANARY
+`)
+
+	for _, tc := range []struct {
+		env      []string
+		expected string
+	}{
+		{
+			env:      []string{"BUILDKITE_BRANCH=main"},
+			expected: `{"env":{"ALWAYS":"set","DEBUG":"1"},"steps":[{"env":{"CANARY":true},"group":"Deploy","steps":[{"command":"echo 1  true"}]}]}`,
+		},
+		{
+			env:      []string{"BUILDKITE_BRANCH=feature"},
+			expected: `{"env":{"ALWAYS":"set","TARGET":"feature-preview"},"steps":[{"env":{},"group":"Deploy","steps":[{"command":"echo  feature-preview "}]}]}`,
+		},
+		{
+			env:      []string{"BUILDKITE_BRANCH=feature", "BUILDKITE_TAG=v1"},
+			expected: `{"env":{"ALWAYS":"set"},"steps":[{"env":{},"group":"Deploy","steps":[{"command":"echo   "}]}]}`,
+		},
+	} {
+		result, err := PipelineParser{Pipeline: pipeline, Env: env.FromSlice(tc.env)}.Parse()
+		assert.NoError(t, err)
+
+		j, err := json.Marshal(result)
+		assert.NoError(t, err)
+		assert.Equal(t, tc.expected, string(j), strings.Join(tc.env, " "))
+	}
+
+	for _, tc := range []struct {
+		pipeline string
+		err      string
+	}{
+		{"env:\n  DEBUG:\n    if: FOO == 'bar'\n", "Failed to parse pipeline: Env block key DEBUG has a condition without a value"},
+		{"env:\n  DEBUG:\n    if: [FOO]\n    value: 1\n", "Failed to parse pipeline: Expected the condition of env block key DEBUG to be a string, got []interface {}"},
+		{"env:\n  DEBUG:\n    if: FOO == 'bar\n    value: 1\n", "Failed to parse pipeline: Failed to evaluate the condition of env block key DEBUG: unterminated string in condition"},
+	} {
+		_, err := PipelineParser{Pipeline: []byte(tc.pipeline), Env: env.New()}.Parse()
+		assert.EqualError(t, err, tc.err, tc.pipeline)
+	}
+}
+
+func TestPipelineParserEnvFile(t *testing.T) {
+	t.Parallel()
+
+	fs := mapFileSystem{
+		"ci/production.env": "# Production\nexport STAGE=production\nIMAGE=\"node:8\"\nPRICE='$5'\n\nURL=https://example.com/?a=b\n",
+		"ci/broken.env":     "STAGE\n",
+	}
+
+	result, err := PipelineParser{
+		Pipeline: []byte("env: ${CI_ENV_FILE}\nsteps:\n  - command: deploy $STAGE $IMAGE $URL\n"),
+		Env:      env.FromSlice([]string{"CI_ENV_FILE=ci/production.env"}),
+		FS:       fs,
+	}.Parse()
+	assert.NoError(t, err)
+
+	j, err := json.Marshal(result)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"env":{"IMAGE":"node:8","PRICE":"$5","STAGE":"production","URL":"https://example.com/?a=b"},"steps":[{"command":"deploy production node:8 https://example.com/?a=b"}]}`, string(j))
+
+	// A missing file is only an error with strict interpolation
+	result, err = PipelineParser{
+		Pipeline: []byte("env: $CI_ENV_FILE\nsteps:\n  - command: deploy\n"),
+		Env:      env.FromSlice([]string{"CI_ENV_FILE=ci/staging.env"}),
+		FS:       fs,
+	}.Parse()
+	assert.NoError(t, err)
+	j, err = json.Marshal(result)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"env":{},"steps":[{"command":"deploy"}]}`, string(j))
+
+	_, err = PipelineParser{
+		Pipeline:            []byte("env: $CI_ENV_FILE\nsteps:\n  - command: deploy\n"),
+		Env:                 env.FromSlice([]string{"CI_ENV_FILE=ci/staging.env"}),
+		FS:                  fs,
+		StrictInterpolation: true,
+	}.Parse()
+	assert.EqualError(t, err, `Failed to parse pipeline: Failed to read env file "ci/staging.env": file does not exist`)
+
+	_, err = PipelineParser{
+		Pipeline: []byte("env: $CI_ENV_FILE\nsteps:\n  - command: deploy\n"),
+		Env:      env.FromSlice([]string{"CI_ENV_FILE=ci/broken.env"}),
+		FS:       fs,
+	}.Parse()
+	assert.EqualError(t, err, `Failed to parse pipeline: Expected KEY=VALUE on line 1 of env file "ci/broken.env"`)
+}
+
+func TestMarshalToYAML(t *testing.T) {
+	t.Parallel()
+
+	parsed, err := PipelineParser{
+		Pipeline: []byte(`steps:
+  - command: make test
+    agents: {queue: test}
+    zzz: last
+    label: Test
+    key: test
+  - wait
+  - group: Deploy
+    steps:
+      - trigger: deploy
+        label: Deploy
+env:
+  FOO: bar
+`),
+		Env: env.New(),
+	}.Parse()
+	assert.NoError(t, err)
+
+	b, err := MarshalToYAML(parsed, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, `env:
+  FOO: bar
+steps:
+- key: test
+  label: Test
+  command: make test
+  agents:
+    queue: test
+  zzz: last
+- wait
+- group: Deploy
+  steps:
+  - label: Deploy
+    trigger: deploy
+`, string(b))
+
+	b, err = MarshalToYAML(parsed, []string{"steps", "command", "label"})
+	assert.NoError(t, err)
+	assert.Equal(t, `steps:
+- command: make test
+  label: Test
+  agents:
+    queue: test
+  key: test
+  zzz: last
+- wait
+- steps:
+  - label: Deploy
+    trigger: deploy
+  group: Deploy
+env:
+  FOO: bar
+`, string(b))
+}
+
+func TestPipelineParserReturnsErrorsForYAMLThatPanics(t *testing.T) {
+	t.Parallel()
+
+	_, err := PipelineParser{Pipeline: []byte("? [0]"), Env: env.New()}.Parse()
+	assert.EqualError(t, err, "Failed to parse pipeline: hash of unhashable type: []interface {}")
+}
@@ -0,0 +1,50 @@
+package agent
+
+import (
+	"fmt"
+
+	// This is a fork of gopkg.in/yaml.v2 that fixes anchors with MapSlice
+	yaml "github.com/buildkite/yaml"
+)
+
+// PartialError is a reference to a file outside the pipeline that couldn't be
+// resolved by ParsePartial
+type PartialError struct {
+	Path      string
+	Reference string
+	Err       error
+}
+
+func (e PartialError) Error() string {
+	return fmt.Sprintf("Failed to resolve %s (%q): %v", e.Path, e.Reference, e.Err)
+}
+
+// ParsePartial parses the pipeline like Parse, except that references to
+// files that can't be read don't stop it. Each one is returned as a
+// PartialError with the reason, so pipelines can be checked without all of
+// the files they need. Errors in the pipeline itself, like invalid YAML, are
+// still returned as an error.
+//
+// The only references to other files that pipelines have are env blocks
+// loaded from a file with `env: $VAR`, which are left empty if the file can't
+// be read. The reason isn't put in the env block, as everything in it is
+// exported to the build's steps.
+func (p PipelineParser) ParsePartial() (interface{}, []PartialError, error) {
+	partialErrors := []PartialError{}
+	p.partialErrors = &partialErrors
+
+	result, err := p.Parse()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return result, partialErrors, nil
+}
+
+// unresolved records an env block reference that couldn't be resolved when
+// parsing with ParsePartial, and returns the empty env block to use in its
+// place
+func (p PipelineParser) unresolved(path, reference string, err error) yaml.MapSlice {
+	*p.partialErrors = append(*p.partialErrors, PartialError{Path: path, Reference: reference, Err: err})
+	return yaml.MapSlice{}
+}
@@ -0,0 +1,52 @@
+package agent
+
+import (
+	"encoding/json"
+	"os"
+	"testing"
+
+	"github.com/buildkite/agent/env"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPipelineParserParsePartial(t *testing.T) {
+	t.Parallel()
+
+	result, partialErrors, err := PipelineParser{
+		Pipeline: []byte("env: $CI_ENV_FILE\nsteps:\n  - command: deploy $STAGE\n"),
+		Env:      env.FromSlice([]string{"CI_ENV_FILE=ci/staging.env"}),
+		FS:       mapFileSystem{},
+	}.ParsePartial()
+	assert.NoError(t, err)
+
+	j, err := json.Marshal(result)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"env":{},"steps":[{"command":"deploy "}]}`, string(j))
+
+	if assert.Len(t, partialErrors, 1) {
+		assert.Equal(t, "env", partialErrors[0].Path)
+		assert.Equal(t, "$CI_ENV_FILE", partialErrors[0].Reference)
+		assert.True(t, os.IsNotExist(partialErrors[0].Err))
+		assert.EqualError(t, partialErrors[0], `Failed to resolve env ("$CI_ENV_FILE"): file does not exist`)
+	}
+
+	// Files that can be read are used as usual
+	result, partialErrors, err = PipelineParser{
+		Pipeline: []byte("env: $CI_ENV_FILE\nsteps:\n  - command: deploy $STAGE\n"),
+		Env:      env.FromSlice([]string{"CI_ENV_FILE=ci/production.env"}),
+		FS:       mapFileSystem{"ci/production.env": "STAGE=production\n"},
+	}.ParsePartial()
+	assert.NoError(t, err)
+	assert.Empty(t, partialErrors)
+
+	j, err = json.Marshal(result)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"env":{"STAGE":"production"},"steps":[{"command":"deploy production"}]}`, string(j))
+
+	// Problems with the pipeline itself are still errors
+	_, _, err = PipelineParser{
+		Pipeline: []byte("steps: [\n"),
+		Env:      env.New(),
+	}.ParsePartial()
+	assert.Error(t, err)
+}
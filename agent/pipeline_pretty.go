@@ -0,0 +1,128 @@
+package agent
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	// This is a fork of gopkg.in/yaml.v2 that fixes anchors with MapSlice
+	yaml "github.com/buildkite/yaml"
+)
+
+// PrettyPrintPipeline serializes a parsed pipeline to YAML for people to read,
+// with each level indented by indent spaces and lists indented under their
+// keys. The keys of each map are in DefaultYAMLKeyOrder, followed by any
+// others sorted alphabetically. Pipelines that are just a list of steps are
+// put under a top-level `steps` key.
+func PrettyPrintPipeline(parsed interface{}, indent int) ([]byte, error) {
+	if indent < 2 || indent > 9 {
+		return nil, fmt.Errorf("Expected an indent between 2 and 9, got %d", indent)
+	}
+
+	if steps, ok := parsed.([]interface{}); ok {
+		parsed = map[string]interface{}{"steps": steps}
+	}
+
+	pp := prettyPrinter{pad: strings.Repeat(" ", indent)}
+	lines, _, err := pp.lines(orderYAMLKeys(parsed, yamlKeyRanks(DefaultYAMLKeyOrder)))
+	if err != nil {
+		return nil, err
+	}
+
+	return []byte(strings.Join(lines, "\n") + "\n"), nil
+}
+
+type prettyPrinter struct {
+	pad string
+}
+
+// blockScalarIndicatorRegex matches the indentation indicator of a block
+// scalar header like `|2-`
+var blockScalarIndicatorRegex = regexp.MustCompile(`^([|>])\d`)
+
+// lines returns the lines of a value, without any indentation of its own, and
+// whether the value has to start on the line after its key or list item
+func (pp prettyPrinter) lines(value interface{}) ([]string, bool, error) {
+	switch v := value.(type) {
+	case yaml.MapSlice:
+		if len(v) == 0 {
+			return []string{"{}"}, false, nil
+		}
+
+		var lines []string
+		for _, item := range v {
+			key, _, err := pp.lines(item.Key)
+			if err != nil {
+				return nil, false, err
+			}
+			if len(key) != 1 {
+				return nil, false, fmt.Errorf("Expected map key %v to fit on one line", item.Key)
+			}
+
+			valueLines, block, err := pp.lines(item.Value)
+			if err != nil {
+				return nil, false, err
+			}
+
+			if block {
+				lines = append(lines, key[0]+":")
+				lines = append(lines, pp.indent(valueLines)...)
+			} else {
+				lines = append(lines, key[0]+": "+valueLines[0])
+				lines = append(lines, pp.indent(valueLines[1:])...)
+			}
+		}
+		return lines, true, nil
+
+	case []interface{}:
+		if len(v) == 0 {
+			return []string{"[]"}, false, nil
+		}
+
+		var lines []string
+		for _, item := range v {
+			itemLines, block, err := pp.lines(item)
+			if err != nil {
+				return nil, false, err
+			}
+
+			if !block && len(itemLines) == 1 {
+				lines = append(lines, "- "+itemLines[0])
+				continue
+			}
+
+			// The first line of each item goes after the `-`, so that the
+			// rest line up with it
+			lines = append(lines, "-"+pp.pad[1:]+itemLines[0])
+			lines = append(lines, pp.indent(itemLines[1:])...)
+		}
+		return lines, true, nil
+	}
+
+	b, err := yaml.Marshal(value)
+	if err != nil {
+		return nil, false, err
+	}
+
+	// Block scalars and long strings that have been wrapped have their
+	// following lines indented by 2 spaces, which is replaced with our own
+	lines := strings.Split(strings.TrimSuffix(string(b), "\n"), "\n")
+	for idx := 1; idx < len(lines); idx++ {
+		lines[idx] = strings.TrimPrefix(lines[idx], "  ")
+	}
+	lines[0] = blockScalarIndicatorRegex.ReplaceAllString(lines[0], "${1}"+strconv.Itoa(len(pp.pad)))
+
+	return lines, false, nil
+}
+
+// indent indents each of the lines by one level, except for empty ones
+func (pp prettyPrinter) indent(lines []string) []string {
+	indented := make([]string, len(lines))
+	for idx, line := range lines {
+		if line != "" {
+			indented[idx] = pp.pad + line
+		}
+	}
+	return indented
+}
@@ -0,0 +1,90 @@
+package agent
+
+import (
+	"testing"
+
+	"github.com/buildkite/agent/env"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPrettyPrintPipeline(t *testing.T) {
+	t.Parallel()
+
+	parsed, err := PipelineParser{Pipeline: []byte(`env: {FOO: bar}
+steps:
+  - command:
+      - make test
+      - make lint
+    zzz: "yes"
+    label: Test
+    key: test
+    agents: {queue: test}
+    plugins:
+      - docker#v3.0.0: {image: node, environment: [A, B]}
+  - wait
+  - group: Deploy
+    steps:
+      - label: Deploy
+        command: "./deploy.sh\n  --force\n"
+        matrix: [[1, 2], []]
+`), Env: env.New()}.Parse()
+	assert.NoError(t, err)
+
+	b, err := PrettyPrintPipeline(parsed, 4)
+	assert.NoError(t, err)
+	assert.Equal(t, `env:
+    FOO: bar
+steps:
+    -   key: test
+        label: Test
+        command:
+            - make test
+            - make lint
+        plugins:
+            -   docker#v3.0.0:
+                    environment:
+                        - A
+                        - B
+                    image: node
+        agents:
+            queue: test
+        zzz: "yes"
+    - wait
+    -   group: Deploy
+        steps:
+            -   label: Deploy
+                command: |
+                    ./deploy.sh
+                      --force
+                matrix:
+                    -   - 1
+                        - 2
+                    - []
+`, string(b))
+
+	// It's the same pipeline once it's parsed again, whatever the indent
+	for _, indent := range []int{2, 4, 9} {
+		b, err := PrettyPrintPipeline(parsed, indent)
+		assert.NoError(t, err)
+
+		reparsed, err := PipelineParser{Pipeline: b, Env: env.New()}.Parse()
+		assert.NoError(t, err, string(b))
+		assert.Equal(t, parsed, reparsed, string(b))
+	}
+
+	// Block scalars that start with spaces need their indentation set
+	indented := map[string]interface{}{"steps": []interface{}{map[string]interface{}{"command": "  ./deploy.sh\nmore"}}}
+	b, err = PrettyPrintPipeline(indented, 3)
+	assert.NoError(t, err)
+	assert.Equal(t, "steps:\n   -  command: |3-\n           ./deploy.sh\n         more\n", string(b))
+	reparsed, err := PipelineParser{Pipeline: b, Env: env.New()}.Parse()
+	assert.NoError(t, err)
+	assert.Equal(t, indented, reparsed)
+
+	b, err = PrettyPrintPipeline([]interface{}{"wait"}, 2)
+	assert.NoError(t, err)
+	assert.Equal(t, "steps:\n  - wait\n", string(b))
+
+	_, err = PrettyPrintPipeline(parsed, 1)
+	assert.EqualError(t, err, "Expected an indent between 2 and 9, got 1")
+}
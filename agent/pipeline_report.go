@@ -0,0 +1,81 @@
+package agent
+
+import (
+	"os"
+
+	"github.com/buildkite/agent/env"
+)
+
+// InterpolationReport lists all of the interpolation that would happen when
+// parsing a pipeline
+type InterpolationReport struct {
+	Substitutions []InterpolationSubstitution
+	Unresolved    []UnresolvedVariable
+}
+
+// InterpolationSubstitution is a single string in a pipeline that references
+// env vars
+type InterpolationSubstitution struct {
+	// Where the string is in the pipeline, like `steps[0].command`
+	Path string
+
+	// The string before and after interpolation
+	Original string
+	Resolved string
+
+	// The variables referenced in the string
+	Variables []string
+}
+
+// UnresolvedVariable is a reference to an env var that isn't set, and that
+// doesn't have a default value
+type UnresolvedVariable struct {
+	Path     string
+	Variable string
+}
+
+// The env block is interpolated once when it's loaded and again along with
+// the rest of the pipeline, so we only keep the first of any duplicates
+
+func (r *InterpolationReport) addSubstitution(s InterpolationSubstitution) {
+	for _, existing := range r.Substitutions {
+		if existing.Path == s.Path && existing.Original == s.Original {
+			return
+		}
+	}
+	r.Substitutions = append(r.Substitutions, s)
+}
+
+func (r *InterpolationReport) addUnresolved(u UnresolvedVariable) {
+	for _, existing := range r.Unresolved {
+		if existing == u {
+			return
+		}
+	}
+	r.Unresolved = append(r.Unresolved, u)
+}
+
+// DryRun returns a report of the interpolation that parsing the pipeline
+// would do. Variables set in the pipeline's env block are tracked in a copy of
+// the environment, so p.Env isn't changed. Unlike Parse, variables that aren't
+// set are recorded in the report even if StrictInterpolation is enabled.
+func (p PipelineParser) DryRun() (*InterpolationReport, error) {
+	p, err := p.loadPipeline()
+	if err != nil {
+		return nil, err
+	}
+
+	if p.Env == nil {
+		p.Env = env.FromSlice(os.Environ())
+	}
+
+	p.Env = p.Env.Copy()
+	p.NoInterpolation = false
+	p.report = &InterpolationReport{}
+
+	if _, err := p.parse(); err != nil {
+		return nil, err
+	}
+
+	return p.report, nil
+}
@@ -0,0 +1,38 @@
+package agent
+
+import (
+	"testing"
+
+	"github.com/buildkite/agent/env"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPipelineParserDryRun(t *testing.T) {
+	t.Parallel()
+
+	environ := env.FromSlice([]string{`DEPLOY_ENV=production`})
+
+	report, err := PipelineParser{
+		Pipeline: []byte(`env:
+  TARGET: "${DEPLOY_ENV}_deploy"
+steps:
+  - label: static
+    command: "deploy $TARGET ${REGION} ${MISSING:-default}"
+`),
+		Env:                 environ,
+		StrictInterpolation: true,
+	}.DryRun()
+	assert.NoError(t, err)
+
+	assert.Equal(t, []InterpolationSubstitution{
+		{Path: "env.TARGET", Original: "${DEPLOY_ENV}_deploy", Resolved: "production_deploy", Variables: []string{"DEPLOY_ENV"}},
+		{Path: "steps[0].command", Original: "deploy $TARGET ${REGION} ${MISSING:-default}", Resolved: "deploy production_deploy  default", Variables: []string{"TARGET", "REGION", "MISSING"}},
+	}, report.Substitutions)
+
+	assert.Equal(t, []UnresolvedVariable{
+		{Path: "steps[0].command", Variable: "REGION"},
+	}, report.Unresolved)
+
+	// The env block didn't leak into the original environment
+	assert.Equal(t, []string{`DEPLOY_ENV=production`}, environ.ToSlice())
+}
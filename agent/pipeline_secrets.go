@@ -0,0 +1,113 @@
+package agent
+
+import (
+	"fmt"
+	"strings"
+
+	// This is a fork of gopkg.in/yaml.v2 that fixes anchors with MapSlice
+	yaml "github.com/buildkite/yaml"
+)
+
+// SecretResolver looks up secrets referenced in a pipeline with
+// `${SECRET{name}}`, such as from Vault or SSM
+type SecretResolver interface {
+	Resolve(name string) (string, error)
+}
+
+const secretPrefix = "${SECRET{"
+
+// expandSecrets replaces any `${SECRET{name}}`'s in a string with the secret
+// from the parser's SecretResolver, escaping any $'s in the secret so that
+// they aren't interpolated. Each secret is also added to Redactions.
+func (p PipelineParser) expandSecrets(str string) (string, error) {
+	if !strings.Contains(str, secretPrefix) {
+		return str, nil
+	}
+
+	return replaceEnvReferences(str, func(ref string) (string, int, error) {
+		if !strings.HasPrefix(ref, secretPrefix) {
+			return "", 0, nil
+		}
+		end := strings.Index(ref, "}}")
+		if end < 0 {
+			return "", 0, fmt.Errorf("Unterminated secret reference in %q", str)
+		}
+		name := ref[len(secretPrefix):end]
+		length := end + len("}}")
+
+		if p.SyntaxOnlyMode {
+			return "__" + name + "__", length, nil
+		}
+
+		if p.SecretResolver == nil {
+			return "", 0, fmt.Errorf("Can't resolve secret %q without a secret resolver", name)
+		}
+		secret, err := p.SecretResolver.Resolve(name)
+		if err != nil {
+			return "", 0, fmt.Errorf("Failed to resolve secret %q: %v", name, err)
+		}
+		if p.Redactions != nil && secret != "" {
+			p.addRedaction(secret)
+		}
+
+		return strings.Replace(secret, "$", "$$", -1), length, nil
+	})
+}
+
+// resolveSecretsBlock resolves each of the secrets in a top-level `secrets`
+// block, which is a list of `{name: db_password, env: DB_PASSWORD}`'s, with
+// the parser's SecretResolver and sets them in the environment so that the
+// rest of the pipeline can use them. `env` defaults to the secret's name.
+func (p PipelineParser) resolveSecretsBlock(block interface{}) error {
+	secrets, ok := block.([]interface{})
+	if !ok {
+		return fmt.Errorf("Expected pipeline top-level secrets block to be a list, got %T", block)
+	}
+
+	for idx, item := range secrets {
+		secretMap, ok := item.(yaml.MapSlice)
+		if !ok {
+			return fmt.Errorf("Expected secrets[%d] to be a map, got %T", idx, item)
+		}
+
+		name, _ := mapSliceValue("name", secretMap).(string)
+		if name == "" {
+			return fmt.Errorf("Expected secrets[%d] to have a name", idx)
+		}
+		envName, _ := mapSliceValue("env", secretMap).(string)
+		if envName == "" {
+			envName = name
+		}
+
+		if p.SyntaxOnlyMode {
+			p.Env.Set(envName, "__"+name+"__")
+			continue
+		}
+
+		if p.SecretResolver == nil {
+			return fmt.Errorf("Can't resolve secret %q without a secret resolver", name)
+		}
+		secret, err := p.SecretResolver.Resolve(name)
+		if err != nil {
+			return fmt.Errorf("Failed to resolve secret %q: %v", name, err)
+		}
+		if p.Redactions != nil && secret != "" {
+			p.addRedaction(secret)
+		}
+
+		p.Env.Set(envName, secret)
+	}
+
+	return nil
+}
+
+// addRedaction adds a secret to Redactions if it's not already there. The
+// env block is interpolated twice, so its secrets are resolved twice.
+func (p PipelineParser) addRedaction(secret string) {
+	for _, existing := range *p.Redactions {
+		if existing == secret {
+			return
+		}
+	}
+	*p.Redactions = append(*p.Redactions, secret)
+}
@@ -0,0 +1,104 @@
+package agent
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/buildkite/agent/env"
+	"github.com/stretchr/testify/assert"
+)
+
+type mapSecretResolver map[string]string
+
+func (m mapSecretResolver) Resolve(name string) (string, error) {
+	if secret, ok := m[name]; ok {
+		return secret, nil
+	}
+	return "", errors.New("not found")
+}
+
+func TestPipelineParserResolvesSecrets(t *testing.T) {
+	t.Parallel()
+
+	var redactions []string
+
+	result, err := PipelineParser{
+		Pipeline: []byte(`env:
+  DB_PASSWORD: ${SECRET{db_password}}
+steps:
+  - command: deploy --token ${SECRET{deploy_token}} --password $DB_PASSWORD
+  - command: echo $${SECRET{db_password}}
+`),
+		Env: env.FromSlice([]string{}),
+		SecretResolver: mapSecretResolver{
+			"db_password":  "hunter2",
+			"deploy_token": "t0k$n",
+		},
+		Redactions: &redactions,
+	}.Parse()
+	assert.NoError(t, err)
+
+	j, err := json.Marshal(result)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"env":{"DB_PASSWORD":"hunter2"},"steps":[{"command":"deploy --token t0k$n --password hunter2"},{"command":"echo ${SECRET{db_password}}"}]}`, string(j))
+	assert.Equal(t, []string{"hunter2", "t0k$n"}, redactions)
+}
+
+func TestPipelineParserSecretErrors(t *testing.T) {
+	t.Parallel()
+
+	pipeline := []byte("steps:\n  - command: echo ${SECRET{missing}}\n")
+
+	_, err := PipelineParser{Pipeline: pipeline, Env: env.FromSlice([]string{}), SecretResolver: mapSecretResolver{}}.Parse()
+	assert.EqualError(t, err, `Failed to resolve secret "missing": not found`)
+
+	_, err = PipelineParser{Pipeline: pipeline, Env: env.FromSlice([]string{})}.Parse()
+	assert.EqualError(t, err, `Can't resolve secret "missing" without a secret resolver`)
+}
+
+func TestPipelineParserSecretsBlock(t *testing.T) {
+	t.Parallel()
+
+	var redactions []string
+
+	pipeline := []byte(`secrets:
+  - name: db_password
+    env: DB_PASSWORD
+  - name: DEPLOY_TOKEN
+env:
+  DATABASE_URL: postgres://app:$DB_PASSWORD@db
+steps:
+  - command: deploy --token $DEPLOY_TOKEN
+`)
+
+	result, err := PipelineParser{
+		Pipeline: pipeline,
+		Env:      env.FromSlice([]string{}),
+		SecretResolver: mapSecretResolver{
+			"db_password":  "hunter2",
+			"DEPLOY_TOKEN": "t0k$n",
+		},
+		Redactions: &redactions,
+	}.Parse()
+	assert.NoError(t, err)
+
+	j, err := json.Marshal(result)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"env":{"DATABASE_URL":"postgres://app:hunter2@db"},"secrets":[{"env":"DB_PASSWORD","name":"db_password"},{"name":"DEPLOY_TOKEN"}],"steps":[{"command":"deploy --token t0k$n"}]}`, string(j))
+	assert.Equal(t, []string{"hunter2", "t0k$n"}, redactions)
+
+	// Without a resolver, the secrets block isn't ours to resolve
+	for _, secrets := range []string{"secrets: [FOO]", "secrets:\n  FOO: bar", "secrets:\n  - name: db_password"} {
+		result, err := PipelineParser{Pipeline: []byte(secrets + "\nsteps: [{command: make}]\n"), Env: env.FromSlice([]string{})}.Parse()
+		assert.NoError(t, err, secrets)
+		_, ok := result.(map[string]interface{})["secrets"]
+		assert.True(t, ok, secrets)
+	}
+
+	_, err = PipelineParser{Pipeline: pipeline, Env: env.FromSlice([]string{}), SecretResolver: mapSecretResolver{}}.Parse()
+	assert.EqualError(t, err, `Failed to parse pipeline: Failed to resolve secret "db_password": not found`)
+
+	_, err = PipelineParser{Pipeline: []byte("secrets:\n  - env: FOO\n"), Env: env.FromSlice([]string{}), SecretResolver: mapSecretResolver{}}.Parse()
+	assert.EqualError(t, err, `Failed to parse pipeline: Expected secrets[0] to have a name`)
+}
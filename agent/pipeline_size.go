@@ -0,0 +1,171 @@
+package agent
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"unicode/utf8"
+)
+
+// EstimateSize returns the size of a parsed pipeline as JSON, and an estimate
+// of its size once gzipped, without serializing it. The JSON size is exact
+// for the types Parse returns.
+//
+// The gzipped size is estimated from how repetitive the pipeline is. The
+// words in its strings that have already been seen compress to a fraction of
+// a back reference, new words to around half of their size (which is typical
+// for commands and labels), and the JSON punctuation to almost nothing.
+func EstimateSize(parsed interface{}) (int, int, error) {
+	e := &sizeEstimator{seen: map[string]bool{}}
+	if err := e.add(parsed); err != nil {
+		return 0, 0, err
+	}
+
+	return e.uncompressed, gzipOverhead + int(math.Ceil(e.compressed)), nil
+}
+
+const (
+	// The size of a gzip header and footer
+	gzipOverhead = 18
+
+	// The estimated compressed size of each byte of a word that hasn't been
+	// seen before, of each repeated word, and of each byte of punctuation
+	newWordRatio      = 0.55
+	repeatedWordBytes = 0.25
+	punctuationRatio  = 0.1
+)
+
+type sizeEstimator struct {
+	uncompressed int
+	compressed   float64
+	seen         map[string]bool
+}
+
+func (e *sizeEstimator) punctuation(n int) {
+	e.uncompressed += n
+	e.compressed += float64(n) * punctuationRatio
+}
+
+// text adds a string, which is split into words made up of letters and
+// numbers, and the individual characters between them
+func (e *sizeEstimator) text(s string) {
+	e.uncompressed += len(s)
+
+	for start := 0; start < len(s); {
+		end := start + 1
+		if isWordByte(s[start]) {
+			for end < len(s) && isWordByte(s[end]) {
+				end++
+			}
+		}
+
+		word := s[start:end]
+		if e.seen[word] {
+			e.compressed += repeatedWordBytes
+		} else {
+			e.seen[word] = true
+			e.compressed += float64(len(word)) * newWordRatio
+		}
+		start = end
+	}
+}
+
+func isWordByte(b byte) bool {
+	return b >= 'a' && b <= 'z' || b >= 'A' && b <= 'Z' || b >= '0' && b <= '9' || b == '_' || b >= 0x80
+}
+
+func (e *sizeEstimator) add(v interface{}) error {
+	switch tv := v.(type) {
+	case nil:
+		e.text("null")
+	case bool:
+		e.text(strconv.FormatBool(tv))
+	case int:
+		e.text(strconv.Itoa(tv))
+	case float64:
+		s, err := jsonFloat(tv)
+		if err != nil {
+			return err
+		}
+		e.text(s)
+	case string:
+		e.punctuation(2)
+		e.text(tv)
+		e.uncompressed += jsonEscapeBytes(tv)
+
+	case []interface{}:
+		e.punctuation(2)
+		for idx, item := range tv {
+			if idx > 0 {
+				e.punctuation(1)
+			}
+			if err := e.add(item); err != nil {
+				return err
+			}
+		}
+
+	case map[string]interface{}:
+		e.punctuation(2)
+		first := true
+		for key, value := range tv {
+			if !first {
+				e.punctuation(1)
+			}
+			first = false
+			if err := e.add(key); err != nil {
+				return err
+			}
+			e.punctuation(1)
+			if err := e.add(value); err != nil {
+				return err
+			}
+		}
+
+	default:
+		return fmt.Errorf("Unexpected type of %T in pipeline", v)
+	}
+
+	return nil
+}
+
+// jsonEscapeBytes returns how many more bytes a string takes up once it's
+// escaped by encoding/json
+func jsonEscapeBytes(s string) int {
+	extra := 0
+	for i := 0; i < len(s); {
+		r, size := utf8.DecodeRuneInString(s[i:])
+		switch {
+		case r == '"' || r == '\\' || r == '\n' || r == '\r' || r == '\t':
+			extra++
+		case r < 0x20 || r == '<' || r == '>' || r == '&':
+			// Escaped as \u00XX
+			extra += 5
+		case r == '\u2028' || r == '\u2029':
+			extra += 6 - size
+		case r == utf8.RuneError && size == 1:
+			// Replaced with the 3 byte replacement character
+			extra += 2
+		}
+		i += size
+	}
+	return extra
+}
+
+// jsonFloat formats a float the same way as encoding/json
+func jsonFloat(f float64) (string, error) {
+	if math.IsInf(f, 0) || math.IsNaN(f) {
+		return "", fmt.Errorf("Unsupported value %v in pipeline", f)
+	}
+
+	abs := math.Abs(f)
+	if abs != 0 && (abs < 1e-6 || abs >= 1e21) {
+		s := strconv.FormatFloat(f, 'e', -1, 64)
+		// Clean up e-09 to e-9
+		if n := len(s); n >= 4 && s[n-4] == 'e' && s[n-3] == '-' && s[n-2] == '0' {
+			s = s[:n-2] + s[n-1:]
+		}
+		return s, nil
+	}
+
+	return strconv.FormatFloat(f, 'f', -1, 64), nil
+}
@@ -0,0 +1,77 @@
+package agent
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/buildkite/agent/env"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEstimateSize(t *testing.T) {
+	t.Parallel()
+
+	var pipeline strings.Builder
+	pipeline.WriteString("env:\n  IMAGE: node:8\nsteps:\n")
+	for i := 0; i < 50; i++ {
+		fmt.Fprintf(&pipeline, "  - label: \":docker: Test shard %d\"\n", i)
+		fmt.Fprintf(&pipeline, "    command: \"docker run --rm -e SHARD=%d $$IMAGE yarn test --shard %d/50 && echo '<done>'\"\n", i, i)
+		pipeline.WriteString("    agents:\n      queue: test\n    retry:\n      automatic: true\n    timeout_in_minutes: 10\n    priority: 0.5\n")
+		pipeline.WriteString("    artifact_paths: [\"coverage/**/*\", \"junit.xml\"]\n    soft_fail: ~\n")
+	}
+
+	parsed, err := PipelineParser{Pipeline: []byte(pipeline.String()), Env: env.New()}.Parse()
+	assert.NoError(t, err)
+
+	j, err := json.Marshal(parsed)
+	assert.NoError(t, err)
+
+	var gzipped bytes.Buffer
+	w := gzip.NewWriter(&gzipped)
+	w.Write(j)
+	w.Close()
+
+	uncompressed, estimated, err := EstimateSize(parsed)
+	assert.NoError(t, err)
+	assert.Equal(t, len(j), uncompressed)
+
+	// The estimate should be in the right ballpark
+	ratio := float64(estimated) / float64(gzipped.Len())
+	assert.True(t, ratio > 0.5 && ratio < 2, fmt.Sprintf("estimated %d, actual %d", estimated, gzipped.Len()))
+}
+
+func TestEstimateSizeMatchesJSONEncoding(t *testing.T) {
+	t.Parallel()
+
+	for _, value := range []interface{}{
+		nil,
+		true,
+		42,
+		-1.5,
+		1e-7,
+		1e21,
+		"quotes \" and \\ and \n\t\r",
+		"html <b>&</b> \u2028 \x01 \xff ünïcode",
+		[]interface{}{},
+		map[string]interface{}{},
+		map[string]interface{}{"a<": []interface{}{1, "two", nil}, "b": map[string]interface{}{"c": false}},
+	} {
+		j, err := json.Marshal(value)
+		assert.NoError(t, err)
+
+		uncompressed, _, err := EstimateSize(value)
+		assert.NoError(t, err)
+		assert.Equal(t, len(j), uncompressed, string(j))
+	}
+
+	_, _, err := EstimateSize(map[string]interface{}{"a": []string{}})
+	assert.EqualError(t, err, "Unexpected type of []string in pipeline")
+
+	_, _, err = EstimateSize(math.Inf(1))
+	assert.EqualError(t, err, "Unsupported value +Inf in pipeline")
+}
@@ -0,0 +1,284 @@
+package agent
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	yaml3 "gopkg.in/yaml.v3"
+)
+
+// yamlSourceKey is the location of a mapping key or sequence item in the raw
+// pipeline source, along with any comments attached to it
+type yamlSourceKey struct {
+	// The path to the key, in the form of `steps[0].command`
+	Path string
+
+	// Whether this is a sequence item rather than a mapping key
+	Item bool
+
+	// The 1-based line and column the key starts at, or that an item's value
+	// starts at
+	Line   int
+	Column int
+
+	// A comment at the end of the line the key is on
+	InlineComment string
+
+	// Comment lines directly above the key (with no blank lines between)
+	HeadComment []string
+}
+
+// SourceLocation is a 1-based line and column in the pipeline source
+type SourceLocation struct {
+	Line   int
+	Column int
+}
+
+// SourceMap maps paths in a parsed pipeline (such as `steps[3].command`) to
+// where they were defined in the pipeline source
+type SourceMap map[string]SourceLocation
+
+// ParseWithSourceMap parses the pipeline, and if WithSourceMap is set also
+// returns the location in the source of each key and list item. The location
+// of a list item is where its value starts, rather than its `-`.
+//
+// Keys and items that come from an alias or a `<<` merge key aren't in the
+// source map, and neither is anything in a TOML pipeline.
+func (p PipelineParser) ParseWithSourceMap() (interface{}, *SourceMap, error) {
+	p, err := p.loadPipeline()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	result, err := p.Parse()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if !p.WithSourceMap {
+		return result, nil, nil
+	}
+
+	sourceMap := SourceMap{}
+	if p.TOML {
+		return result, &sourceMap, nil
+	}
+
+	keys, _, err := parseYAMLSource(p.Pipeline)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Failed to parse pipeline: %v", parseYAMLError(err))
+	}
+	for _, key := range keys {
+		sourceMap[key.Path] = SourceLocation{Line: key.Line, Column: key.Column}
+	}
+
+	return result, &sourceMap, nil
+}
+
+// YAMLComment is a comment in the pipeline source
+type YAMLComment struct {
+	// The 1-based line the comment is on
+	Line int
+
+	// The text of the comment, without the leading `#`
+	Text string
+
+	// The path of the key or list item the comment is attached to, either
+	// because it's on the same line or on the lines directly above it. It's
+	// empty for comments that aren't attached to anything.
+	ParentPath string
+}
+
+// ParseWithComments parses the pipeline, and if PreserveComments is set also
+// returns the comments in the source in the order they appear. TOML pipelines
+// don't have any.
+func (p PipelineParser) ParseWithComments() (interface{}, []YAMLComment, error) {
+	p, err := p.loadPipeline()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	result, err := p.Parse()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if !p.PreserveComments {
+		return result, nil, nil
+	}
+
+	if p.TOML {
+		return result, []YAMLComment{}, nil
+	}
+
+	_, comments, err := parseYAMLSource(p.Pipeline)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Failed to parse pipeline: %v", parseYAMLError(err))
+	}
+	return result, comments, nil
+}
+
+// yamlSource is the keys and list items in YAML source, along with its
+// comments, which are found by walking the nodes that yaml.v3 parses it to
+type yamlSource struct {
+	lines    []string
+	keys     []yamlSourceKey
+	comments []YAMLComment
+}
+
+// parseYAMLSource returns the location of each mapping key and sequence item
+// in YAML source, and all of its comments in the order they appear. The
+// buildkite/yaml fork doesn't keep comments or positions, so this is how we
+// recover them. Anything that comes from an alias or a `<<` merge key isn't
+// returned, as it isn't in the source where it's used.
+func parseYAMLSource(src []byte) ([]yamlSourceKey, []YAMLComment, error) {
+	var doc yaml3.Node
+	if err := yaml3.Unmarshal(src, &doc); err != nil {
+		return nil, nil, err
+	}
+
+	s := &yamlSource{lines: strings.Split(string(src), "\n")}
+	if len(doc.Content) > 0 {
+		// Comments at the start of the document that are followed by a
+		// blank line aren't attached to the first key
+		s.headComment(&doc, doc.Content[0].Line, "")
+		s.walk(doc.Content[0], "", nil)
+	}
+	s.footComment(&doc)
+
+	sort.SliceStable(s.comments, func(i, j int) bool {
+		return s.comments[i].Line < s.comments[j].Line
+	})
+
+	return s.keys, s.comments, nil
+}
+
+// walk adds the keys and items in a node. The comments directly above a list
+// item are attached to the item, and to its first key in itemHead too, as
+// that's the key they're above.
+func (s *yamlSource) walk(n *yaml3.Node, path string, itemHead []string) {
+	switch n.Kind {
+	case yaml3.MappingNode:
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			key, value := n.Content[i], n.Content[i+1]
+			if key.Kind != yaml3.ScalarNode || isStandardYAMLMergeKey(key) {
+				continue
+			}
+
+			keyPath := key.Value
+			if path != "" {
+				keyPath = path + "." + key.Value
+			}
+			s.add(keyPath, false, key, value)
+			if last := &s.keys[len(s.keys)-1]; i == 0 && len(last.HeadComment) == 0 {
+				last.HeadComment = itemHead
+			}
+			s.walk(value, keyPath, nil)
+		}
+
+	case yaml3.SequenceNode:
+		for idx, item := range n.Content {
+			itemPath := fmt.Sprintf("%s[%d]", path, idx)
+			s.add(itemPath, true, item, item)
+			s.walk(item, itemPath, s.keys[len(s.keys)-1].HeadComment)
+		}
+	}
+}
+
+// add adds the key or item at a node, with the comments on it and on its
+// value. The location of an item is where its value starts.
+func (s *yamlSource) add(path string, item bool, n, value *yaml3.Node) {
+	key := yamlSourceKey{
+		Path:        path,
+		Item:        item,
+		Line:        n.Line,
+		Column:      n.Column,
+		HeadComment: s.headComment(n, n.Line, path),
+	}
+
+	for _, c := range []*yaml3.Node{n, value} {
+		if c.LineComment != "" && key.InlineComment == "" && c.Line == n.Line {
+			key.InlineComment = commentText(c.LineComment)
+			s.comments = append(s.comments, YAMLComment{
+				Line:       s.findComment(c.LineComment, c.Line, 1),
+				Text:       key.InlineComment,
+				ParentPath: path,
+			})
+		}
+	}
+
+	s.footComment(n)
+	if value != n {
+		s.footComment(value)
+	}
+
+	s.keys = append(s.keys, key)
+}
+
+// headComment adds the comment lines above a node, and returns the ones
+// directly above it (with no blank lines between), which are attached to it
+func (s *yamlSource) headComment(n *yaml3.Node, line int, path string) []string {
+	if n.HeadComment == "" {
+		return nil
+	}
+
+	var attached []string
+	lines := strings.Split(n.HeadComment, "\n")
+	for i := len(lines) - 1; i >= 0; i-- {
+		if strings.TrimSpace(lines[i]) == "" {
+			path = ""
+			continue
+		}
+
+		line = s.findComment(lines[i], line-1, -1)
+		text := commentText(lines[i])
+		s.comments = append(s.comments, YAMLComment{Line: line, Text: text, ParentPath: path})
+		if path != "" {
+			attached = append([]string{text}, attached...)
+		}
+	}
+
+	return attached
+}
+
+// footComment adds the comment lines after a node, which aren't attached to
+// anything
+func (s *yamlSource) footComment(n *yaml3.Node) {
+	line := lastYAMLNodeLine(n)
+	for _, comment := range strings.Split(n.FootComment, "\n") {
+		if strings.TrimSpace(comment) != "" {
+			line = s.findComment(comment, line+1, 1)
+			s.comments = append(s.comments, YAMLComment{Line: line, Text: commentText(comment)})
+		}
+	}
+}
+
+// findComment returns the line that a comment is at the end of, searching
+// from a line in the given direction
+func (s *yamlSource) findComment(comment string, from, direction int) int {
+	comment = strings.TrimSpace(comment)
+	for line := from; line >= 1 && line <= len(s.lines); line += direction {
+		if strings.HasSuffix(strings.TrimRight(s.lines[line-1], " \t\r"), comment) {
+			return line
+		}
+	}
+	return from
+}
+
+// lastYAMLNodeLine returns the last line that a node or any of its children
+// start on
+func lastYAMLNodeLine(n *yaml3.Node) int {
+	line := n.Line
+	for _, c := range n.Content {
+		if l := lastYAMLNodeLine(c); l > line {
+			line = l
+		}
+	}
+	return line
+}
+
+// commentText returns the text of a comment without its leading `#`
+func commentText(comment string) string {
+	return strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(comment), "#"))
+}
@@ -0,0 +1,183 @@
+package agent
+
+import (
+	"testing"
+
+	"github.com/buildkite/agent/env"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseYAMLSource(t *testing.T) {
+	t.Parallel()
+
+	keys, _, err := parseYAMLSource([]byte(`# The pipeline
+env:
+  FOO: "bar # not a comment" # a comment
+
+steps:
+  - label: ":llama: Test"
+    command: |
+      echo "hello: world"
+      make test
+  -   wait # just wait
+  - trigger: deploy
+    build:
+      # What it's for
+      message: "Deploy" # the message
+  - {"quoted key": 1}
+`))
+	assert.NoError(t, err)
+
+	var paths, items []string
+	for _, key := range keys {
+		if key.Item {
+			items = append(items, key.Path)
+		} else {
+			paths = append(paths, key.Path)
+		}
+	}
+
+	assert.Equal(t, []string{
+		"env",
+		"env.FOO",
+		"steps",
+		"steps[0].label",
+		"steps[0].command",
+		"steps[2].trigger",
+		"steps[2].build",
+		"steps[2].build.message",
+		"steps[3].quoted key",
+	}, paths)
+
+	assert.Equal(t, []string{"steps[0]", "steps[1]", "steps[2]", "steps[3]"}, items)
+
+	assert.Equal(t, yamlSourceKey{Path: "env", Line: 2, Column: 1, HeadComment: []string{"The pipeline"}}, keys[0])
+	assert.Equal(t, "a comment", keys[1].InlineComment)
+	assert.Equal(t, yamlSourceKey{Path: "steps[0].command", Line: 7, Column: 5}, keys[5])
+	assert.Equal(t, yamlSourceKey{Path: "steps[1]", Item: true, Line: 10, Column: 7, InlineComment: "just wait"}, keys[6])
+	assert.Equal(t, yamlSourceKey{Path: "steps[2].build.message", Line: 14, Column: 7, InlineComment: "the message", HeadComment: []string{"What it's for"}}, keys[10])
+
+	_, _, err = parseYAMLSource([]byte("steps: [\n"))
+	assert.Error(t, err)
+}
+
+func TestPipelineParserParseWithSourceMap(t *testing.T) {
+	t.Parallel()
+
+	result, sourceMap, err := PipelineParser{Pipeline: []byte(`env:
+  FOO: bar
+
+steps:
+  - label: Build
+    command: make
+  - wait
+  - group: Deploy
+    steps:
+      - command: make deploy
+`), WithSourceMap: true}.ParseWithSourceMap()
+	assert.NoError(t, err)
+	assert.NotNil(t, result)
+
+	assert.Equal(t, SourceMap{
+		"env":                       {Line: 1, Column: 1},
+		"env.FOO":                   {Line: 2, Column: 3},
+		"steps":                     {Line: 4, Column: 1},
+		"steps[0]":                  {Line: 5, Column: 5},
+		"steps[0].label":            {Line: 5, Column: 5},
+		"steps[0].command":          {Line: 6, Column: 5},
+		"steps[1]":                  {Line: 7, Column: 5},
+		"steps[2]":                  {Line: 8, Column: 5},
+		"steps[2].group":            {Line: 8, Column: 5},
+		"steps[2].steps":            {Line: 9, Column: 5},
+		"steps[2].steps[0]":         {Line: 10, Column: 9},
+		"steps[2].steps[0].command": {Line: 10, Column: 9},
+	}, *sourceMap)
+
+	// Flow style YAML and JSON have locations too
+	_, sourceMap, err = PipelineParser{Pipeline: []byte(`{"steps": [{"command": "make"}]}`), WithSourceMap: true}.ParseWithSourceMap()
+	assert.NoError(t, err)
+	assert.Equal(t, SourceMap{
+		"steps":            {Line: 1, Column: 2},
+		"steps[0]":         {Line: 1, Column: 12},
+		"steps[0].command": {Line: 1, Column: 13},
+	}, *sourceMap)
+
+	// As do keys in multi-line strings that look like keys
+	_, sourceMap, err = PipelineParser{Pipeline: []byte("steps:\n  - command: \"echo\n      label: nope\"\n  - &step\n    label: Test\n  - *step\n"), WithSourceMap: true}.ParseWithSourceMap()
+	assert.NoError(t, err)
+	assert.Equal(t, SourceMap{
+		"steps":            {Line: 1, Column: 1},
+		"steps[0]":         {Line: 2, Column: 5},
+		"steps[0].command": {Line: 2, Column: 5},
+		"steps[1]":         {Line: 4, Column: 5},
+		"steps[1].label":   {Line: 5, Column: 5},
+		"steps[2]":         {Line: 6, Column: 5},
+	}, *sourceMap)
+
+	// Without WithSourceMap there's no source map
+	result, sourceMap, err = PipelineParser{Pipeline: []byte("steps:\n  - command: make\n")}.ParseWithSourceMap()
+	assert.NoError(t, err)
+	assert.NotNil(t, result)
+	assert.Nil(t, sourceMap)
+}
+
+func TestPipelineParserParseWithComments(t *testing.T) {
+	t.Parallel()
+
+	pipeline := `# The pipeline
+
+env:
+  # Where to deploy
+  TARGET: production # for now
+steps:
+  # Build first
+  - command: make # builds everything
+  - commands:
+      - make clean # tidy up
+      - make deploy
+    # Trailing
+
+# The end
+`
+
+	parser := PipelineParser{Pipeline: []byte(pipeline), Env: env.FromSlice([]string{})}
+
+	_, comments, err := parser.ParseWithComments()
+	assert.NoError(t, err)
+	assert.Nil(t, comments)
+
+	parser.PreserveComments = true
+	result, comments, err := parser.ParseWithComments()
+	assert.NoError(t, err)
+	assert.NotNil(t, result)
+	assert.Equal(t, []YAMLComment{
+		{Line: 1, Text: "The pipeline"},
+		{Line: 4, Text: "Where to deploy", ParentPath: "env.TARGET"},
+		{Line: 5, Text: "for now", ParentPath: "env.TARGET"},
+		{Line: 7, Text: "Build first", ParentPath: "steps[0]"},
+		{Line: 8, Text: "builds everything", ParentPath: "steps[0].command"},
+		{Line: 10, Text: "tidy up", ParentPath: "steps[1].commands[0]"},
+		{Line: 12, Text: "Trailing"},
+		{Line: 14, Text: "The end"},
+	}, comments)
+
+	// Comments are found in flow style YAML, but not in strings
+	parser.Pipeline = []byte(`steps:
+  # Only the last group is attached
+
+  # Quick
+  - {command: "echo '# not a comment'"} # says hello
+  - command: |
+      # Still not a comment
+      make
+    label: "a # b" # the label
+`)
+	_, comments, err = parser.ParseWithComments()
+	assert.NoError(t, err)
+	assert.Equal(t, []YAMLComment{
+		{Line: 2, Text: "Only the last group is attached"},
+		{Line: 4, Text: "Quick", ParentPath: "steps[0]"},
+		{Line: 5, Text: "says hello", ParentPath: "steps[0]"},
+		{Line: 9, Text: "the label", ParentPath: "steps[1].label"},
+	}, comments)
+}
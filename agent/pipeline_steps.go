@@ -0,0 +1,525 @@
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// FlatPipeline is a pipeline where all group steps have been expanded into
+// their child steps. Any top-level keys other than `steps` (such as `env`)
+// are kept in Keys.
+type FlatPipeline struct {
+	Steps []interface{}
+	Keys  map[string]interface{}
+}
+
+// FlattenPipeline takes the result of PipelineParser.Parse and recursively
+// replaces any group steps (steps that contain their own `steps` key) with
+// the steps they contain, returning a flat list of leaf steps
+func FlattenPipeline(parsed interface{}) ([]interface{}, error) {
+	flat, err := FlattenPipelineWithKeys(parsed)
+	if err != nil {
+		return nil, err
+	}
+	return flat.Steps, nil
+}
+
+// FlattenPipelineWithKeys is like FlattenPipeline, but returns the pipeline's
+// other top-level keys (such as `env`) along with the flat list of steps
+func FlattenPipelineWithKeys(parsed interface{}) (*FlatPipeline, error) {
+	flat := &FlatPipeline{Keys: map[string]interface{}{}}
+
+	var steps interface{}
+
+	switch p := parsed.(type) {
+	case []interface{}:
+		steps = p
+	case map[string]interface{}:
+		for k, v := range p {
+			if k == "steps" {
+				steps = v
+			} else {
+				flat.Keys[k] = v
+			}
+		}
+	default:
+		return nil, fmt.Errorf("Unexpected type of %T for pipeline", parsed)
+	}
+
+	if steps == nil {
+		return flat, nil
+	}
+
+	stepsSlice, ok := steps.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("Expected steps to be a list, got %T", steps)
+	}
+
+	// Groups are left out, as the steps in them are walked straight after
+	flat.Steps = []interface{}{}
+	err := walkStepList(stepsSlice, "steps", func(path string, step interface{}) error {
+		if stepMap, ok := step.(map[string]interface{}); ok {
+			if children, ok := stepMap["steps"]; ok {
+				if _, ok := children.([]interface{}); !ok {
+					return fmt.Errorf("Expected %s.steps to be a list, got %T", path, children)
+				}
+				return nil
+			}
+		}
+		flat.Steps = append(flat.Steps, step)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return flat, nil
+}
+
+// pipelineSteps returns the top-level steps of a parsed pipeline, which is
+// either a map with a `steps` key, or just a list of steps
+func pipelineSteps(pipeline interface{}) []interface{} {
+	switch p := pipeline.(type) {
+	case []interface{}:
+		return p
+	case map[string]interface{}:
+		if steps, ok := p["steps"].([]interface{}); ok {
+			return steps
+		}
+	}
+	return nil
+}
+
+// isGroupStep returns whether a step is a group step, either declared with a
+// `group` key or with `type: group`
+func isGroupStep(step map[string]interface{}) bool {
+	if _, ok := step["group"]; ok {
+		return true
+	}
+	return stepString(step, "type") == "group"
+}
+
+// stepString returns the string value of a key in a step, or an empty string
+// if it's missing or not a string
+func stepString(step map[string]interface{}, key string) string {
+	s, _ := step[key].(string)
+	return strings.TrimSpace(s)
+}
+
+// stepName returns a human readable name for a step, falling back to its
+// path if it has no label, name or key
+func stepName(path string, step map[string]interface{}) string {
+	for _, key := range []string{"label", "name", "group", "block", "input", "key"} {
+		if name := stepString(step, key); name != "" {
+			return name
+		}
+	}
+	return path
+}
+
+// isCommandStep returns whether a step runs a command
+func isCommandStep(step map[string]interface{}) bool {
+	for _, key := range []string{"command", "commands"} {
+		if _, ok := step[key]; ok {
+			return true
+		}
+	}
+	switch stepString(step, "type") {
+	case "script", "command", "commands":
+		return true
+	}
+	return false
+}
+
+// stepType returns the type of a step, which is one of `command`, `wait`,
+// `block`, `input`, `trigger` or `group`, or an empty string if it's not known
+func stepType(step interface{}) string {
+	switch s := step.(type) {
+	// Some steps can be given as just a string
+	case string:
+		switch s {
+		case "wait", "waiter":
+			return "wait"
+		case "block", "manual":
+			return "block"
+		case "input":
+			return "input"
+		}
+
+	case map[string]interface{}:
+		switch {
+		case isGroupStep(s) || s["steps"] != nil:
+			return "group"
+		case isCommandStep(s):
+			return "command"
+		case hasKeyOrType(s, "trigger"):
+			return "trigger"
+		case hasKeyOrType(s, "wait", "waiter"):
+			return "wait"
+		case hasKeyOrType(s, "block", "manual"):
+			return "block"
+		case hasKeyOrType(s, "input"):
+			return "input"
+		}
+	}
+
+	return ""
+}
+
+// hasKeyOrType returns whether a step has one of the keys, or a `type` of one
+// of them
+func hasKeyOrType(step map[string]interface{}, keys ...string) bool {
+	t := stepString(step, "type")
+	for _, key := range keys {
+		if _, ok := step[key]; ok || t == key {
+			return true
+		}
+	}
+	return false
+}
+
+// stepQueue returns the queue a step targets, either from an `agents` map or
+// from a list of `queue=name` agent rules
+func stepQueue(step map[string]interface{}) string {
+	switch agents := step["agents"].(type) {
+	case map[string]interface{}:
+		return stepString(agents, "queue")
+	case []interface{}:
+		for _, rule := range agents {
+			if s, ok := rule.(string); ok && strings.HasPrefix(s, "queue=") {
+				return strings.TrimPrefix(s, "queue=")
+			}
+		}
+	}
+	return ""
+}
+
+// stepPlugins returns the locations of the plugins used by a step (such as
+// `docker-compose#v1.0.0`), which can either be a list of plugins or a map
+func stepPlugins(step map[string]interface{}) []string {
+	var locations []string
+
+	switch plugins := step["plugins"].(type) {
+	case []interface{}:
+		for _, plugin := range plugins {
+			switch p := plugin.(type) {
+			case string:
+				locations = append(locations, p)
+			case map[string]interface{}:
+				for location := range p {
+					locations = append(locations, location)
+				}
+			}
+		}
+	case map[string]interface{}:
+		for location := range plugins {
+			locations = append(locations, location)
+		}
+	}
+
+	return locations
+}
+
+// normalizeLabels removes leading and trailing emoji from the labels of all
+// of the steps in a pipeline
+func normalizeLabels(pipeline interface{}) {
+	walkSteps(pipelineSteps(pipeline), "steps", func(path string, step map[string]interface{}) {
+		for _, key := range []string{"label", "name"} {
+			if label, ok := step[key].(string); ok {
+				step[key] = normalizeLabel(label)
+			}
+		}
+	})
+}
+
+var (
+	leadingEmojiShortcodeRegex  = regexp.MustCompile(`^:[a-zA-Z0-9_+-]+:`)
+	trailingEmojiShortcodeRegex = regexp.MustCompile(`:[a-zA-Z0-9_+-]+:$`)
+)
+
+// normalizeLabel removes any emoji shortcodes like `:rocket:` and emoji
+// characters from the start and end of a label, along with whitespace
+func normalizeLabel(label string) string {
+	for {
+		trimmed := strings.TrimSpace(label)
+		trimmed = leadingEmojiShortcodeRegex.ReplaceAllString(trimmed, "")
+		trimmed = trailingEmojiShortcodeRegex.ReplaceAllString(trimmed, "")
+		trimmed = strings.TrimLeftFunc(trimmed, isEmoji)
+		trimmed = strings.TrimRightFunc(trimmed, isEmoji)
+		if trimmed == label {
+			return label
+		}
+		label = trimmed
+	}
+}
+
+// isEmoji returns whether a rune is an emoji, or one of the characters used
+// to modify and join them
+func isEmoji(r rune) bool {
+	switch {
+	case r >= 0x1F000 && r <= 0x1FAFF: // Pictographs, emoticons, transport, flags and skin tones
+	case r >= 0x2600 && r <= 0x27BF: // Miscellaneous symbols and dingbats
+	case r >= 0x2300 && r <= 0x23FF: // Miscellaneous technical, like ⌚ and ⏩
+	case r >= 0x2B00 && r <= 0x2BFF: // Arrows and stars, like ⭐
+	case r >= 0xE0020 && r <= 0xE007F: // Tags used in flags
+	case r == 0x200D || r == 0xFE0F || r == 0x20E3: // Joiners, variation selectors and keycaps
+	default:
+		return false
+	}
+	return true
+}
+
+// ErrSkipGroup can be returned by the function passed to WalkSteps to skip
+// the steps in a group
+var ErrSkipGroup = errors.New("skip this group")
+
+// WalkSteps calls fn for each step in a parsed pipeline that's a map, in
+// depth-first order. Group steps (any step with `steps`) are passed to fn as
+// well as the steps in them, which come straight after the group itself. The
+// path passed to fn is in the form of `steps[2].steps[0]`. If fn returns
+// ErrSkipGroup the group's steps are skipped, and any other error stops the
+// walk and is returned.
+func WalkSteps(parsed interface{}, fn func(path string, step map[string]interface{}) error) error {
+	return walkStepList(pipelineSteps(parsed), "steps", func(path string, step interface{}) error {
+		if stepMap, ok := step.(map[string]interface{}); ok {
+			return fn(path, stepMap)
+		}
+		return nil
+	})
+}
+
+// walkStepList is WalkSteps for a list of steps, which also calls fn for the
+// steps that aren't maps, like `wait`
+func walkStepList(steps []interface{}, path string, fn func(path string, step interface{}) error) error {
+	for idx, step := range steps {
+		stepPath := fmt.Sprintf("%s[%d]", path, idx)
+		if err := fn(stepPath, step); err == ErrSkipGroup {
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		// The group is read after fn, so fn can replace its steps
+		stepMap, ok := step.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if children, ok := stepMap["steps"].([]interface{}); ok {
+			if err := walkStepList(children, stepPath+".steps", fn); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// walkSteps calls fn for every step map in a list of steps, descending into
+// group steps. The path passed to fn is in the form of `steps[1].steps[0]`.
+func walkSteps(steps []interface{}, path string, fn func(path string, step map[string]interface{})) {
+	_ = walkStepList(steps, path, func(path string, step interface{}) error {
+		if stepMap, ok := step.(map[string]interface{}); ok {
+			fn(path, stepMap)
+		}
+		return nil
+	})
+}
+
+// rewriteSteps replaces a list of steps with the result of calling fn with
+// it, and then does the same for the steps in each group in the result, using
+// WalkSteps. The path passed to fn is the list's, like `steps[1].steps`. fn
+// has to return copies of any groups it doesn't want changed in place.
+func rewriteSteps(steps []interface{}, fn func(path string, steps []interface{}) ([]interface{}, error)) ([]interface{}, error) {
+	rewritten, err := fn("steps", steps)
+	if err != nil {
+		return nil, err
+	}
+
+	err = WalkSteps(rewritten, func(path string, step map[string]interface{}) error {
+		children, ok := step["steps"].([]interface{})
+		if !ok {
+			return nil
+		}
+		rewrittenChildren, err := fn(path+".steps", children)
+		if err != nil {
+			return err
+		}
+		step["steps"] = rewrittenChildren
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return rewritten, nil
+}
+
+// transformSteps replaces each step map in a list of steps, including those in
+// groups, with the result of calling fn with it. The steps in a group are
+// transformed after the group itself.
+func transformSteps(steps []interface{}, path string, fn func(step map[string]interface{}) (map[string]interface{}, error)) error {
+	for idx, step := range steps {
+		stepMap, ok := step.(map[string]interface{})
+		if !ok {
+			continue
+		}
+
+		stepPath := fmt.Sprintf("%s[%d]", path, idx)
+		transformed, err := fn(stepMap)
+		if err != nil {
+			return fmt.Errorf("Failed to transform %s: %v", stepPath, err)
+		}
+		steps[idx] = transformed
+
+		if children, ok := transformed["steps"].([]interface{}); ok {
+			if err := transformSteps(children, stepPath+".steps", fn); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// joinPath adds a key to a path like `steps[0]`
+func joinPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+// pathSegments splits a path like `steps[0].command` (or `steps.0.command`)
+// into its keys and indexes
+func pathSegments(path string) []string {
+	path = strings.Replace(path, "[", ".", -1)
+	path = strings.Replace(path, "]", "", -1)
+	return strings.Split(strings.TrimPrefix(path, "."), ".")
+}
+
+// ReorderSteps sorts a list of steps so that every step comes after the steps
+// it lists in `depends_on`. Steps are otherwise kept in their original order.
+// Dependencies on keys that aren't in the list are ignored, as they may be in
+// another pipeline. Group steps are moved as a whole, and steps can be moved
+// across `wait` steps to satisfy their dependencies.
+func ReorderSteps(steps []interface{}) ([]interface{}, error) {
+	declared := map[string]int{}
+	for idx, step := range steps {
+		if stepMap, ok := step.(map[string]interface{}); ok {
+			if key := stepString(stepMap, "key"); key != "" {
+				declared[key] = idx
+			}
+		}
+	}
+
+	deps := make([]map[int]bool, len(steps))
+	for idx, step := range steps {
+		deps[idx] = map[int]bool{}
+		if stepMap, ok := step.(map[string]interface{}); ok {
+			for _, key := range stepDependencies(stepMap) {
+				if dep, ok := declared[key]; ok && dep != idx {
+					deps[idx][dep] = true
+				}
+			}
+		}
+	}
+
+	sorted := make([]interface{}, 0, len(steps))
+	done := make([]bool, len(steps))
+
+	for len(sorted) < len(steps) {
+		progressed := false
+
+		for idx, step := range steps {
+			if done[idx] {
+				continue
+			}
+
+			ready := true
+			for dep := range deps[idx] {
+				if !done[dep] {
+					ready = false
+					break
+				}
+			}
+
+			if ready {
+				sorted = append(sorted, step)
+				done[idx] = true
+				progressed = true
+				break
+			}
+		}
+
+		if !progressed {
+			var cycle []string
+			for idx, step := range steps {
+				if done[idx] {
+					continue
+				}
+				key := stepString(step.(map[string]interface{}), "key")
+				if key == "" {
+					key = fmt.Sprintf("steps[%d]", idx)
+				}
+				cycle = append(cycle, key)
+			}
+			return nil, fmt.Errorf("Circular dependency between steps %s", strings.Join(cycle, ", "))
+		}
+	}
+
+	return sorted, nil
+}
+
+// stepDependencies returns the keys in a step's `depends_on`, which can be a
+// single key, a list of keys, or a list of `{step: key}` maps
+func stepDependencies(step map[string]interface{}) []string {
+	var keys []string
+
+	switch dependsOn := step["depends_on"].(type) {
+	case string:
+		keys = append(keys, dependsOn)
+	case []interface{}:
+		for _, dep := range dependsOn {
+			switch d := dep.(type) {
+			case string:
+				keys = append(keys, d)
+			case map[string]interface{}:
+				if key := stepString(d, "step"); key != "" {
+					keys = append(keys, key)
+				}
+			}
+		}
+	}
+
+	return keys
+}
+
+// ClonePipeline returns a deep copy of a pipeline returned from
+// PipelineParser.Parse, so that it can be changed without changing the
+// original. Only maps and lists are copied, as everything else in a parsed
+// pipeline is a value.
+func ClonePipeline(parsed interface{}) interface{} {
+	switch t := parsed.(type) {
+	case map[string]interface{}:
+		copied := make(map[string]interface{}, len(t))
+		for key, value := range t {
+			copied[key] = ClonePipeline(value)
+		}
+		return copied
+	case []interface{}:
+		copied := make([]interface{}, len(t))
+		for idx, value := range t {
+			copied[idx] = ClonePipeline(value)
+		}
+		return copied
+	case map[string]string:
+		copied := make(map[string]string, len(t))
+		for key, value := range t {
+			copied[key] = value
+		}
+		return copied
+	case []string:
+		return append([]string{}, t...)
+	}
+	return parsed
+}
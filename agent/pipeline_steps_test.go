@@ -0,0 +1,300 @@
+package agent
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/buildkite/agent/env"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFlattenPipeline(t *testing.T) {
+	t.Parallel()
+
+	parsed, err := PipelineParser{Pipeline: []byte(`
+env:
+  FOO: bar
+steps:
+  - command: one
+  - group: Tests
+    steps:
+      - command: two
+      - wait
+      - group: Nested
+        steps:
+          - command: three
+  - command: four
+`)}.Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	steps, err := FlattenPipeline(parsed)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	j, err := json.Marshal(steps)
+	assert.NoError(t, err)
+	assert.Equal(t, `[{"command":"one"},{"command":"two"},"wait",{"command":"three"},{"command":"four"}]`, string(j))
+
+	flat, err := FlattenPipelineWithKeys(parsed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, steps, flat.Steps)
+	assert.Equal(t, map[string]interface{}{"env": map[string]interface{}{"FOO": "bar"}}, flat.Keys)
+}
+
+func TestFlattenPipelineWithStepsOnly(t *testing.T) {
+	t.Parallel()
+
+	flat, err := FlattenPipelineWithKeys([]interface{}{
+		map[string]interface{}{"steps": []interface{}{"wait"}},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []interface{}{"wait"}, flat.Steps)
+	assert.Empty(t, flat.Keys)
+}
+
+func TestFlattenPipelineReturnsErrorsForInvalidGroups(t *testing.T) {
+	t.Parallel()
+
+	_, err := FlattenPipeline(map[string]interface{}{
+		"steps": []interface{}{
+			map[string]interface{}{"steps": "llamas"},
+		},
+	})
+	assert.EqualError(t, err, "Expected steps[0].steps to be a list, got string")
+
+	_, err = FlattenPipeline("llamas")
+	assert.EqualError(t, err, "Unexpected type of string for pipeline")
+}
+
+func TestReorderSteps(t *testing.T) {
+	t.Parallel()
+
+	parsed, err := PipelineParser{Pipeline: []byte(`
+steps:
+  - command: deploy
+    key: deploy
+    depends_on:
+      - test
+      - step: build
+        allow_failure: false
+  - command: lint
+  - command: test
+    key: test
+    depends_on: build
+  - wait
+  - command: build
+    key: build
+  - command: notify
+    depends_on: external
+`)}.Parse()
+	assert.NoError(t, err)
+
+	steps, err := ReorderSteps(pipelineSteps(parsed))
+	assert.NoError(t, err)
+
+	j, err := json.Marshal(steps)
+	assert.NoError(t, err)
+	assert.Equal(t, `[{"command":"lint"},"wait",{"command":"build","key":"build"},{"command":"test","depends_on":"build","key":"test"},{"command":"deploy","depends_on":["test",{"allow_failure":false,"step":"build"}],"key":"deploy"},{"command":"notify","depends_on":"external"}]`, string(j))
+}
+
+func TestReorderStepsReturnsErrorsForCycles(t *testing.T) {
+	t.Parallel()
+
+	parsed, err := PipelineParser{Pipeline: []byte(`
+steps:
+  - command: build
+    key: build
+  - command: one
+    key: one
+    depends_on: two
+  - command: two
+    key: two
+    depends_on: [build, one]
+`)}.Parse()
+	assert.NoError(t, err)
+
+	_, err = ReorderSteps(pipelineSteps(parsed))
+	assert.EqualError(t, err, "Circular dependency between steps one, two")
+}
+
+func TestNormalizeLabel(t *testing.T) {
+	t.Parallel()
+
+	for label, expected := range map[string]string{
+		":rocket: Deploy":                 "Deploy",
+		"Deploy :rocket:":                 "Deploy",
+		" :docker::hammer: Build :fire: ": "Build",
+		"🚀 Deploy ✅":                      "Deploy",
+		"👩🏽‍💻 Test ❤️":                    "Test",
+		"Deploy to :prod: now":            "Deploy to :prod: now",
+		"Run 🚀 tests":                     "Run 🚀 tests",
+		":rocket:":                        "",
+		"Plain":                           "Plain",
+	} {
+		assert.Equal(t, expected, normalizeLabel(label), label)
+	}
+}
+
+func TestPipelineParserNormalizeLabels(t *testing.T) {
+	t.Parallel()
+
+	result, err := PipelineParser{
+		Pipeline: []byte(`steps:
+  - label: ":rocket: Deploy $STAGE"
+    command: deploy
+  - name: "🧪 Test"
+    command: test
+  - group: ":package: Packages"
+    steps:
+      - label: ":docker: Build"
+        command: build
+`),
+		Env:             env.FromSlice([]string{"STAGE=production"}),
+		NormalizeLabels: true,
+	}.Parse()
+	assert.NoError(t, err)
+
+	j, err := json.Marshal(result)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"steps":[{"command":"deploy","label":"Deploy production"},{"command":"test","name":"Test"},{"group":":package: Packages","steps":[{"command":"build","label":"Build"}]}]}`, string(j))
+}
+
+func TestPipelineParserStepTransformer(t *testing.T) {
+	t.Parallel()
+
+	parser := PipelineParser{
+		Pipeline: []byte(`steps:
+  - command: make test $SUITE
+  - wait
+  - command: make lint
+    retry: {automatic: {limit: 3}}
+  - group: Deploy
+    steps:
+      - command: make deploy
+      - block: Release
+`),
+		Env: env.FromSlice([]string{"SUITE=unit"}),
+		StepTransformer: func(step map[string]interface{}) (map[string]interface{}, error) {
+			if _, ok := step["command"]; ok {
+				if _, ok := step["retry"]; !ok {
+					step["retry"] = map[string]interface{}{"automatic": map[string]interface{}{"limit": 1}}
+				}
+			}
+			return step, nil
+		},
+	}
+
+	result, err := parser.Parse()
+	assert.NoError(t, err)
+
+	j, err := json.Marshal(result)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"steps":[{"command":"make test unit","retry":{"automatic":{"limit":1}}},"wait",{"command":"make lint","retry":{"automatic":{"limit":3}}},{"group":"Deploy","steps":[{"command":"make deploy","retry":{"automatic":{"limit":1}}},{"block":"Release"}]}]}`, string(j))
+
+	parser.StepTransformer = func(step map[string]interface{}) (map[string]interface{}, error) {
+		if _, ok := step["block"]; ok {
+			return nil, errors.New("block steps aren't allowed")
+		}
+		return step, nil
+	}
+	_, err = parser.Parse()
+	assert.EqualError(t, err, "Failed to transform steps[3].steps[1]: block steps aren't allowed")
+}
+
+func TestWalkSteps(t *testing.T) {
+	t.Parallel()
+
+	parsed, err := PipelineParser{Pipeline: []byte(`steps:
+  - command: build
+  - wait
+  - group: Test
+    steps:
+      - command: test
+      - group: Nested
+        steps:
+          - command: nested
+  - group: Skipped
+    steps:
+      - command: skipped
+  - command: deploy
+`), NoInterpolation: true}.Parse()
+	assert.NoError(t, err)
+
+	var paths []string
+	err = WalkSteps(parsed, func(path string, step map[string]interface{}) error {
+		paths = append(paths, path)
+		if step["group"] == "Skipped" {
+			return ErrSkipGroup
+		}
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{
+		"steps[0]",
+		"steps[2]",
+		"steps[2].steps[0]",
+		"steps[2].steps[1]",
+		"steps[2].steps[1].steps[0]",
+		"steps[3]",
+		"steps[4]",
+	}, paths)
+
+	paths = nil
+	err = WalkSteps(parsed, func(path string, step map[string]interface{}) error {
+		paths = append(paths, path)
+		if step["command"] == "test" {
+			return errors.New("stop")
+		}
+		return nil
+	})
+	assert.EqualError(t, err, "stop")
+	assert.Equal(t, []string{"steps[0]", "steps[2]", "steps[2].steps[0]"}, paths)
+}
+
+func TestClonePipeline(t *testing.T) {
+	t.Parallel()
+
+	parsed, err := PipelineParser{Pipeline: []byte(`
+env:
+  FOO: bar
+steps:
+  - command: make test
+    parallelism: 2
+    soft_fail: true
+    artifact_paths: [dist/*]
+  - group: Deploy
+    steps:
+      - trigger: deploy
+        build: {env: {FOO: baz}}
+  - wait: ~
+`), NoInterpolation: true}.Parse()
+	assert.NoError(t, err)
+
+	original, err := json.Marshal(parsed)
+	assert.NoError(t, err)
+
+	cloned := ClonePipeline(parsed)
+	assert.Equal(t, parsed, cloned)
+
+	// Changing the clone anywhere leaves the original as it was
+	clonedMap := cloned.(map[string]interface{})
+	clonedMap["env"].(map[string]interface{})["FOO"] = "changed"
+	steps := clonedMap["steps"].([]interface{})
+	steps[0].(map[string]interface{})["artifact_paths"].([]interface{})[0] = "changed"
+	group := steps[1].(map[string]interface{})
+	group["steps"].([]interface{})[0].(map[string]interface{})["build"].(map[string]interface{})["env"] = nil
+	clonedMap["steps"] = append(steps, "wait")
+
+	after, err := json.Marshal(parsed)
+	assert.NoError(t, err)
+	assert.Equal(t, string(original), string(after))
+
+	assert.Nil(t, ClonePipeline(nil))
+	assert.Equal(t, "steps", ClonePipeline("steps"))
+}
@@ -0,0 +1,322 @@
+package agent
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"regexp"
+	"strings"
+
+	"github.com/buildkite/agent/env"
+
+	// This is a fork of gopkg.in/yaml.v2 that fixes anchors with MapSlice
+	yaml "github.com/buildkite/yaml"
+)
+
+// ParseStream parses a pipeline from a reader, sending each of its steps on
+// the returned channel as soon as it has been read and interpolated, so that
+// large pipelines don't need to be held in memory all at once. The steps
+// channel is closed when the pipeline has been read, and at most one error is
+// sent on the error channel, which is then closed too.
+//
+// Pipelines can either be a list of steps, or a map with the steps in a block
+// style list under `steps`. The top-level env block is used for interpolation
+// if it comes before the steps. It's an error for the pipeline to have a
+// top-level line that isn't a list item or a plain or quoted key, such as a
+// flow style map. Validations, templates, `extends` and anchors
+// shared between steps aren't supported, as they need the whole pipeline.
+// If the caller stops reading steps, the parser's Context should be cancelled
+// so that the parsing stops too.
+func (p PipelineParser) ParseStream(r io.Reader) (<-chan interface{}, <-chan error) {
+	steps := make(chan interface{})
+	errs := make(chan error, 1)
+
+	if p.Env == nil {
+		p.Env = env.FromSlice(os.Environ())
+	}
+
+	go func() {
+		defer close(errs)
+		defer close(steps)
+
+		s := &pipelineStream{parser: p, reader: bufio.NewReader(r), steps: steps}
+		if err := s.run(); err != nil {
+			errs <- s.wrapError(err)
+		}
+	}()
+
+	return steps, errs
+}
+
+// pipelineStream splits a pipeline into its top-level sections, and its
+// steps into separate chunks of YAML that can be parsed on their own
+type pipelineStream struct {
+	parser PipelineParser
+	reader *bufio.Reader
+	steps  chan<- interface{}
+
+	// The top-level key that's being read, or "-" if the pipeline is a list
+	// of steps
+	section string
+	lines   []string
+
+	// The number of lines read, and the line number of the first line in
+	// lines, so that errors have the line number in the whole pipeline
+	lineNumber int
+	linesStart int
+
+	// The indentation of the steps in the current list of steps, or -1 if
+	// the first step hasn't been seen yet
+	stepIndent int
+	stepCount  int
+}
+
+func (s *pipelineStream) wrapError(err error) error {
+	if _, ok := err.(*YAMLError); !ok {
+		return err
+	}
+	if s.parser.Filename != "" {
+		return fmt.Errorf("Failed to parse %s: %v", s.parser.Filename, err)
+	}
+	return fmt.Errorf("Failed to parse pipeline: %v", err)
+}
+
+func (s *pipelineStream) run() error {
+	for {
+		line, readErr := s.reader.ReadString('\n')
+		if readErr != nil && readErr != io.EOF {
+			return readErr
+		}
+
+		if line != "" {
+			if err := s.parser.contextErr(); err != nil {
+				return err
+			}
+			if err := s.readLine(strings.TrimRight(line, "\r\n")); err != nil {
+				return err
+			}
+		}
+
+		if readErr == io.EOF {
+			return s.endSection()
+		}
+	}
+}
+
+func (s *pipelineStream) readLine(line string) error {
+	s.lineNumber++
+
+	trimmed := strings.TrimSpace(line)
+	indent := len(line) - len(strings.TrimLeft(line, " "))
+
+	// Blank lines and comments don't start or end anything
+	if trimmed == "" || strings.HasPrefix(trimmed, "#") || trimmed == "---" {
+		s.appendLine(line)
+		return nil
+	}
+
+	// Anything that isn't indented starts a new top-level section, except
+	// for the items of a pipeline that's just a list of steps
+	if indent == 0 && !((s.section == "-" || s.section == "steps") && isYAMLListItem(trimmed)) {
+		if err := s.endSection(); err != nil {
+			return err
+		}
+
+		if isYAMLListItem(trimmed) {
+			s.section = "-"
+		} else if key, ok := topLevelYAMLKey(line); ok {
+			s.section = key
+		} else {
+			return &YAMLError{Line: s.lineNumber, Message: "can't stream a top-level line that isn't a key or a list item"}
+		}
+		s.stepIndent = -1
+
+		// Top-level steps start straight away, otherwise the section's key
+		// is kept until the section is done with
+		if s.section != "-" {
+			s.lines = nil
+			s.appendLine(line)
+			return nil
+		}
+	}
+
+	if s.section == "-" || (s.section == "steps" && isYAMLListItem(trimmed)) {
+		if s.stepIndent < 0 {
+			s.stepIndent = indent
+			if s.section == "steps" {
+				// The `steps:` line is no longer needed
+				s.lines = nil
+			}
+		}
+		if indent == s.stepIndent && isYAMLListItem(trimmed) {
+			if err := s.flushStep(); err != nil {
+				return err
+			}
+		}
+	}
+
+	s.appendLine(line)
+	return nil
+}
+
+func (s *pipelineStream) appendLine(line string) {
+	if len(s.lines) == 0 {
+		s.linesStart = s.lineNumber
+	}
+	s.lines = append(s.lines, line)
+}
+
+// joinLines joins lines back into YAML, keeping the newline at the end so
+// that block scalars on the last line keep theirs
+func joinLines(lines []string) string {
+	if len(lines) == 0 {
+		return ""
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// yamlError returns the error from parsing the current lines, with the line
+// number it has in the whole pipeline
+func (s *pipelineStream) yamlError(err error, start int) *YAMLError {
+	yamlErr := parseYAMLError(err)
+	if yamlErr.Line > 0 {
+		yamlErr.Line += start - 1
+	}
+	return yamlErr
+}
+
+// endSection handles the lines of the top-level section that's being read
+func (s *pipelineStream) endSection() error {
+	lines, start := s.lines, s.linesStart
+	s.lines = nil
+
+	switch {
+	case s.section == "-" || (s.section == "steps" && s.stepIndent >= 0):
+		s.lines = lines
+		return s.flushStep()
+
+	// Steps that aren't in a block style list are parsed all at once
+	case s.section == "steps":
+		var section yaml.MapSlice
+		if err := unmarshalYAML([]byte(joinLines(lines)), &section); err != nil {
+			return s.yamlError(err, start)
+		}
+		item, _ := mapSliceItem("steps", section)
+		steps, ok := item.Value.([]interface{})
+		if !ok && item.Value != nil {
+			return fmt.Errorf("Expected pipeline top-level steps to be a list, got %T", item.Value)
+		}
+		for _, step := range steps {
+			if err := s.sendStep(step); err != nil {
+				return err
+			}
+		}
+
+	case s.section == "env":
+		if s.stepCount > 0 {
+			return fmt.Errorf("The pipeline's env block must come before its steps when it's streamed")
+		}
+		var section yaml.MapSlice
+		if err := unmarshalYAML([]byte(joinLines(lines)), &section); err != nil {
+			return s.yamlError(err, start)
+		}
+		item, _ := mapSliceItem("env", section)
+		envMap, ok := item.Value.(yaml.MapSlice)
+		if !ok {
+			return fmt.Errorf("Expected pipeline top-level env block to be a map, got %T", item.Value)
+		}
+		return s.parser.interpolateEnvBlock(envMap)
+	}
+
+	return nil
+}
+
+// flushStep parses the step that's been read so far, if there is one
+func (s *pipelineStream) flushStep() error {
+	chunk, start := joinLines(s.lines), s.linesStart
+	s.lines = nil
+
+	if strings.TrimSpace(chunk) == "" {
+		return nil
+	}
+
+	var steps []interface{}
+	if err := unmarshalYAML([]byte(chunk), &steps); err != nil {
+		return s.yamlError(err, start)
+	}
+
+	for _, step := range steps {
+		if err := s.sendStep(step); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// sendStep interpolates a step and sends it on the steps channel
+func (s *pipelineStream) sendStep(step interface{}) error {
+	path := fmt.Sprintf("[%d]", s.stepCount)
+	if s.section == "steps" {
+		path = "steps" + path
+	}
+	s.stepCount++
+
+	var interpolated interface{}
+	if step != nil {
+		original := reflect.ValueOf(step)
+		copy := reflect.New(original.Type()).Elem()
+		if err := s.parser.interpolateRecursive(copy, original, path); err != nil {
+			return err
+		}
+		interpolated = copy.Interface()
+	}
+
+	// Roundtrip the step to get JSON compatible maps, the same as Parse
+	b, err := yaml.Marshal(interpolated)
+	if err != nil {
+		return err
+	}
+
+	var result interface{}
+	if err := unmarshalAsStringMap(b, &result); err != nil {
+		return parseYAMLError(err)
+	}
+
+	if s.parser.Context == nil {
+		s.steps <- result
+		return nil
+	}
+
+	select {
+	case s.steps <- result:
+		return nil
+	case <-s.parser.Context.Done():
+		return s.parser.Context.Err()
+	}
+}
+
+// topLevelKeyRegex matches the plain or quoted key at the start of a line
+var topLevelKeyRegex = regexp.MustCompile(`^("(?:[^"\\]|\\.)*"|'(?:[^']|'')*'|[^\s"'#{}\[\],&*!|>%@` + "`" + `?:-][^#]*?)\s*:(?:\s|$)`)
+
+// topLevelYAMLKey returns the key that a top-level line of a map starts with,
+// unquoting it the same way as the YAML parser does
+func topLevelYAMLKey(line string) (string, bool) {
+	match := topLevelKeyRegex.FindStringSubmatch(line)
+	if match == nil {
+		return "", false
+	}
+
+	var key string
+	if err := unmarshalYAML([]byte(match[1]), &key); err != nil {
+		return "", false
+	}
+	return key, true
+}
+
+// isYAMLListItem returns whether a trimmed line starts a block style list item
+func isYAMLListItem(trimmed string) bool {
+	return trimmed == "-" || strings.HasPrefix(trimmed, "- ")
+}
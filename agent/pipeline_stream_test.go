@@ -0,0 +1,142 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/buildkite/agent/env"
+	"github.com/stretchr/testify/assert"
+)
+
+func collectStream(steps <-chan interface{}, errs <-chan error) (string, error) {
+	var collected []interface{}
+	for step := range steps {
+		collected = append(collected, step)
+	}
+	err := <-errs
+
+	j, _ := json.Marshal(collected)
+	return string(j), err
+}
+
+func TestPipelineParserParseStream(t *testing.T) {
+	t.Parallel()
+
+	steps, errs := PipelineParser{
+		Env: env.FromSlice([]string{"BRANCH=main"}),
+	}.ParseStream(strings.NewReader(`# A big pipeline
+env:
+  IMAGE: node:8
+
+steps:
+  # Build things
+  - label: Build $BRANCH
+    command:
+      - make
+      - make test
+    plugins:
+      - docker#v1.0.0:
+          image: $IMAGE
+
+  - wait
+  - group: Deploy
+    steps:
+      - command: deploy $IMAGE
+  -
+    command: echo $$HOME
+notify:
+  - email: dev@example.com
+`))
+
+	actual, err := collectStream(steps, errs)
+	assert.NoError(t, err)
+	assert.Equal(t, `[`+
+		`{"command":["make","make test"],"label":"Build main","plugins":[{"docker#v1.0.0":{"image":"node:8"}}]},`+
+		`"wait",`+
+		`{"group":"Deploy","steps":[{"command":"deploy node:8"}]},`+
+		`{"command":"echo $HOME"}]`, actual)
+}
+
+func TestPipelineParserParseStreamOfSteps(t *testing.T) {
+	t.Parallel()
+
+	for _, pipeline := range []string{
+		"- command: one\n- wait\n- command: two\n",
+		"steps:\n- command: one\n- wait\n- command: two\n",
+		"steps: [{command: one}, wait, {command: two}]\n",
+	} {
+		actual, err := collectStream(PipelineParser{Env: env.New()}.ParseStream(strings.NewReader(pipeline)))
+		assert.NoError(t, err, pipeline)
+		assert.Equal(t, `[{"command":"one"},"wait",{"command":"two"}]`, actual, pipeline)
+	}
+}
+
+func TestPipelineParserParseStreamMatchesParse(t *testing.T) {
+	t.Parallel()
+
+	for _, pipeline := range []string{
+		"\"steps\":\n  - command: one\n  - wait\n",
+		"'steps':\n  - command: one\n",
+		"env:\n  FOO: bar\n\"steps\": [{command: $FOO}]\n",
+		"steps:\n  - command: |\n      make\n      make test\n",
+		"steps:\n  - command: >\n      make\n\n  - command: |-\n      make\n",
+		"- label: \"Build: it\"\n  command: |\n    make\n",
+		"agents:\n  queue: deploy\nsteps:\n  - group: Deploy\n    steps:\n      - command: |\n          deploy\n",
+	} {
+		streamed, err := collectStream(PipelineParser{Env: env.New()}.ParseStream(strings.NewReader(pipeline)))
+		assert.NoError(t, err, pipeline)
+
+		result, err := PipelineParser{Pipeline: []byte(pipeline), Env: env.New()}.Parse()
+		assert.NoError(t, err, pipeline)
+
+		steps := result
+		if m, ok := result.(map[string]interface{}); ok {
+			steps = m["steps"]
+		}
+		parsed, _ := json.Marshal(steps)
+		assert.Equal(t, string(parsed), streamed, pipeline)
+	}
+}
+
+func TestPipelineParserParseStreamErrors(t *testing.T) {
+	t.Parallel()
+
+	_, err := collectStream(PipelineParser{Env: env.New(), Filename: "big.yml"}.ParseStream(strings.NewReader("steps:\n  - wait\n  - command: [\n  - wait\n")))
+	assert.EqualError(t, err, "Failed to parse big.yml: line 3: did not find expected node content")
+
+	actual, err := collectStream(PipelineParser{Env: env.New()}.ParseStream(strings.NewReader("steps:\n  - command: one\nenv:\n  FOO: bar\n")))
+	assert.EqualError(t, err, "The pipeline's env block must come before its steps when it's streamed")
+	assert.Equal(t, `[{"command":"one"}]`, actual)
+
+	// Top-level lines that can't be split up aren't silently ignored
+	for _, pipeline := range []string{
+		"{steps: [{command: one}]}\n",
+		"? steps\n: - command: one\n",
+	} {
+		_, err = collectStream(PipelineParser{Env: env.New()}.ParseStream(strings.NewReader(pipeline)))
+		assert.EqualError(t, err, "Failed to parse pipeline: line 1: can't stream a top-level line that isn't a key or a list item", pipeline)
+	}
+}
+
+func TestPipelineParserParseStreamStopsWhenCancelled(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	r, w := io.Pipe()
+	go func() {
+		w.Write([]byte("- command: one\n- command: two\n- command: three\n"))
+		w.Close()
+	}()
+
+	steps, errs := PipelineParser{Env: env.New(), Context: ctx}.ParseStream(r)
+	assert.Equal(t, map[string]interface{}{"command": "one"}, <-steps)
+	cancel()
+
+	for range steps {
+	}
+	assert.Equal(t, context.Canceled, <-errs)
+}
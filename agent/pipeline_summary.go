@@ -0,0 +1,93 @@
+package agent
+
+import (
+	"fmt"
+	"sort"
+)
+
+// PipelineSummary has counts of the different parts of a parsed pipeline
+type PipelineSummary struct {
+	CommandStepCount int
+	TriggerStepCount int
+	WaitStepCount    int
+	GroupStepCount   int
+	BlockStepCount   int
+
+	// All steps, including group steps and the steps inside them, and any
+	// steps that aren't one of the types above (such as input steps)
+	TotalStepCount int
+
+	// The env vars in the top-level env block and in the env of each step
+	EnvVarCount int
+
+	// The names of the plugins used by the steps, such as `docker-compose`,
+	// sorted and without duplicates
+	PluginNames []string
+}
+
+// SummarizePipeline returns a summary of a pipeline returned from
+// PipelineParser.Parse
+func SummarizePipeline(parsed interface{}) (*PipelineSummary, error) {
+	summary := &PipelineSummary{PluginNames: []string{}}
+
+	var steps []interface{}
+
+	switch p := parsed.(type) {
+	case []interface{}:
+		steps = p
+	case map[string]interface{}:
+		if env, ok := p["env"].(map[string]interface{}); ok {
+			summary.EnvVarCount += len(env)
+		}
+		steps = pipelineSteps(p)
+	default:
+		return nil, fmt.Errorf("Unexpected type of %T for pipeline", parsed)
+	}
+
+	plugins := map[string]bool{}
+	summarizeSteps(summary, steps, plugins)
+
+	for name := range plugins {
+		summary.PluginNames = append(summary.PluginNames, name)
+	}
+	sort.Strings(summary.PluginNames)
+
+	return summary, nil
+}
+
+func summarizeSteps(summary *PipelineSummary, steps []interface{}, plugins map[string]bool) {
+	for _, step := range steps {
+		summary.TotalStepCount++
+
+		switch stepType(step) {
+		case "command":
+			summary.CommandStepCount++
+		case "trigger":
+			summary.TriggerStepCount++
+		case "wait":
+			summary.WaitStepCount++
+		case "group":
+			summary.GroupStepCount++
+		case "block":
+			summary.BlockStepCount++
+		}
+
+		if s, ok := step.(map[string]interface{}); ok {
+			if env, ok := s["env"].(map[string]interface{}); ok {
+				summary.EnvVarCount += len(env)
+			}
+
+			for _, location := range stepPlugins(s) {
+				name := location
+				if plugin, err := CreatePlugin(location, nil); err == nil {
+					name = plugin.Name()
+				}
+				plugins[name] = true
+			}
+
+			if children, ok := s["steps"].([]interface{}); ok {
+				summarizeSteps(summary, children, plugins)
+			}
+		}
+	}
+}
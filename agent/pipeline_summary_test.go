@@ -0,0 +1,56 @@
+package agent
+
+import (
+	"testing"
+
+	"github.com/buildkite/agent/env"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSummarizePipeline(t *testing.T) {
+	t.Parallel()
+
+	parsed, err := PipelineParser{Pipeline: []byte(`
+env:
+  FOO: bar
+  BAR: baz
+steps:
+  - command: make test
+    env:
+      CI: true
+    plugins:
+      - docker-compose#v2.0.0:
+          run: app
+  - wait
+  - group: Deploy
+    steps:
+      - block: Release?
+      - trigger: deploy
+      - commands:
+          - make deploy
+        plugins:
+          github.com/my-org/audit-buildkite-plugin#v1.0.0: ~
+          docker-compose#v2.1.0: {}
+      - wait: ~
+  - input: Details
+    fields: []
+  - block
+`), Env: env.FromSlice([]string{})}.Parse()
+	assert.NoError(t, err)
+
+	summary, err := SummarizePipeline(parsed)
+	assert.NoError(t, err)
+	assert.Equal(t, &PipelineSummary{
+		CommandStepCount: 2,
+		TriggerStepCount: 1,
+		WaitStepCount:    2,
+		GroupStepCount:   1,
+		BlockStepCount:   2,
+		TotalStepCount:   9,
+		EnvVarCount:      3,
+		PluginNames:      []string{"audit", "docker-compose"},
+	}, summary)
+
+	_, err = SummarizePipeline("nope")
+	assert.EqualError(t, err, "Unexpected type of string for pipeline")
+}
@@ -0,0 +1,203 @@
+package agent
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// The width of a table from RenderTable when it's not known from $COLUMNS
+const defaultTableWidth = 120
+
+var tableHeader = []string{"#", "Key", "Label", "Type", "Command/Trigger", "DependsOn"}
+
+// Columns that are truncated to fit a table into the width, widest first
+var tableShrinkableColumns = []int{5, 4, 2, 1}
+
+// The narrowest that a truncated column gets
+const minTableColumnWidth = 8
+
+// tableRow is a row in a table from RenderTable, or a separator for a wait
+// step if it has no cells
+type tableRow []string
+
+// RenderTable writes a pipeline returned from PipelineParser.Parse to w as a
+// table of its steps, with the steps in a group indented below it and wait
+// steps as separators. The table fits in the width of the terminal given by
+// $COLUMNS, with the longest columns truncated if it has to be.
+func RenderTable(parsed interface{}, w io.Writer) error {
+	width := defaultTableWidth
+	if columns, err := strconv.Atoi(os.Getenv("COLUMNS")); err == nil && columns > 0 {
+		width = columns
+	}
+	return renderTable(parsed, w, width)
+}
+
+func renderTable(parsed interface{}, w io.Writer, width int) error {
+	switch parsed.(type) {
+	case []interface{}, map[string]interface{}:
+	default:
+		return fmt.Errorf("Unexpected type of %T for pipeline", parsed)
+	}
+
+	rows := tableRows(pipelineSteps(parsed), "", 0)
+
+	widths := make([]int, len(tableHeader))
+	for _, row := range append([]tableRow{tableHeader}, rows...) {
+		for i, cell := range row {
+			if n := utf8.RuneCountInString(cell); n > widths[i] {
+				widths[i] = n
+			}
+		}
+	}
+
+	// Take a character at a time from the widest column that can be
+	// truncated, until the table fits or they can't get any narrower
+	total := func() int {
+		sum := 3*len(widths) + 1
+		for _, n := range widths {
+			sum += n
+		}
+		return sum
+	}
+	for total() > width {
+		widest := -1
+		for _, i := range tableShrinkableColumns {
+			if widths[i] > minTableColumnWidth && (widest < 0 || widths[i] > widths[widest]) {
+				widest = i
+			}
+		}
+		if widest < 0 {
+			break
+		}
+		widths[widest]--
+	}
+
+	var b strings.Builder
+
+	separator := func() {
+		b.WriteString("+")
+		for _, n := range widths {
+			b.WriteString(strings.Repeat("-", n+2))
+			b.WriteString("+")
+		}
+		b.WriteString("\n")
+	}
+
+	row := func(cells tableRow) {
+		b.WriteString("|")
+		for i, n := range widths {
+			cell := truncateTableCell(cells[i], n)
+			fmt.Fprintf(&b, " %s%s |", cell, strings.Repeat(" ", n-utf8.RuneCountInString(cell)))
+		}
+		b.WriteString("\n")
+	}
+
+	separator()
+	row(tableHeader)
+	separator()
+	for _, r := range rows {
+		if len(r) == 0 {
+			separator()
+		} else {
+			row(r)
+		}
+	}
+	separator()
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// tableRows returns a row for each step, numbered like `3` or `3.1` for a step
+// in a group
+func tableRows(steps []interface{}, prefix string, depth int) []tableRow {
+	var rows []tableRow
+
+	n := 0
+	for _, step := range steps {
+		t := stepType(step)
+		if t == "wait" {
+			rows = append(rows, tableRow{})
+			continue
+		}
+
+		n++
+		num := prefix + strconv.Itoa(n)
+		indent := strings.Repeat("  ", depth)
+
+		stepMap, ok := step.(map[string]interface{})
+		if !ok {
+			s, _ := step.(string)
+			rows = append(rows, tableRow{num, "", indent + s, t, "", ""})
+			continue
+		}
+
+		var action string
+		switch t {
+		case "trigger":
+			action = stepString(stepMap, "trigger")
+		case "command":
+			action = stepCommandLine(stepMap)
+		}
+
+		rows = append(rows, tableRow{
+			num,
+			stepString(stepMap, "key"),
+			indent + stepName("", stepMap),
+			t,
+			action,
+			strings.Join(stepDependencies(stepMap), ", "),
+		})
+
+		if children, ok := stepMap["steps"].([]interface{}); ok {
+			rows = append(rows, tableRows(children, num+".", depth+1)...)
+		}
+	}
+
+	return rows
+}
+
+// stepCommandLine returns a step's commands on a single line
+func stepCommandLine(step map[string]interface{}) string {
+	var commands []string
+	for _, key := range []string{"command", "commands"} {
+		switch c := step[key].(type) {
+		case string:
+			commands = append(commands, c)
+		case []interface{}:
+			for _, command := range c {
+				if s, ok := command.(string); ok {
+					commands = append(commands, s)
+				}
+			}
+		}
+	}
+
+	var lines []string
+	for _, command := range commands {
+		for _, line := range strings.Split(command, "\n") {
+			if line = strings.TrimSpace(line); line != "" {
+				lines = append(lines, line)
+			}
+		}
+	}
+
+	return strings.Join(lines, " && ")
+}
+
+// truncateTableCell shortens a cell to a width, ending it with `...` if it's
+// been truncated
+func truncateTableCell(cell string, width int) string {
+	if utf8.RuneCountInString(cell) <= width {
+		return cell
+	}
+	runes := []rune(cell)
+	if width <= 3 {
+		return string(runes[:width])
+	}
+	return string(runes[:width-3]) + "..."
+}
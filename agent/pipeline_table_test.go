@@ -0,0 +1,70 @@
+package agent
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRenderTable(t *testing.T) {
+	t.Parallel()
+
+	parsed, err := PipelineParser{Pipeline: []byte(`
+steps:
+  - label: Build
+    key: build
+    command:
+      - make deps
+      - make build
+  - wait
+  - group: Tests
+    key: tests
+    depends_on: build
+    steps:
+      - label: Unit
+        command: make test
+      - trigger: integration-tests
+        depends_on:
+          - build
+          - step: lint
+  - block
+  - label: Deploy
+    commands: ./scripts/deploy.sh --environment production --verbose
+`), NoInterpolation: true}.Parse()
+	assert.NoError(t, err)
+
+	var b bytes.Buffer
+	assert.NoError(t, renderTable(parsed, &b, 200))
+	assert.Equal(t, ""+
+		"+-----+-------+--------+---------+--------------------------------------------------------+-------------+\n"+
+		"| #   | Key   | Label  | Type    | Command/Trigger                                        | DependsOn   |\n"+
+		"+-----+-------+--------+---------+--------------------------------------------------------+-------------+\n"+
+		"| 1   | build | Build  | command | make deps && make build                                |             |\n"+
+		"+-----+-------+--------+---------+--------------------------------------------------------+-------------+\n"+
+		"| 2   | tests | Tests  | group   |                                                        | build       |\n"+
+		"| 2.1 |       |   Unit | command | make test                                              |             |\n"+
+		"| 2.2 |       |        | trigger | integration-tests                                      | build, lint |\n"+
+		"| 3   |       | block  | block   |                                                        |             |\n"+
+		"| 4   |       | Deploy | command | ./scripts/deploy.sh --environment production --verbose |             |\n"+
+		"+-----+-------+--------+---------+--------------------------------------------------------+-------------+\n",
+		b.String())
+
+	b.Reset()
+	assert.NoError(t, renderTable(parsed, &b, 80))
+	assert.Equal(t, ""+
+		"+-----+-------+--------+---------+-------------------------------+-------------+\n"+
+		"| #   | Key   | Label  | Type    | Command/Trigger               | DependsOn   |\n"+
+		"+-----+-------+--------+---------+-------------------------------+-------------+\n"+
+		"| 1   | build | Build  | command | make deps && make build       |             |\n"+
+		"+-----+-------+--------+---------+-------------------------------+-------------+\n"+
+		"| 2   | tests | Tests  | group   |                               | build       |\n"+
+		"| 2.1 |       |   Unit | command | make test                     |             |\n"+
+		"| 2.2 |       |        | trigger | integration-tests             | build, lint |\n"+
+		"| 3   |       | block  | block   |                               |             |\n"+
+		"| 4   |       | Deploy | command | ./scripts/deploy.sh --envi... |             |\n"+
+		"+-----+-------+--------+---------+-------------------------------+-------------+\n",
+		b.String())
+
+	assert.EqualError(t, RenderTable(42, &b), "Unexpected type of int for pipeline")
+}
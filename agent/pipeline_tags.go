@@ -0,0 +1,138 @@
+package agent
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/buildkite/agent/env"
+	"github.com/buildkite/agent/logger"
+	yaml3 "gopkg.in/yaml.v3"
+)
+
+// TagHandler replaces the value of a node with a custom YAML tag, such as
+// `!vault secret/deploy`, with the value it returns. The tag is given without
+// its leading `!`.
+type TagHandler interface {
+	Handle(tag string, value interface{}, env *env.Environment) (interface{}, error)
+}
+
+// TagHandlerFunc is a function that's a TagHandler
+type TagHandlerFunc func(tag string, value interface{}, env *env.Environment) (interface{}, error)
+
+func (f TagHandlerFunc) Handle(tag string, value interface{}, env *env.Environment) (interface{}, error) {
+	return f(tag, value, env)
+}
+
+// A custom tag. Standard tags like `!!str` start with two `!`s, or are
+// resolved to `tag:yaml.org,2002:` ones, so aren't matched.
+var yamlTagRegex = regexp.MustCompile(`^!([A-Za-z][\w.-]*)$`)
+
+// resolveTags replaces the values of any nodes in the pipeline with a tag in
+// TagHandlers with what the handler returns, before the pipeline is parsed.
+// The YAML parser ignores tags it doesn't know, so the pipeline is parsed
+// with yaml.v3, which keeps them, and encoded again if any are replaced.
+// Unknown tags are a warning, or an error with StrictTags.
+func (p PipelineParser) resolveTags() (PipelineParser, error) {
+	if (len(p.TagHandlers) == 0 && !p.StrictTags) || p.TOML {
+		return p, nil
+	}
+
+	var doc yaml3.Node
+	if err := yaml3.Unmarshal(p.Pipeline, &doc); err != nil {
+		if p.Filename == "" {
+			return p, fmt.Errorf("Failed to parse pipeline: %v", parseYAMLError(err))
+		}
+		return p, fmt.Errorf("Failed to parse %s: %v", p.Filename, parseYAMLError(err))
+	}
+
+	resolved, err := p.resolveNodeTags(&doc)
+	if err != nil {
+		return p, err
+	}
+
+	if resolved {
+		pipeline, err := yaml3.Marshal(&doc)
+		if err != nil {
+			return p, err
+		}
+		p.Pipeline = pipeline
+	}
+
+	// The copy might be loaded again, which shouldn't resolve tags twice
+	p.TagHandlers = nil
+	p.StrictTags = false
+
+	return p, nil
+}
+
+// resolveNodeTags replaces a node and its children that have a tag in
+// TagHandlers, and returns whether any were replaced
+func (p PipelineParser) resolveNodeTags(n *yaml3.Node) (bool, error) {
+	// Aliases are resolved where their anchor is
+	if n.Kind == yaml3.AliasNode {
+		return false, nil
+	}
+
+	matches := yamlTagRegex.FindStringSubmatch(n.Tag)
+	if matches == nil {
+		var resolved bool
+		for _, c := range n.Content {
+			r, err := p.resolveNodeTags(c)
+			if err != nil {
+				return false, err
+			}
+			resolved = resolved || r
+		}
+		return resolved, nil
+	}
+	tag := matches[1]
+
+	handler, ok := p.TagHandlers[tag]
+	if !ok {
+		if p.StrictTags {
+			return false, fmt.Errorf("Unknown YAML tag !%s on line %d", tag, n.Line)
+		}
+		logger.Warn("Ignoring unknown YAML tag !%s on line %d", tag, n.Line)
+		return false, nil
+	}
+
+	// The value is what it would be without the tag
+	untagged := *n
+	untagged.Tag = ""
+	value, err := standardYAMLNodeValue(&untagged)
+	if err != nil {
+		return false, fmt.Errorf("Failed to resolve the !%s tag on line %d: %v", tag, n.Line, err)
+	}
+
+	replacement, err := handler.Handle(tag, standardYAMLStringMap(value), p.Env)
+	if err != nil {
+		return false, fmt.Errorf("Failed to resolve the !%s tag on line %d: %v", tag, n.Line, err)
+	}
+
+	var replaced yaml3.Node
+	if err := replaced.Encode(replacement); err != nil {
+		return false, fmt.Errorf("Failed to resolve the !%s tag on line %d: %v", tag, n.Line, err)
+	}
+
+	// What a handler returns is used as is, rather than interpolated
+	if !p.NoInterpolation {
+		escapeNodeStrings(&replaced)
+	}
+
+	// Anything that's an alias of the node gets the replacement too
+	replaced.Anchor = n.Anchor
+	*n = replaced
+
+	return true, nil
+}
+
+// escapeNodeStrings escapes the $'s in the strings in a node as `$$`
+func escapeNodeStrings(n *yaml3.Node) {
+	if n.Kind == yaml3.ScalarNode && n.ShortTag() == "!!str" {
+		n.Value = strings.Replace(n.Value, "$", "$$", -1)
+	}
+	for _, c := range n.Content {
+		escapeNodeStrings(c)
+	}
+}
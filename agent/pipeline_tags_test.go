@@ -0,0 +1,118 @@
+package agent
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/buildkite/agent/env"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPipelineParserTagHandlers(t *testing.T) {
+	t.Parallel()
+
+	vault := TagHandlerFunc(func(tag string, value interface{}, environ *env.Environment) (interface{}, error) {
+		path, _ := value.(string)
+		if path == "secret/missing" {
+			return nil, errors.New("no such secret")
+		}
+		vaultEnv, _ := environ.Get("VAULT_ENV")
+		return "s3cr$t from " + path + " in " + vaultEnv, nil
+	})
+	file := TagHandlerFunc(func(tag string, value interface{}, environ *env.Environment) (interface{}, error) {
+		return map[string]interface{}{"file": value, "lines": 2}, nil
+	})
+	handlers := map[string]TagHandler{"vault": vault, "file": file}
+
+	var testCases = []struct {
+		name     string
+		pipeline string
+		parser   PipelineParser
+		expected string
+		err      string
+	}{
+		{
+			name: "values are replaced",
+			pipeline: "env:\n" +
+				"  TOKEN: !vault secret/deploy # a comment\n" +
+				"steps:\n" +
+				"  - command: echo $TOKEN\n" +
+				"    plugins:\n" +
+				"      - !file \"config.yml\"\n",
+			parser:   PipelineParser{TagHandlers: handlers},
+			expected: `{"env":{"TOKEN":"s3cr$t from secret/deploy in prod"},"steps":[{"command":"echo s3cr$t from secret/deploy in prod","plugins":[{"file":"config.yml","lines":2}]}]}`,
+		},
+		{
+			name:     "values aren't interpolated",
+			pipeline: "steps:\n  - command: !vault secret/deploy\n",
+			parser:   PipelineParser{TagHandlers: handlers, NoInterpolation: true},
+			expected: `{"steps":[{"command":"s3cr$t from secret/deploy in prod"}]}`,
+		},
+		{
+			name:     "block scalars are left alone",
+			pipeline: "steps:\n  - command: |\n      - !vault secret/deploy\n    label: !vault secret/label\n",
+			parser:   PipelineParser{TagHandlers: handlers},
+			expected: `{"steps":[{"command":"- !vault secret/deploy\n","label":"s3cr$t from secret/label in prod"}]}`,
+		},
+		{
+			name:     "unknown tags are ignored",
+			pipeline: "steps:\n  - command: !ssm /deploy/token\n",
+			parser:   PipelineParser{TagHandlers: handlers},
+			expected: `{"steps":[{"command":"/deploy/token"}]}`,
+		},
+		{
+			name:     "unknown tags are an error when strict",
+			pipeline: "steps:\n  - command: !ssm /deploy/token\n",
+			parser:   PipelineParser{TagHandlers: handlers, StrictTags: true},
+			err:      "Unknown YAML tag !ssm on line 2",
+		},
+		{
+			name:     "handler errors",
+			pipeline: "steps:\n  - command: !vault secret/missing\n",
+			parser:   PipelineParser{TagHandlers: handlers},
+			err:      "Failed to resolve the !vault tag on line 2: no such secret",
+		},
+		{
+			name:     "values can be on the following lines",
+			pipeline: "steps:\n  - plugins: !file\n      - docker\n",
+			parser:   PipelineParser{TagHandlers: handlers},
+			expected: `{"steps":[{"plugins":{"file":["docker"],"lines":2}}]}`,
+		},
+		{
+			name:     "values in flow style and anchors are replaced",
+			pipeline: "env: {TOKEN: &token !vault secret/deploy}\nsteps:\n  - {command: \"echo !vault secret/label\", label: *token}\n",
+			parser:   PipelineParser{TagHandlers: handlers},
+			expected: `{"env":{"TOKEN":"s3cr$t from secret/deploy in prod"},"steps":[{"command":"echo !vault secret/label","label":"s3cr$t from secret/deploy in prod"}]}`,
+		},
+		{
+			name:     "values in multi-line strings are left alone",
+			pipeline: "steps:\n  - command: \"echo\n      label: !vault secret/label\"\n",
+			parser:   PipelineParser{TagHandlers: handlers},
+			expected: `{"steps":[{"command":"echo label: !vault secret/label"}]}`,
+		},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			tc.parser.Pipeline = []byte(tc.pipeline)
+			tc.parser.Env = env.FromSlice([]string{"VAULT_ENV=prod"})
+
+			result, err := tc.parser.Parse()
+			if tc.err != "" {
+				assert.EqualError(t, err, tc.err)
+				return
+			}
+			if !assert.NoError(t, err) {
+				return
+			}
+
+			j, err := json.Marshal(result)
+			assert.NoError(t, err)
+			assert.JSONEq(t, tc.expected, string(j))
+		})
+	}
+}
@@ -0,0 +1,429 @@
+package agent
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	// This is a fork of gopkg.in/yaml.v2 that fixes anchors with MapSlice
+	yaml "github.com/buildkite/yaml"
+)
+
+var templateParamRegex = regexp.MustCompile(`\{\{\s*([a-zA-Z_][a-zA-Z0-9_-]*)\s*\}\}`)
+
+// expandTemplates expands any steps with a `template: name` key using the
+// named templates in the pipeline's top-level `templates` block. The template's
+// keys are merged with the step's, with the step's winning, and any
+// `{{ param }}`'s in the template are replaced with the values in the step's
+// `with` map, apart from `{{ matrix }}`'s which are left for the matrix
+// expansion. The `templates` block is removed from the pipeline.
+func expandTemplates(pipeline yaml.MapSlice) (yaml.MapSlice, error) {
+	item, ok := mapSliceItem("templates", pipeline)
+	if !ok {
+		return pipeline, nil
+	}
+
+	templatesMap, ok := item.Value.(yaml.MapSlice)
+	if !ok {
+		return nil, fmt.Errorf("Expected pipeline top-level templates block to be a map, got %T", item.Value)
+	}
+
+	templates := map[string]yaml.MapSlice{}
+	for _, t := range templatesMap {
+		name, ok := t.Key.(string)
+		if !ok {
+			return nil, fmt.Errorf("Unexpected type of %T for template name %v", t.Key, t.Key)
+		}
+		template, ok := t.Value.(yaml.MapSlice)
+		if !ok {
+			return nil, fmt.Errorf("Expected template %q to be a map, got %T", name, t.Value)
+		}
+		templates[name] = template
+	}
+
+	expanded := yaml.MapSlice{}
+	for _, pipelineItem := range pipeline {
+		if k, ok := pipelineItem.Key.(string); ok && k == "templates" {
+			continue
+		}
+		if k, ok := pipelineItem.Key.(string); ok && k == "steps" {
+			if steps, ok := pipelineItem.Value.([]interface{}); ok {
+				expandedSteps, err := expandTemplateSteps(steps, templates)
+				if err != nil {
+					return nil, err
+				}
+				pipelineItem.Value = expandedSteps
+			}
+		}
+		expanded = append(expanded, pipelineItem)
+	}
+
+	return expanded, nil
+}
+
+func expandTemplateSteps(steps []interface{}, templates map[string]yaml.MapSlice) ([]interface{}, error) {
+	expanded := make([]interface{}, 0, len(steps))
+
+	for _, step := range steps {
+		stepMap, ok := step.(yaml.MapSlice)
+		if !ok {
+			expanded = append(expanded, step)
+			continue
+		}
+
+		if item, ok := mapSliceItem("template", stepMap); ok {
+			var err error
+			if stepMap, err = expandTemplateStep(stepMap, item.Value, templates); err != nil {
+				return nil, err
+			}
+		}
+
+		// Group steps can use templates too
+		for idx, item := range stepMap {
+			if k, ok := item.Key.(string); ok && k == "steps" {
+				if children, ok := item.Value.([]interface{}); ok {
+					expandedChildren, err := expandTemplateSteps(children, templates)
+					if err != nil {
+						return nil, err
+					}
+					stepMap[idx].Value = expandedChildren
+				}
+			}
+		}
+
+		expanded = append(expanded, stepMap)
+	}
+
+	return expanded, nil
+}
+
+func expandTemplateStep(step yaml.MapSlice, nameValue interface{}, templates map[string]yaml.MapSlice) (yaml.MapSlice, error) {
+	name, _ := nameValue.(string)
+	template, ok := templates[name]
+	if !ok {
+		return nil, fmt.Errorf("Step uses unknown template %q", fmt.Sprint(nameValue))
+	}
+
+	params := map[string]string{}
+	if item, ok := mapSliceItem("with", step); ok {
+		with, ok := item.Value.(yaml.MapSlice)
+		if !ok {
+			return nil, fmt.Errorf("Expected `with` for template %q to be a map, got %T", name, item.Value)
+		}
+		for _, param := range with {
+			params[fmt.Sprint(param.Key)] = fmt.Sprint(param.Value)
+		}
+	}
+
+	substituted, err := substituteTemplateParams(template, name, params)
+	if err != nil {
+		return nil, err
+	}
+
+	// Start with the template, and then replace or add the step's own keys
+	merged := append(yaml.MapSlice{}, substituted.(yaml.MapSlice)...)
+	for _, item := range step {
+		if k, ok := item.Key.(string); ok && (k == "template" || k == "with") {
+			continue
+		}
+
+		replaced := false
+		for idx := range merged {
+			if merged[idx].Key == item.Key {
+				merged[idx].Value = item.Value
+				replaced = true
+				break
+			}
+		}
+		if !replaced {
+			merged = append(merged, item)
+		}
+	}
+
+	return merged, nil
+}
+
+// substituteTemplateParams returns a copy of a template value with all of the
+// `{{ param }}`'s in its strings replaced
+func substituteTemplateParams(value interface{}, name string, params map[string]string) (interface{}, error) {
+	switch v := value.(type) {
+	case string:
+		var missing string
+		result := templateParamRegex.ReplaceAllStringFunc(v, func(match string) string {
+			param := templateParamRegex.FindStringSubmatch(match)[1]
+			if isMatrixParam(param) {
+				return match
+			}
+			if replacement, ok := params[param]; ok {
+				return replacement
+			}
+			if missing == "" {
+				missing = param
+			}
+			return match
+		})
+		if missing != "" {
+			return nil, fmt.Errorf("Template %q uses the parameter %q, which isn't set in `with`", name, missing)
+		}
+		return result, nil
+
+	case yaml.MapSlice:
+		copy := make(yaml.MapSlice, 0, len(v))
+		for _, item := range v {
+			key, err := substituteTemplateParams(item.Key, name, params)
+			if err != nil {
+				return nil, err
+			}
+			value, err := substituteTemplateParams(item.Value, name, params)
+			if err != nil {
+				return nil, err
+			}
+			copy = append(copy, yaml.MapItem{Key: key, Value: value})
+		}
+		return copy, nil
+
+	case []interface{}:
+		copy := make([]interface{}, 0, len(v))
+		for _, item := range v {
+			value, err := substituteTemplateParams(item, name, params)
+			if err != nil {
+				return nil, err
+			}
+			copy = append(copy, value)
+		}
+		return copy, nil
+	}
+
+	return value, nil
+}
+
+// isMatrixParam returns whether a `{{ param }}` is a matrix value like
+// `{{ matrix }}` or `{{ matrix.os }}`, rather than a template parameter
+func isMatrixParam(param string) bool {
+	return param == "matrix" || strings.HasPrefix(param, "matrix.")
+}
+
+// expandExtends expands any steps with an `extends` key by deep merging them
+// onto the step template or step it names. Templates are looked up in the
+// pipeline's top-level `step_templates` block first, and then by step `key`.
+// Maps are merged with the extending step winning, and anything else
+// (including lists) is replaced. A step's `key` is never inherited. The
+// `step_templates` block is removed from the pipeline.
+func expandExtends(pipeline yaml.MapSlice) (yaml.MapSlice, error) {
+	bases := map[string]yaml.MapSlice{}
+
+	var steps []interface{}
+	if item, ok := mapSliceItem("steps", pipeline); ok {
+		steps, _ = item.Value.([]interface{})
+	}
+	collectKeyedSteps(steps, bases)
+
+	if item, ok := mapSliceItem("step_templates", pipeline); ok {
+		templatesMap, ok := item.Value.(yaml.MapSlice)
+		if !ok {
+			return nil, fmt.Errorf("Expected pipeline top-level step_templates block to be a map, got %T", item.Value)
+		}
+		for _, t := range templatesMap {
+			template, ok := t.Value.(yaml.MapSlice)
+			if !ok {
+				return nil, fmt.Errorf("Expected step template %q to be a map, got %T", fmt.Sprint(t.Key), t.Value)
+			}
+			bases[fmt.Sprint(t.Key)] = template
+		}
+	} else if !hasExtends(steps) {
+		return pipeline, nil
+	}
+
+	e := &stepExtender{bases: bases, resolved: map[string]yaml.MapSlice{}, resolving: map[string]bool{}}
+
+	expanded := yaml.MapSlice{}
+	for _, pipelineItem := range pipeline {
+		if k, ok := pipelineItem.Key.(string); ok && k == "step_templates" {
+			continue
+		}
+		if k, ok := pipelineItem.Key.(string); ok && k == "steps" && steps != nil {
+			expandedSteps, err := e.expandSteps(steps)
+			if err != nil {
+				return nil, err
+			}
+			pipelineItem.Value = expandedSteps
+		}
+		expanded = append(expanded, pipelineItem)
+	}
+
+	return expanded, nil
+}
+
+// collectKeyedSteps adds the steps with a `key`, including those in groups,
+// to a map of the steps that can be extended
+func collectKeyedSteps(steps []interface{}, bases map[string]yaml.MapSlice) {
+	for _, step := range steps {
+		stepMap, ok := step.(yaml.MapSlice)
+		if !ok {
+			continue
+		}
+		if item, ok := mapSliceItem("key", stepMap); ok {
+			if key, ok := item.Value.(string); ok {
+				bases[key] = stepMap
+			}
+		}
+		if item, ok := mapSliceItem("steps", stepMap); ok {
+			if children, ok := item.Value.([]interface{}); ok {
+				collectKeyedSteps(children, bases)
+			}
+		}
+	}
+}
+
+// hasExtends returns whether any of the steps, including those in groups,
+// extend another
+func hasExtends(steps []interface{}) bool {
+	for _, step := range steps {
+		stepMap, ok := step.(yaml.MapSlice)
+		if !ok {
+			continue
+		}
+		if _, ok := mapSliceItem("extends", stepMap); ok {
+			return true
+		}
+		if item, ok := mapSliceItem("steps", stepMap); ok {
+			if children, ok := item.Value.([]interface{}); ok && hasExtends(children) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+type stepExtender struct {
+	bases     map[string]yaml.MapSlice
+	resolved  map[string]yaml.MapSlice
+	resolving map[string]bool
+}
+
+func (e *stepExtender) expandSteps(steps []interface{}) ([]interface{}, error) {
+	expanded := make([]interface{}, 0, len(steps))
+
+	for _, step := range steps {
+		stepMap, ok := step.(yaml.MapSlice)
+		if !ok {
+			expanded = append(expanded, step)
+			continue
+		}
+
+		stepMap, err := e.extend(stepMap)
+		if err != nil {
+			return nil, err
+		}
+
+		// Group steps can extend, and have steps that extend
+		for idx, item := range stepMap {
+			if k, ok := item.Key.(string); ok && k == "steps" {
+				if children, ok := item.Value.([]interface{}); ok {
+					expandedChildren, err := e.expandSteps(children)
+					if err != nil {
+						return nil, err
+					}
+					stepMap[idx].Value = expandedChildren
+				}
+			}
+		}
+
+		expanded = append(expanded, stepMap)
+	}
+
+	return expanded, nil
+}
+
+// extend returns a step merged onto the step it extends, if it extends one
+func (e *stepExtender) extend(step yaml.MapSlice) (yaml.MapSlice, error) {
+	item, ok := mapSliceItem("extends", step)
+	if !ok {
+		return step, nil
+	}
+
+	name, ok := item.Value.(string)
+	if !ok {
+		return nil, fmt.Errorf("Expected `extends` to be a string, got %T", item.Value)
+	}
+
+	base, err := e.resolve(name)
+	if err != nil {
+		return nil, err
+	}
+
+	inherited := yaml.MapSlice{}
+	for _, baseItem := range base {
+		if k, ok := baseItem.Key.(string); ok && k == "key" {
+			continue
+		}
+		inherited = append(inherited, baseItem)
+	}
+
+	child := yaml.MapSlice{}
+	for _, stepItem := range step {
+		if k, ok := stepItem.Key.(string); ok && k == "extends" {
+			continue
+		}
+		child = append(child, stepItem)
+	}
+
+	return deepMergeMapSlices(inherited, child), nil
+}
+
+// resolve returns a step template or keyed step with its own `extends`
+// expanded
+func (e *stepExtender) resolve(name string) (yaml.MapSlice, error) {
+	if resolved, ok := e.resolved[name]; ok {
+		return resolved, nil
+	}
+
+	base, ok := e.bases[name]
+	if !ok {
+		return nil, fmt.Errorf("Step extends %q, which isn't a step template or step key", name)
+	}
+
+	if e.resolving[name] {
+		return nil, fmt.Errorf("Circular `extends` reference to %q", name)
+	}
+	e.resolving[name] = true
+	defer delete(e.resolving, name)
+
+	resolved, err := e.extend(base)
+	if err != nil {
+		return nil, err
+	}
+	e.resolved[name] = resolved
+
+	return resolved, nil
+}
+
+// deepMergeMapSlices returns a copy of base with the items in override merged
+// in. Maps in both are merged, and any other value in override replaces the
+// one in base.
+func deepMergeMapSlices(base, override yaml.MapSlice) yaml.MapSlice {
+	merged := append(yaml.MapSlice{}, base...)
+
+	for _, item := range override {
+		replaced := false
+		for idx := range merged {
+			if merged[idx].Key != item.Key {
+				continue
+			}
+			baseMap, baseIsMap := merged[idx].Value.(yaml.MapSlice)
+			overrideMap, overrideIsMap := item.Value.(yaml.MapSlice)
+			if baseIsMap && overrideIsMap {
+				merged[idx].Value = deepMergeMapSlices(baseMap, overrideMap)
+			} else {
+				merged[idx].Value = item.Value
+			}
+			replaced = true
+			break
+		}
+		if !replaced {
+			merged = append(merged, item)
+		}
+	}
+
+	return merged
+}
@@ -0,0 +1,208 @@
+package agent
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/buildkite/agent/env"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPipelineParserExpandsTemplates(t *testing.T) {
+	t.Parallel()
+
+	result, err := PipelineParser{
+		Pipeline: []byte(`env:
+  REGISTRY: docker.example.com
+templates:
+  deploy:
+    label: "Deploy {{ service }}"
+    command: "deploy.sh {{service}} $REGISTRY/{{ service }}"
+    agents:
+      queue: deploy
+    timeout_in_minutes: 10
+steps:
+  - template: deploy
+    with:
+      service: api
+  - template: deploy
+    with:
+      service: web
+    timeout_in_minutes: 20
+  - group: Workers
+    steps:
+      - template: deploy
+        with:
+          service: worker
+  - command: "echo {{ not a param }}"
+`),
+		Env:             env.FromSlice([]string{}),
+		ExpandTemplates: true,
+	}.Parse()
+	assert.NoError(t, err)
+
+	j, err := json.Marshal(result)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"env":{"REGISTRY":"docker.example.com"},"steps":[`+
+		`{"agents":{"queue":"deploy"},"command":"deploy.sh api docker.example.com/api","label":"Deploy api","timeout_in_minutes":10},`+
+		`{"agents":{"queue":"deploy"},"command":"deploy.sh web docker.example.com/web","label":"Deploy web","timeout_in_minutes":20},`+
+		`{"group":"Workers","steps":[{"agents":{"queue":"deploy"},"command":"deploy.sh worker docker.example.com/worker","label":"Deploy worker","timeout_in_minutes":10}]},`+
+		`{"command":"echo {{ not a param }}"}]}`, string(j))
+}
+
+func TestPipelineParserTemplateErrors(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		pipeline string
+		err      string
+	}{
+		{
+			pipeline: "templates:\n  test:\n    command: make\nsteps:\n  - template: nope\n",
+			err:      `Failed to parse pipeline: Step uses unknown template "nope"`,
+		},
+		{
+			pipeline: "templates:\n  test:\n    command: make {{ target }}\nsteps:\n  - template: test\n",
+			err:      `Failed to parse pipeline: Template "test" uses the parameter "target", which isn't set in ` + "`with`",
+		},
+		{
+			pipeline: "templates: [nope]\nsteps: []\n",
+			err:      "Failed to parse pipeline: Expected pipeline top-level templates block to be a map, got []interface {}",
+		},
+	} {
+		_, err := PipelineParser{Pipeline: []byte(tc.pipeline), Env: env.FromSlice([]string{}), ExpandTemplates: true}.Parse()
+		assert.EqualError(t, err, tc.err)
+	}
+}
+
+func TestPipelineParserTemplatesWithMatrix(t *testing.T) {
+	t.Parallel()
+
+	pipeline := []byte(`templates:
+  test:
+    command: "echo {{ matrix }} {{ target }}"
+    matrix: [a, b]
+steps:
+  - template: test
+    with:
+      target: all
+`)
+
+	result, err := PipelineParser{Pipeline: pipeline, Env: env.FromSlice([]string{}), ExpandTemplates: true}.Parse()
+	assert.NoError(t, err)
+
+	j, err := json.Marshal(result)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"steps":[{"command":"echo {{ matrix }} all","matrix":["a","b"]}]}`, string(j))
+
+	result, err = PipelineParser{Pipeline: pipeline, Env: env.FromSlice([]string{}), ExpandTemplates: true, ExpandMatrix: true}.Parse()
+	assert.NoError(t, err)
+
+	var commands []interface{}
+	for _, step := range pipelineSteps(result) {
+		commands = append(commands, step.(map[string]interface{})["command"])
+	}
+	assert.Equal(t, []interface{}{"echo a all", "echo b all"}, commands)
+
+	// Without ExpandTemplates the templates are left alone
+	result, err = PipelineParser{Pipeline: pipeline, Env: env.FromSlice([]string{})}.Parse()
+	assert.NoError(t, err)
+
+	j, err = json.Marshal(result)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"steps":[{"template":"test","with":{"target":"all"}}],"templates":{"test":{"command":"echo {{ matrix }} {{ target }}","matrix":["a","b"]}}}`, string(j))
+}
+
+func TestPipelineParserExpandsExtends(t *testing.T) {
+	t.Parallel()
+
+	result, err := PipelineParser{
+		Pipeline: []byte(`env:
+  REGISTRY: docker.example.com
+step_templates:
+  deploy:
+    label: Deploy
+    command: deploy.sh $$SERVICE
+    env:
+      REGISTRY: $REGISTRY
+      STAGE: production
+    agents:
+      queue: deploy
+    plugins:
+      - docker#v1.0.0
+  canary:
+    extends: deploy
+    env:
+      STAGE: canary
+steps:
+  - key: build
+    label: Build
+    command: make
+    agents:
+      queue: build
+  - extends: build
+    label: Build docs
+    command: make docs
+  - extends: deploy
+    env:
+      SERVICE: api
+    plugins:
+      - ecr#v1.0.0
+  - group: Canaries
+    steps:
+      - extends: canary
+        env:
+          SERVICE: web
+`),
+		Env:           env.FromSlice([]string{}),
+		ExpandExtends: true,
+	}.Parse()
+	assert.NoError(t, err)
+
+	j, err := json.Marshal(result)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"env":{"REGISTRY":"docker.example.com"},"steps":[`+
+		`{"agents":{"queue":"build"},"command":"make","key":"build","label":"Build"},`+
+		`{"agents":{"queue":"build"},"command":"make docs","label":"Build docs"},`+
+		`{"agents":{"queue":"deploy"},"command":"deploy.sh $SERVICE","env":{"REGISTRY":"docker.example.com","SERVICE":"api","STAGE":"production"},"label":"Deploy","plugins":["ecr#v1.0.0"]},`+
+		`{"group":"Canaries","steps":[{"agents":{"queue":"deploy"},"command":"deploy.sh $SERVICE","env":{"REGISTRY":"docker.example.com","SERVICE":"web","STAGE":"canary"},"label":"Deploy","plugins":["docker#v1.0.0"]}]}]}`, string(j))
+}
+
+func TestPipelineParserLeavesExtendsWithoutExpandExtends(t *testing.T) {
+	t.Parallel()
+
+	result, err := PipelineParser{
+		Pipeline: []byte("step_templates:\n  test:\n    command: make\nsteps:\n  - extends: test\n"),
+		Env:      env.FromSlice([]string{}),
+	}.Parse()
+	assert.NoError(t, err)
+
+	j, err := json.Marshal(result)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"step_templates":{"test":{"command":"make"}},"steps":[{"extends":"test"}]}`, string(j))
+}
+
+func TestPipelineParserExtendsErrors(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		pipeline string
+		err      string
+	}{
+		{
+			pipeline: "steps:\n  - extends: nope\n",
+			err:      `Failed to parse pipeline: Step extends "nope", which isn't a step template or step key`,
+		},
+		{
+			pipeline: "step_templates:\n  a:\n    extends: b\n  b:\n    extends: a\nsteps:\n  - extends: a\n",
+			err:      "Failed to parse pipeline: Circular `extends` reference to \"a\"",
+		},
+		{
+			pipeline: "step_templates: []\nsteps:\n  - command: make\n",
+			err:      `Failed to parse pipeline: Expected pipeline top-level step_templates block to be a map, got []interface {}`,
+		},
+	} {
+		_, err := PipelineParser{Pipeline: []byte(tc.pipeline), Env: env.FromSlice([]string{}), ExpandExtends: true}.Parse()
+		assert.EqualError(t, err, tc.err, tc.pipeline)
+	}
+}
@@ -0,0 +1,103 @@
+package agent
+
+import (
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+
+	// This is a fork of gopkg.in/yaml.v2 that fixes anchors with MapSlice
+	yaml "github.com/buildkite/yaml"
+)
+
+// isTOMLFilename returns whether a pipeline's filename has a `.toml` extension
+func isTOMLFilename(filename string) bool {
+	return strings.EqualFold(filepath.Ext(filename), ".toml")
+}
+
+// tomlToYAML converts a TOML pipeline to YAML, keeping the order of the keys,
+// so that it's parsed in the same way as a YAML pipeline. A top-level `env`
+// table is the same as an `env:` block.
+func tomlToYAML(src []byte) ([]byte, error) {
+	ordered, err := decodeTOML(src)
+	if err != nil {
+		return nil, err
+	}
+	return yaml.Marshal(ordered)
+}
+
+// decodeTOML decodes TOML with its tables as ordered yaml.MapSlices
+func decodeTOML(src []byte) (yaml.MapSlice, error) {
+	var data map[string]interface{}
+	md, err := toml.Decode(string(src), &data)
+	if err != nil {
+		return nil, err
+	}
+	return orderTOMLValue(data, md.Keys(), nil).(yaml.MapSlice), nil
+}
+
+// orderTOMLValue returns a decoded TOML value with its tables as
+// yaml.MapSlices, with keys in the order they're defined in the source. Keys
+// that aren't in the order (like those of inline tables in arrays) come after
+// the rest, sorted.
+func orderTOMLValue(value interface{}, keys []toml.Key, parent toml.Key) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		var ordered yaml.MapSlice
+		seen := map[string]bool{}
+
+		for _, key := range keys {
+			if len(key) != len(parent)+1 || !tomlKeyHasPrefix(key, parent) {
+				continue
+			}
+			name := key[len(parent)]
+			if child, ok := v[name]; ok && !seen[name] {
+				seen[name] = true
+				ordered = append(ordered, yaml.MapItem{Key: name, Value: orderTOMLValue(child, keys, key)})
+			}
+		}
+
+		var rest []string
+		for name := range v {
+			if !seen[name] {
+				rest = append(rest, name)
+			}
+		}
+		sort.Strings(rest)
+		for _, name := range rest {
+			ordered = append(ordered, yaml.MapItem{Key: name, Value: orderTOMLValue(v[name], keys, append(parent[:len(parent):len(parent)], name))})
+		}
+
+		return ordered
+
+	case []map[string]interface{}:
+		items := make([]interface{}, len(v))
+		for idx, item := range v {
+			items[idx] = orderTOMLValue(item, keys, parent)
+		}
+		return items
+
+	case []interface{}:
+		items := make([]interface{}, len(v))
+		for idx, item := range v {
+			items[idx] = orderTOMLValue(item, keys, parent)
+		}
+		return items
+
+	case time.Time:
+		return v.Format(time.RFC3339Nano)
+	}
+
+	return value
+}
+
+func tomlKeyHasPrefix(key, prefix toml.Key) bool {
+	for idx := range prefix {
+		if key[idx] != prefix[idx] {
+			return false
+		}
+	}
+	return true
+}
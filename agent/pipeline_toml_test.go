@@ -0,0 +1,91 @@
+package agent
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/buildkite/agent/env"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPipelineParserParsesTOML(t *testing.T) {
+	t.Parallel()
+
+	pipeline := []byte(`
+[env]
+ZEBRA = "stripes"
+APPLE = "$ZEBRA and ${FRIEND}"
+
+[[steps]]
+label = "Build"
+command = "make build $APPLE"
+agents = { queue = "default" }
+
+[[steps]]
+wait = "~"
+
+[[steps]]
+label = "Test"
+commands = ["make test", "make lint"]
+parallelism = 2
+`)
+
+	expected := `{"env":{"ZEBRA":"stripes","APPLE":"stripes and friend"},"steps":[` +
+		`{"label":"Build","command":"make build stripes and friend","agents":{"queue":"default"}},` +
+		`{"wait":"~"},` +
+		`{"label":"Test","commands":["make test","make lint"],"parallelism":2}]}`
+
+	// By the extension, or by the TOML option
+	for _, filename := range []string{"pipeline.toml", ""} {
+		result, err := PipelineParser{
+			Filename: filename,
+			Pipeline: pipeline,
+			Env:      env.FromSlice([]string{"FRIEND=friend"}),
+			TOML:     filename == "",
+		}.Parse()
+		if !assert.NoError(t, err, filename) {
+			continue
+		}
+
+		j, err := json.Marshal(result)
+		assert.NoError(t, err)
+		assert.JSONEq(t, expected, string(j), filename)
+
+		// The env block is processed in the order it's defined in
+		envMap, ok := result.(map[string]interface{})["env"].(map[string]interface{})
+		assert.True(t, ok)
+		assert.Equal(t, "stripes and friend", envMap["APPLE"])
+	}
+}
+
+func TestPipelineParserTOMLErrors(t *testing.T) {
+	t.Parallel()
+
+	_, err := PipelineParser{
+		Filename: "pipeline.toml",
+		Pipeline: []byte("steps = [\n"),
+		Env:      env.New(),
+	}.Parse()
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "Failed to parse pipeline.toml: ")
+
+	// A pipeline that's neither gets the YAML error
+	_, err = PipelineParser{Pipeline: []byte("steps: [\n"), Env: env.New()}.Parse()
+	assert.EqualError(t, err, "Failed to parse pipeline: line 1: did not find expected node content")
+}
+
+func TestPipelineParserOnlyParsesTOMLWhenAsked(t *testing.T) {
+	t.Parallel()
+
+	// Pipelines that happen to be valid TOML are still YAML
+	_, err := PipelineParser{Pipeline: []byte("steps = 1\n"), Env: env.New()}.Parse()
+	assert.EqualError(t, err, "Failed to parse pipeline: unmarshal errors:\n  line 1: cannot unmarshal !!str `steps = 1` into yaml.MapSlice")
+
+	// As are ones that only say they're TOML in a `# pipeline:` comment
+	result, err := PipelineParser{Pipeline: []byte("# pipeline: deploy.toml\nsteps:\n  - command: make\n"), Env: env.New()}.Parse()
+	assert.NoError(t, err)
+
+	j, err := json.Marshal(result)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"steps":[{"command":"make"}]}`, string(j))
+}
@@ -0,0 +1,51 @@
+package agent
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/buildkite/agent/api"
+	"github.com/buildkite/agent/logger"
+	"github.com/buildkite/agent/retry"
+)
+
+// pipelineUploadInterval is how long the first retry of a failed upload waits,
+// and it doubles after each attempt
+var pipelineUploadInterval = 1 * time.Second
+
+// ParseAndUpload parses the pipeline and uploads it to the job with the given
+// ID. Parsing and any enabled validations happen before anything is sent, so
+// validation errors are returned without making a request. Uploads that fail
+// with a 5xx response or a connection error are retried with exponential
+// backoff.
+func (p PipelineParser) ParseAndUpload(client *api.Client, jobID string) error {
+	parsed, err := p.Parse()
+	if err != nil {
+		return err
+	}
+
+	// The UUID is the same for each attempt, so the API can tell that they're
+	// all for the same pipeline change
+	pipeline := &api.Pipeline{UUID: api.NewUUID(), Pipeline: parsed}
+
+	err = retry.Do(func(s *retry.Stats) error {
+		_, err := client.Pipelines.Upload(jobID, pipeline)
+		if err != nil {
+			s.Interval = pipelineUploadInterval << uint(s.Attempt-1)
+			logger.Warn("%s (%s)", err, s)
+
+			// Only server errors are worth retrying
+			if apierr, ok := err.(*api.ErrorResponse); ok && apierr.Response.StatusCode < 500 {
+				logger.Error("Unrecoverable error, skipping retries")
+				s.Break()
+			}
+		}
+
+		return err
+	}, &retry.Config{Maximum: 5, Interval: pipelineUploadInterval})
+	if err != nil {
+		return fmt.Errorf("Failed to upload pipeline: %v", err)
+	}
+
+	return nil
+}
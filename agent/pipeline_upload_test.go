@@ -0,0 +1,93 @@
+package agent
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/buildkite/agent/api"
+	"github.com/stretchr/testify/assert"
+)
+
+func newPipelineUploadTestClient(t *testing.T, handler http.HandlerFunc) (*api.Client, func()) {
+	ts := httptest.NewServer(handler)
+
+	client := api.NewClient(http.DefaultClient)
+	baseURL, err := url.Parse(ts.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.BaseURL = baseURL
+
+	return client, ts.Close
+}
+
+func TestParseAndUploadRetriesServerErrors(t *testing.T) {
+	defer func(interval time.Duration) { pipelineUploadInterval = interval }(pipelineUploadInterval)
+	pipelineUploadInterval = time.Millisecond
+
+	var uuids []string
+	client, closeServer := newPipelineUploadTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/jobs/job-1/pipelines", r.URL.Path)
+
+		var body struct {
+			UUID     string      `json:"uuid"`
+			Pipeline interface{} `json:"pipeline"`
+		}
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+		assert.Equal(t, map[string]interface{}{"steps": []interface{}{map[string]interface{}{"command": "make"}}}, body.Pipeline)
+		uuids = append(uuids, body.UUID)
+
+		if len(uuids) < 3 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+	defer closeServer()
+
+	err := PipelineParser{Pipeline: []byte("steps:\n  - command: make\n")}.ParseAndUpload(client, "job-1")
+	assert.NoError(t, err)
+
+	assert.Len(t, uuids, 3)
+	assert.Equal(t, uuids[0], uuids[1])
+	assert.Equal(t, uuids[0], uuids[2])
+}
+
+func TestParseAndUploadDoesntRetryClientErrors(t *testing.T) {
+	defer func(interval time.Duration) { pipelineUploadInterval = interval }(pipelineUploadInterval)
+	pipelineUploadInterval = time.Millisecond
+
+	requests := 0
+	client, closeServer := newPipelineUploadTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		w.Write([]byte(`{"message":"Step 1 is invalid"}`))
+	})
+	defer closeServer()
+
+	err := PipelineParser{Pipeline: []byte("steps:\n  - command: make\n")}.ParseAndUpload(client, "job-1")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "Step 1 is invalid")
+	assert.Equal(t, 1, requests)
+}
+
+func TestParseAndUploadValidatesBeforeUploading(t *testing.T) {
+	t.Parallel()
+
+	requests := 0
+	client, closeServer := newPipelineUploadTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		requests++
+	})
+	defer closeServer()
+
+	err := PipelineParser{
+		Pipeline:           []byte("steps:\n  - group:\n    steps:\n      - command: make\n"),
+		RequireGroupLabels: true,
+	}.ParseAndUpload(client, "job-1")
+	assert.EqualError(t, err, "Pipeline validation failed: Group step 0 is missing a label")
+	assert.Equal(t, 0, requests)
+}
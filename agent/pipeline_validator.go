@@ -0,0 +1,402 @@
+package agent
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// PipelineValidationError is returned from PipelineParser.Parse when one or
+// more of the optional validations fail. Each failure is kept so that callers
+// can type-assert on the individual errors.
+type PipelineValidationError struct {
+	Errors []error
+}
+
+func (e *PipelineValidationError) Error() string {
+	messages := []string{}
+	for _, err := range e.Errors {
+		messages = append(messages, err.Error())
+	}
+	return fmt.Sprintf("Pipeline validation failed: %s", strings.Join(messages, ", "))
+}
+
+// MissingGroupLabelError is returned for a group step without a non-empty
+// `group` or `label`
+type MissingGroupLabelError struct {
+	GroupIndex int
+}
+
+func (e MissingGroupLabelError) Error() string {
+	return fmt.Sprintf("Group step %d is missing a label", e.GroupIndex)
+}
+
+// MissingConditionCommentError is returned for a step with an `if` condition
+// that doesn't have a comment explaining it
+type MissingConditionCommentError struct {
+	StepIndex string
+}
+
+func (e MissingConditionCommentError) Error() string {
+	return fmt.Sprintf("Step %s has an `if` condition without a comment", e.StepIndex)
+}
+
+// OrphanedAllowDependencyFailureError is returned for a step that allows
+// dependency failures without depending on anything
+type OrphanedAllowDependencyFailureError struct {
+	StepIndex string
+}
+
+func (e OrphanedAllowDependencyFailureError) Error() string {
+	return fmt.Sprintf("Step %s sets `allow_dependency_failure` without `depends_on`", e.StepIndex)
+}
+
+// MissingTimeoutError is returned for a command step without a timeout when
+// timeouts are being enforced
+type MissingTimeoutError struct {
+	StepIndex string
+}
+
+func (e MissingTimeoutError) Error() string {
+	return fmt.Sprintf("Step %s is missing `timeout_in_minutes`", e.StepIndex)
+}
+
+// MissingIdempotencyMarkerError is returned for a command step that isn't
+// marked as being safe to retry
+type MissingIdempotencyMarkerError struct {
+	StepIndex string
+}
+
+func (e MissingIdempotencyMarkerError) Error() string {
+	return fmt.Sprintf("Step %s isn't marked as idempotent", e.StepIndex)
+}
+
+// InvalidConcurrencyValueError is returned for a step with a concurrency that
+// isn't a positive integer
+type InvalidConcurrencyValueError struct {
+	StepIndex string
+	Value     int
+}
+
+func (e InvalidConcurrencyValueError) Error() string {
+	return fmt.Sprintf("Step %s has a concurrency of %d, it must be a positive integer", e.StepIndex, e.Value)
+}
+
+// MissingRequiredPluginError is returned for a command step that targets a
+// queue without using the plugin required for that queue
+type MissingRequiredPluginError struct {
+	StepIndex string
+	Queue     string
+	Plugin    string
+}
+
+func (e MissingRequiredPluginError) Error() string {
+	return fmt.Sprintf("Step %s targets the %q queue but doesn't use the %q plugin", e.StepIndex, e.Queue, e.Plugin)
+}
+
+// ParallelismLimitError is returned for a step with a parallelism higher than
+// the configured maximum
+type ParallelismLimitError struct {
+	StepIndex string
+	Value     int
+	Max       int
+}
+
+func (e ParallelismLimitError) Error() string {
+	return fmt.Sprintf("Step %s has a parallelism of %d, which is more than the maximum of %d", e.StepIndex, e.Value, e.Max)
+}
+
+// InvalidTriggerSlugError is returned for a trigger step with a pipeline slug
+// that isn't valid
+type InvalidTriggerSlugError struct {
+	StepIndex string
+	Slug      string
+}
+
+func (e InvalidTriggerSlugError) Error() string {
+	return fmt.Sprintf("Step %s triggers %q, which isn't a valid pipeline slug", e.StepIndex, e.Slug)
+}
+
+// validate runs the validations that have been enabled on the parser against
+// the parsed pipeline, and returns all of the failures at once
+func (p PipelineParser) validate(pipeline interface{}) error {
+	var errs []error
+
+	if p.RequireGroupLabels {
+		errs = append(errs, validateGroupLabels(pipeline)...)
+	}
+
+	if p.RequireConditionComments {
+		errs = append(errs, validateConditionComments(pipeline, p.Pipeline)...)
+	}
+
+	if p.ValidateAllowDependencyFailure {
+		errs = append(errs, validateAllowDependencyFailure(pipeline)...)
+	}
+
+	if p.EnforceTimeout {
+		errs = append(errs, validateTimeouts(pipeline)...)
+	}
+
+	if p.RequireIdempotencyMarkers {
+		errs = append(errs, validateIdempotencyMarkers(pipeline, p.Pipeline)...)
+	}
+
+	if p.ValidateConcurrencyValue {
+		errs = append(errs, validateConcurrencyValues(pipeline)...)
+	}
+
+	if len(p.QueueRequiredPlugins) > 0 {
+		errs = append(errs, validateQueueRequiredPlugins(pipeline, p.QueueRequiredPlugins)...)
+	}
+
+	if p.MaxParallelism > 0 {
+		errs = append(errs, validateMaxParallelism(pipeline, p.MaxParallelism)...)
+	}
+
+	if p.ValidateTriggerSlugs {
+		errs = append(errs, validateTriggerSlugs(pipeline)...)
+	}
+
+	if len(errs) > 0 {
+		return &PipelineValidationError{Errors: errs}
+	}
+
+	return nil
+}
+
+func validateGroupLabels(pipeline interface{}) []error {
+	var errs []error
+
+	for idx, step := range pipelineSteps(pipeline) {
+		stepMap, ok := step.(map[string]interface{})
+		if !ok || !isGroupStep(stepMap) {
+			continue
+		}
+
+		// A group can be labelled either with `group: name` or `label: name`
+		if stepString(stepMap, "group") == "" && stepString(stepMap, "label") == "" {
+			errs = append(errs, MissingGroupLabelError{GroupIndex: idx})
+		}
+	}
+
+	return errs
+}
+
+// validateConditionComments checks the source for a comment on or directly
+// above each `if` condition. Conditions that don't appear in the step's own
+// source, such as those merged in from an anchor, are reported as uncommented.
+func validateConditionComments(pipeline interface{}, src []byte) []error {
+	var errs []error
+
+	keys, _, err := parseYAMLSource(src)
+	if err != nil {
+		return []error{fmt.Errorf("Failed to find the comments on conditions: %v", parseYAMLError(err))}
+	}
+
+	commented := map[string]bool{}
+	for _, key := range keys {
+		commented[key.Path] = key.InlineComment != "" || len(key.HeadComment) > 0
+	}
+
+	// Bare lists of steps don't have a `steps` key in the source
+	_, isSlice := pipeline.([]interface{})
+
+	walkSteps(pipelineSteps(pipeline), "steps", func(path string, step map[string]interface{}) {
+		if _, ok := step["if"]; !ok {
+			return
+		}
+
+		sourcePath := path + ".if"
+		if isSlice {
+			sourcePath = strings.TrimPrefix(sourcePath, "steps")
+		}
+
+		if !commented[sourcePath] {
+			errs = append(errs, MissingConditionCommentError{StepIndex: path})
+		}
+	})
+
+	return errs
+}
+
+func validateAllowDependencyFailure(pipeline interface{}) []error {
+	var errs []error
+
+	walkSteps(pipelineSteps(pipeline), "steps", func(path string, step map[string]interface{}) {
+		if allow, _ := step["allow_dependency_failure"].(bool); !allow {
+			return
+		}
+		if dependsOn, ok := step["depends_on"]; !ok || dependsOn == nil {
+			errs = append(errs, OrphanedAllowDependencyFailureError{StepIndex: path})
+		}
+	})
+
+	return errs
+}
+
+func validateTimeouts(pipeline interface{}) []error {
+	var errs []error
+
+	walkSteps(pipelineSteps(pipeline), "steps", func(path string, step map[string]interface{}) {
+		if timeout, ok := step["timeout_in_minutes"]; isCommandStep(step) && (!ok || timeout == nil) {
+			errs = append(errs, MissingTimeoutError{StepIndex: path})
+		}
+	})
+
+	return errs
+}
+
+// validateIdempotencyMarkers checks that every command step either has
+// `metadata.idempotent: true`, or a comment containing "idempotent" on or
+// directly above its `command` or `commands` key, or on one of the commands.
+//
+// This is a heuristic. Commands that come from anchors need the metadata key,
+// as their comments aren't in the step's own source, and there's no check
+// that the comment doesn't say something like "not idempotent".
+func validateIdempotencyMarkers(pipeline interface{}, src []byte) []error {
+	var errs []error
+
+	keys, _, err := parseYAMLSource(src)
+	if err != nil {
+		return []error{fmt.Errorf("Failed to find the comments on commands: %v", parseYAMLError(err))}
+	}
+
+	marked := map[string]bool{}
+	for _, key := range keys {
+		comments := append([]string{key.InlineComment}, key.HeadComment...)
+		for _, comment := range comments {
+			if strings.Contains(strings.ToLower(comment), "idempotent") {
+				marked[key.Path] = true
+			}
+		}
+	}
+
+	// Bare lists of steps don't have a `steps` key in the source
+	_, isSlice := pipeline.([]interface{})
+
+	walkSteps(pipelineSteps(pipeline), "steps", func(path string, step map[string]interface{}) {
+		if !isCommandStep(step) {
+			return
+		}
+
+		if metadata, ok := step["metadata"].(map[string]interface{}); ok {
+			if idempotent, _ := metadata["idempotent"].(bool); idempotent {
+				return
+			}
+		}
+
+		sourcePath := path
+		if isSlice {
+			sourcePath = strings.TrimPrefix(sourcePath, "steps")
+		}
+
+		for markedPath := range marked {
+			for _, key := range []string{".command", ".commands"} {
+				if markedPath == sourcePath+key || strings.HasPrefix(markedPath, sourcePath+key+"[") {
+					return
+				}
+			}
+		}
+
+		errs = append(errs, MissingIdempotencyMarkerError{StepIndex: path})
+	})
+
+	return errs
+}
+
+func validateConcurrencyValues(pipeline interface{}) []error {
+	var errs []error
+
+	walkSteps(pipelineSteps(pipeline), "steps", func(path string, step map[string]interface{}) {
+		switch v := step["concurrency"].(type) {
+		case int:
+			if v <= 0 {
+				errs = append(errs, InvalidConcurrencyValueError{StepIndex: path, Value: v})
+			}
+		case float64:
+			if v <= 0 || v != float64(int(v)) {
+				errs = append(errs, InvalidConcurrencyValueError{StepIndex: path, Value: int(v)})
+			}
+		}
+	})
+
+	return errs
+}
+
+func validateQueueRequiredPlugins(pipeline interface{}, required map[string]string) []error {
+	var errs []error
+
+	walkSteps(pipelineSteps(pipeline), "steps", func(path string, step map[string]interface{}) {
+		if !isCommandStep(step) {
+			return
+		}
+
+		queue := stepQueue(step)
+		plugin, ok := required[queue]
+		if !ok || queue == "" {
+			return
+		}
+
+		for _, location := range stepPlugins(step) {
+			if pluginMatches(location, plugin) {
+				return
+			}
+		}
+
+		errs = append(errs, MissingRequiredPluginError{StepIndex: path, Queue: queue, Plugin: plugin})
+	})
+
+	return errs
+}
+
+// pluginMatches returns whether a plugin location (such as
+// `github.com/buildkite-plugins/docker-compose-buildkite-plugin#v1.0.0`)
+// refers to a plugin name (such as `docker-compose`). If the name has a
+// version, it must match too.
+func pluginMatches(location, name string) bool {
+	if strings.Contains(name, "#") {
+		return location == name
+	}
+
+	plugin, err := CreatePlugin(location, nil)
+	if err != nil {
+		return false
+	}
+
+	return plugin.Location == name || plugin.Name() == name
+}
+
+func validateMaxParallelism(pipeline interface{}, max int) []error {
+	var errs []error
+
+	walkSteps(pipelineSteps(pipeline), "steps", func(path string, step map[string]interface{}) {
+		if !isCommandStep(step) {
+			return
+		}
+		if parallelism, ok := step["parallelism"].(int); ok && parallelism > max {
+			errs = append(errs, ParallelismLimitError{StepIndex: path, Value: parallelism, Max: max})
+		}
+	})
+
+	return errs
+}
+
+var triggerSlugRegex = regexp.MustCompile(`^[a-z0-9][a-z0-9-]*$`)
+
+func validateTriggerSlugs(pipeline interface{}) []error {
+	var errs []error
+
+	walkSteps(pipelineSteps(pipeline), "steps", func(path string, step map[string]interface{}) {
+		trigger, ok := step["trigger"]
+		if !ok {
+			return
+		}
+		slug, _ := trigger.(string)
+		if !triggerSlugRegex.MatchString(slug) {
+			errs = append(errs, InvalidTriggerSlugError{StepIndex: path, Slug: fmt.Sprint(trigger)})
+		}
+	})
+
+	return errs
+}
@@ -0,0 +1,328 @@
+package agent
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPipelineParserRequireGroupLabels(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		name     string
+		pipeline string
+		errors   []error
+	}{
+		{
+			name:     "labelled",
+			pipeline: "steps:\n  - group: Tests\n    steps:\n      - command: make test\n  - type: group\n    label: Deploy\n    steps:\n      - command: make deploy",
+		},
+		{
+			name:     "labelled with an empty group name",
+			pipeline: "steps:\n  - group: \"\"\n    label: Tests\n    steps:\n      - command: make test",
+		},
+		{
+			name:     "unlabelled",
+			pipeline: "steps:\n  - command: make\n  - type: group\n    steps:\n      - command: make test",
+			errors:   []error{MissingGroupLabelError{GroupIndex: 1}},
+		},
+		{
+			name:     "empty label",
+			pipeline: "steps:\n  - group: \"\"\n    steps:\n      - command: make test\n  - group: ~\n    label: \"  \"\n    steps:\n      - command: make deploy",
+			errors:   []error{MissingGroupLabelError{GroupIndex: 0}, MissingGroupLabelError{GroupIndex: 1}},
+		},
+	} {
+		tc := tc
+		t.Run(tc.name, func(tt *testing.T) {
+			tt.Parallel()
+			_, err := PipelineParser{Pipeline: []byte(tc.pipeline), RequireGroupLabels: true}.Parse()
+			if tc.errors == nil {
+				assert.NoError(tt, err)
+				return
+			}
+			if assert.IsType(tt, &PipelineValidationError{}, err) {
+				assert.Equal(tt, tc.errors, err.(*PipelineValidationError).Errors)
+			}
+		})
+	}
+}
+
+func TestPipelineParserRequireConditionComments(t *testing.T) {
+	t.Parallel()
+
+	pipeline := `steps:
+  - command: make test
+    # Only deploy from main
+    if: build.branch == "main"
+  - command: make deploy
+    if: build.tag != null # Tagged releases only
+  - group: Nested
+    steps:
+      - command: make lint
+        if: build.pull_request.id != null
+  - if: build.message !~ /skip/
+    command: make
+`
+
+	_, err := PipelineParser{Pipeline: []byte(pipeline), RequireConditionComments: true}.Parse()
+	if assert.IsType(t, &PipelineValidationError{}, err) {
+		assert.Equal(t, []error{
+			MissingConditionCommentError{StepIndex: "steps[2].steps[0]"},
+			MissingConditionCommentError{StepIndex: "steps[3]"},
+		}, err.(*PipelineValidationError).Errors)
+	}
+
+	_, err = PipelineParser{Pipeline: []byte("- command: make\n  # Always\n  if: true\n"), RequireConditionComments: true}.Parse()
+	assert.NoError(t, err)
+
+	// A comment above a list item is above its first key too
+	_, err = PipelineParser{Pipeline: []byte("- wait\n# Always\n- if: true\n  command: make\n"), RequireConditionComments: true}.Parse()
+	assert.NoError(t, err)
+
+	// Comments in flow style YAML are found too
+	_, err = PipelineParser{Pipeline: []byte("steps: [{command: make, if: \"true\"}, {command: make, if: \"true\" # Always\n}]\n"), RequireConditionComments: true}.Parse()
+	if assert.IsType(t, &PipelineValidationError{}, err) {
+		assert.Equal(t, []error{
+			MissingConditionCommentError{StepIndex: "steps[0]"},
+		}, err.(*PipelineValidationError).Errors)
+	}
+}
+
+func TestPipelineParserValidateAllowDependencyFailure(t *testing.T) {
+	t.Parallel()
+
+	pipeline := `steps:
+  - key: build
+    command: make
+  - command: make notify
+    depends_on: build
+    allow_dependency_failure: true
+  - command: make report
+    allow_dependency_failure: false
+  - command: make cleanup
+    allow_dependency_failure: true
+`
+
+	_, err := PipelineParser{Pipeline: []byte(pipeline)}.Parse()
+	assert.NoError(t, err)
+
+	_, err = PipelineParser{Pipeline: []byte(pipeline), ValidateAllowDependencyFailure: true}.Parse()
+	if assert.IsType(t, &PipelineValidationError{}, err) {
+		assert.Equal(t, []error{
+			OrphanedAllowDependencyFailureError{StepIndex: "steps[3]"},
+		}, err.(*PipelineValidationError).Errors)
+	}
+}
+
+func TestPipelineParserEnforceTimeout(t *testing.T) {
+	t.Parallel()
+
+	pipeline := "steps:\n  - command: one\n    timeout_in_minutes: 5\n  - wait\n  - command: two\n  - trigger: deploy"
+
+	t.Run("already set", func(tt *testing.T) {
+		tt.Parallel()
+		_, err := PipelineParser{
+			Pipeline:       []byte("steps:\n  - command: one\n    timeout_in_minutes: 5\n  - wait"),
+			EnforceTimeout: true,
+		}.Parse()
+		assert.NoError(tt, err)
+	})
+
+	t.Run("inject default", func(tt *testing.T) {
+		tt.Parallel()
+		result, err := PipelineParser{
+			Pipeline:              []byte(pipeline),
+			EnforceTimeout:        true,
+			DefaultTimeoutMinutes: 30,
+		}.Parse()
+		assert.NoError(tt, err)
+		j, err := json.Marshal(result)
+		assert.NoError(tt, err)
+		assert.Equal(tt, `{"steps":[{"command":"one","timeout_in_minutes":5},"wait",{"command":"two","timeout_in_minutes":30},{"trigger":"deploy"}]}`, string(j))
+	})
+
+	t.Run("inject error", func(tt *testing.T) {
+		tt.Parallel()
+		_, err := PipelineParser{
+			Pipeline:       []byte(pipeline),
+			EnforceTimeout: true,
+		}.Parse()
+		if assert.IsType(tt, &PipelineValidationError{}, err) {
+			assert.Equal(tt, []error{MissingTimeoutError{StepIndex: "steps[2]"}}, err.(*PipelineValidationError).Errors)
+		}
+	})
+}
+
+func TestPipelineParserRequireIdempotencyMarkers(t *testing.T) {
+	t.Parallel()
+
+	pipeline := `steps:
+  - command: make build
+    metadata:
+      idempotent: true
+  # Idempotent, it only reads
+  - command: make test
+  - command: make lint # idempotent
+  - commands:
+      - make clean
+      - make package # idempotent
+  - wait
+  - command: make deploy
+  - commands:
+      - make upload
+    metadata:
+      idempotent: false
+`
+
+	_, err := PipelineParser{Pipeline: []byte(pipeline), RequireIdempotencyMarkers: true}.Parse()
+	if assert.IsType(t, &PipelineValidationError{}, err) {
+		assert.Equal(t, []error{
+			MissingIdempotencyMarkerError{StepIndex: "steps[5]"},
+			MissingIdempotencyMarkerError{StepIndex: "steps[6]"},
+		}, err.(*PipelineValidationError).Errors)
+	}
+
+	// Comments on the commands in flow style YAML count, but ones on the
+	// step itself or in strings don't
+	_, err = PipelineParser{Pipeline: []byte(`steps:
+  - {command: make test} # idempotent
+  - commands: [make clean, make package] # idempotent
+  - command: |
+      # idempotent
+      make deploy
+`), RequireIdempotencyMarkers: true}.Parse()
+	if assert.IsType(t, &PipelineValidationError{}, err) {
+		assert.Equal(t, []error{
+			MissingIdempotencyMarkerError{StepIndex: "steps[0]"},
+			MissingIdempotencyMarkerError{StepIndex: "steps[2]"},
+		}, err.(*PipelineValidationError).Errors)
+	}
+}
+
+func TestPipelineParserValidateConcurrencyValue(t *testing.T) {
+	t.Parallel()
+
+	pipeline := `steps:
+  - command: one
+    concurrency: 1
+    concurrency_group: deploys
+  - command: two
+    concurrency: 0
+    concurrency_group: deploys
+  - command: three
+    concurrency: -2
+    concurrency_group: deploys
+  - command: four
+`
+
+	_, err := PipelineParser{Pipeline: []byte(pipeline), ValidateConcurrencyValue: true}.Parse()
+	if assert.IsType(t, &PipelineValidationError{}, err) {
+		assert.Equal(t, []error{
+			InvalidConcurrencyValueError{StepIndex: "steps[1]", Value: 0},
+			InvalidConcurrencyValueError{StepIndex: "steps[2]", Value: -2},
+		}, err.(*PipelineValidationError).Errors)
+	}
+
+	_, err = PipelineParser{Pipeline: []byte("steps:\n  - command: one\n    concurrency: 10"), ValidateConcurrencyValue: true}.Parse()
+	assert.NoError(t, err)
+}
+
+func TestPipelineParserQueueRequiredPlugins(t *testing.T) {
+	t.Parallel()
+
+	pipeline := `steps:
+  - command: make deploy
+    agents:
+      queue: deploy
+    plugins:
+      - docker-compose#v2.0.0:
+          run: app
+      - github.com/my-org/audit-buildkite-plugin#v1.0.0
+  - command: make deploy
+    agents:
+      queue: deploy
+    plugins:
+      - docker-compose#v2.0.0:
+          run: app
+  - command: make test
+    agents:
+      queue: test
+  - command: make build
+    agents:
+      queue: build
+`
+
+	_, err := PipelineParser{
+		Pipeline: []byte(pipeline),
+		QueueRequiredPlugins: map[string]string{
+			"deploy": "audit",
+			"test":   "docker-compose",
+		},
+	}.Parse()
+	if assert.IsType(t, &PipelineValidationError{}, err) {
+		assert.Equal(t, []error{
+			MissingRequiredPluginError{StepIndex: "steps[1]", Queue: "deploy", Plugin: "audit"},
+			MissingRequiredPluginError{StepIndex: "steps[2]", Queue: "test", Plugin: "docker-compose"},
+		}, err.(*PipelineValidationError).Errors)
+	}
+}
+
+func TestPipelineParserMaxParallelism(t *testing.T) {
+	t.Parallel()
+
+	pipeline := "steps:\n  - command: one\n    parallelism: 10\n  - command: two\n    parallelism: 1000\n  - command: three"
+
+	t.Run("at limit", func(tt *testing.T) {
+		tt.Parallel()
+		_, err := PipelineParser{Pipeline: []byte("steps:\n  - command: one\n    parallelism: 10"), MaxParallelism: 10}.Parse()
+		assert.NoError(tt, err)
+	})
+
+	t.Run("over limit", func(tt *testing.T) {
+		tt.Parallel()
+		_, err := PipelineParser{Pipeline: []byte(pipeline), MaxParallelism: 10}.Parse()
+		if assert.IsType(tt, &PipelineValidationError{}, err) {
+			assert.Equal(tt, []error{
+				ParallelismLimitError{StepIndex: "steps[1]", Value: 1000, Max: 10},
+			}, err.(*PipelineValidationError).Errors)
+		}
+	})
+
+	t.Run("no limit", func(tt *testing.T) {
+		tt.Parallel()
+		_, err := PipelineParser{Pipeline: []byte(pipeline)}.Parse()
+		assert.NoError(tt, err)
+	})
+}
+
+func TestPipelineParserValidateTriggerSlugs(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		name   string
+		slug   string
+		errors []error
+	}{
+		{name: "valid", slug: "deploy-app-2"},
+		{name: "uppercase", slug: "Deploy-App", errors: []error{InvalidTriggerSlugError{StepIndex: "steps[1]", Slug: "Deploy-App"}}},
+		{name: "space", slug: "deploy app", errors: []error{InvalidTriggerSlugError{StepIndex: "steps[1]", Slug: "deploy app"}}},
+		{name: "special characters", slug: "deploy_app!", errors: []error{InvalidTriggerSlugError{StepIndex: "steps[1]", Slug: "deploy_app!"}}},
+		{name: "leading hyphen", slug: "-deploy", errors: []error{InvalidTriggerSlugError{StepIndex: "steps[1]", Slug: "-deploy"}}},
+	} {
+		tc := tc
+		t.Run(tc.name, func(tt *testing.T) {
+			tt.Parallel()
+			pipeline := "steps:\n  - command: make\n  - trigger: \"" + tc.slug + "\""
+			_, err := PipelineParser{Pipeline: []byte(pipeline), ValidateTriggerSlugs: true}.Parse()
+			if tc.errors == nil {
+				assert.NoError(tt, err)
+				return
+			}
+			if assert.IsType(tt, &PipelineValidationError{}, err) {
+				assert.Equal(tt, tc.errors, err.(*PipelineValidationError).Errors)
+			}
+		})
+	}
+}
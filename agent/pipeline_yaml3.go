@@ -0,0 +1,191 @@
+package agent
+
+import (
+	"fmt"
+
+	// This is a fork of gopkg.in/yaml.v2 that fixes anchors with MapSlice
+	yaml "github.com/buildkite/yaml"
+	yaml3 "gopkg.in/yaml.v3"
+)
+
+// YAMLBehaviorDiff is how parsing a pipeline with gopkg.in/yaml.v3 differs
+// from parsing it with the buildkite/yaml fork. In each DiffEntry, Old is the
+// fork's value and New is yaml.v3's.
+type YAMLBehaviorDiff struct {
+	Differences []DiffEntry
+
+	// Set if only one of them failed to parse the pipeline
+	ForkError     error
+	StandardError error
+}
+
+// CompareYAMLBehavior parses a pipeline (without interpolation) with both
+// the buildkite/yaml fork and gopkg.in/yaml.v3, and returns the differences
+// in what they parse it to, such as `yes` being a boolean in the fork and a
+// string in yaml.v3. It's an error if neither of them can parse it.
+func CompareYAMLBehavior(pipeline []byte) (*YAMLBehaviorDiff, error) {
+	diff := &YAMLBehaviorDiff{Differences: []DiffEntry{}}
+
+	var fork interface{}
+	diff.ForkError = unmarshalAsStringMap(pipeline, &fork)
+
+	standard, err := decodeStandardYAML(pipeline)
+	if err == nil {
+		standard = standardYAMLStringMap(standard)
+	}
+	diff.StandardError = err
+
+	if diff.ForkError != nil && diff.StandardError != nil {
+		return nil, fmt.Errorf("Failed to parse pipeline: %v", parseYAMLError(diff.ForkError))
+	}
+	if diff.ForkError == nil && diff.StandardError == nil {
+		diff.Differences = DiffPipelines(fork, standard)
+	}
+
+	return diff, nil
+}
+
+// standardYAMLToFork parses a pipeline with gopkg.in/yaml.v3 and encodes it
+// again as YAML that the fork parses to the same thing, so that the rest of
+// the parse is unchanged
+func standardYAMLToFork(src []byte) ([]byte, error) {
+	value, err := decodeStandardYAML(src)
+	if err != nil {
+		return nil, err
+	}
+	return yaml.Marshal(value)
+}
+
+// decodeStandardYAML parses YAML with gopkg.in/yaml.v3, with maps as
+// yaml.MapSlices so that the order of their keys is kept
+func decodeStandardYAML(src []byte) (interface{}, error) {
+	var doc yaml3.Node
+	if err := yaml3.Unmarshal(src, &doc); err != nil {
+		return nil, err
+	}
+	return standardYAMLNodeValue(&doc)
+}
+
+func standardYAMLNodeValue(n *yaml3.Node) (interface{}, error) {
+	switch n.Kind {
+	case yaml3.DocumentNode:
+		if len(n.Content) == 0 {
+			return nil, nil
+		}
+		return standardYAMLNodeValue(n.Content[0])
+
+	case yaml3.AliasNode:
+		return standardYAMLNodeValue(n.Alias)
+
+	case yaml3.SequenceNode:
+		items := make([]interface{}, 0, len(n.Content))
+		for _, item := range n.Content {
+			value, err := standardYAMLNodeValue(item)
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, value)
+		}
+		return items, nil
+
+	case yaml3.MappingNode:
+		return standardYAMLMapping(n)
+
+	case yaml3.ScalarNode:
+		var value interface{}
+		if err := n.Decode(&value); err != nil {
+			return nil, err
+		}
+		return value, nil
+	}
+
+	return nil, fmt.Errorf("line %d: unexpected YAML node", n.Line)
+}
+
+// standardYAMLMapping returns a mapping node as a yaml.MapSlice. The keys
+// from any `<<` merge keys are added where the merge key is, unless they're
+// also set explicitly, which wins wherever it is in the mapping.
+func standardYAMLMapping(n *yaml3.Node) (yaml.MapSlice, error) {
+	explicit := map[interface{}]bool{}
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		if !isStandardYAMLMergeKey(n.Content[i]) {
+			key, err := standardYAMLNodeValue(n.Content[i])
+			if err != nil {
+				return nil, err
+			}
+			explicit[fmt.Sprintf("%v", key)] = true
+		}
+	}
+
+	var mapping yaml.MapSlice
+	merged := map[interface{}]bool{}
+
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		keyNode, valueNode := n.Content[i], n.Content[i+1]
+
+		if isStandardYAMLMergeKey(keyNode) {
+			if valueNode.Kind == yaml3.AliasNode {
+				valueNode = valueNode.Alias
+			}
+			sources := []*yaml3.Node{valueNode}
+			if valueNode.Kind == yaml3.SequenceNode {
+				sources = valueNode.Content
+			}
+
+			for _, source := range sources {
+				value, err := standardYAMLNodeValue(source)
+				if err != nil {
+					return nil, err
+				}
+				items, ok := value.(yaml.MapSlice)
+				if !ok {
+					return nil, fmt.Errorf("line %d: map merge requires map or sequence of maps as the value", keyNode.Line)
+				}
+				for _, item := range items {
+					name := fmt.Sprintf("%v", item.Key)
+					if !explicit[name] && !merged[name] {
+						merged[name] = true
+						mapping = append(mapping, item)
+					}
+				}
+			}
+			continue
+		}
+
+		key, err := standardYAMLNodeValue(keyNode)
+		if err != nil {
+			return nil, err
+		}
+		value, err := standardYAMLNodeValue(valueNode)
+		if err != nil {
+			return nil, err
+		}
+		mapping = append(mapping, yaml.MapItem{Key: key, Value: value})
+	}
+
+	return mapping, nil
+}
+
+func isStandardYAMLMergeKey(n *yaml3.Node) bool {
+	return n.Kind == yaml3.ScalarNode && n.Value == "<<" && n.ShortTag() == "!!merge"
+}
+
+// standardYAMLStringMap converts the yaml.MapSlices from decodeStandardYAML
+// to maps with string keys, like unmarshalAsStringMap
+func standardYAMLStringMap(v interface{}) interface{} {
+	switch t := v.(type) {
+	case yaml.MapSlice:
+		m := make(map[string]interface{}, len(t))
+		for _, item := range t {
+			m[fmt.Sprintf("%v", item.Key)] = standardYAMLStringMap(item.Value)
+		}
+		return m
+	case []interface{}:
+		items := make([]interface{}, len(t))
+		for idx, item := range t {
+			items[idx] = standardYAMLStringMap(item)
+		}
+		return items
+	}
+	return v
+}
@@ -0,0 +1,68 @@
+package agent
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/buildkite/agent/env"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPipelineParserUseStandardYAML(t *testing.T) {
+	t.Parallel()
+
+	pipeline := []byte(`
+env:
+  FRIEND: friend
+  GREETING: hello $FRIEND
+base: &base
+  agents:
+    queue: default
+  soft_fail: yes
+steps:
+  - <<: *base
+    label: Build
+    command: echo $GREETING
+  - <<: *base
+    soft_fail: no
+    label: Test
+`)
+
+	result, err := PipelineParser{Pipeline: pipeline, Env: env.New(), UseStandardYAML: true}.Parse()
+	assert.NoError(t, err)
+	j, err := json.Marshal(result)
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{
+		"env": {"FRIEND": "friend", "GREETING": "hello friend"},
+		"base": {"agents": {"queue": "default"}, "soft_fail": "yes"},
+		"steps": [
+			{"agents": {"queue": "default"}, "soft_fail": "yes", "label": "Build", "command": "echo hello friend"},
+			{"agents": {"queue": "default"}, "soft_fail": "no", "label": "Test"}
+		]
+	}`, string(j))
+
+	_, err = PipelineParser{Pipeline: []byte("steps: [\n"), Env: env.New(), UseStandardYAML: true}.Parse()
+	assert.EqualError(t, err, "Failed to parse pipeline: line 1: did not find expected node content")
+}
+
+func TestCompareYAMLBehavior(t *testing.T) {
+	t.Parallel()
+
+	diff, err := CompareYAMLBehavior([]byte(`
+steps:
+  - command: make
+    soft_fail: yes
+    retry: {automatic: on}
+    label: "same"
+`))
+	assert.NoError(t, err)
+	assert.Equal(t, []DiffEntry{
+		{Path: "steps[0].retry.automatic", Type: "changed", Old: true, New: "on"},
+		{Path: "steps[0].soft_fail", Type: "changed", Old: true, New: "yes"},
+	}, diff.Differences)
+	assert.NoError(t, diff.ForkError)
+	assert.NoError(t, diff.StandardError)
+
+	_, err = CompareYAMLBehavior([]byte("steps: [\n"))
+	assert.EqualError(t, err, "Failed to parse pipeline: line 1: did not find expected node content")
+}
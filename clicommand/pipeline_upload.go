@@ -172,11 +172,10 @@ var PipelineUploadCommand = cli.Command{
 		var parsed interface{}
 
 		// Parse the pipeline
-		parsed, err = agent.PipelineParser{
-			Filename:        filename,
-			Pipeline:        input,
-			NoInterpolation: cfg.NoInterpolation,
-		}.Parse()
+		parsed, err = agent.NewPipelineParser(input, os.Environ(),
+			agent.WithFilename(filename),
+			agent.WithNoInterpolation(cfg.NoInterpolation),
+		).Parse()
 		if err != nil {
 			logger.Fatal("Pipeline parsing of \"%s\" failed (%s)", filename, err)
 		}